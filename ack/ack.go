@@ -0,0 +1,32 @@
+package ack
+
+import (
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+)
+
+// DecodeInt decodes the data for an ack window or ack extension, first
+// deserializing as a node and then reading it as an integer.
+func DecodeInt(data []byte, ipldBridge ipldbridge.IPLDBridge) (int, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return 0, err
+	}
+	return node.AsInt()
+}
+
+// EncodeInt encodes an ack window or message sequence number to an IPLD node
+// then serializes to raw bytes
+func EncodeInt(value int, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateInt(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
@@ -0,0 +1,22 @@
+package ack
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-graphsync/testbridge"
+)
+
+func TestDecodeEncodeInt(t *testing.T) {
+	bridge := testbridge.NewMockIPLDBridge()
+	encoded, err := EncodeInt(42, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeInt(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if decoded != 42 {
+		t.Fatal("Value changed during encoding and decoding")
+	}
+}
@@ -0,0 +1,73 @@
+package allocator
+
+import (
+	"context"
+	"sync"
+)
+
+// Allocator tracks the total size of blocks buffered for sending, and makes
+// callers wait to buffer more while that total is at a fixed budget.
+type Allocator struct {
+	maxBytes uint64
+
+	allocatedLk sync.Mutex
+	allocated   uint64
+	released    chan struct{}
+}
+
+// New returns a new Allocator with a budget of maxBytes. A budget of zero
+// tracks allocations without limiting them.
+func New(maxBytes uint64) *Allocator {
+	return &Allocator{
+		maxBytes: maxBytes,
+		released: make(chan struct{}),
+	}
+}
+
+// Allocate blocks until n more bytes fit within the budget, then records
+// them as allocated. When nothing is allocated, any size fits, so a single
+// allocation larger than the budget does not wait forever. It returns an
+// error, without allocating, if the context is cancelled first.
+func (a *Allocator) Allocate(ctx context.Context, n uint64) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		a.allocatedLk.Lock()
+		if a.maxBytes == 0 || a.allocated == 0 || a.allocated+n <= a.maxBytes {
+			a.allocated += n
+			a.allocatedLk.Unlock()
+			return nil
+		}
+		released := a.released
+		a.allocatedLk.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns n previously allocated bytes to the budget, waking anyone
+// waiting to allocate.
+func (a *Allocator) Release(n uint64) {
+	if n == 0 {
+		return
+	}
+	a.allocatedLk.Lock()
+	if n > a.allocated {
+		n = a.allocated
+	}
+	a.allocated -= n
+	close(a.released)
+	a.released = make(chan struct{})
+	a.allocatedLk.Unlock()
+}
+
+// Allocated returns the number of bytes currently allocated
+func (a *Allocator) Allocated() uint64 {
+	a.allocatedLk.Lock()
+	defer a.allocatedLk.Unlock()
+	return a.allocated
+}
@@ -0,0 +1,63 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAllocatorWaitsForBudget(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	allocator := New(1000)
+
+	err := allocator.Allocate(ctx, 600)
+	if err != nil {
+		t.Fatal("should allocate within budget")
+	}
+	allocated := make(chan error, 1)
+	go func() {
+		allocated <- allocator.Allocate(ctx, 600)
+	}()
+	select {
+	case <-allocated:
+		t.Fatal("should wait while over budget")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if allocator.Allocated() != 600 {
+		t.Fatal("should not count waiting allocation")
+	}
+
+	allocator.Release(600)
+	select {
+	case <-ctx.Done():
+		t.Fatal("should allocate after release")
+	case err := <-allocated:
+		if err != nil {
+			t.Fatal("should not have errored allocating")
+		}
+	}
+	if allocator.Allocated() != 600 {
+		t.Fatal("did not track allocation")
+	}
+}
+
+func TestAllocatorOversizeAllocation(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	allocator := New(1000)
+
+	err := allocator.Allocate(ctx, 2000)
+	if err != nil {
+		t.Fatal("should allocate oversize block when nothing is allocated")
+	}
+	err = allocator.Allocate(ctx, 1)
+	if err == nil {
+		t.Fatal("should have errored when context was cancelled")
+	}
+	if allocator.Allocated() != 2000 {
+		t.Fatal("should not allocate after cancellation")
+	}
+}
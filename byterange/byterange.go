@@ -0,0 +1,155 @@
+package byterange
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+)
+
+// ErrOutOfRange means a byte range starts past the end of the block
+var ErrOutOfRange = errors.New("byte range starts past the end of the block")
+
+// ErrNotRoot means a byte range was asked for with a selector that reaches
+// past the root block, which is the only block a range applies to
+var ErrNotRoot = errors.New("byte range requests must select only the root block")
+
+// Request is the range of bytes within a request's root block sent in the
+// graphsync.ExtensionByteRange extension of a request. A Length of zero means
+// through the end of the block.
+type Request struct {
+	Offset uint64
+	Length uint64
+}
+
+// Response is the part of a block sent in the graphsync.ExtensionByteRange
+// extension of a response. Partial is false only if Data is the whole block.
+// Only a whole block can be checked against its CID, so the Data of a partial
+// response is whatever the responder sent, unverified.
+type Response struct {
+	Offset  uint64
+	Data    []byte
+	Partial bool
+}
+
+// SelectsRootOnly returns whether a selector spec matches the root node and
+// nothing else, as a byte range request's selector must
+func SelectsRootOnly(selectorSpec ipld.Node) bool {
+	if selectorSpec.ReprKind() != ipld.ReprKind_Map || selectorSpec.Length() != 1 {
+		return false
+	}
+	_, err := selectorSpec.LookupString(selector.SelectorKey_Matcher)
+	return err == nil
+}
+
+// NewExtension encodes a byte range as extension data to send with a request
+func NewExtension(r Request, ipldBridge ipldbridge.IPLDBridge) (graphsync.ExtensionData, error) {
+	data, err := EncodeRequest(r, ipldBridge)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	return graphsync.ExtensionData{Name: graphsync.ExtensionByteRange, Data: data}, nil
+}
+
+// Slice returns the response for a byte range of the given block data. A
+// range running past the end of the block is cut short.
+func Slice(data []byte, r Request) (Response, error) {
+	if r.Offset > uint64(len(data)) {
+		return Response{}, ErrOutOfRange
+	}
+	end := uint64(len(data))
+	if r.Length > 0 && r.Length < end-r.Offset {
+		end = r.Offset + r.Length
+	}
+	return Response{
+		Offset:  r.Offset,
+		Data:    data[r.Offset:end],
+		Partial: r.Offset > 0 || end < uint64(len(data)),
+	}, nil
+}
+
+// DecodeRequest assembles a byte range request from a raw byte array, first
+// deserializing as a node and then reading its offset and length.
+func DecodeRequest(data []byte, ipldBridge ipldbridge.IPLDBridge) (Request, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return Request{}, err
+	}
+	var offset, length int
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		offset = simpleNode.LookupString("offset").AsInt()
+		length = simpleNode.LookupString("length").AsInt()
+	})
+	if err != nil {
+		return Request{}, err
+	}
+	if offset < 0 || length < 0 {
+		return Request{}, errors.New("negative byte range")
+	}
+	return Request{uint64(offset), uint64(length)}, nil
+}
+
+// EncodeRequest encodes a byte range request to an IPLD node then serializes
+// to raw bytes
+func EncodeRequest(r Request, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+			mb.Insert(knb.CreateString("offset"), vnb.CreateInt(int(r.Offset)))
+			mb.Insert(knb.CreateString("length"), vnb.CreateInt(int(r.Length)))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
+
+// DecodeResponse assembles the part of a block sent in a response from a raw
+// byte array, first deserializing as a node and then reading its fields.
+func DecodeResponse(data []byte, ipldBridge ipldbridge.IPLDBridge) (Response, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return Response{}, err
+	}
+	var r Response
+	var offset int
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		offset = simpleNode.LookupString("offset").AsInt()
+		r.Data = simpleNode.LookupString("data").AsBytes()
+		r.Partial = simpleNode.LookupString("partial").AsBool()
+	})
+	if err != nil {
+		return Response{}, err
+	}
+	if offset < 0 {
+		return Response{}, errors.New("negative byte range")
+	}
+	r.Offset = uint64(offset)
+	return r, nil
+}
+
+// EncodeResponse encodes the part of a block sent in a response to an IPLD
+// node then serializes to raw bytes
+func EncodeResponse(r Response, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+			mb.Insert(knb.CreateString("offset"), vnb.CreateInt(int(r.Offset)))
+			mb.Insert(knb.CreateString("data"), vnb.CreateBytes(r.Data))
+			mb.Insert(knb.CreateString("partial"), vnb.CreateBool(r.Partial))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
@@ -0,0 +1,103 @@
+package byterange
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/testutil"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+)
+
+func TestDecodeEncodeRequest(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	r := Request{Offset: 100, Length: 100}
+	encoded, err := EncodeRequest(r, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeRequest(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if decoded != r {
+		t.Fatal("Request changed during encoding and decoding")
+	}
+}
+
+func TestDecodeEncodeResponse(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	r := Response{Offset: 100, Data: testutil.RandomBytes(100), Partial: true}
+	encoded, err := EncodeResponse(r, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeResponse(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if decoded.Offset != r.Offset || !bytes.Equal(decoded.Data, r.Data) || decoded.Partial != r.Partial {
+		t.Fatal("Response changed during encoding and decoding")
+	}
+}
+
+func TestSlice(t *testing.T) {
+	data := testutil.RandomBytes(1000)
+	testCases := map[string]struct {
+		request  Request
+		expected Response
+		err      error
+	}{
+		"middle": {
+			request:  Request{Offset: 100, Length: 100},
+			expected: Response{Offset: 100, Data: data[100:200], Partial: true},
+		},
+		"to end": {
+			request:  Request{Offset: 900},
+			expected: Response{Offset: 900, Data: data[900:], Partial: true},
+		},
+		"past end": {
+			request:  Request{Offset: 900, Length: 500},
+			expected: Response{Offset: 900, Data: data[900:], Partial: true},
+		},
+		"whole block": {
+			request:  Request{Length: 1000},
+			expected: Response{Data: data, Partial: false},
+		},
+		"out of range": {
+			request: Request{Offset: 1001},
+			err:     ErrOutOfRange,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response, err := Slice(data, tc.request)
+			if err != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if response.Offset != tc.expected.Offset || !bytes.Equal(response.Data, tc.expected.Data) || response.Partial != tc.expected.Partial {
+				t.Fatal("wrong slice of block")
+			}
+		})
+	}
+}
+
+func TestSelectsRootOnly(t *testing.T) {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	if !SelectsRootOnly(ssb.Matcher().Node()) {
+		t.Fatal("should accept a selector matching only the root")
+	}
+	allSelector := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if SelectsRootOnly(allSelector) {
+		t.Fatal("should reject a selector reaching past the root")
+	}
+	fieldSelector := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Parents", ssb.Matcher())
+	}).Node()
+	if SelectsRootOnly(fieldSelector) {
+		t.Fatal("should reject a selector matching a field of the root")
+	}
+}
@@ -0,0 +1,45 @@
+package cancelreason
+
+import (
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+)
+
+// DecodeCancelReason assembles a cancel reason from a raw byte array, first
+// deserializing as a node and then reading its code and message.
+func DecodeCancelReason(data []byte, ipldBridge ipldbridge.IPLDBridge) (graphsync.CancelReason, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return graphsync.CancelReason{}, err
+	}
+	var reason graphsync.CancelReason
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		reason.Code = graphsync.CancelReasonCode(simpleNode.LookupString("code").AsInt())
+		reason.Message = simpleNode.LookupString("message").AsString()
+	})
+	if err != nil {
+		return graphsync.CancelReason{}, err
+	}
+	return reason, nil
+}
+
+// EncodeCancelReason encodes a cancel reason to an IPLD node then serializes
+// to raw bytes
+func EncodeCancelReason(reason graphsync.CancelReason, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+			mb.Insert(knb.CreateString("code"), vnb.CreateInt(int(reason.Code)))
+			mb.Insert(knb.CreateString("message"), vnb.CreateString(reason.Message))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
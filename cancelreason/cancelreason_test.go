@@ -0,0 +1,24 @@
+package cancelreason
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+)
+
+func TestDecodeEncodeCancelReason(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	reason := graphsync.CancelReason{Code: graphsync.CancelReasonFoundElsewhere, Message: "fetched from a closer peer"}
+	encoded, err := EncodeCancelReason(reason, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeCancelReason(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if decoded != reason {
+		t.Fatal("Cancel reason changed during encoding and decoding")
+	}
+}
@@ -0,0 +1,72 @@
+package cidset
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// EncodeCidSet encodes a set of CIDs, as sent in the
+// graphsync.ExtensionDoNotSendCIDs extension, to an IPLD list of links then
+// serializes to raw bytes
+func EncodeCidSet(cids *cid.Set, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	return EncodeCidList(cids.Keys(), ipldBridge)
+}
+
+// DecodeCidSet assembles a set of CIDs from a raw byte array, first
+// deserializing as a node and then reading a list of links.
+func DecodeCidSet(data []byte, ipldBridge ipldbridge.IPLDBridge) (*cid.Set, error) {
+	cids, err := DecodeCidList(data, ipldBridge)
+	if err != nil {
+		return nil, err
+	}
+	set := cid.NewSet()
+	for _, c := range cids {
+		set.Add(c)
+	}
+	return set, nil
+}
+
+// EncodeCidList encodes an ordered list of CIDs, as sent in the
+// graphsync.ExtensionPreferredOrder extension, to an IPLD list of links then
+// serializes to raw bytes
+func EncodeCidList(cids []cid.Cid, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateList(func(lb ipldbridge.ListBuilder, nb ipldbridge.NodeBuilder) {
+			for _, c := range cids {
+				lb.Append(nb.CreateLink(cidlink.Link{Cid: c}))
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
+
+// DecodeCidList reads an ordered list of CIDs from a raw byte array, first
+// deserializing as a node and then reading a list of links.
+func DecodeCidList(data []byte, ipldBridge ipldbridge.IPLDBridge) ([]cid.Cid, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	var cids []cid.Cid
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		iterator := simpleNode.ListIterator()
+		for !iterator.Done() {
+			_, item := iterator.Next()
+			cids = append(cids, item.AsLink().(cidlink.Link).Cid)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cids, nil
+}
@@ -0,0 +1,51 @@
+package cidset
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestDecodeEncodeCidSet(t *testing.T) {
+	cids := cid.NewSet()
+	for _, block := range testutil.GenerateBlocksOfSize(3, 100) {
+		cids.Add(block.Cid())
+	}
+	bridge := ipldbridge.NewIPLDBridge()
+	encoded, err := EncodeCidSet(cids, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeCidSet(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if decoded.Len() != cids.Len() {
+		t.Fatal("did not decode all cids")
+	}
+	_ = cids.ForEach(func(c cid.Cid) error {
+		if !decoded.Has(c) {
+			t.Fatal("did not decode cid")
+		}
+		return nil
+	})
+}
+
+func TestDecodeEncodeCidList(t *testing.T) {
+	cids := testutil.GenerateCids(5)
+	bridge := ipldbridge.NewIPLDBridge()
+	encoded, err := EncodeCidList(cids, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeCidList(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if !reflect.DeepEqual(decoded, cids) {
+		t.Fatal("did not decode cids in order")
+	}
+}
@@ -0,0 +1,109 @@
+package cursor
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+)
+
+// Cursor records how far a responder got with a response, as the number of
+// blocks it sent and the path from the root to the last of them. It names the
+// root and selector it was made for, since the path only means something for
+// a traversal of the same selector from the same root.
+//
+// The state of the selector at the path is not kept, as this version of
+// go-ipld-prime cannot start a traversal partway. A resumed response
+// traverses from the root again, loading every block up to the path but
+// holding them back rather than sending them again, so resuming costs the
+// responder a load for each block already sent. A responder with a shared
+// block cache may have them in memory still.
+type Cursor struct {
+	Root     cid.Cid
+	Selector []byte
+	Blocks   int
+	Path     ipld.Path
+}
+
+// DecodeCursor assembles a cursor from a raw byte array, first deserializing
+// as a node and then reading its fields.
+func DecodeCursor(data []byte, ipldBridge ipldbridge.IPLDBridge) (Cursor, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return Cursor{}, err
+	}
+	var c Cursor
+	var rootBytes []byte
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		rootBytes = simpleNode.LookupString("root").AsBytes()
+		c.Selector = simpleNode.LookupString("selector").AsBytes()
+		c.Blocks = simpleNode.LookupString("blocks").AsInt()
+		c.Path = ipld.ParsePath(simpleNode.LookupString("path").AsString())
+	})
+	if err != nil {
+		return Cursor{}, err
+	}
+	c.Root, err = cid.Cast(rootBytes)
+	if err != nil {
+		return Cursor{}, err
+	}
+	return c, nil
+}
+
+// EncodeCursor encodes a cursor to an IPLD node then serializes to raw bytes
+func EncodeCursor(c Cursor, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+			mb.Insert(knb.CreateString("root"), vnb.CreateBytes(c.Root.Bytes()))
+			mb.Insert(knb.CreateString("selector"), vnb.CreateBytes(c.Selector))
+			mb.Insert(knb.CreateString("blocks"), vnb.CreateInt(c.Blocks))
+			mb.Insert(knb.CreateString("path"), vnb.CreateString(c.Path.String()))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
+
+// ErrNoProgress is returned by FromResponses when there are no responses, so
+// there is nothing to resume from
+var ErrNoProgress = errors.New("no responses to resume from")
+
+// FromResponses encodes a cursor for a request the requestor stopped itself,
+// such as by cancelling it, which the responder does not send one for. It
+// points at the last block the given responses, as received for the request
+// in order, loaded, so making the request again with graphsync.ResumeFrom
+// sends only the blocks after it.
+func FromResponses(root cid.Cid, selector ipld.Node, responses []graphsync.ResponseProgress, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	if len(responses) == 0 {
+		return nil, ErrNoProgress
+	}
+	selectorBytes, err := ipldBridge.EncodeNode(selector)
+	if err != nil {
+		return nil, err
+	}
+	// the root is loaded before the first response, and every other block
+	// before the first response for a node in it
+	blocks := 1
+	var lastLink ipld.Link
+	for _, response := range responses {
+		if response.LastBlock.Link != nil && response.LastBlock.Link != lastLink {
+			lastLink = response.LastBlock.Link
+			blocks++
+		}
+	}
+	return EncodeCursor(Cursor{
+		Root:     root,
+		Selector: selectorBytes,
+		Blocks:   blocks,
+		Path:     responses[len(responses)-1].LastBlock.Path,
+	}, ipldBridge)
+}
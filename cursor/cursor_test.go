@@ -0,0 +1,32 @@
+package cursor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/testutil"
+	"github.com/ipld/go-ipld-prime"
+)
+
+func TestDecodeEncodeCursor(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	c := Cursor{
+		Root:     testutil.GenerateCids(1)[0],
+		Selector: testutil.RandomBytes(100),
+		Blocks:   7,
+		Path:     ipld.ParsePath("Parents/0/Parents/0"),
+	}
+	encoded, err := EncodeCursor(c, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeCursor(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if !decoded.Root.Equals(c.Root) || !bytes.Equal(decoded.Selector, c.Selector) ||
+		decoded.Blocks != c.Blocks || decoded.Path.String() != c.Path.String() {
+		t.Fatal("Cursor changed during encoding and decoding")
+	}
+}
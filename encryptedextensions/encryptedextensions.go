@@ -0,0 +1,262 @@
+package encryptedextensions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	pb "github.com/libp2p/go-libp2p-core/crypto/pb"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	contentKeySize = 32
+	keyLengthSize  = 2
+)
+
+var (
+	// ErrMalformedCiphertext means encrypted extension data was too short or
+	// badly framed to decrypt
+	ErrMalformedCiphertext = errors.New("malformed encrypted extension data")
+	// ErrNoKey means the host does not know the key needed to encrypt to or
+	// decrypt for a peer
+	ErrNoKey = errors.New("no key for peer")
+)
+
+// UnsupportedKeyTypeError is returned when extension data is encrypted to,
+// or decrypted with, a key that is not RSA. Keys are only wrapped with
+// RSA-OAEP, so peers with the Ed25519, Secp256k1 or ECDSA identities libp2p
+// generates by default cannot send or receive encrypted extensions.
+type UnsupportedKeyTypeError struct {
+	KeyType pb.KeyType
+}
+
+func (e UnsupportedKeyTypeError) Error() string {
+	return fmt.Sprintf("extension encryption requires an RSA key, not %s", e.KeyType)
+}
+
+// EncryptExtension encrypts extension data so only the holder of the private
+// key for recipient can read it. The data is sealed with a random AES-GCM key,
+// which is itself encrypted to the recipient with RSA-OAEP. The extension name
+// is authenticated, so the encrypted data cannot be moved to another
+// extension. The recipient must have an RSA key; any other key type returns
+// an UnsupportedKeyTypeError.
+func EncryptExtension(data graphsync.ExtensionData, recipient crypto.PubKey) (graphsync.ExtensionData, error) {
+	if recipient.Type() != pb.KeyType_RSA {
+		return graphsync.ExtensionData{}, UnsupportedKeyTypeError{recipient.Type()}
+	}
+	raw, err := recipient.Raw()
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(raw)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return graphsync.ExtensionData{}, UnsupportedKeyTypeError{recipient.Type()}
+	}
+
+	contentKey := make([]byte, contentKeySize)
+	_, err = rand.Read(contentKey)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, contentKey, nil)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	gcm, err := newGCM(contentKey)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+
+	// layout: key length | encrypted key | nonce | sealed data
+	encrypted := make([]byte, keyLengthSize, keyLengthSize+len(encryptedKey)+len(nonce)+len(data.Data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(encrypted, uint16(len(encryptedKey)))
+	encrypted = append(encrypted, encryptedKey...)
+	encrypted = append(encrypted, nonce...)
+	encrypted = gcm.Seal(encrypted, nonce, data.Data, []byte(data.Name))
+	return graphsync.ExtensionData{Name: data.Name, Data: encrypted}, nil
+}
+
+// DecryptExtension decrypts extension data encrypted with EncryptExtension to
+// the public key of priv, which must be an RSA key.
+func DecryptExtension(data graphsync.ExtensionData, priv crypto.PrivKey) (graphsync.ExtensionData, error) {
+	if priv.Type() != pb.KeyType_RSA {
+		return graphsync.ExtensionData{}, UnsupportedKeyTypeError{priv.Type()}
+	}
+	raw, err := priv.Raw()
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	sk, err := x509.ParsePKCS1PrivateKey(raw)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+
+	encrypted := data.Data
+	if len(encrypted) < keyLengthSize {
+		return graphsync.ExtensionData{}, ErrMalformedCiphertext
+	}
+	keyLength := int(binary.BigEndian.Uint16(encrypted))
+	encrypted = encrypted[keyLengthSize:]
+	if len(encrypted) < keyLength {
+		return graphsync.ExtensionData{}, ErrMalformedCiphertext
+	}
+	contentKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, sk, encrypted[:keyLength], nil)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	encrypted = encrypted[keyLength:]
+	gcm, err := newGCM(contentKey)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return graphsync.ExtensionData{}, ErrMalformedCiphertext
+	}
+	decrypted, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], []byte(data.Name))
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	return graphsync.ExtensionData{Name: data.Name, Data: decrypted}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Registry tracks the names of extensions that are sent encrypted, and uses
+// the keys known to a libp2p host to encrypt them for peers and to decrypt
+// them for hooks.
+type Registry struct {
+	host host.Host
+
+	namesLk sync.RWMutex
+	names   map[graphsync.ExtensionName]struct{}
+}
+
+// NewRegistry creates a Registry that uses the keys in the given host's
+// peerstore. Only RSA keys are supported: the host must have an RSA identity
+// to decrypt, and can only encrypt to peers that do, so hosts made with
+// libp2p's default Ed25519 identity fail with UnsupportedKeyTypeError.
+func NewRegistry(host host.Host) *Registry {
+	return &Registry{
+		host:  host,
+		names: make(map[graphsync.ExtensionName]struct{}),
+	}
+}
+
+// Register marks an extension as encrypted, so hooks wrapped by the registry
+// see its data decrypted.
+func (r *Registry) Register(name graphsync.ExtensionName) {
+	r.namesLk.Lock()
+	r.names[name] = struct{}{}
+	r.namesLk.Unlock()
+}
+
+// Encrypt encrypts extension data to the public key of the given peer.
+func (r *Registry) Encrypt(p peer.ID, data graphsync.ExtensionData) (graphsync.ExtensionData, error) {
+	pub := r.host.Peerstore().PubKey(p)
+	if pub == nil {
+		return graphsync.ExtensionData{}, ErrNoKey
+	}
+	return EncryptExtension(data, pub)
+}
+
+// decryptAll decrypts every registered extension present, reading each with
+// the given lookup
+func (r *Registry) decryptAll(lookup func(graphsync.ExtensionName) ([]byte, bool)) (map[graphsync.ExtensionName][]byte, error) {
+	r.namesLk.RLock()
+	defer r.namesLk.RUnlock()
+	decrypted := make(map[graphsync.ExtensionName][]byte)
+	for name := range r.names {
+		data, has := lookup(name)
+		if !has {
+			continue
+		}
+		priv := r.host.Peerstore().PrivKey(r.host.ID())
+		if priv == nil {
+			return nil, ErrNoKey
+		}
+		extension, err := DecryptExtension(graphsync.ExtensionData{Name: name, Data: data}, priv)
+		if err != nil {
+			return nil, err
+		}
+		decrypted[name] = extension.Data
+	}
+	return decrypted, nil
+}
+
+// RequestReceivedHook wraps a request hook, so it sees registered extensions
+// on incoming requests decrypted. Requests with a registered extension that
+// cannot be decrypted are terminated without running the hook.
+func (r *Registry) RequestReceivedHook(hook graphsync.OnRequestReceivedHook) graphsync.OnRequestReceivedHook {
+	return func(p peer.ID, request graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		decrypted, err := r.decryptAll(request.Extension)
+		if err != nil {
+			hookActions.TerminateWithError(err)
+			return
+		}
+		hook(p, decryptedRequest{request, decrypted}, hookActions)
+	}
+}
+
+// ResponseReceivedHook wraps a response hook, so it sees registered
+// extensions on incoming responses decrypted. Responses with a registered
+// extension that cannot be decrypted return an error without running the
+// hook, cancelling the request.
+func (r *Registry) ResponseReceivedHook(hook graphsync.OnResponseReceivedHook) graphsync.OnResponseReceivedHook {
+	return func(p peer.ID, response graphsync.ResponseData) error {
+		decrypted, err := r.decryptAll(response.Extension)
+		if err != nil {
+			return err
+		}
+		return hook(p, decryptedResponse{response, decrypted})
+	}
+}
+
+type decryptedRequest struct {
+	graphsync.RequestData
+	decrypted map[graphsync.ExtensionName][]byte
+}
+
+func (dr decryptedRequest) Extension(name graphsync.ExtensionName) ([]byte, bool) {
+	if data, ok := dr.decrypted[name]; ok {
+		return data, true
+	}
+	return dr.RequestData.Extension(name)
+}
+
+type decryptedResponse struct {
+	graphsync.ResponseData
+	decrypted map[graphsync.ExtensionName][]byte
+}
+
+func (dr decryptedResponse) Extension(name graphsync.ExtensionName) ([]byte, bool) {
+	if data, ok := dr.decrypted[name]; ok {
+		return data, true
+	}
+	return dr.ResponseData.Extension(name)
+}
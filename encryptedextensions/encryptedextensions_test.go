@@ -0,0 +1,77 @@
+package encryptedextensions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	pb "github.com/libp2p/go-libp2p-core/crypto/pb"
+)
+
+func TestEncryptDecryptExtension(t *testing.T) {
+	priv, pub, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate key")
+	}
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("AppleSauce/McGee"),
+		Data: testutil.RandomBytes(100),
+	}
+	encrypted, err := EncryptExtension(extension, pub)
+	if err != nil {
+		t.Fatal("unable to encrypt extension")
+	}
+	if encrypted.Name != extension.Name {
+		t.Fatal("should keep extension name")
+	}
+	if bytes.Contains(encrypted.Data, extension.Data) {
+		t.Fatal("encrypted data should not contain plaintext")
+	}
+	decrypted, err := DecryptExtension(encrypted, priv)
+	if err != nil {
+		t.Fatal("unable to decrypt extension")
+	}
+	if !bytes.Equal(decrypted.Data, extension.Data) {
+		t.Fatal("did not decrypt original data")
+	}
+
+	otherPriv, _, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate key")
+	}
+	_, err = DecryptExtension(encrypted, otherPriv)
+	if err == nil {
+		t.Fatal("should not decrypt with another key")
+	}
+
+	moved := graphsync.ExtensionData{Name: graphsync.ExtensionName("AppleSauce/Other"), Data: encrypted.Data}
+	_, err = DecryptExtension(moved, priv)
+	if err == nil {
+		t.Fatal("should not decrypt data moved to another extension")
+	}
+
+	_, err = DecryptExtension(graphsync.ExtensionData{Name: extension.Name, Data: encrypted.Data[:1]}, priv)
+	if err != ErrMalformedCiphertext {
+		t.Fatal("should reject truncated data")
+	}
+
+	_, edPub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate key")
+	}
+	_, err = EncryptExtension(extension, edPub)
+	if keyTypeErr, ok := err.(UnsupportedKeyTypeError); !ok || keyTypeErr.KeyType != pb.KeyType_Ed25519 {
+		t.Fatal("should reject non RSA keys")
+	}
+	edPriv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate key")
+	}
+	_, err = DecryptExtension(encrypted, edPriv)
+	if keyTypeErr, ok := err.(UnsupportedKeyTypeError); !ok || keyTypeErr.KeyType != pb.KeyType_Ed25519 {
+		t.Fatal("should reject decrypting with non RSA keys")
+	}
+}
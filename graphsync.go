@@ -2,11 +2,18 @@ package graphsync
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // RequestID is a unique identifier for a GraphSync request.
@@ -39,8 +46,145 @@ const (
 	// ExtensionDoNotSendCIDs tells the responding peer not to send certain blocks if they
 	// are encountered in a traversal and is documented at
 	// https://github.com/ipld/specs/blob/master/block-layer/graphsync/known_extensions.md
+	// Its data is an IPLD list of links, as encoded by the cidset package.
 	ExtensionDoNotSendCIDs = ExtensionName("graphsync/do-not-send-cids")
 
+	// ExtensionAckWindow opts a request in to message acknowledgements. Its data
+	// is the maximum number of response messages the responder may have sent
+	// the requestor without receiving an acknowledgement, encoded as an IPLD int.
+	ExtensionAckWindow = ExtensionName("graphsync/ack-window")
+
+	// ExtensionAck carries the sequence number of a response message. The
+	// responder sets it on responses to requests sent with ExtensionAckWindow, and
+	// the requestor sends its data back on a request with the same ID to
+	// acknowledge that message and all earlier messages for the request.
+	ExtensionAck = ExtensionName("graphsync/ack")
+
+	// ExtensionPersistentExtensions lists, as IPLD strings, the names of
+	// extensions on a response whose data applies to every later response for
+	// the same request, so the responder only sends it once.
+	ExtensionPersistentExtensions = ExtensionName("graphsync/persistent-extensions")
+
+	// ExtensionNonce carries a random value and timestamp, encoded as an IPLD
+	// map, that a responder can use to reject replayed requests.
+	ExtensionNonce = ExtensionName("graphsync/nonce")
+
+	// ExtensionPreferredOrder lists links, as an IPLD list encoded by the
+	// cidset package, under which the requestor would like blocks sent first,
+	// in order. The responder sends blocks under earlier links before blocks
+	// under later ones and before the rest of the traversal, as far as it can
+	// while following the selector. It is only a hint.
+	ExtensionPreferredOrder = ExtensionName("graphsync/preferred-order")
+
+	// ExtensionByteRange asks for only a range of bytes within the request's
+	// root block, usually a raw leaf, instead of a traversal. On a request it
+	// holds the offset and length, and on the response the bytes themselves,
+	// as IPLD maps encoded by the byterange package. The selector must match
+	// the root and nothing else: a requestor fails the request with
+	// byterange.ErrNotRoot before sending it, and a responder fails it if
+	// sent. A partial block cannot be verified against its CID, so the bytes
+	// returned are unverified, and are never stored.
+	ExtensionByteRange = ExtensionName("graphsync/byte-range")
+
+	// ExtensionSelectorName names, as raw bytes, a selector the responder has
+	// registered, so it can use its pre-parsed copy instead of decoding the
+	// selector sent with the request. Unknown names are ignored.
+	ExtensionSelectorName = ExtensionName("graphsync/selector-name")
+
+	// ExtensionMinProgressInterval holds the duration set by
+	// MinProgressInterval. It is read by the requestor, and never sent.
+	ExtensionMinProgressInterval = ExtensionName("graphsync/min-progress-interval")
+
+	// ExtensionVerifyConnectivity marks a request made with
+	// VerifyConnectivity. It is read by the requestor, and never sent.
+	ExtensionVerifyConnectivity = ExtensionName("graphsync/verify-connectivity")
+
+	// ExtensionRequestID holds the request ID set by WithRequestID. It is read
+	// by the requestor, and never sent.
+	ExtensionRequestID = ExtensionName("graphsync/request-id")
+
+	// ExtensionProgressPerBlock marks a request made with ProgressPerBlock. It
+	// is read by the requestor, and never sent.
+	ExtensionProgressPerBlock = ExtensionName("graphsync/progress-per-block")
+
+	// ExtensionSkipIfLocal marks a request made with SkipIfLocal or, with data
+	// of a single 1 byte, SkipIfLocalSubtree. It is read by the requestor, and
+	// never sent.
+	ExtensionSkipIfLocal = ExtensionName("graphsync/skip-if-local")
+
+	// ExtensionCancelReason carries the CancelReason for a cancelled request on
+	// the cancel sent to the responder, as an IPLD map encoded by the
+	// cancelreason package.
+	ExtensionCancelReason = ExtensionName("graphsync/cancel-reason")
+
+	// ExtensionAcceptPush opts a request in to content the responder pushes
+	// beyond what the selector reaches. It has no data.
+	ExtensionAcceptPush = ExtensionName("graphsync/accept-push")
+
+	// ExtensionPushedSubtrees lists, as an IPLD list encoded by the cidset
+	// package, the roots of DAGs a responder suggests the requestor might also
+	// want. If the request was made with ExtensionAcceptPush, the responder
+	// sends the blocks under them in the same response, after the blocks the
+	// selector reaches.
+	ExtensionPushedSubtrees = ExtensionName("graphsync/pushed-subtrees")
+
+	// ExtensionExpandSelector asks the requestor to request the same root
+	// again with its selector expanded to also cover the selector spec in the
+	// data, encoded as it is in a request. A responder sends it when it can
+	// tell the requestor will need data next to what it asked for. Requests
+	// made with FollowExpansions act on it, and others ignore it.
+	ExtensionExpandSelector = ExtensionName("graphsync/expand-selector")
+
+	// ExtensionFollowExpansions holds the most expansions set by
+	// FollowExpansions. It is read by the requestor, and never sent.
+	ExtensionFollowExpansions = ExtensionName("graphsync/follow-expansions")
+
+	// ExtensionRedirect names, as the bytes of a CID, the root a responder
+	// redirects a request to. It is sent on the response that ends the
+	// request with RequestFailedContentNotFound, so requestors that do not
+	// know it fail the request as they would for missing content. Requests
+	// made with FollowRedirects request the new root instead.
+	ExtensionRedirect = ExtensionName("graphsync/redirect")
+
+	// ExtensionFollowRedirects holds the most redirects set by
+	// FollowRedirects. It is read by the requestor, and never sent.
+	ExtensionFollowRedirects = ExtensionName("graphsync/follow-redirects")
+
+	// ExtensionMetricLabels holds the labels set by WithMetricLabels, as a
+	// JSON object of strings. It is read by the requestor, and never sent.
+	ExtensionMetricLabels = ExtensionName("graphsync/metric-labels")
+
+	// ExtensionRequestName holds the name set by WithRequestName. It is read
+	// by the requestor, and never sent.
+	ExtensionRequestName = ExtensionName("graphsync/request-name")
+
+	// ExtensionTraversalConcurrency holds the most concurrent loads set by
+	// TraversalConcurrency. It is read by the requestor, and never sent.
+	ExtensionTraversalConcurrency = ExtensionName("graphsync/traversal-concurrency")
+
+	// ExtensionCheckpoint opts a request in to checkpoints, so a responder
+	// that saves them can resume the response after it restarts instead of
+	// starting over. It has no data.
+	ExtensionCheckpoint = ExtensionName("graphsync/checkpoint")
+
+	// ExtensionCursor holds, as encoded by the cursor package, how far a
+	// responder got with a response that stopped partway through, whether at
+	// its maximum response duration, on an error, or because the requestor
+	// cancelled it. The responder sends it on the response that ends the
+	// request, and a later request for the same root and selector sent with
+	// it, by ResumeFrom, resumes the response from there.
+	ExtensionCursor = ExtensionName("graphsync/cursor")
+
+	// ExtensionRawPassthrough asks the responder to send only blocks whose
+	// bytes, as loaded, hash to their CID. It has no data.
+	ExtensionRawPassthrough = ExtensionName("graphsync/raw-passthrough")
+
+	// ExtensionSupportedExtensions asks, on a request with no root or selector,
+	// which extensions the responder supports. The responder answers right
+	// away, without a traversal, with their names on the response as an IPLD
+	// list of strings, encoded by the persistentextensions package.
+	ExtensionSupportedExtensions = ExtensionName("graphsync/supported-extensions")
+
 	// GraphSync Response Status Codes
 
 	// Informational Response Codes (partial)
@@ -67,6 +211,10 @@ const (
 	// RequestCompletedPartial means the response is completed, and part of the
 	// GraphSync request was sent back, but not the complete request.
 	RequestCompletedPartial = ResponseStatusCode(21)
+	// RequestCompletedEmpty means the response is completed, all blocks needed
+	// for the traversal were sent back, but the selector matched no nodes
+	// (i.e. a path that does not exist in the DAG). This is not an error.
+	RequestCompletedEmpty = ResponseStatusCode(22)
 
 	// Error Response Codes (request terminated)
 
@@ -82,13 +230,434 @@ const (
 	RequestFailedLegal = ResponseStatusCode(33)
 	// RequestFailedContentNotFound means the respondent does not have the content.
 	RequestFailedContentNotFound = ResponseStatusCode(34)
+	// RequestFailedTimeout means the responder stopped working on the request
+	// because it took longer than the responder allows.
+	RequestFailedTimeout = ResponseStatusCode(35)
 )
 
 var (
 	// ErrExtensionAlreadyRegistered means a user extension can be registered only once
 	ErrExtensionAlreadyRegistered = errors.New("extension already registered")
+
+	// ErrExtensionsNotAdvertised means a peer did not say which extensions it
+	// supports, most likely because it predates ExtensionSupportedExtensions
+	ErrExtensionsNotAdvertised = errors.New("peer does not advertise supported extensions")
+
+	// ErrRequestIDInUse is returned on a request's error channel when the
+	// request was made WithRequestID and the ID belongs to a request still in
+	// progress.
+	ErrRequestIDInUse = errors.New("request ID already in use")
+
+	// ErrRequestCancelled is returned on a request's error channel when the
+	// request was cancelled with GraphExchange.Cancel.
+	ErrRequestCancelled = errors.New("request cancelled")
+
+	// ErrRequestNotFound is returned by GraphExchange.Cancel when no request
+	// with the given ID is in progress.
+	ErrRequestNotFound = errors.New("request not found")
+
+	// ErrNoInitialResponse is returned on a request's error channel when the
+	// request was made with MinProgressInterval and no block arrived in time.
+	ErrNoInitialResponse = errors.New("no blocks received within minimum progress interval")
+
+	// ErrProgressNotRead is returned on a request's error channel when the
+	// requestor cancelled the request because its progress channel was not
+	// being read. See impl.MaxBufferedProgress.
+	ErrProgressNotRead = errors.New("request cancelled: progress not read")
+
+	// ErrSendAbandoned is the reason given to OnResponseUndeliverableHook for
+	// responses dropped without an attempt to send them, because the peer
+	// disconnected or the exchange shut down first.
+	ErrSendAbandoned = errors.New("abandoned before sending")
 )
 
+// MinProgressInterval returns an extension that aborts a request with
+// ErrNoInitialResponse if not a single block has arrived for it within d of
+// the request starting. Once any block arrives, it has no further effect. It is
+// handled by the requestor, and not sent to the responder.
+func MinProgressInterval(d time.Duration) ExtensionData {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(d))
+	return ExtensionData{
+		Name: ExtensionMinProgressInterval,
+		Data: data,
+	}
+}
+
+// VerifyConnectivity returns an extension that checks, once a request's
+// traversal succeeds, that the blocks now in the local store connect up as
+// the selector expects. The selector is run again over the local store alone,
+// and a ConnectivityError is returned on the request's error channel if any
+// link it follows is missing, or if the responder sent blocks it does not
+// reach. It is handled by the requestor, and not sent to the responder.
+func VerifyConnectivity() ExtensionData {
+	return ExtensionData{Name: ExtensionVerifyConnectivity}
+}
+
+// WithRequestID returns an extension that sends a request with the given ID
+// instead of one the requestor picks, so a caller can correlate requests
+// across restarts. A responder still serving a request with the same ID from
+// the same peer carries on with that response rather than starting another,
+// which makes reissuing a request after a restart idempotent. If the root,
+// selector, or extensions differ, the responder stops the response in
+// progress instead, and fails the ID with a single status, usually
+// RequestFailedUnknown. It is handled by the requestor, and not sent to the
+// responder.
+func WithRequestID(id RequestID) ExtensionData {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(id))
+	return ExtensionData{
+		Name: ExtensionRequestID,
+		Data: data,
+	}
+}
+
+// ProgressPerBlock returns an extension that reports a request's progress once
+// per block rather than once per node. Normally every node the selector
+// visits is reported, so a block holding a map with a list in it yields
+// several events. With ProgressPerBlock, only the first node visited in each
+// distinct block is reported, with LastBlock.Link set to that block's link,
+// including for the root block. It is handled by the requestor, and not sent
+// to the responder.
+func ProgressPerBlock() ExtensionData {
+	return ExtensionData{Name: ExtensionProgressPerBlock}
+}
+
+// FollowExpansions returns an extension that lets the responder expand a
+// request's selector with ExtensionExpandSelector. When the responder
+// completes a request it asked to expand, the requestor requests the same
+// root again with a selector covering both the old selector and the
+// expansion, and reports only nodes the earlier requests did not. At most max
+// expansions are followed, after which the responder's asks are ignored, so a
+// responder cannot keep a request going forever. It is handled by the
+// requestor, and not sent to the responder.
+func FollowExpansions(max int) ExtensionData {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(max))
+	return ExtensionData{
+		Name: ExtensionFollowExpansions,
+		Data: data,
+	}
+}
+
+// FollowRedirects returns an extension that makes a request again, with the
+// same selector and extensions, when the responder redirects it to another
+// root with ExtensionRedirect. Progress is reported for the new root as if it
+// had been requested, and errors from the redirected request are dropped. At
+// most max redirects are followed, after which a redirect fails the request
+// with a RedirectError, so responders redirecting in a loop cannot keep a
+// request going forever. It is handled by the requestor, and not sent to the
+// responder.
+func FollowRedirects(max int) ExtensionData {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(max))
+	return ExtensionData{
+		Name: ExtensionFollowRedirects,
+		Data: data,
+	}
+}
+
+// WithMetricLabels returns an extension that attaches labels to every metric
+// the requestor reports for a request, so metrics can be grouped by something
+// meaningful to the caller, such as a tenant or a kind of request, instead of
+// by peer IDs, which are too many to label metrics with. It is handled by the
+// requestor, and not sent to the responder.
+func WithMetricLabels(labels map[string]string) ExtensionData {
+	// a map of strings always marshals
+	data, _ := json.Marshal(labels)
+	return ExtensionData{
+		Name: ExtensionMetricLabels,
+		Data: data,
+	}
+}
+
+// RequestNameLabel is the metric label holding the name a request was made
+// with using WithRequestName
+const RequestNameLabel = "request-name"
+
+// WithRequestName returns an extension that names a request, so it is easier
+// to pick out while debugging than by its ID. The name is listed with the
+// request by ActiveRequests, follows its ID in log messages about it, and is
+// added to its metric labels as RequestNameLabel. It is handled by the
+// requestor, and not sent to the responder.
+func WithRequestName(name string) ExtensionData {
+	return ExtensionData{
+		Name: ExtensionRequestName,
+		Data: []byte(name),
+	}
+}
+
+// TraversalConcurrency returns an extension that lets the requestor load up to
+// n sibling links from its local store at once, ahead of its traversal, so a
+// wide DAG it already has is read in parallel rather than one block at a
+// time. Nodes are still visited and reported in the same order. Links the
+// local store does not have are loaded from the responder as usual. The
+// default, or an n of 1 or less, loads links one at a time. It is handled by
+// the requestor, and not sent to the responder.
+func TraversalConcurrency(n int) ExtensionData {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(n))
+	return ExtensionData{
+		Name: ExtensionTraversalConcurrency,
+		Data: data,
+	}
+}
+
+// SkipIfLocal returns an extension that completes a request right away, with
+// no responses or errors and without any network traffic, if the requestor's
+// loader can already load the root. It is handled by the requestor, and not
+// sent to the responder.
+func SkipIfLocal() ExtensionData {
+	return ExtensionData{Name: ExtensionSkipIfLocal}
+}
+
+// SkipIfLocalSubtree is like SkipIfLocal, but only skips a request if every
+// block the selector reaches from the root can be loaded locally.
+func SkipIfLocalSubtree() ExtensionData {
+	return ExtensionData{Name: ExtensionSkipIfLocal, Data: []byte{1}}
+}
+
+// AcceptPush returns an extension that opts a request in to subtrees the
+// responder pushes beyond what the selector reaches. Pushed blocks are stored
+// locally if every hook registered with RegisterPushReceivedHook accepts them,
+// but are not reported as responses, and a pushed subtree the responder
+// cannot send in full fails nothing.
+func AcceptPush() ExtensionData {
+	return ExtensionData{Name: ExtensionAcceptPush}
+}
+
+// Checkpointed returns an extension that opts a request in to checkpoints. A
+// responder that saves checkpoints and restarts while the request is in
+// progress resumes the response from its last checkpoint, so the requestor
+// should keep the request open while the responder comes back.
+func Checkpointed() ExtensionData {
+	return ExtensionData{Name: ExtensionCheckpoint}
+}
+
+// ResumeFrom returns an extension that resumes a response that stopped
+// partway through, from the cursor of the InterruptedError it ended with, or
+// for a request the requestor cancelled, one made by cursor.FromResponses.
+// The request must have the same root and selector. The responder sends only
+// the blocks it had not sent before, so the requestor's store must still have
+// the ones it did. The responder does load them all again, though, as it
+// walks from the root back to the cursor.
+func ResumeFrom(cursor []byte) ExtensionData {
+	return ExtensionData{Name: ExtensionCursor, Data: cursor}
+}
+
+// RawPassthrough returns an extension that guarantees every block of a
+// request reaches the local store with the exact bytes the responder loaded.
+// Blocks are always sent and stored as their original bytes rather than
+// encoded again, and both sides decode them only to follow the selector. With
+// RawPassthrough, both also hash each block against its CID: the responder
+// treats a block whose loaded bytes do not match as missing, and the
+// requestor fails the load of one that does not match, whether it came from
+// the responder or the local store, with a BlockBytesMismatchError.
+func RawPassthrough() ExtensionData {
+	return ExtensionData{Name: ExtensionRawPassthrough}
+}
+
+// ActiveRequest describes a request this node has in progress
+type ActiveRequest struct {
+	ID   RequestID
+	Peer peer.ID
+	Root cid.Cid
+	// Name is the name given with WithRequestName, if any
+	Name string
+}
+
+// ConnectivityError is returned on a request's error channel when a request
+// made with VerifyConnectivity left a DAG in the local store that is not
+// connected as the selector expects
+type ConnectivityError struct {
+	// Missing are links the selector follows that are not in the local store
+	Missing []ipld.Link
+	// Orphans are blocks the responder sent that the selector does not reach
+	Orphans []ipld.Link
+}
+
+func (e ConnectivityError) Error() string {
+	return fmt.Sprintf("DAG is not connected: %d missing links, %d orphan blocks", len(e.Missing), len(e.Orphans))
+}
+
+// CancelReasonCode says why a requestor cancelled a request
+type CancelReasonCode int
+
+const (
+	// CancelReasonUnknown means the requestor gave no reason
+	CancelReasonUnknown = CancelReasonCode(iota)
+	// CancelReasonTimeout means the request ran past a deadline
+	CancelReasonTimeout
+	// CancelReasonUserAbort means the user of the requestor gave up on the
+	// request
+	CancelReasonUserAbort
+	// CancelReasonFoundElsewhere means the requestor got the content from
+	// somewhere else
+	CancelReasonFoundElsewhere
+	// CancelReasonProgressNotRead means the requestor's caller stopped
+	// reading the request's progress. See impl.MaxBufferedProgress.
+	CancelReasonProgressNotRead
+	// CancelReasonStoreFailed means the requestor could not store the blocks
+	// it received, such as when its disk is full
+	CancelReasonStoreFailed
+)
+
+// CancelReason is sent to the responder when a request is cancelled, so it
+// can log or count why requestors abandon requests
+type CancelReason struct {
+	Code    CancelReasonCode
+	Message string
+}
+
+type cancelReasonKey struct{}
+
+type cancelReasonHolder struct {
+	lk     sync.Mutex
+	reason *CancelReason
+}
+
+// WithCancelReason is like context.WithCancel, but the returned cancel
+// function takes the reason to send to the responder of any request made with
+// the context. Only the first reason given is kept.
+func WithCancelReason(parent context.Context) (context.Context, func(CancelReason)) {
+	holder := &cancelReasonHolder{}
+	ctx, cancel := context.WithCancel(context.WithValue(parent, cancelReasonKey{}, holder))
+	return ctx, func(reason CancelReason) {
+		holder.lk.Lock()
+		if holder.reason == nil {
+			holder.reason = &reason
+		}
+		holder.lk.Unlock()
+		cancel()
+	}
+}
+
+// CancelReasonFromContext returns the reason a done context was cancelled
+// with WithCancelReason. Otherwise, it is CancelReasonTimeout if the context's
+// deadline passed, or CancelReasonUnknown.
+func CancelReasonFromContext(ctx context.Context) CancelReason {
+	if holder, ok := ctx.Value(cancelReasonKey{}).(*cancelReasonHolder); ok {
+		holder.lk.Lock()
+		reason := holder.reason
+		holder.lk.Unlock()
+		if reason != nil {
+			return *reason
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return CancelReason{Code: CancelReasonTimeout}
+	}
+	return CancelReason{Code: CancelReasonUnknown}
+}
+
+// DialError is returned on a request's error channel when the requestor was
+// unable to connect to the peer it was sending the request to
+type DialError struct {
+	Peer peer.ID
+	Err  error
+}
+
+func (e DialError) Error() string {
+	return fmt.Sprintf("unable to dial peer %s: %s", e.Peer, e.Err)
+}
+
+// AddrError is returned on a request's error channel when the address it was
+// made to with RequestFromAddr does not name a peer
+type AddrError struct {
+	Addr ma.Multiaddr
+	Err  error
+}
+
+func (e AddrError) Error() string {
+	return fmt.Sprintf("invalid peer address %s: %s", e.Addr, e.Err)
+}
+
+// RedirectError is returned on a request's error channel when the responder
+// redirected the request to another root, and the request was not made with
+// FollowRedirects or had no redirects left to follow
+type RedirectError struct {
+	Root cid.Cid
+}
+
+func (e RedirectError) Error() string {
+	return fmt.Sprintf("request redirected to %s", e.Root)
+}
+
+// InterruptedError is returned on a request's error channel when the
+// responder stopped partway through the response and said how far it got.
+// Err is the error for the status the response ended with. Making the request
+// again with ResumeFrom(Cursor) carries on where the response stopped.
+type InterruptedError struct {
+	Err    error
+	Cursor []byte
+}
+
+func (e InterruptedError) Error() string {
+	return fmt.Sprintf("response interrupted: %s", e.Err)
+}
+
+// BlockDecodeError is returned on a request's error channel when a block
+// received for the request could not be decoded as IPLD, such as a block
+// whose CID claims dag-cbor but whose bytes are not valid CBOR
+type BlockDecodeError struct {
+	Cid cid.Cid
+	Err error
+}
+
+func (e BlockDecodeError) Error() string {
+	return fmt.Sprintf("unable to decode block %s: %s", e.Cid, e.Err)
+}
+
+// StoreError is returned on a request's error channel when the requestor
+// could not store a block it received, such as when its disk is full. The
+// request is cancelled with the responder as soon as it happens, with
+// CancelReasonStoreFailed.
+type StoreError struct {
+	Cid cid.Cid
+	Err error
+}
+
+func (e StoreError) Error() string {
+	return fmt.Sprintf("unable to store block %s: %s", e.Cid, e.Err)
+}
+
+// BlockBytesMismatchError is returned on the error channel of a request made
+// with RawPassthrough when the bytes of a block do not hash to its CID
+type BlockBytesMismatchError struct {
+	Cid cid.Cid
+}
+
+func (e BlockBytesMismatchError) Error() string {
+	return fmt.Sprintf("bytes of block %s do not match its cid", e.Cid)
+}
+
+// ResponseLatencyError is returned on the error channel of RequestFromPeers
+// when the last peer tried went longer than the fallback policy allows without
+// delivering a response
+type ResponseLatencyError struct {
+	Peer       peer.ID
+	MaxLatency time.Duration
+}
+
+func (e ResponseLatencyError) Error() string {
+	return fmt.Sprintf("no response from peer %s within %s", e.Peer, e.MaxLatency)
+}
+
+// FallbackPolicy determines how RequestFromPeers spreads a request across
+// the peers it is given.
+type FallbackPolicy struct {
+	// Race sends the request to every peer at once. The first peer to deliver
+	// a response is kept, and the requests to the others are cancelled. Peers
+	// that fail before any peer responds are dropped from the race.
+	Race bool
+
+	// MaxLatency, when not racing, is the longest the requestor waits for the
+	// peer it is currently using to deliver its next response. If the peer
+	// takes longer, or its request fails, the request is cancelled and sent
+	// to the next peer in order. Zero means only fall back on failure.
+	MaxLatency time.Duration
+}
+
 // ResponseProgress is the fundamental unit of responses making progress in Graphsync.
 type ResponseProgress struct {
 	Node      ipld.Node // a node which matched the graphsync query
@@ -97,6 +666,40 @@ type ResponseProgress struct {
 		Path ipld.Path
 		Link ipld.Link
 	}
+	// Explored is true if the traversal went on to explore beneath this node,
+	// following any links under it, and false if the selector stopped here --
+	// for example, a node that matched without its links being followed.
+	Explored bool
+	// Warnings are conditions met loading the block this node is in that did
+	// not stop the request, such as a block the responder did not send
+	Warnings []Warning
+}
+
+// WarningCode identifies the kind of condition a Warning reports
+type WarningCode int
+
+const (
+	// WarningBlockNotSent means the responder listed a block as sent without
+	// sending it, usually because it sent the block once already for another
+	// request, and the block was loaded from the local store instead
+	WarningBlockNotSent WarningCode = iota
+)
+
+// Warning is a condition met during a request that is worth surfacing but
+// is not a failure, reported on the progress event it affected
+type Warning struct {
+	Code WarningCode
+	// Link is the block the warning is about
+	Link ipld.Link
+}
+
+func (w Warning) String() string {
+	switch w.Code {
+	case WarningBlockNotSent:
+		return fmt.Sprintf("block %s was not sent, loaded from local store", w.Link)
+	default:
+		return fmt.Sprintf("warning %d for block %s", w.Code, w.Link)
+	}
 }
 
 // RequestData describes a received graphsync request.
@@ -119,6 +722,9 @@ type RequestData interface {
 
 	// IsCancel returns true if this particular request is being cancelled
 	IsCancel() bool
+
+	// RequestScratch returns the scratch shared by all hooks for the request
+	RequestScratch() RequestScratch
 }
 
 // ResponseData describes a received Graphsync response
@@ -132,14 +738,66 @@ type ResponseData interface {
 	// Extension returns the content for an extension on a response, or errors
 	// if extension is not present
 	Extension(name ExtensionName) ([]byte, bool)
+
+	// RequestScratch returns the scratch shared by all hooks for the request
+	RequestScratch() RequestScratch
+}
+
+// RequestScratch stores values that hooks share for a single request on this
+// node, so a value one hook computes can be read by later hooks for the same
+// request. It is safe for concurrent use. A responder creates the scratch for
+// a request when the request is queued, and drops it once the response
+// finishes or the requestor cancels it, after the cancelled hooks run. A
+// requestor creates the scratch for a request when it is made, and drops it
+// once the request completes.
+type RequestScratch interface {
+	// Get returns the value stored for a key, if any
+	Get(key interface{}) (interface{}, bool)
+	// Set stores a value for a key, replacing any value stored before
+	Set(key interface{}, value interface{})
+}
+
+type requestScratch struct {
+	lk     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// NewRequestScratch returns an empty RequestScratch
+func NewRequestScratch() RequestScratch {
+	return &requestScratch{values: make(map[interface{}]interface{})}
+}
+
+func (rs *requestScratch) Get(key interface{}) (interface{}, bool) {
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+	value, ok := rs.values[key]
+	return value, ok
+}
+
+func (rs *requestScratch) Set(key interface{}, value interface{}) {
+	rs.lk.Lock()
+	rs.values[key] = value
+	rs.lk.Unlock()
 }
 
 // RequestReceivedHookActions are actions that a request hook can take to change
 // behavior for the response
 type RequestReceivedHookActions interface {
 	SendExtensionData(ExtensionData)
+	// SendPersistentExtensionData sends extension data that applies to every
+	// response for the request, but only puts it on the wire once
+	SendPersistentExtensionData(ExtensionData)
 	TerminateWithError(error)
 	ValidateRequest()
+	// PushSubtrees suggests DAGs the requestor might also want, and, if the
+	// request was made with ExtensionAcceptPush, sends them after the blocks
+	// the selector reaches
+	PushSubtrees(roots ...cid.Cid)
+	// Redirect ends the request with RequestFailedContentNotFound, naming
+	// root as the one to request instead with ExtensionRedirect
+	Redirect(root cid.Cid)
+	// RequestScratch returns the scratch shared by all hooks for the request
+	RequestScratch() RequestScratch
 }
 
 // OnRequestReceivedHook is a hook that runs each time a request is received.
@@ -149,16 +807,85 @@ type RequestReceivedHookActions interface {
 // err - error - if not nil, halt request and return RequestRejected with the responseData
 type OnRequestReceivedHook func(p peer.ID, request RequestData, hookActions RequestReceivedHookActions)
 
+// OnRequestQueuedHook is a hook that runs each time a responder queues a
+// received request to be worked on. It should not block.
+type OnRequestQueuedHook func(p peer.ID, request RequestData)
+
+// OnRequestCancelledHook is a hook that runs each time a requestor cancels a
+// request the responder has queued or is working on, with the reason the
+// requestor gave. It should not block.
+type OnRequestCancelledHook func(p peer.ID, request RequestData, reason CancelReason)
+
+// TraversalStats describes the work a responder did for a response
+type TraversalStats struct {
+	// NodesVisited is how many nodes the selector traversal visited
+	NodesVisited int
+	// BlocksSent is how many blocks were queued to send to the requestor. A
+	// block already sent to the requestor, or one it asked not to be sent, is
+	// not counted.
+	BlocksSent int
+	// MaxDepth is the most path segments between the root and a node the
+	// traversal visited
+	MaxDepth int
+	// Duration is how long the responder worked on the response, from taking
+	// it off the queue to finishing it
+	Duration time.Duration
+}
+
+// OnResponseCompletedHook is a hook that runs each time a responder finishes
+// working on a response, whether or not it succeeded, with statistics about
+// the work it did. A response the requestor cancels runs
+// OnRequestCancelledHook instead. It should not block.
+type OnResponseCompletedHook func(p peer.ID, request RequestData, stats TraversalStats)
+
+// OnRequestStartedHook is a hook that runs each time a responder takes a
+// queued request off the queue to begin working on it. It should not block.
+type OnRequestStartedHook func(p peer.ID, request RequestData)
+
+// OnResponseUndeliverableHook is a hook that runs each time a message of
+// responses to a request a responder worked on is abandoned without being
+// sent, such as when the requestor disconnects or the stream keeps failing,
+// with the error sending it, or ErrSendAbandoned. It should not block.
+type OnResponseUndeliverableHook func(p peer.ID, request RequestData, reason error)
+
 // OnResponseReceivedHook is a hook that runs each time a response is received.
 // It receives the peer that sent the response and all data about the response.
 // If it returns an error processing is halted and the original request is cancelled.
 type OnResponseReceivedHook func(p peer.ID, responseData ResponseData) error
 
+// OnPushReceivedHook is a hook that runs each time a responder offers to push
+// subtrees for a request made with AcceptPush. It receives the response that
+// listed them and their roots, and returns whether to accept them.
+type OnPushReceivedHook func(p peer.ID, responseData ResponseData, roots []cid.Cid) bool
+
 // GraphExchange is a protocol that can exchange IPLD graphs based on a selector
 type GraphExchange interface {
 	// Request initiates a new GraphSync request to the given peer using the given selector spec.
 	Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
 
+	// RequestFromPeers makes the same request to several peers that all have
+	// the content, falling back from one to another according to the policy,
+	// and merges the results into a single set of channels, as if from one
+	// request. Responses already delivered are not repeated after falling back.
+	RequestFromPeers(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, policy FallbackPolicy, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// RequestFromAddr connects to the peer at a multiaddr ending in its peer
+	// ID, such as /ip4/1.2.3.4/tcp/4001/p2p/Qm..., and makes a request to it.
+	// An address with no peer ID fails the request with an AddrError, and a
+	// peer that cannot be reached fails it with a DialError.
+	RequestFromAddr(ctx context.Context, addr ma.Multiaddr, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// RequestDiff requests the DAG under newRoot from the peer, without the
+	// blocks the selector reaches from oldRoot, an earlier version already in
+	// the local store. The peer is asked not to send those blocks with
+	// ExtensionDoNotSendCIDs, so only what changed comes over the network. The
+	// responses are the same as for an ordinary request for newRoot.
+	RequestDiff(ctx context.Context, p peer.ID, oldRoot ipld.Link, newRoot ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// FetchFile requests the whole UnixFS file DAG under root from the peer,
+	// and once it is stored locally returns a reader of the file's contents.
+	FetchFile(ctx context.Context, p peer.ID, root ipld.Link) (io.ReadCloser, error)
+
 	// RegisterRequestReceivedHook adds a hook that runs when a request is received
 	// If overrideDefaultValidation is set to true, then if the hook does not error,
 	// it is considered to have "validated" the request -- and that validation supersedes
@@ -167,4 +894,71 @@ type GraphExchange interface {
 
 	// RegisterResponseReceivedHook adds a hook that runs when a response is received
 	RegisterResponseReceivedHook(OnResponseReceivedHook) error
+
+	// PeerExtensions asks a peer which extensions it supports as a responder.
+	// It returns ErrExtensionsNotAdvertised for peers that do not say.
+	PeerExtensions(ctx context.Context, p peer.ID) ([]ExtensionName, error)
+
+	// AdvertiseExtension adds a user extension to those this node tells peers
+	// it supports, when they ask with PeerExtensions. Extensions graphsync
+	// handles itself are advertised already. An extension can be advertised
+	// only once.
+	AdvertiseExtension(name ExtensionName) error
+
+	// RegisterPushReceivedHook adds a hook that runs when a responder offers to
+	// push subtrees. Pushed subtrees are stored only if every hook accepts them.
+	RegisterPushReceivedHook(OnPushReceivedHook) error
+
+	// RegisterRequestQueuedHook adds a hook that runs when a received request is
+	// queued, before the responder begins work on it
+	RegisterRequestQueuedHook(OnRequestQueuedHook) error
+
+	// RegisterRequestStartedHook adds a hook that runs when the responder takes
+	// a queued request off the queue and begins work on it. Together with
+	// RegisterRequestQueuedHook, it measures how long requests wait in the queue.
+	RegisterRequestStartedHook(OnRequestStartedHook) error
+
+	// RegisterResponseCompletedHook adds a hook that runs when the responder
+	// finishes working on a response, with statistics about its traversal
+	RegisterResponseCompletedHook(OnResponseCompletedHook) error
+
+	// RegisterRequestCancelledHook adds a hook that runs when a requestor
+	// cancels a received request, with the reason it gave. Requests made with a
+	// context from WithCancelReason send the reason given to its cancel
+	// function.
+	RegisterRequestCancelledHook(OnRequestCancelledHook) error
+
+	// RegisterUndeliverableResponseHook adds a hook that runs when responses
+	// to a received request are abandoned without being sent, so a responder
+	// can tell what it actually served
+	RegisterUndeliverableResponseHook(OnResponseUndeliverableHook) error
+
+	// ActiveRequests returns a snapshot of the requests this node has made
+	// that are still in progress
+	ActiveRequests() []ActiveRequest
+
+	// ResumeCheckpoints resumes the responses to requests made with
+	// Checkpointed that a responder saving checkpoints had in progress when
+	// it last stopped. Hooks run again for each, so it should be called after
+	// they are registered.
+	ResumeCheckpoints() error
+
+	// Cancel cancels the in progress request with the given ID, such as one
+	// chosen with WithRequestID, sending the reason to the responder. The
+	// request's error channel receives ErrRequestCancelled.
+	Cancel(requestID RequestID, reason CancelReason) error
+
+	// CancelPeer cancels every in progress request to the peer, as Cancel
+	// does, and returns how many it cancelled
+	CancelPeer(p peer.ID) int
+
+	// BufferedResponseBytes returns the total size of blocks loaded for
+	// responses to all peers but not yet handed to the network
+	BufferedResponseBytes() uint64
+
+	// RegisterSelector registers a selector spec under a name. Incoming requests
+	// that name it with ExtensionSelectorName use it directly, without decoding,
+	// validating, or parsing the selector they were sent with. It should only be
+	// used for trusted selectors.
+	RegisterSelector(name string, selector ipld.Node) error
 }
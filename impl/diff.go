@@ -0,0 +1,44 @@
+package graphsync
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/selectorutil"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// RequestDiff requests the DAG under newRoot, asking the peer not to send
+// the blocks the same selector reaches from oldRoot in the local store.
+func (gs *GraphSync) RequestDiff(ctx context.Context, p peer.ID, oldRoot ipld.Link, newRoot ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	localCids, err := gs.localCids(ctx, oldRoot, selector)
+	if err != nil {
+		return errorResponse(err)
+	}
+	data, err := cidset.EncodeCidSet(localCids, gs.ipldBridge)
+	if err != nil {
+		return errorResponse(err)
+	}
+	extensions = append(extensions, graphsync.ExtensionData{
+		Name: graphsync.ExtensionDoNotSendCIDs,
+		Data: data,
+	})
+	return gs.Request(ctx, p, newRoot, selector, extensions...)
+}
+
+// localCids collects the CIDs of the blocks the selector reaches from root
+// that can be loaded locally, up to the first block that is missing.
+func (gs *GraphSync) localCids(ctx context.Context, root ipld.Link, selectorSpec ipld.Node) (*cid.Set, error) {
+	visited, _, err := selectorutil.LocalVisit(ctx, gs.ipldBridge, gs.loaderFor(ctx), root, selectorSpec)
+	if err != nil {
+		return nil, err
+	}
+	cids := cid.NewSet()
+	for _, c := range visited {
+		cids.Add(c)
+	}
+	return cids, nil
+}
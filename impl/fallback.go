@@ -0,0 +1,274 @@
+package graphsync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var errNoPeers = errors.New("no peers to request from")
+
+// RequestFromPeers initiates the same request to several peers, falling back
+// between them according to the given policy.
+func (gs *GraphSync) RequestFromPeers(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, policy graphsync.FallbackPolicy, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if len(peers) == 0 {
+		return errorResponse(errNoPeers)
+	}
+	fr := &fallbackRequest{
+		gs:             gs,
+		ctx:            ctx,
+		peers:          peers,
+		root:           root,
+		selector:       selector,
+		extensions:     extensions,
+		policy:         policy,
+		events:         make(chan attemptEvent),
+		outgoing:       make(chan graphsync.ResponseProgress),
+		outgoingErrors: make(chan error),
+		sent:           make(map[string]struct{}),
+	}
+	go fr.run()
+	return fr.outgoing, fr.outgoingErrors
+}
+
+// attemptEvent is a progress event, error, or completion from the request
+// to a single peer
+type attemptEvent struct {
+	attempt  int
+	progress *graphsync.ResponseProgress
+	err      error
+	done     bool
+}
+
+type attempt struct {
+	p        peer.ID
+	cancelFn context.CancelFunc
+	errs     []error
+}
+
+type fallbackRequest struct {
+	gs         *GraphSync
+	ctx        context.Context
+	peers      []peer.ID
+	root       ipld.Link
+	selector   ipld.Node
+	extensions []graphsync.ExtensionData
+	policy     graphsync.FallbackPolicy
+
+	events         chan attemptEvent
+	outgoing       chan graphsync.ResponseProgress
+	outgoingErrors chan error
+
+	// internal do not touch outside run loop
+	attempts []*attempt
+	sent     map[string]struct{}
+	errs     []error
+}
+
+func (fr *fallbackRequest) run() {
+	defer func() {
+		for _, a := range fr.attempts {
+			a.cancelFn()
+		}
+		// errors are sent after all responses, so consumers can read the
+		// response channel to completion before the error channel
+		close(fr.outgoing)
+		for _, err := range fr.errs {
+			select {
+			case <-fr.ctx.Done():
+			case fr.outgoingErrors <- err:
+			}
+		}
+		close(fr.outgoingErrors)
+	}()
+	if fr.policy.Race {
+		fr.race()
+		return
+	}
+	fr.sequence()
+}
+
+// sequence tries each peer in order, moving on when a peer fails or takes
+// longer than the policy's max latency to respond
+func (fr *fallbackRequest) sequence() {
+	current := fr.start(0)
+	timer := fr.newLatencyTimer()
+	for {
+		select {
+		case <-fr.ctx.Done():
+			return
+		case <-timer.C:
+			current.cancelFn()
+			if len(fr.attempts) == len(fr.peers) {
+				fr.errs = append(fr.errs, graphsync.ResponseLatencyError{Peer: current.p, MaxLatency: fr.policy.MaxLatency})
+				return
+			}
+			log.Infof("Peer %s exceeded max latency, falling back", current.p)
+			current = fr.start(len(fr.attempts))
+			timer.reset()
+		case event := <-fr.events:
+			if fr.attempts[event.attempt] != current {
+				continue
+			}
+			switch {
+			case event.progress != nil:
+				timer.reset()
+				if !fr.receive(*event.progress) {
+					return
+				}
+			case event.err != nil:
+				current.errs = append(current.errs, event.err)
+			case event.done:
+				if len(current.errs) == 0 {
+					return
+				}
+				if len(fr.attempts) == len(fr.peers) {
+					fr.errs = current.errs
+					return
+				}
+				log.Infof("Request to peer %s failed, falling back", current.p)
+				current = fr.start(len(fr.attempts))
+				timer.reset()
+			}
+		}
+	}
+}
+
+// race tries all peers at once, keeping the first to deliver a response
+func (fr *fallbackRequest) race() {
+	for i := range fr.peers {
+		fr.start(i)
+	}
+	var winner *attempt
+	finished := 0
+	for {
+		var event attemptEvent
+		select {
+		case <-fr.ctx.Done():
+			return
+		case event = <-fr.events:
+		}
+		a := fr.attempts[event.attempt]
+		if winner == nil && event.progress != nil {
+			winner = a
+			for _, other := range fr.attempts {
+				if other != winner {
+					other.cancelFn()
+				}
+			}
+		}
+		if winner != nil && a != winner {
+			continue
+		}
+		switch {
+		case event.progress != nil:
+			if !fr.receive(*event.progress) {
+				return
+			}
+		case event.err != nil:
+			a.errs = append(a.errs, event.err)
+		case event.done:
+			if winner != nil || len(a.errs) == 0 {
+				fr.errs = a.errs
+				return
+			}
+			finished++
+			if finished == len(fr.attempts) {
+				fr.errs = a.errs
+				return
+			}
+		}
+	}
+}
+
+// start sends the request to the peer at the given index
+func (fr *fallbackRequest) start(index int) *attempt {
+	attemptCtx, attemptCancel := context.WithCancel(fr.ctx)
+	a := &attempt{p: fr.peers[index], cancelFn: attemptCancel}
+	fr.attempts = append(fr.attempts, a)
+	progressChan, errChan := fr.gs.Request(attemptCtx, a.p, fr.root, fr.selector, fr.extensions...)
+	go fr.forward(attemptCtx, index, progressChan, errChan)
+	return a
+}
+
+// forward passes events from a single request to the run loop, until the
+// request finishes or is abandoned
+func (fr *fallbackRequest) forward(ctx context.Context, index int, progressChan <-chan graphsync.ResponseProgress, errChan <-chan error) {
+	for progressChan != nil || errChan != nil {
+		var event attemptEvent
+		select {
+		case progress, ok := <-progressChan:
+			if !ok {
+				progressChan = nil
+				continue
+			}
+			event = attemptEvent{attempt: index, progress: &progress}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			event = attemptEvent{attempt: index, err: err}
+		}
+		select {
+		case fr.events <- event:
+		case <-ctx.Done():
+		}
+	}
+	select {
+	case fr.events <- attemptEvent{attempt: index, done: true}:
+	case <-ctx.Done():
+	}
+}
+
+// receive passes on a response, unless an earlier peer already delivered it.
+// Responses are matched by the node's path and the link of the block it was
+// loaded from, since a peer fallen back to need not repeat exactly the
+// responses the earlier peers sent.
+func (fr *fallbackRequest) receive(progress graphsync.ResponseProgress) bool {
+	key := progress.Path.String()
+	if progress.LastBlock.Link != nil {
+		key += "@" + progress.LastBlock.Link.String()
+	}
+	if _, ok := fr.sent[key]; ok {
+		return true
+	}
+	select {
+	case <-fr.ctx.Done():
+		return false
+	case fr.outgoing <- progress:
+		fr.sent[key] = struct{}{}
+		return true
+	}
+}
+
+// latencyTimer fires when the max latency passes without being reset, or
+// never when there is no max latency
+type latencyTimer struct {
+	*time.Timer
+	maxLatency time.Duration
+}
+
+func (fr *fallbackRequest) newLatencyTimer() *latencyTimer {
+	if fr.policy.MaxLatency <= 0 {
+		return &latencyTimer{Timer: &time.Timer{}}
+	}
+	return &latencyTimer{time.NewTimer(fr.policy.MaxLatency), fr.policy.MaxLatency}
+}
+
+func (lt *latencyTimer) reset() {
+	if lt.maxLatency <= 0 {
+		return
+	}
+	if !lt.Stop() {
+		select {
+		case <-lt.C:
+		default:
+		}
+	}
+	lt.Reset(lt.maxLatency)
+}
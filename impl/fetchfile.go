@@ -0,0 +1,114 @@
+package graphsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	files "github.com/ipfs/go-ipfs-files"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	ipld "github.com/ipld/go-ipld-prime"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// fetchFileDepth is deeper than any practical UnixFS file DAG, and the
+// deepest recursion responders accept without a validating hook
+const fetchFileDepth = 100
+
+var errNotAFile = errors.New("root is not a UnixFS file")
+
+// FetchFile requests the whole UnixFS DAG under root from p, storing it with
+// the local storer, then returns a reader of the file's contents, assembled
+// from the blocks in the local store.
+func (gs *GraphSync) FetchFile(ctx context.Context, p peer.ID, root ipld.Link) (io.ReadCloser, error) {
+	rootCid, err := ipldbridge.LinkCid(root)
+	if err != nil {
+		return nil, err
+	}
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(fetchFileDepth),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	progress, errs := gs.Request(ctx, p, root, allSelector)
+	var requestErr error
+	for progress != nil || errs != nil {
+		select {
+		case _, ok := <-progress:
+			if !ok {
+				progress = nil
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if requestErr == nil {
+				requestErr = err
+			}
+		}
+	}
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	dagService := merkledag.NewReadOnlyDagService(&loaderNodeGetter{gs.loaderFor(ctx)})
+	node, err := dagService.Get(ctx, rootCid)
+	if err != nil {
+		return nil, err
+	}
+	fileNode, err := unixfile.NewUnixfsFile(ctx, dagService, node)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := fileNode.(files.File)
+	if !ok {
+		return nil, errNotAFile
+	}
+	return file, nil
+}
+
+// loaderNodeGetter reads go-ipld-format nodes from an IPLD loader
+type loaderNodeGetter struct {
+	loader ipldbridge.Loader
+}
+
+func (lng *loaderNodeGetter) Get(ctx context.Context, c cid.Cid) (ipldformat.Node, error) {
+	reader, err := lng.loader(cidlink.Link{Cid: c}, ipldbridge.LinkContext{})
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return ipldformat.Decode(block)
+}
+
+func (lng *loaderNodeGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipldformat.NodeOption {
+	out := make(chan *ipldformat.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			node, err := lng.Get(ctx, c)
+			select {
+			case out <- &ipldformat.NodeOption{Node: node, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
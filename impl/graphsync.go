@@ -2,26 +2,47 @@ package graphsync
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/allocator"
+	"github.com/ipfs/go-graphsync/ratelimiter"
 	"github.com/ipfs/go-graphsync/requestmanager/asyncloader"
 
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
 	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/nonce"
 	"github.com/ipfs/go-graphsync/peermanager"
 	"github.com/ipfs/go-graphsync/requestmanager"
 	"github.com/ipfs/go-graphsync/responsemanager"
+	responseloader "github.com/ipfs/go-graphsync/responsemanager/loader"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
+	"github.com/ipfs/go-graphsync/selectorutil"
+	"github.com/ipfs/go-graphsync/throughput"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipfs/go-peertaskqueue"
 	ipld "github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var log = logging.Logger("graphsync")
 
+const (
+	// throughputWeight is how much each new measurement moves a peer's
+	// throughput estimate
+	throughputWeight = 0.2
+	// throughputIdleTimeout is the longest gap between responses from a peer
+	// that still counts as time spent transferring
+	throughputIdleTimeout = time.Second
+)
+
 // GraphSync is an instance of a GraphSync exchange that implements
 // the graphsync protocol.
 type GraphSync struct {
@@ -37,55 +58,590 @@ type GraphSync struct {
 	peerManager         *peermanager.PeerMessageManager
 	ctx                 context.Context
 	cancel              context.CancelFunc
+
+	incomingRateLimiter        *ratelimiter.RateLimiter
+	incomingRateLimitPerPeer   uint64
+	incomingPeerRateLimitersLk sync.Mutex
+	incomingPeerRateLimiters   map[peer.ID]*ratelimiter.RateLimiter
+	connectOnRequest           bool
+	maxBufferedProgress        int
+	dialTimeout                time.Duration
+	sendRequestNonces          bool
+	replayWindow               time.Duration
+	createMessageQueue         peermanager.PeerQueueFactory
+	rejectUnboundedSelectors   bool
+	serializeLoadsPerPeer      bool
+	maxResponseDuration        time.Duration
+	maxServedPeers             int
+	blockCacheBytes            uint64
+	blockCacheTTL              time.Duration
+	responseAllocator          *allocator.Allocator
+	maxMessageBlockBytes       uint64
+	maxQueuedBytesPerPeer      uint64
+	responseBatchWindow        time.Duration
+	maxConcurrentResponses     int
+	streamsPerPeer             int
+	requestMetrics             requestmanager.RequestMetrics
+	checkpointStore            responsemanager.CheckpointStore
+	checkpointInterval         int
+	resultCache                responseloader.ResultCache
+	maxResultBytes             uint64
+	contextLoader              ipldbridge.ContextLoader
+	maxTotalRequests           int
+	maxRequestsPerPeer         int
+	coalesceWindow             time.Duration
+	maxCoalescedRequests       int
+	loadIdentityFromStore      bool
+	throughputTracker          *throughput.Tracker
+}
+
+// Option defines the functional option type that can be used to configure
+// graphsync instances
+type Option func(*GraphSync)
+
+// MaxIncomingRateLimit limits the rate, in bytes per second, at which blocks
+// are read off the network in responses from all peers combined
+func MaxIncomingRateLimit(bytesPerSec uint64) Option {
+	return func(gs *GraphSync) {
+		gs.incomingRateLimiter = ratelimiter.New(bytesPerSec)
+	}
+}
+
+// MaxIncomingRateLimitPerPeer limits the rate, in bytes per second, at which
+// blocks are read off the network in responses from any single peer
+func MaxIncomingRateLimitPerPeer(bytesPerSec uint64) Option {
+	return func(gs *GraphSync) {
+		gs.incomingRateLimitPerPeer = bytesPerSec
+	}
+}
+
+// ConnectOnRequest makes graphsync dial a peer, if it is not already
+// connected, before sending it a request. If the peer cannot be reached within
+// dialTimeout, the request fails with a graphsync.DialError. A dialTimeout of
+// zero means no limit beyond the request's context.
+func ConnectOnRequest(dialTimeout time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.connectOnRequest = true
+		gs.dialTimeout = dialTimeout
+	}
+}
+
+// SendRequestNonces attaches a fresh graphsync.ExtensionNonce to every
+// outgoing request, so responders can reject replays of it.
+func SendRequestNonces() Option {
+	return func(gs *GraphSync) {
+		gs.sendRequestNonces = true
+	}
+}
+
+// RejectReplayedRequests rejects incoming requests whose nonce was already
+// seen from the same peer, or whose nonce timestamp is further than window
+// from the current time. Requests without a nonce are rejected too, so
+// requestors must send them, for example with SendRequestNonces.
+func RejectReplayedRequests(window time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.replayWindow = window
+	}
+}
+
+// WithMessageQueueFactory replaces the in-memory queue used to send messages
+// to each peer with the queues created by the given factory. The default
+// queue, messagequeue.New, can be wrapped to extend rather than replace it.
+func WithMessageQueueFactory(createMessageQueue peermanager.PeerQueueFactory) Option {
+	return func(gs *GraphSync) {
+		gs.createMessageQueue = createMessageQueue
+	}
+}
+
+// RejectUnboundedSelectors rejects incoming requests whose selector does not
+// bound the depth of its traversal, as reported by selectorutil.IsBounded.
+// This applies even to requests a hook has validated, so it should not be
+// used by responders that serve legitimately unbounded selectors, such as
+// walks of a chain to its genesis.
+func RejectUnboundedSelectors() Option {
+	return func(gs *GraphSync) {
+		gs.rejectUnboundedSelectors = true
+	}
+}
+
+// MaxBufferedProgress cancels any request whose caller falls more than n
+// progress events behind reading them, sending a cancel to the responder and
+// returning graphsync.ErrProgressNotRead on the request's error channel. By
+// default progress is buffered without limit until the caller reads it or
+// cancels the request's context.
+func MaxBufferedProgress(n int) Option {
+	return func(gs *GraphSync) {
+		gs.maxBufferedProgress = n
+	}
+}
+
+// SerializeLoadsPerPeer makes the responder load blocks for each peer one at
+// a time, even when the peer has several requests in progress. Loads for
+// different peers still run concurrently. This can improve throughput when
+// the loader reads from storage that slows down under concurrent access.
+func SerializeLoadsPerPeer() Option {
+	return func(gs *GraphSync) {
+		gs.serializeLoadsPerPeer = true
+	}
+}
+
+// MaxResponseDuration makes the responder abort any response that is still in
+// progress after d, finishing it with graphsync.RequestFailedTimeout. This
+// bounds the time spent on a single request regardless of any deadline the
+// requestor sets, guarding against slow loaders and huge traversals.
+func MaxResponseDuration(d time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.maxResponseDuration = d
+	}
+}
+
+// MaxServedPeers bounds the resources a public responder spends by serving at
+// most n distinct peers at a time. Requests from further peers are refused
+// with graphsync.RequestFailedBusy, which requestors can retry later, while
+// peers already being served carry on as usual. A peer stops counting
+// against the limit once its last response finishes.
+func MaxServedPeers(n int) Option {
+	return func(gs *GraphSync) {
+		gs.maxServedPeers = n
+	}
+}
+
+// SharedBlockCache makes concurrent responses share the blocks they load, so
+// when several peers fetch overlapping DAGs at once, each shared block is
+// loaded once. Up to maxBytes of blocks are kept, each for at most ttl, so
+// the cache only helps responses running close together. This trades memory
+// for fewer loads when loading is slow.
+func SharedBlockCache(maxBytes uint64, ttl time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.blockCacheBytes = maxBytes
+		gs.blockCacheTTL = ttl
+	}
+}
+
+// CacheSelectorResults keeps the blocks sent for a root and selector in cache,
+// such as a DirResultCache from the responsemanager/loader package, which
+// keeps them on disk. Later requests for the same root and selector are
+// answered from it without a traversal or any block loads. Only results of up
+// to maxResultBytes that hold every block the selector reaches are kept.
+// Hooks still run for every request.
+func CacheSelectorResults(cache responseloader.ResultCache, maxResultBytes uint64) Option {
+	return func(gs *GraphSync) {
+		gs.resultCache = cache
+		gs.maxResultBytes = maxResultBytes
+	}
+}
+
+// MaxBufferedResponseBytes limits the total size of blocks loaded for
+// responses to all peers but not yet handed to the network. Responses stop
+// loading blocks while the limit is reached, until earlier messages are sent.
+func MaxBufferedResponseBytes(n uint64) Option {
+	return func(gs *GraphSync) {
+		gs.responseAllocator = allocator.New(n)
+	}
+}
+
+// MaxQueuedResponseBytesPerPeer limits the size of the blocks in response
+// messages for each peer not yet handed to the network. Responses to a peer
+// stop loading blocks while its limit is reached, so a peer slow to read its
+// stream holds up only its own responses, without its messages growing
+// without bound. ResponseQueues shows how full each peer's queue is.
+func MaxQueuedResponseBytesPerPeer(n uint64) Option {
+	return func(gs *GraphSync) {
+		gs.maxQueuedBytesPerPeer = n
+	}
+}
+
+// MaxMessageBlockBytes sets the most block data a responder batches into one
+// response message. Larger messages mean fewer round trips on high latency
+// links, and smaller ones get the first blocks to the requestor sooner. A
+// block larger than n is still sent, alone. The default is 512KiB.
+func MaxMessageBlockBytes(n uint64) Option {
+	return func(gs *GraphSync) {
+		gs.maxMessageBlockBytes = n
+	}
+}
+
+// ResponseBatchWindow makes a responder wait d after response data for a
+// peer is ready before sending it, so data for other requests that arrives in
+// the meantime shares the same messages. It trades latency for fewer, fuller
+// messages when many small requests run at once.
+func ResponseBatchWindow(d time.Duration) Option {
+	return func(gs *GraphSync) {
+		gs.responseBatchWindow = d
+	}
+}
+
+// MaxConcurrentResponses sets how many responses, across all peers, a
+// responder works on at once. Others wait in the queue. The default is 6.
+func MaxConcurrentResponses(n int) Option {
+	return func(gs *GraphSync) {
+		gs.maxConcurrentResponses = n
+	}
+}
+
+// StreamsPerPeer sends messages to each peer over a pool of up to n streams
+// rather than one, so a large message on one stream does not block a small
+// message for another request behind it. Messages for the same request stay
+// in order. It has no effect when WithMessageQueueFactory replaces the
+// default queue. The default is 1.
+func StreamsPerPeer(n int) Option {
+	return func(gs *GraphSync) {
+		gs.streamsPerPeer = n
+	}
+}
+
+// CoalesceRequests waits window after a request to a peer before sending it,
+// so requests to the same peer made in the meantime share one message. It
+// trades latency for less overhead per request when many small requests are
+// made in bursts. Once maxBatch requests are waiting, they are sent without
+// waiting out the window, unless maxBatch is zero, and later requests wait in
+// another message. Cancels are never held back. It has no effect when
+// WithMessageQueueFactory replaces the default queue.
+func CoalesceRequests(window time.Duration, maxBatch int) Option {
+	return func(gs *GraphSync) {
+		gs.coalesceWindow = window
+		gs.maxCoalescedRequests = maxBatch
+	}
+}
+
+// WithRequestMetrics reports the progress of every request this node makes to
+// metrics, with the labels each request was made with using
+// graphsync.WithMetricLabels.
+func WithRequestMetrics(metrics requestmanager.RequestMetrics) Option {
+	return func(gs *GraphSync) {
+		gs.requestMetrics = metrics
+	}
+}
+
+// WithCheckpointStore saves the progress of responses to requests made with
+// graphsync.Checkpointed to store, once they start and every interval blocks
+// after, so a responder made with the same store after a restart can resume
+// them with ResumeCheckpoints.
+func WithCheckpointStore(store responsemanager.CheckpointStore, interval int) Option {
+	return func(gs *GraphSync) {
+		gs.checkpointStore = store
+		gs.checkpointInterval = interval
+	}
+}
+
+// MaxTotalOutstandingRequests queues requests made while n requests to any
+// peers are in progress, until earlier requests finish. Queued requests start
+// in the order they were made, once every limit on outstanding requests
+// allows them, including MaxOutstandingRequestsPerPeer. A request is
+// outstanding until its progress and error channels are closed.
+func MaxTotalOutstandingRequests(n int) Option {
+	return func(gs *GraphSync) {
+		gs.maxTotalRequests = n
+	}
+}
+
+// MaxOutstandingRequestsPerPeer queues requests made while n requests to the
+// same peer are in progress, as MaxTotalOutstandingRequests does. A request
+// queued for a busy peer does not hold up requests to other peers.
+func MaxOutstandingRequestsPerPeer(n int) Option {
+	return func(gs *GraphSync) {
+		gs.maxRequestsPerPeer = n
+	}
+}
+
+// TrackPeerThroughput estimates the rate at which each peer sends blocks, as
+// a moving average over the responses received from it, for PeerThroughput
+// to report. This helps choose the faster of several peers to request from.
+func TrackPeerThroughput() Option {
+	return func(gs *GraphSync) {
+		gs.throughputTracker = throughput.New(throughputWeight, throughputIdleTimeout)
+	}
+}
+
+// LoadIdentityBlocksFromStore loads blocks with identity CIDs, whose data is
+// held in the CID itself, with the loader like any other block. By default
+// they are decoded from the CID without a store lookup, as most stores do not
+// keep them.
+func LoadIdentityBlocksFromStore() Option {
+	return func(gs *GraphSync) {
+		gs.loadIdentityFromStore = true
+	}
+}
+
+// UseContextLoader loads blocks with a loader that is given the context of
+// the request or response it loads for, in place of the loader passed to New,
+// so cancelling a request or response, or its deadline passing, aborts loads
+// in progress for it. This matters for slow loaders, such as ones that fetch
+// blocks over a network.
+func UseContextLoader(loader ipldbridge.ContextLoader) Option {
+	return func(gs *GraphSync) {
+		gs.contextLoader = loader
+	}
 }
 
 // New creates a new GraphSync Exchange on the given network,
 // using the given bridge to IPLD and the given link loader.
 func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	ipldBridge ipldbridge.IPLDBridge, loader ipldbridge.Loader,
-	storer ipldbridge.Storer) graphsync.GraphExchange {
+	storer ipldbridge.Storer, options ...Option) graphsync.GraphExchange {
 	ctx, cancel := context.WithCancel(parent)
+	graphSync := &GraphSync{
+		ipldBridge:               ipldBridge,
+		network:                  network,
+		loader:                   loader,
+		storer:                   storer,
+		ctx:                      ctx,
+		cancel:                   cancel,
+		incomingPeerRateLimiters: make(map[peer.ID]*ratelimiter.RateLimiter),
+		responseAllocator:        allocator.New(0),
+	}
 
-	createMessageQueue := func(ctx context.Context, p peer.ID) peermanager.PeerQueue {
-		return messagequeue.New(ctx, p, network)
+	for _, option := range options {
+		option(graphSync)
+	}
+	if !graphSync.loadIdentityFromStore {
+		loader = ipldbridge.DecodeIdentityLinks(loader)
+		graphSync.loader = loader
+		if graphSync.contextLoader != nil {
+			graphSync.contextLoader = ipldbridge.DecodeIdentityLinksContext(graphSync.contextLoader)
+		}
+	}
+	if graphSync.createMessageQueue == nil {
+		graphSync.createMessageQueue = func(ctx context.Context, p peer.ID) peermanager.PeerQueue {
+			return messagequeue.New(ctx, p, network, messagequeue.Streams(graphSync.streamsPerPeer),
+				messagequeue.ReportResponses(graphSync.responsesReported),
+				messagequeue.CoalesceRequests(graphSync.coalesceWindow, graphSync.maxCoalescedRequests))
+		}
+	}
+
+	peerManager := peermanager.NewMessageManager(ctx, graphSync.createMessageQueue)
+	var asyncLoader *asyncloader.AsyncLoader
+	if graphSync.contextLoader != nil {
+		asyncLoader = asyncloader.NewWithContextLoader(ctx, graphSync.contextLoader, storer)
+	} else {
+		asyncLoader = asyncloader.New(ctx, loader, storer)
 	}
-	peerManager := peermanager.NewMessageManager(ctx, createMessageQueue)
-	asyncLoader := asyncloader.New(ctx, loader, storer)
 	requestManager := requestmanager.New(ctx, asyncLoader, ipldBridge)
+	if graphSync.contextLoader != nil {
+		requestManager.SetLocalContextLoader(graphSync.contextLoader)
+	} else {
+		requestManager.SetLocalLoader(loader)
+	}
+	if graphSync.maxBufferedProgress > 0 {
+		requestManager.SetMaxBufferedProgress(graphSync.maxBufferedProgress)
+	}
+	if graphSync.requestMetrics != nil {
+		requestManager.SetRequestMetrics(graphSync.requestMetrics)
+	}
+	if graphSync.maxTotalRequests > 0 || graphSync.maxRequestsPerPeer > 0 {
+		requestManager.SetRequestLimits(graphSync.maxTotalRequests, graphSync.maxRequestsPerPeer)
+	}
+	if graphSync.connectOnRequest {
+		requestManager.ConnectBeforeRequests(network, graphSync.dialTimeout)
+	}
 	peerTaskQueue := peertaskqueue.New()
+	senderOptions := []peerresponsemanager.SenderOption{peerresponsemanager.ReportAbandoned(graphSync.responsesReported)}
+	if graphSync.maxMessageBlockBytes > 0 {
+		senderOptions = append(senderOptions, peerresponsemanager.MaxMessageBlockBytes(graphSync.maxMessageBlockBytes))
+	}
+	if graphSync.responseBatchWindow > 0 {
+		senderOptions = append(senderOptions, peerresponsemanager.BatchWindow(graphSync.responseBatchWindow))
+	}
+	if graphSync.maxQueuedBytesPerPeer > 0 {
+		senderOptions = append(senderOptions, peerresponsemanager.MaxQueuedBytes(graphSync.maxQueuedBytesPerPeer))
+	}
 	createdResponseQueue := func(ctx context.Context, p peer.ID) peerresponsemanager.PeerResponseSender {
-		return peerresponsemanager.NewResponseSender(ctx, p, peerManager, ipldBridge)
+		return peerresponsemanager.NewResponseSender(ctx, p, peerManager, ipldBridge, graphSync.responseAllocator, senderOptions...)
 	}
 	peerResponseManager := peerresponsemanager.New(ctx, createdResponseQueue)
 	responseManager := responsemanager.New(ctx, loader, ipldBridge, peerResponseManager, peerTaskQueue)
-	graphSync := &GraphSync{
-		ipldBridge:          ipldBridge,
-		network:             network,
-		loader:              loader,
-		storer:              storer,
-		asyncLoader:         asyncLoader,
-		requestManager:      requestManager,
-		peerManager:         peerManager,
-		peerTaskQueue:       peerTaskQueue,
-		peerResponseManager: peerResponseManager,
-		responseManager:     responseManager,
-		ctx:                 ctx,
-		cancel:              cancel,
+	if graphSync.contextLoader != nil {
+		responseManager.SetContextLoader(graphSync.contextLoader)
+	}
+	if graphSync.serializeLoadsPerPeer {
+		responseManager.SerializeLoadsPerPeer()
+	}
+	if graphSync.maxResponseDuration > 0 {
+		responseManager.SetMaxResponseDuration(graphSync.maxResponseDuration)
+	}
+	if graphSync.maxServedPeers > 0 {
+		responseManager.SetMaxServedPeers(graphSync.maxServedPeers)
+	}
+	if graphSync.maxConcurrentResponses > 0 {
+		responseManager.SetMaxInProcessResponses(graphSync.maxConcurrentResponses)
+	}
+	if graphSync.blockCacheBytes > 0 && graphSync.blockCacheTTL > 0 {
+		responseManager.UseBlockCache(graphSync.blockCacheBytes, graphSync.blockCacheTTL)
+	}
+	if graphSync.resultCache != nil {
+		responseManager.UseResultCache(graphSync.resultCache, graphSync.maxResultBytes)
+	}
+	if graphSync.checkpointStore != nil {
+		responseManager.SetCheckpointStore(graphSync.checkpointStore, graphSync.checkpointInterval)
 	}
+	graphSync.asyncLoader = asyncLoader
+	graphSync.requestManager = requestManager
+	graphSync.peerManager = peerManager
+	graphSync.peerTaskQueue = peerTaskQueue
+	graphSync.peerResponseManager = peerResponseManager
+	graphSync.responseManager = responseManager
 
 	asyncLoader.Startup()
 	requestManager.SetDelegate(peerManager)
 	requestManager.Startup()
 	responseManager.Startup()
+	if graphSync.replayWindow != 0 {
+		replayGuard := nonce.NewReplayGuard(graphSync.replayWindow, ipldBridge)
+		replayGuard.RequireNonce()
+		responseManager.RegisterHook(replayGuard.RequestReceivedHook)
+		responseManager.AdvertiseExtension(graphsync.ExtensionNonce)
+	}
+	if graphSync.rejectUnboundedSelectors {
+		responseManager.RegisterHook(graphSync.rejectUnboundedSelector)
+	}
 	network.SetDelegate((*graphSyncReceiver)(graphSync))
 	return graphSync
 }
 
 // Request initiates a new GraphSync request to the given peer using the given selector spec.
 func (gs *GraphSync) Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	skip, extensions := extractSkipIfLocal(extensions)
+	if skip != skipNever && gs.isLocal(ctx, root, selector, skip == skipIfLocalSubtree) {
+		return emptyResponse()
+	}
+	if gs.sendRequestNonces {
+		nonceExtension, err := nonce.NewExtension(gs.ipldBridge)
+		if err != nil {
+			return errorResponse(err)
+		}
+		extensions = append(extensions, nonceExtension)
+	}
 	return gs.requestManager.SendRequest(ctx, p, root, selector, extensions...)
 }
 
+// RequestFromAddr connects to the peer at addr, which must end in its peer
+// ID, and makes a request to it. The dial is bounded by the timeout given with
+// ConnectOnRequest, if any.
+func (gs *GraphSync) RequestFromAddr(ctx context.Context, addr ma.Multiaddr, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	info, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return errorResponse(graphsync.AddrError{Addr: addr, Err: err})
+	}
+	dialCtx := ctx
+	if gs.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, gs.dialTimeout)
+		defer cancel()
+	}
+	err = gs.network.ConnectToAddrs(dialCtx, *info)
+	if err != nil {
+		return errorResponse(graphsync.DialError{Peer: info.ID, Err: err})
+	}
+	return gs.Request(ctx, info.ID, root, selector, extensions...)
+}
+
+func (gs *GraphSync) rejectUnboundedSelector(p peer.ID, request graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+	selectorSpec, err := gs.ipldBridge.DecodeNode(request.Selector())
+	if err != nil || !selectorutil.IsBounded(selectorSpec) {
+		hookActions.TerminateWithError(selectorutil.ErrUnboundedSelector)
+	}
+}
+
+type skipIfLocal int
+
+const (
+	skipNever skipIfLocal = iota
+	skipIfLocalRoot
+	skipIfLocalSubtree
+)
+
+// extractSkipIfLocal removes the requestor-only skip if local extension, so it
+// is not sent, and returns which check it asks for
+func extractSkipIfLocal(extensions []graphsync.ExtensionData) (skipIfLocal, []graphsync.ExtensionData) {
+	skip := skipNever
+	remaining := make([]graphsync.ExtensionData, 0, len(extensions))
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionSkipIfLocal {
+			remaining = append(remaining, extension)
+			continue
+		}
+		if len(extension.Data) == 1 && extension.Data[0] == 1 {
+			skip = skipIfLocalSubtree
+		} else if skip == skipNever {
+			skip = skipIfLocalRoot
+		}
+	}
+	return skip, remaining
+}
+
+// loaderFor returns the loader for local loads made for an operation with the
+// given context
+func (gs *GraphSync) loaderFor(ctx context.Context) ipldbridge.Loader {
+	if gs.contextLoader != nil {
+		return ipldbridge.BindContext(ctx, gs.contextLoader)
+	}
+	return gs.loader
+}
+
+// isLocal checks whether the root, or with subtree the entire traversal, can
+// be loaded from the local loader.
+func (gs *GraphSync) isLocal(ctx context.Context, root ipld.Link, selectorSpec ipld.Node, subtree bool) bool {
+	loader := gs.loaderFor(ctx)
+	if !subtree {
+		reader, err := loader(root, ipldbridge.LinkContext{})
+		if err != nil {
+			return false
+		}
+		_, err = ioutil.ReadAll(reader)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		return err == nil
+	}
+	selector, err := gs.ipldBridge.ParseSelector(selectorSpec)
+	if err != nil {
+		return false
+	}
+	err = gs.ipldBridge.Traverse(ctx, loader, root, selector, func(ipldbridge.TraversalProgress, ipld.Node, ipldbridge.TraversalReason) error {
+		return nil
+	})
+	return err == nil
+}
+
+func emptyResponse() (<-chan graphsync.ResponseProgress, <-chan error) {
+	ch := make(chan graphsync.ResponseProgress)
+	close(ch)
+	errCh := make(chan error)
+	close(errCh)
+	return ch, errCh
+}
+
+func errorResponse(err error) (<-chan graphsync.ResponseProgress, <-chan error) {
+	ch := make(chan graphsync.ResponseProgress)
+	close(ch)
+	errCh := make(chan error, 1)
+	errCh <- err
+	close(errCh)
+	return ch, errCh
+}
+
+// BufferedResponseBytes returns the total size of blocks loaded for responses
+// but not yet handed to the network
+func (gs *GraphSync) BufferedResponseBytes() uint64 {
+	return gs.responseAllocator.Allocated()
+}
+
+// PeerThroughput returns the estimated rate, in bytes per second, at which
+// blocks arrive from the given peer, or zero if throughput is not tracked or
+// too little has arrived from the peer to measure
+func (gs *GraphSync) PeerThroughput(p peer.ID) float64 {
+	if gs.throughputTracker == nil {
+		return 0
+	}
+	return gs.throughputTracker.Estimate(p)
+}
+
+// ResponseQueues returns, for each peer this node is connected to, the
+// response messages built for it but not yet handed to the network
+func (gs *GraphSync) ResponseQueues() map[peer.ID]peerresponsemanager.QueueStats {
+	return gs.peerResponseManager.QueueStats()
+}
+
 // RegisterRequestReceivedHook adds a hook that runs when a request is received
 // If overrideDefaultValidation is set to true, then if the hook does not error,
 // it is considered to have "validated" the request -- and that validation supersedes
@@ -95,12 +651,102 @@ func (gs *GraphSync) RegisterRequestReceivedHook(hook graphsync.OnRequestReceive
 	return nil
 }
 
+// RegisterSelector registers a selector spec that incoming requests can name
+// with graphsync.ExtensionSelectorName
+func (gs *GraphSync) RegisterSelector(name string, selector ipld.Node) error {
+	return gs.responseManager.RegisterSelector(name, selector)
+}
+
 // RegisterResponseReceivedHook adds a hook that runs when a response is received
 func (gs *GraphSync) RegisterResponseReceivedHook(hook graphsync.OnResponseReceivedHook) error {
 	gs.requestManager.RegisterHook(hook)
 	return nil
 }
 
+// PeerExtensions asks a peer which extensions it supports as a responder
+func (gs *GraphSync) PeerExtensions(ctx context.Context, p peer.ID) ([]graphsync.ExtensionName, error) {
+	return gs.requestManager.PeerExtensions(ctx, p)
+}
+
+// AdvertiseExtension adds a user extension to those this node tells peers it
+// supports
+func (gs *GraphSync) AdvertiseExtension(name graphsync.ExtensionName) error {
+	return gs.responseManager.AdvertiseExtension(name)
+}
+
+// RegisterPushReceivedHook adds a hook that runs when a responder offers to
+// push subtrees
+func (gs *GraphSync) RegisterPushReceivedHook(hook graphsync.OnPushReceivedHook) error {
+	gs.requestManager.RegisterPushHook(hook)
+	return nil
+}
+
+// RegisterRequestQueuedHook adds a hook that runs when a received request is
+// queued
+func (gs *GraphSync) RegisterRequestQueuedHook(hook graphsync.OnRequestQueuedHook) error {
+	gs.responseManager.RegisterQueuedHook(hook)
+	return nil
+}
+
+// RegisterRequestStartedHook adds a hook that runs when a queued request
+// begins
+func (gs *GraphSync) RegisterRequestStartedHook(hook graphsync.OnRequestStartedHook) error {
+	gs.responseManager.RegisterStartedHook(hook)
+	return nil
+}
+
+// RegisterResponseCompletedHook adds a hook that runs when the responder
+// finishes working on a response
+func (gs *GraphSync) RegisterResponseCompletedHook(hook graphsync.OnResponseCompletedHook) error {
+	gs.responseManager.RegisterCompletedHook(hook)
+	return nil
+}
+
+// RegisterRequestCancelledHook adds a hook that runs when a requestor cancels
+// a received request
+func (gs *GraphSync) RegisterRequestCancelledHook(hook graphsync.OnRequestCancelledHook) error {
+	gs.responseManager.RegisterCancelledHook(hook)
+	return nil
+}
+
+// RegisterUndeliverableResponseHook adds a hook that runs when responses to a
+// received request are abandoned without being sent. It has no effect when
+// WithMessageQueueFactory replaces the default queue, which does not report
+// what it sends.
+func (gs *GraphSync) RegisterUndeliverableResponseHook(hook graphsync.OnResponseUndeliverableHook) error {
+	gs.responseManager.RegisterUndeliverableHook(hook)
+	return nil
+}
+
+// ActiveRequests returns a snapshot of the requests this node has made that
+// are still in progress, in order of their IDs
+func (gs *GraphSync) ActiveRequests() []graphsync.ActiveRequest {
+	return gs.requestManager.ActiveRequests()
+}
+
+// ResumeCheckpoints resumes the responses saved in the store given with
+// WithCheckpointStore. It does nothing without one.
+func (gs *GraphSync) ResumeCheckpoints() error {
+	return gs.responseManager.ResumeCheckpoints()
+}
+
+// responsesReported passes on what the message queues report sending to the
+// response manager
+func (gs *GraphSync) responsesReported(p peer.ID, responses []gsmsg.GraphSyncResponse, err error) {
+	gs.responseManager.ResponsesReported(p, responses, err)
+}
+
+// Cancel cancels the in progress request with the given ID, sending the
+// reason to the responder
+func (gs *GraphSync) Cancel(requestID graphsync.RequestID, reason graphsync.CancelReason) error {
+	return gs.requestManager.CancelRequest(requestID, reason)
+}
+
+// CancelPeer cancels every in progress request to the peer
+func (gs *GraphSync) CancelPeer(p peer.ID) int {
+	return gs.requestManager.CancelPeer(p)
+}
+
 type graphSyncReceiver GraphSync
 
 func (gsr *graphSyncReceiver) graphSync() *GraphSync {
@@ -114,7 +760,54 @@ func (gsr *graphSyncReceiver) ReceiveMessage(
 	sender peer.ID,
 	incoming gsmsg.GraphSyncMessage) {
 	gsr.graphSync().responseManager.ProcessRequests(ctx, sender, incoming.Requests())
-	gsr.graphSync().requestManager.ProcessResponses(sender, incoming.Responses(), incoming.Blocks())
+	blks := incoming.Blocks()
+	err := gsr.graphSync().waitForIncomingRateLimit(sender, blks)
+	if err != nil {
+		return
+	}
+	// measured once the rate limits let the blocks through, so the estimate
+	// is the rate they are actually taken in at
+	if gsr.graphSync().throughputTracker != nil {
+		gsr.graphSync().throughputTracker.Record(sender, blocksSize(blks), time.Now())
+	}
+	gsr.graphSync().requestManager.ProcessResponses(sender, incoming.Responses(), blks)
+}
+
+// waitForIncomingRateLimit blocks reading from the network until the given
+// blocks fit within the configured incoming rate limits.
+func (gs *GraphSync) waitForIncomingRateLimit(sender peer.ID, blks []blocks.Block) error {
+	if gs.incomingRateLimiter == nil && gs.incomingRateLimitPerPeer == 0 {
+		return nil
+	}
+	size := blocksSize(blks)
+	if size == 0 {
+		return nil
+	}
+	if gs.incomingRateLimitPerPeer != 0 {
+		gs.incomingPeerRateLimitersLk.Lock()
+		peerRateLimiter, ok := gs.incomingPeerRateLimiters[sender]
+		if !ok {
+			peerRateLimiter = ratelimiter.New(gs.incomingRateLimitPerPeer)
+			gs.incomingPeerRateLimiters[sender] = peerRateLimiter
+		}
+		gs.incomingPeerRateLimitersLk.Unlock()
+		err := peerRateLimiter.Wait(gs.ctx, size)
+		if err != nil {
+			return err
+		}
+	}
+	if gs.incomingRateLimiter != nil {
+		return gs.incomingRateLimiter.Wait(gs.ctx, size)
+	}
+	return nil
+}
+
+func blocksSize(blks []blocks.Block) int {
+	size := 0
+	for _, block := range blks {
+		size += len(block.RawData())
+	}
+	return size
 }
 
 // ReceiveError is part of the network's Receiver interface and handles incoming
@@ -137,4 +830,7 @@ func (gsr *graphSyncReceiver) Connected(p peer.ID) {
 func (gsr *graphSyncReceiver) Disconnected(p peer.ID) {
 	gsr.graphSync().peerManager.Disconnected(p)
 	gsr.graphSync().peerResponseManager.Disconnected(p)
+	gsr.graphSync().incomingPeerRateLimitersLk.Lock()
+	delete(gsr.graphSync().incomingPeerRateLimiters, p)
+	gsr.graphSync().incomingPeerRateLimitersLk.Unlock()
 }
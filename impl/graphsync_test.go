@@ -3,7 +3,9 @@ package graphsync
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
@@ -11,6 +13,8 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,6 +39,19 @@ import (
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ack"
+	"github.com/ipfs/go-graphsync/byterange"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/cursor"
+	"github.com/ipfs/go-graphsync/encryptedextensions"
+	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/nonce"
+	"github.com/ipfs/go-graphsync/peermanager"
+	"github.com/ipfs/go-graphsync/responsemanager"
+	responseloader "github.com/ipfs/go-graphsync/responsemanager/loader"
+	"github.com/ipfs/go-graphsync/selectorutil"
+	"github.com/ipfs/go-graphsync/storeutil"
 
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
@@ -44,9 +61,11 @@ import (
 	ipld "github.com/ipld/go-ipld-prime"
 	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
 	mh "github.com/multiformats/go-multihash"
 )
 
@@ -290,6 +309,138 @@ func TestGraphsyncRoundTrip(t *testing.T) {
 	}
 }
 
+func TestGraphsyncRoundTripInProcessTransport(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	bridge := ipldbridge.NewIPLDBridge()
+
+	// graphsync over pipes within the process, with no libp2p hosts at all
+	ipn := gsnet.NewInProcessNetwork()
+	peers := testutil.GeneratePeers(2)
+	requestorStore := make(map[ipld.Link][]byte)
+	requestorLoader, requestorStorer := testbridge.NewMockStore(requestorStore)
+	responderLoader, responderStorer := testbridge.NewMockStore(make(map[ipld.Link][]byte))
+	requestor := New(ctx, gsnet.NewFromTransport(ipn.Transport(peers[0])), bridge, requestorLoader, requestorStorer)
+	_ = New(ctx, gsnet.NewFromTransport(ipn.Transport(peers[1])), bridge, responderLoader, responderStorer)
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, responderStorer, bridge, 100, blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, peers[1], blockChain.tipLink, blockChainSelector(blockChainLength))
+
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	if len(requestorStore) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+}
+
+func TestGraphsyncRoundTripNonExistentPath(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	td.GraphSyncHost2()
+
+	receivedStatuses := make(chan graphsync.ResponseStatusCode, 1)
+	err := requestor.RegisterResponseReceivedHook(
+		func(p peer.ID, responseData graphsync.ResponseData) error {
+			receivedStatuses <- responseData.Status()
+			return nil
+		})
+	if err != nil {
+		t.Fatal("Error setting up extension")
+	}
+
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	spec := ssb.ExploreFields(func(efsb ipldbridge.ExploreFieldsSpecBuilder) {
+		efsb.Insert("DoesNotExist", ssb.Matcher())
+	}).Node()
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	// the root is visited in search of the path, but nothing else is
+	if len(responses) != 1 || responses[0].Path.String() != "" {
+		t.Fatal("should not have traversed beyond root")
+	}
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not receive a response status")
+	case status := <-receivedStatuses:
+		if status != graphsync.RequestCompletedEmpty {
+			t.Fatal("should have completed with empty status")
+		}
+	}
+}
+
+func TestGraphsyncRoundTripConnectOnRequest(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := New(ctx, td.gsnet1, td.bridge, td.loader1, td.storer1, ConnectOnRequest(time.Second))
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	td.GraphSyncHost2()
+
+	spec := blockChainSelector(blockChainLength)
+
+	t.Run("peer is reachable but not connected", func(t *testing.T) {
+		if len(td.host1.Network().ConnsToPeer(td.host2.ID())) != 0 {
+			t.Fatal("peers should not be connected yet")
+		}
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		testutil.VerifyEmptyErrors(ctx, t, errChan)
+		if len(responses) != blockChainLength*2 {
+			t.Fatal("did not traverse all nodes")
+		}
+	})
+
+	t.Run("peer is unreachable", func(t *testing.T) {
+		host3, err := td.mn.GenPeer()
+		if err != nil {
+			t.Fatal("error generating host")
+		}
+		progressChan, errChan := requestor.Request(ctx, host3.ID(), blockChain.tipLink, spec)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		testutil.VerifyEmptyResponse(ctx, t, progressChan)
+		if len(errs) != 1 {
+			t.Fatal("should have errored dialing peer")
+		}
+		dialErr, ok := errs[0].(graphsync.DialError)
+		if !ok || dialErr.Peer != host3.ID() {
+			t.Fatal("should have returned a dial error for the unreachable peer")
+		}
+	})
+}
+
 // TestRoundTripLargeBlocksSlowNetwork test verifies graphsync continues to work
 // under a specific of adverse conditions:
 // -- large blocks being returned by a query
@@ -333,188 +484,1523 @@ func TestRoundTripLargeBlocksSlowNetwork(t *testing.T) {
 	}
 }
 
-// What this test does:
-// - Construct a blockstore + dag service
-// - Import a file to UnixFS v1
-// - setup a graphsync request from one node to the other
-// for the file
-// - Load the file from the new block store on the other node
-// using the
-// existing UnixFS v1 file reader
-// - Verify the bytes match the original
-func TestUnixFSFetch(t *testing.T) {
+func TestRoundTripStreamsPerPeerHighLatency(t *testing.T) {
 	if testing.Short() {
 		t.Skip()
 	}
-
-	const unixfsChunkSize uint64 = 1 << 10
-	const unixfsLinksPerLevel = 1024
-
+	// create network
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
-
-	makeLoader := func(bs bstore.Blockstore) ipld.Loader {
-		return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
-			c, ok := lnk.(cidlink.Link)
-			if !ok {
-				return nil, errors.New("Incorrect Link Type")
-			}
-			// read block from one store
-			block, err := bs.Get(c.Cid)
-			if err != nil {
-				return nil, err
-			}
-			return bytes.NewReader(block.RawData()), nil
-		}
-	}
-
-	makeStorer := func(bs bstore.Blockstore) ipld.Storer {
-		return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
-			var buf bytes.Buffer
-			var committer ipld.StoreCommitter = func(lnk ipld.Link) error {
-				c, ok := lnk.(cidlink.Link)
-				if !ok {
-					return errors.New("Incorrect Link Type")
-				}
-				block, err := blocks.NewBlockWithCid(buf.Bytes(), c.Cid)
-				if err != nil {
-					return err
-				}
-				return bs.Put(block)
-			}
-			return &buf, committer, nil
-		}
+	td := newGsTestData(ctx, t)
+	latency := 50 * time.Millisecond
+	for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), td.host2.ID()) {
+		link.SetOptions(mocknet.LinkOptions{Latency: latency})
 	}
-	// make a blockstore and dag service
-	bs1 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-
-	// make a second blockstore
-	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
-	dagService2 := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
 
-	// read in a fixture file
-	path, err := filepath.Abs(filepath.Join("fixtures", "lorem.txt"))
-	if err != nil {
-		t.Fatal("unable to create path for fixture file")
-	}
+	requestor := td.GraphSyncHost1(StreamsPerPeer(4))
 
-	f, err := os.Open(path)
-	if err != nil {
-		t.Fatal("unable to open fixture file")
-	}
-	var buf bytes.Buffer
-	tr := io.TeeReader(f, &buf)
-	file := files.NewReaderFile(tr)
+	// a large response split over many messages, and a small one
+	largeChainLength := 20
+	largeChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 200000, largeChainLength)
+	smallChainLength := 2
+	smallChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, smallChainLength)
 
-	// import to UnixFS
-	bufferedDS := ipldformat.NewBufferedDAG(ctx, dagService2)
+	td.GraphSyncHost2(StreamsPerPeer(4), MaxMessageBlockBytes(200000))
 
-	params := ihelper.DagBuilderParams{
-		Maxlinks:   unixfsLinksPerLevel,
-		RawLeaves:  true,
-		CidBuilder: nil,
-		Dagserv:    bufferedDS,
-	}
+	largeProgress, largeErrs := requestor.Request(ctx, td.host2.ID(), largeChain.tipLink, blockChainSelector(largeChainLength))
+	// wait for the large response to be underway
+	testutil.ReadNResponses(ctx, t, largeProgress, 2)
+	smallProgress, smallErrs := requestor.Request(ctx, td.host2.ID(), smallChain.tipLink, blockChainSelector(smallChainLength))
 
-	db, err := params.New(chunker.NewSizeSplitter(file, int64(unixfsChunkSize)))
-	if err != nil {
-		t.Fatal("unable to setup dag builder")
+	responses := testutil.CollectResponses(ctx, t, smallProgress)
+	testutil.VerifyEmptyErrors(ctx, t, smallErrs)
+	if len(responses) != smallChainLength*2 {
+		t.Fatal("did not traverse all nodes of small response")
 	}
-	nd, err := balanced.Layout(db)
-	if err != nil {
-		t.Fatal("unable to create unix fs node")
+	responses = testutil.CollectResponses(ctx, t, largeProgress)
+	testutil.VerifyEmptyErrors(ctx, t, largeErrs)
+	if len(responses) != (largeChainLength-1)*2 {
+		t.Fatal("did not traverse all nodes of large response")
 	}
-	err = bufferedDS.Commit()
-	if err != nil {
-		t.Fatal("unable to commit unix fs node")
+	if len(td.blockStore1) != largeChainLength+smallChainLength {
+		t.Fatal("did not store all blocks")
 	}
+}
 
-	// save the original files bytes
-	origBytes := buf.Bytes()
-
-	// setup an IPLD loader/storer for blockstore 1
-	loader1 := makeLoader(bs1)
-	storer1 := makeStorer(bs1)
-
-	// setup an IPLD loader/storer for blockstore 2
-	loader2 := makeLoader(bs2)
-	storer2 := makeStorer(bs2)
-
+func TestRoundTripIncomingRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
 	td := newGsTestData(ctx, t)
-	requestor := New(ctx, td.gsnet1, td.bridge, loader1, storer1)
-	responder := New(ctx, td.gsnet2, td.bridge, loader2, storer2)
-	extensionName := graphsync.ExtensionName("Free for all")
-	responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
-		hookActions.ValidateRequest()
-		hookActions.SendExtensionData(graphsync.ExtensionData{
-			Name: extensionName,
-			Data: nil,
-		})
-	})
-	// make a go-ipld-prime link for the root UnixFS node
-	clink := cidlink.Link{Cid: nd.Cid()}
-
-	// create a selector for the whole UnixFS dag
-	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
 
-	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(),
-		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	var rateLimit uint64 = 40000
+	// initialize graphsync on first node to make requests
+	requestor := New(ctx, td.gsnet1, td.bridge, td.loader1, td.storer1, MaxIncomingRateLimit(rateLimit), TrackPeerThroughput())
 
-	// execute the traversal
-	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), clink, allSelector,
-		graphsync.ExtensionData{
-			Name: extensionName,
-			Data: nil,
-		})
+	// setup receiving peer to just record message coming in
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 1000, blockChainLength)
+	totalSize := 0
+	for _, data := range td.blockStore2 {
+		totalSize += len(data)
+	}
 
-	_ = testutil.CollectResponses(ctx, t, progressChan)
-	responseErrors := testutil.CollectErrors(ctx, t, errChan)
+	// initialize graphsync on second node to response to requests, over
+	// several messages so there is throughput to measure
+	td.GraphSyncHost2(MaxMessageBlockBytes(4000))
 
-	// verify traversal was successful
-	if len(responseErrors) != 0 {
-		t.Fatal("Response should be successful but wasn't")
-	}
+	spec := blockChainSelector(blockChainLength)
+	start := time.Now()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
 
-	// setup a DagService for the second block store
-	dagService1 := merkledag.NewDAGService(blockservice.New(bs1, offline.Exchange(bs1)))
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	elapsed := time.Since(start)
 
-	// load the root of the UnixFS DAG from the new blockstore
-	otherNode, err := dagService1.Get(ctx, nd.Cid())
-	if err != nil {
-		t.Fatal("should have been able to read received root node but didn't")
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
 	}
-
-	// Setup a UnixFS file reader
-	n, err := unixfile.NewUnixfsFile(ctx, dagService1, otherNode)
-	if err != nil {
-		t.Fatal("should have been able to setup UnixFS file but wasn't")
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
 	}
-
-	fn, ok := n.(files.File)
-	if !ok {
-		t.Fatal("file should be a regular file, but wasn't")
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
 	}
-
-	// Read the bytes for the UnixFS File
-	finalBytes, err := ioutil.ReadAll(fn)
-	if err != nil {
-		t.Fatal("should have been able to read all of unix FS file but wasn't")
+	minimumDuration := time.Duration(uint64(totalSize) * uint64(time.Second) / rateLimit)
+	if elapsed < minimumDuration {
+		t.Fatal("received blocks faster than rate limit allows")
 	}
-
-	// verify original bytes match final bytes!
-	if !reflect.DeepEqual(origBytes, finalBytes) {
-		t.Fatal("should have gotten same bytes written as read but didn't")
+	// throughput is measured as blocks are let through, not as they arrive
+	if estimate := requestor.(*GraphSync).PeerThroughput(td.host2.ID()); estimate == 0 || estimate > float64(rateLimit)*1.25 {
+		t.Fatalf("estimated throughput %f should be near the rate limit %d", estimate, rateLimit)
 	}
-
 }
 
-type gsTestData struct {
-	mn                       mocknet.Mocknet
-	ctx                      context.Context
-	host1                    host.Host
-	host2                    host.Host
-	gsnet1                   gsnet.GraphSyncNetwork
+func TestRoundTripAckWindowHighLatency(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	latency := 50 * time.Millisecond
+	for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), td.host2.ID()) {
+		link.SetOptions(mocknet.LinkOptions{Latency: latency})
+	}
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+	var sequencesLk sync.Mutex
+	var sequences []int
+	err := requestor.RegisterResponseReceivedHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		ackData, has := responseData.Extension(graphsync.ExtensionAck)
+		if has {
+			sequence, err := ack.DecodeInt(ackData, td.bridge)
+			if err != nil {
+				return err
+			}
+			sequencesLk.Lock()
+			sequences = append(sequences, sequence)
+			sequencesLk.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error setting up extension")
+	}
+
+	// setup large blocks so the response is split over several messages
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 200000, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	td.GraphSyncHost2()
+
+	window, err := ack.EncodeInt(1, td.bridge)
+	if err != nil {
+		t.Fatal("Error encoding ack window")
+	}
+	spec := blockChainSelector(blockChainLength)
+	start := time.Now()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.ExtensionData{
+		Name: graphsync.ExtensionAckWindow,
+		Data: window,
+	})
+
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	elapsed := time.Since(start)
+
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	sequencesLk.Lock()
+	defer sequencesLk.Unlock()
+	if len(sequences) < 2 {
+		t.Fatal("did not send response over multiple acknowledged messages")
+	}
+	for i, sequence := range sequences {
+		if sequence != i+1 {
+			t.Fatal("did not receive messages in sequence")
+		}
+	}
+	// with a window of one, each message after the first waits for
+	// the ack of the previous one to make a round trip
+	minimumDuration := time.Duration(len(sequences)-1) * 2 * latency
+	if elapsed < minimumDuration {
+		t.Fatal("responder sent messages without waiting for acknowledgements")
+	}
+}
+
+func TestPersistentExtensionSentOnce(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet1.SetDelegate(r)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	err := responder.RegisterRequestReceivedHook(
+		func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+			hookActions.SendPersistentExtensionData(td.extensionResponse)
+		},
+	)
+	if err != nil {
+		t.Fatal("error registering extension")
+	}
+
+	// setup large blocks so the response is split over several messages
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 200000, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	selectorData, err := td.bridge.EncodeNode(spec)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	message := gsmsg.New()
+	message.AddRequest(gsmsg.NewRequest(requestID, blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32)))
+	td.gsnet1.SendMessage(ctx, td.host2.ID(), message)
+
+	messageCount := 0
+	extensionCount := 0
+readAllMessages:
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive complete response")
+		case message := <-r.messageReceived:
+			messageCount++
+			receivedResponses := message.message.Responses()
+			if len(receivedResponses) != 1 {
+				t.Fatal("Did not receive response")
+			}
+			_, found := receivedResponses[0].Extension(td.extensionName)
+			if found {
+				extensionCount++
+			}
+			if receivedResponses[0].Status() != graphsync.PartialResponse {
+				break readAllMessages
+			}
+		}
+	}
+	if messageCount < 2 {
+		t.Fatal("did not send response over multiple messages")
+	}
+	if extensionCount != 1 {
+		t.Fatal("should have sent persistent extension exactly once")
+	}
+
+	// now verify a graphsync requestor sees the extension on every response
+	requestor := td.GraphSyncHost1()
+	responseCount := 0
+	responsesWithExtension := 0
+	err = requestor.RegisterResponseReceivedHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		responseCount++
+		data, has := responseData.Extension(td.extensionName)
+		if has && reflect.DeepEqual(data, td.extensionResponseData) {
+			responsesWithExtension++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("error registering extension")
+	}
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	if responseCount < 2 || responsesWithExtension != responseCount {
+		t.Fatal("hook did not see persistent extension on every response")
+	}
+}
+
+func TestRejectReplayedRequests(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet1.SetDelegate(r)
+
+	// initialize graphsync on second node to response to requests
+	New(ctx, td.gsnet2, td.bridge, td.loader2, td.storer2, RejectReplayedRequests(time.Minute))
+
+	blockChainLength := 5
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	selectorData, err := td.bridge.EncodeNode(spec)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+	nonceExtension, err := nonce.NewExtension(td.bridge)
+	if err != nil {
+		t.Fatal("could not generate nonce")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+
+	sendAndReadStatus := func() graphsync.ResponseStatusCode {
+		message := gsmsg.New()
+		message.AddRequest(gsmsg.NewRequest(requestID, blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32), nonceExtension))
+		td.gsnet1.SendMessage(ctx, td.host2.ID(), message)
+		for {
+			select {
+			case <-ctx.Done():
+				t.Fatal("did not receive complete response")
+			case message := <-r.messageReceived:
+				receivedResponses := message.message.Responses()
+				if len(receivedResponses) != 1 {
+					t.Fatal("Did not receive response")
+				}
+				if receivedResponses[0].Status() != graphsync.PartialResponse {
+					return receivedResponses[0].Status()
+				}
+			}
+		}
+	}
+
+	if status := sendAndReadStatus(); status != graphsync.RequestCompletedFull {
+		t.Fatal("should have served original request")
+	}
+	if status := sendAndReadStatus(); status != graphsync.RequestFailedUnknown {
+		t.Fatal("should have rejected replayed request")
+	}
+
+	// a request without a nonce cannot get around the guard
+	plainRequestor := New(ctx, td.gsnet1, td.bridge, td.loader1, td.storer1)
+	progressChan, errChan := plainRequestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+	testutil.CollectResponses(ctx, t, progressChan)
+	if errs := testutil.CollectErrors(ctx, t, errChan); len(errs) == 0 {
+		t.Fatal("should have rejected request without nonce")
+	}
+
+	// a requestor that sends nonces gets a fresh one on each request
+	requestor := New(ctx, td.gsnet1, td.bridge, td.loader1, td.storer1, SendRequestNonces())
+	for i := 0; i < 2; i++ {
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+		testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		if len(errs) != 0 {
+			t.Fatal("should have served request with fresh nonce")
+		}
+	}
+}
+
+func TestSkipIfLocal(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet2.SetDelegate(r)
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer1, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	graphSync := td.GraphSyncHost1()
+	expectSkipped := func(skip graphsync.ExtensionData) {
+		progressChan, errChan := graphSync.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, skip)
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		if len(responses) != 0 || len(errs) != 0 {
+			t.Fatal("should have skipped request for local content without error")
+		}
+	}
+	expectSkipped(graphsync.SkipIfLocal())
+	expectSkipped(graphsync.SkipIfLocalSubtree())
+
+	select {
+	case <-r.messageReceived:
+		t.Fatal("should not have sent a request for local content")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// with a block missing, only the root check still skips the request
+	delete(td.blockStore1, blockChain.middleLinks[50])
+	expectSkipped(graphsync.SkipIfLocal())
+
+	requestCtx, requestCancel := context.WithCancel(ctx)
+	defer requestCancel()
+	graphSync.Request(requestCtx, td.host2.ID(), blockChain.tipLink, spec, graphsync.SkipIfLocalSubtree())
+	select {
+	case <-ctx.Done():
+		t.Fatal("should have sent request for partially local content")
+	case message := <-r.messageReceived:
+		requests := message.message.Requests()
+		if len(requests) != 1 {
+			t.Fatal("did not send request")
+		}
+		if _, ok := requests[0].Extension(graphsync.ExtensionSkipIfLocal); ok {
+			t.Fatal("should not have sent requestor-only extension")
+		}
+	}
+}
+
+type queueEvent struct {
+	enqueue   bool
+	requests  int
+	responses int
+}
+
+// recordingQueue wraps the default message queue and records the order in
+// which messages are added to it and picked up for sending
+type recordingQueue struct {
+	peermanager.PeerQueue
+	eventsLk sync.Mutex
+	events   []queueEvent
+}
+
+func (rq *recordingQueue) record(event queueEvent) {
+	rq.eventsLk.Lock()
+	rq.events = append(rq.events, event)
+	rq.eventsLk.Unlock()
+}
+
+func (rq *recordingQueue) recordedEvents() []queueEvent {
+	rq.eventsLk.Lock()
+	defer rq.eventsLk.Unlock()
+	return append([]queueEvent(nil), rq.events...)
+}
+
+func (rq *recordingQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest) {
+	rq.record(queueEvent{enqueue: true, requests: 1})
+	rq.PeerQueue.AddRequest(graphSyncRequest)
+}
+
+func (rq *recordingQueue) AddResponses(responses []gsmsg.GraphSyncResponse, blks []blocks.Block) <-chan struct{} {
+	// hold the lock so the dequeue can't be recorded before the enqueue
+	rq.eventsLk.Lock()
+	rq.events = append(rq.events, queueEvent{enqueue: true, responses: len(responses)})
+	sent := rq.PeerQueue.AddResponses(responses, blks)
+	rq.eventsLk.Unlock()
+	notification := make(chan struct{}, 1)
+	go func() {
+		<-sent
+		rq.record(queueEvent{enqueue: false, responses: len(responses)})
+		notification <- struct{}{}
+	}()
+	return notification
+}
+
+func TestCustomMessageQueue(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	queuesLk := sync.Mutex{}
+	queues := make(map[peer.ID]*recordingQueue)
+	recordingQueueFactory := func(network gsnet.GraphSyncNetwork) peermanager.PeerQueueFactory {
+		return func(ctx context.Context, p peer.ID) peermanager.PeerQueue {
+			rq := &recordingQueue{PeerQueue: messagequeue.New(ctx, p, network)}
+			queuesLk.Lock()
+			queues[p] = rq
+			queuesLk.Unlock()
+			return rq
+		}
+	}
+
+	requestor := New(ctx, td.gsnet1, td.bridge, td.loader1, td.storer1, WithMessageQueueFactory(recordingQueueFactory(td.gsnet1)))
+	New(ctx, td.gsnet2, td.bridge, td.loader2, td.storer2, WithMessageQueueFactory(recordingQueueFactory(td.gsnet2)))
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 || len(responses) != blockChainLength*2 {
+		t.Fatal("should have completed request through custom queues")
+	}
+
+	queuesLk.Lock()
+	requestorQueue, responderQueue := queues[td.host2.ID()], queues[td.host1.ID()]
+	queuesLk.Unlock()
+	if requestorQueue == nil || responderQueue == nil {
+		t.Fatal("should have created custom queues on both sides")
+	}
+	requestorEvents := requestorQueue.recordedEvents()
+	if len(requestorEvents) != 1 || !requestorEvents[0].enqueue || requestorEvents[0].requests != 1 {
+		t.Fatal("should have enqueued request on requestor's custom queue")
+	}
+
+	// wait for every batch of responses to be picked up for sending
+	var responderEvents []queueEvent
+	for {
+		responderEvents = responderQueue.recordedEvents()
+		enqueued := 0
+		for _, event := range responderEvents {
+			if event.enqueue {
+				enqueued++
+			}
+		}
+		if enqueued > 0 && enqueued*2 == len(responderEvents) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("responses were not all dequeued")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	pending := 0
+	totalResponses := 0
+	for _, event := range responderEvents {
+		if event.requests != 0 {
+			t.Fatal("responder should not have enqueued requests")
+		}
+		if event.enqueue {
+			pending++
+			totalResponses += event.responses
+		} else {
+			pending--
+		}
+		if pending < 0 {
+			t.Fatal("dequeued responses before enqueueing them")
+		}
+	}
+	if totalResponses < 1 {
+		t.Fatal("should have enqueued responses on responder's custom queue")
+	}
+}
+
+func TestRejectUnboundedSelectors(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	responder := New(ctx, td.gsnet2, td.bridge, td.loader2, td.storer2, RejectUnboundedSelectors())
+	// validated requests skip the default depth limit, but not the bound check
+	responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		hookActions.ValidateRequest()
+	})
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	unboundedSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(),
+		ssb.ExploreFields(func(efsb ipldbridge.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Parents", ssb.ExploreAll(
+				ssb.ExploreRecursiveEdge()))
+		})).Node()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, unboundedSelector)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(responses) != 0 || len(errs) != 1 {
+		t.Fatal("should have rejected request with unbounded selector")
+	}
+
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
+	responses = testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 || len(errs) != 0 {
+		t.Fatal("should have served request with bounded selector")
+	}
+}
+
+func TestProgressReportsExploration(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	td.GraphSyncHost2()
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	// match the tip's parent, without following the parent's own parents
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	parentSelector := ssb.ExploreFields(func(efsb ipldbridge.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Parents", ssb.ExploreIndex(0, ssb.Matcher()))
+	}).Node()
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, parentSelector)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("should have completed request")
+	}
+	if len(responses) != 3 {
+		t.Fatal("should have visited tip, parents list, and parent")
+	}
+	if !responses[0].Explored || !responses[1].Explored {
+		t.Fatal("should have reported exploring beneath tip and parents list")
+	}
+	parent := responses[2]
+	if parent.Explored {
+		t.Fatal("should have reported matched parent was not explored")
+	}
+	if parent.LastBlock.Link != blockChain.middleLinks[len(blockChain.middleLinks)-1] {
+		t.Fatal("should have matched tip's parent")
+	}
+
+	// a full traversal of the chain explores every block, stopping only at
+	// the genesis block's empty list of parents
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
+	responses = testutil.CollectResponses(ctx, t, progressChan)
+	testutil.CollectErrors(ctx, t, errChan)
+	for i, response := range responses {
+		if response.Explored != (i != len(responses)-1) {
+			t.Fatal("should have explored all but the last node visited")
+		}
+	}
+}
+
+func TestRequestFromPeers(t *testing.T) {
+	blockChainLength := 20
+	slowLatency := 500 * time.Millisecond
+
+	// setupResponders gives the requestor on host1 a fast responder on host2
+	// and a slow responder, with the same block chain
+	setupResponders := func(ctx context.Context, t *testing.T) (*gsTestData, peer.ID, *blockChain) {
+		td := newGsTestData(ctx, t)
+		slowHost, err := td.mn.GenPeer()
+		if err != nil {
+			t.Fatal("error generating host")
+		}
+		err = td.mn.LinkAll()
+		if err != nil {
+			t.Fatal("error linking hosts")
+		}
+		for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), slowHost.ID()) {
+			link.SetOptions(mocknet.LinkOptions{Latency: slowLatency})
+		}
+		blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+		slowBlockStore := make(map[ipld.Link][]byte)
+		for link, data := range td.blockStore2 {
+			slowBlockStore[link] = data
+		}
+		slowLoader, slowStorer := testbridge.NewMockStore(slowBlockStore)
+		td.GraphSyncHost2()
+		New(ctx, gsnet.NewFromLibp2pHost(slowHost), td.bridge, slowLoader, slowStorer)
+		return td, slowHost.ID(), blockChain
+	}
+
+	verifyResponses := func(t *testing.T, responses []graphsync.ResponseProgress, errs []error) {
+		if len(errs) != 0 {
+			t.Fatal("errors during request")
+		}
+		if len(responses) != blockChainLength*2 {
+			t.Fatal("did not traverse all nodes")
+		}
+		paths := make(map[string]struct{})
+		for _, response := range responses {
+			paths[response.Path.String()] = struct{}{}
+		}
+		if len(paths) != len(responses) {
+			t.Fatal("repeated responses")
+		}
+	}
+
+	t.Run("falls back from slow peer", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		td, slowPeer, blockChain := setupResponders(ctx, t)
+		requestor := td.GraphSyncHost1()
+
+		start := time.Now()
+		policy := graphsync.FallbackPolicy{MaxLatency: 100 * time.Millisecond}
+		progressChan, errChan := requestor.RequestFromPeers(ctx, []peer.ID{slowPeer, td.host2.ID()}, blockChain.tipLink, blockChainSelector(blockChainLength), policy)
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		verifyResponses(t, responses, errs)
+		if time.Since(start) >= slowLatency {
+			t.Fatal("should have fallen back before slow peer responded")
+		}
+	})
+
+	t.Run("reports latency when no peer is fast enough", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		td, slowPeer, blockChain := setupResponders(ctx, t)
+		requestor := td.GraphSyncHost1()
+
+		policy := graphsync.FallbackPolicy{MaxLatency: 100 * time.Millisecond}
+		progressChan, errChan := requestor.RequestFromPeers(ctx, []peer.ID{slowPeer}, blockChain.tipLink, blockChainSelector(blockChainLength), policy)
+		testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		if len(errs) != 1 || errs[0] != (graphsync.ResponseLatencyError{Peer: slowPeer, MaxLatency: policy.MaxLatency}) {
+			t.Fatal("should have reported slow peer exceeded max latency")
+		}
+	})
+
+	t.Run("races peers", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		td, slowPeer, blockChain := setupResponders(ctx, t)
+		requestor := td.GraphSyncHost1()
+
+		start := time.Now()
+		policy := graphsync.FallbackPolicy{Race: true}
+		progressChan, errChan := requestor.RequestFromPeers(ctx, []peer.ID{slowPeer, td.host2.ID()}, blockChain.tipLink, blockChainSelector(blockChainLength), policy)
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		verifyResponses(t, responses, errs)
+		if time.Since(start) >= slowLatency {
+			t.Fatal("should have kept fast peer's responses")
+		}
+	})
+}
+
+func TestPeerThroughput(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	slowHost, err := td.mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	err = td.mn.LinkAll()
+	if err != nil {
+		t.Fatal("error linking hosts")
+	}
+
+	// small response messages give each transfer several to measure
+	blockChainLength := 25
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 4000, blockChainLength)
+	slowBlockStore := make(map[ipld.Link][]byte)
+	for link, data := range td.blockStore2 {
+		slowBlockStore[link] = data
+	}
+	slowLoader, slowStorer := testbridge.NewMockStore(slowBlockStore)
+	td.GraphSyncHost2(MaxMessageBlockBytes(20000))
+	New(ctx, gsnet.NewFromLibp2pHost(slowHost), td.bridge, slowLoader, slowStorer, MaxMessageBlockBytes(20000))
+
+	requestor := td.GraphSyncHost1(TrackPeerThroughput()).(*GraphSync)
+	if requestor.PeerThroughput(td.host2.ID()) != 0 {
+		t.Fatal("should not estimate throughput before any transfer")
+	}
+	spec := blockChainSelector(blockChainLength)
+	bandwidths := map[peer.ID]float64{td.host2.ID(): 2 << 20, slowHost.ID(): 200 << 10}
+	for p, bandwidth := range bandwidths {
+		// the whole chain is fetched from each peer
+		for link := range td.blockStore1 {
+			delete(td.blockStore1, link)
+		}
+		// setting the bandwidth just before the transfer leaves the link no
+		// allowance to send a burst faster than it
+		for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), p) {
+			link.SetOptions(mocknet.LinkOptions{Bandwidth: bandwidth})
+		}
+		progressChan, errChan := requestor.Request(ctx, p, blockChain.tipLink, spec)
+		testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		if len(errs) != 0 {
+			t.Fatal("errors during traverse")
+		}
+	}
+
+	fast := requestor.PeerThroughput(td.host2.ID())
+	slow := requestor.PeerThroughput(slowHost.ID())
+	if slow == 0 {
+		t.Fatal("should have estimated throughput for the slow peer")
+	}
+	if fast <= slow {
+		t.Fatalf("estimated %f bytes/sec from the fast peer, no more than %f from the slow peer", fast, slow)
+	}
+}
+
+func TestFallbackRequestDeduplicatesByPathAndLink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fr := &fallbackRequest{
+		ctx:      ctx,
+		outgoing: make(chan graphsync.ResponseProgress, 10),
+		sent:     make(map[string]struct{}),
+	}
+	links := testutil.GenerateCids(2)
+	progressAt := func(path string, link ipld.Link) graphsync.ResponseProgress {
+		var progress graphsync.ResponseProgress
+		progress.Path = ipld.ParsePath(path)
+		progress.LastBlock.Path = progress.Path
+		progress.LastBlock.Link = link
+		return progress
+	}
+	fr.receive(progressAt("", cidlink.Link{Cid: links[0]}))
+	fr.receive(progressAt("Parents", cidlink.Link{Cid: links[0]}))
+	// the second peer skips a response the first sent, and repeats another
+	fr.receive(progressAt("Parents", cidlink.Link{Cid: links[0]}))
+	fr.receive(progressAt("Parents/0", cidlink.Link{Cid: links[1]}))
+	fr.receive(progressAt("Parents/0", cidlink.Link{Cid: links[1]}))
+	close(fr.outgoing)
+
+	var paths []string
+	for progress := range fr.outgoing {
+		paths = append(paths, progress.Path.String())
+	}
+	if !reflect.DeepEqual(paths, []string{"", "Parents", "Parents/0"}) {
+		t.Fatal("should have passed on each response once")
+	}
+}
+
+// What this test does:
+// - Construct a blockstore + dag service
+// - Import a file to UnixFS v1
+// - setup a graphsync request from one node to the other
+// for the file
+// - Load the file from the new block store on the other node
+// using the
+// existing UnixFS v1 file reader
+// - Verify the bytes match the original
+func TestEncryptedExtensionRoundTrip(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// encryption needs RSA peer keys, which mocknet does not generate
+	newRSAHost := func(port int) host.Host {
+		sk, _, err := crypto.GenerateRSAKeyPair(2048, cryptorand.Reader)
+		if err != nil {
+			t.Fatal("unable to generate key")
+		}
+		h, err := td.mn.AddPeer(sk, multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)))
+		if err != nil {
+			t.Fatal("error adding host")
+		}
+		return h
+	}
+	requestorHost := newRSAHost(4243)
+	responderHost := newRSAHost(4244)
+	err := td.mn.LinkAll()
+	if err != nil {
+		t.Fatal("error linking hosts")
+	}
+	// real transports exchange keys on connecting, mocknet does not
+	requestorHost.Peerstore().AddPubKey(responderHost.ID(), responderHost.Peerstore().PubKey(responderHost.ID()))
+	responderHost.Peerstore().AddPubKey(requestorHost.ID(), requestorHost.Peerstore().PubKey(requestorHost.ID()))
+	requestorNet := gsnet.NewFromLibp2pHost(requestorHost)
+	responderNet := gsnet.NewFromLibp2pHost(responderHost)
+
+	blockChainLength := 5
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	requestorRegistry := encryptedextensions.NewRegistry(requestorHost)
+	requestorRegistry.Register(td.extensionName)
+	encryptedExtension, err := requestorRegistry.Encrypt(responderHost.ID(), td.extension)
+	if err != nil {
+		t.Fatal("unable to encrypt extension")
+	}
+
+	// the extension is unreadable on the wire
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	responderNet.SetDelegate(r)
+	selectorData, err := td.bridge.EncodeNode(spec)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+	sent := gsmsg.New()
+	sent.AddRequest(gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32), encryptedExtension))
+	requestorNet.SendMessage(ctx, responderHost.ID(), sent)
+	var message receivedMessage
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not receive message sent")
+	case message = <-r.messageReceived:
+	}
+	receivedRequests := message.message.Requests()
+	if len(receivedRequests) != 1 {
+		t.Fatal("Did not add request to received message")
+	}
+	wireData, found := receivedRequests[0].Extension(td.extensionName)
+	if !found {
+		t.Fatal("did not send encrypted extension")
+	}
+	if bytes.Contains(wireData, td.extensionData) {
+		t.Fatal("extension data was readable on the wire")
+	}
+
+	// but the responder's hooks see it decrypted, and can encrypt a reply
+	responderRegistry := encryptedextensions.NewRegistry(responderHost)
+	responderRegistry.Register(td.extensionName)
+	requestor := New(ctx, requestorNet, td.bridge, td.loader1, td.storer1)
+	responder := New(ctx, responderNet, td.bridge, td.loader2, td.storer2)
+
+	// decrypting hooks still share the request scratch with other hooks
+	type scratchKey struct{}
+	err = responder.RegisterRequestQueuedHook(func(p peer.ID, requestData graphsync.RequestData) {
+		requestData.RequestScratch().Set(scratchKey{}, true)
+	})
+	if err != nil {
+		t.Fatal("error registering hook")
+	}
+	var receivedRequestData []byte
+	var requestScratchShared bool
+	err = responder.RegisterRequestReceivedHook(responderRegistry.RequestReceivedHook(
+		func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+			_, requestScratchShared = requestData.RequestScratch().Get(scratchKey{})
+			receivedRequestData, _ = requestData.Extension(td.extensionName)
+			encryptedResponse, err := responderRegistry.Encrypt(p, td.extensionResponse)
+			if err != nil {
+				hookActions.TerminateWithError(err)
+				return
+			}
+			hookActions.SendExtensionData(encryptedResponse)
+		},
+	))
+	if err != nil {
+		t.Fatal("error registering extension")
+	}
+	err = requestor.RegisterResponseReceivedHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		responseData.RequestScratch().Set(scratchKey{}, true)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("error registering hook")
+	}
+	var receivedResponseData []byte
+	var responseScratchShared bool
+	err = requestor.RegisterResponseReceivedHook(requestorRegistry.ResponseReceivedHook(
+		func(p peer.ID, responseData graphsync.ResponseData) error {
+			_, responseScratchShared = responseData.RequestScratch().Get(scratchKey{})
+			data, has := responseData.Extension(td.extensionName)
+			if has {
+				receivedResponseData = data
+			}
+			return nil
+		},
+	))
+	if err != nil {
+		t.Fatal("error registering extension")
+	}
+
+	progressChan, errChan := requestor.Request(ctx, responderHost.ID(), blockChain.tipLink, spec, encryptedExtension)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if !reflect.DeepEqual(receivedRequestData, td.extensionData) {
+		t.Fatal("responder did not decrypt request extension")
+	}
+	if !reflect.DeepEqual(receivedResponseData, td.extensionResponseData) {
+		t.Fatal("requestor did not decrypt response extension")
+	}
+	if !requestScratchShared || !responseScratchShared {
+		t.Fatal("decrypting hooks did not share the request scratch")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2()
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	// A redirects to B, which the responder serves, while C and D redirect to
+	// each other
+	a := testutil.GenerateCids(1)[0]
+	b := blockChain.tipLink.(cidlink.Link).Cid
+	loop := testutil.GenerateCids(2)
+	redirects := map[cid.Cid]cid.Cid{
+		a:       b,
+		loop[0]: loop[1],
+		loop[1]: loop[0],
+	}
+	err := responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		if to, ok := redirects[requestData.Root()]; ok {
+			hookActions.Redirect(to)
+		}
+	})
+	if err != nil {
+		t.Fatal("Error setting up hook")
+	}
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), cidlink.Link{Cid: a}, spec, graphsync.FollowRedirects(1))
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors following redirect")
+	}
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse the root redirected to")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), cidlink.Link{Cid: a}, spec)
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) == 0 || errs[0] != (graphsync.RedirectError{Root: b}) {
+		t.Fatal("should have reported the redirect when not following it")
+	}
+
+	// a redirect loop stops once the redirects allowed are used up
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), cidlink.Link{Cid: loop[0]}, spec, graphsync.FollowRedirects(3))
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) == 0 || errs[0] != (graphsync.RedirectError{Root: loop[0]}) {
+		t.Fatal("should have stopped following redirects")
+	}
+}
+
+func TestRequestDiff(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// the responder has the new version of the chain, three blocks longer
+	// than the old version the requestor already has
+	blockChainLength := 100
+	newBlocks := 3
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	newLinks := append([]ipld.Link{blockChain.tipLink}, blockChain.middleLinks[len(blockChain.middleLinks)-newBlocks+1:]...)
+	oldRoot := blockChain.middleLinks[len(blockChain.middleLinks)-newBlocks]
+	for link, data := range td.blockStore2 {
+		td.blockStore1[link] = data
+	}
+	for _, link := range newLinks {
+		delete(td.blockStore1, link)
+	}
+
+	// record the blocks the requestor receives over the network
+	var storedLk sync.Mutex
+	var stored []ipld.Link
+	recordingStorer := func(lnkCtx ipldbridge.LinkContext) (io.Writer, ipldbridge.StoreCommitter, error) {
+		writer, committer, err := td.storer1(lnkCtx)
+		return writer, func(lnk ipld.Link) error {
+			storedLk.Lock()
+			stored = append(stored, lnk)
+			storedLk.Unlock()
+			return committer(lnk)
+		}, err
+	}
+	requestor := New(ctx, td.gsnet1, td.bridge, td.loader1, recordingStorer)
+	td.GraphSyncHost2()
+
+	spec := blockChainSelector(blockChainLength)
+	progressChan, errChan := requestor.RequestDiff(ctx, td.host2.ID(), oldRoot, blockChain.tipLink, spec)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	storedLk.Lock()
+	defer storedLk.Unlock()
+	if len(stored) != newBlocks {
+		t.Fatal("should only receive blocks not in the old version")
+	}
+	for _, link := range newLinks {
+		if _, ok := td.blockStore1[link]; !ok {
+			t.Fatal("did not store new block")
+		}
+	}
+}
+
+func TestMaxResponseDuration(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet1.SetDelegate(r)
+
+	// initialize graphsync on second node with a loader too slow to finish
+	// the request within the max response duration
+	slowLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		time.Sleep(10 * time.Millisecond)
+		return td.loader2(lnk, lnkCtx)
+	}
+	New(ctx, td.gsnet2, td.bridge, slowLoader, td.storer2, MaxResponseDuration(50*time.Millisecond))
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	selectorData, err := td.bridge.EncodeNode(spec)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	message := gsmsg.New()
+	message.AddRequest(gsmsg.NewRequest(requestID, blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32)))
+	td.gsnet1.SendMessage(ctx, td.host2.ID(), message)
+
+	var status graphsync.ResponseStatusCode
+	for !gsmsg.IsTerminalResponseCode(status) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive complete response")
+		case message := <-r.messageReceived:
+			receivedResponses := message.message.Responses()
+			if len(receivedResponses) != 1 {
+				t.Fatal("Did not receive response")
+			}
+			status = receivedResponses[0].Status()
+		}
+	}
+	if status != graphsync.RequestFailedTimeout {
+		t.Fatal("should have terminated response with timeout status")
+	}
+}
+
+func TestMaxBufferedResponseBytes(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), td.host2.ID()) {
+		link.SetOptions(mocknet.LinkOptions{Latency: 5 * time.Millisecond, Bandwidth: 20000000})
+	}
+
+	requestor := td.GraphSyncHost1()
+	budget := uint64(300000)
+	responder := New(ctx, td.gsnet2, td.bridge, td.loader2, td.storer2, MaxBufferedResponseBytes(budget))
+
+	// several concurrent responses of large blocks, far more than the budget
+	concurrentRequests := 5
+	blockChainLength := 10
+	blockChains := make([]*blockChain, 0, concurrentRequests)
+	for i := 0; i < concurrentRequests; i++ {
+		blockChains = append(blockChains, setupBlockChain(ctx, t, td.storer2, td.bridge, 100000, blockChainLength))
+	}
+	spec := blockChainSelector(blockChainLength)
+
+	// sample the buffered bytes through the requests
+	var maxBuffered uint64
+	sampleCtx, sampleCancel := context.WithCancel(ctx)
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			buffered := responder.BufferedResponseBytes()
+			if buffered > maxBuffered {
+				maxBuffered = buffered
+			}
+			select {
+			case <-sampleCtx.Done():
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+		}
+	}()
+
+	type result struct {
+		responses int
+		errs      int
+	}
+	results := make(chan result, concurrentRequests)
+	for _, blockChain := range blockChains {
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+		go func() {
+			var r result
+			for range progressChan {
+				r.responses++
+			}
+			for range errChan {
+				r.errs++
+			}
+			results <- r
+		}()
+	}
+	for i := 0; i < concurrentRequests; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not complete requests")
+		case r := <-results:
+			if r.errs != 0 {
+				t.Fatal("errors during traverse")
+			}
+			if r.responses != blockChainLength*2 {
+				t.Fatal("did not traverse all nodes")
+			}
+		}
+	}
+	sampleCancel()
+	<-sampled
+
+	if maxBuffered == 0 {
+		t.Fatal("did not track buffered blocks")
+	}
+	if maxBuffered > budget {
+		t.Fatal("buffered more response bytes than budget allows")
+	}
+	if responder.BufferedResponseBytes() != 0 {
+		t.Fatal("should release buffered bytes once sent")
+	}
+}
+
+func TestFieldsSelector(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// record the blocks the responder loads
+	var loadedLk sync.Mutex
+	var loaded []ipld.Link
+	recordingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		loadedLk.Lock()
+		loaded = append(loaded, lnk)
+		loadedLk.Unlock()
+		return td.loader2(lnk, lnkCtx)
+	}
+	requestor := td.GraphSyncHost1()
+	New(ctx, td.gsnet2, td.bridge, recordingLoader, td.storer2)
+
+	blockChainLength := 5
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	spec := selectorutil.FieldsSelector("Messages")
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	matchedMessages := false
+	for _, response := range responses {
+		path := response.Path.Segments()
+		if len(path) == 0 {
+			continue
+		}
+		if path[0].String() != "Messages" {
+			t.Fatal("traversed field not in selector")
+		}
+		matchedMessages = true
+	}
+	if !matchedMessages {
+		t.Fatal("did not traverse selected field")
+	}
+	loadedLk.Lock()
+	defer loadedLk.Unlock()
+	if len(loaded) != 1 || loaded[0] != blockChain.tipLink {
+		t.Fatal("should not load blocks under other fields")
+	}
+}
+
+func TestPreferredOrder(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet1.SetDelegate(r)
+
+	// initialize graphsync on second node to response to requests
+	New(ctx, td.gsnet2, td.bridge, td.loader2, td.storer2)
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+	selectorData, err := td.bridge.EncodeNode(spec)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+
+	// hint an older block, whose ancestors the traversal reaches last
+	hintedIndex := 5
+	hintData, err := cidset.EncodeCidList([]cid.Cid{blockChain.middleLinks[hintedIndex].(cidlink.Link).Cid}, td.bridge)
+	if err != nil {
+		t.Fatal("could not encode hints")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	message := gsmsg.New()
+	message.AddRequest(gsmsg.NewRequest(requestID, blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32),
+		graphsync.ExtensionData{
+			Name: graphsync.ExtensionPreferredOrder,
+			Data: hintData,
+		}))
+	td.gsnet1.SendMessage(ctx, td.host2.ID(), message)
+
+	var status graphsync.ResponseStatusCode
+	var sentLinks []ipld.Link
+	for !gsmsg.IsTerminalResponseCode(status) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive complete response")
+		case message := <-r.messageReceived:
+			receivedResponses := message.message.Responses()
+			if len(receivedResponses) != 1 {
+				t.Fatal("Did not receive response")
+			}
+			status = receivedResponses[0].Status()
+			metadataData, has := receivedResponses[0].Extension(graphsync.ExtensionMetadata)
+			if !has {
+				t.Fatal("response should include metadata")
+			}
+			md, err := metadata.DecodeMetadata(metadataData, td.bridge)
+			if err != nil {
+				t.Fatal("unable to decode metadata")
+			}
+			for _, item := range md {
+				sentLinks = append(sentLinks, item.Link)
+			}
+		}
+	}
+	if status != graphsync.RequestCompletedFull {
+		t.Fatal("response should complete")
+	}
+	if len(sentLinks) != blockChainLength {
+		t.Fatal("should send every block")
+	}
+
+	// the hinted block and its ancestors go first, newest to oldest
+	expected := []ipld.Link{}
+	for i := hintedIndex; i >= 0; i-- {
+		expected = append(expected, blockChain.middleLinks[i])
+	}
+	expected = append(expected, blockChain.genisisLink)
+	if !reflect.DeepEqual(sentLinks[:len(expected)], expected) {
+		t.Fatal("should send hinted blocks before others")
+	}
+}
+
+func TestUnixFSFetch(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	const unixfsChunkSize uint64 = 1 << 10
+	const unixfsLinksPerLevel = 1024
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	makeLoader := func(bs bstore.Blockstore) ipld.Loader {
+		return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+			c, ok := lnk.(cidlink.Link)
+			if !ok {
+				return nil, errors.New("Incorrect Link Type")
+			}
+			// read block from one store
+			block, err := bs.Get(c.Cid)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(block.RawData()), nil
+		}
+	}
+
+	makeStorer := func(bs bstore.Blockstore) ipld.Storer {
+		return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+			var buf bytes.Buffer
+			var committer ipld.StoreCommitter = func(lnk ipld.Link) error {
+				c, ok := lnk.(cidlink.Link)
+				if !ok {
+					return errors.New("Incorrect Link Type")
+				}
+				block, err := blocks.NewBlockWithCid(buf.Bytes(), c.Cid)
+				if err != nil {
+					return err
+				}
+				return bs.Put(block)
+			}
+			return &buf, committer, nil
+		}
+	}
+	// make a blockstore and dag service
+	bs1 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	// make a second blockstore
+	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dagService2 := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
+
+	// read in a fixture file
+	path, err := filepath.Abs(filepath.Join("fixtures", "lorem.txt"))
+	if err != nil {
+		t.Fatal("unable to create path for fixture file")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("unable to open fixture file")
+	}
+	var buf bytes.Buffer
+	tr := io.TeeReader(f, &buf)
+	file := files.NewReaderFile(tr)
+
+	// import to UnixFS
+	bufferedDS := ipldformat.NewBufferedDAG(ctx, dagService2)
+
+	params := ihelper.DagBuilderParams{
+		Maxlinks:   unixfsLinksPerLevel,
+		RawLeaves:  true,
+		CidBuilder: nil,
+		Dagserv:    bufferedDS,
+	}
+
+	db, err := params.New(chunker.NewSizeSplitter(file, int64(unixfsChunkSize)))
+	if err != nil {
+		t.Fatal("unable to setup dag builder")
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal("unable to create unix fs node")
+	}
+	err = bufferedDS.Commit()
+	if err != nil {
+		t.Fatal("unable to commit unix fs node")
+	}
+
+	// save the original files bytes
+	origBytes := buf.Bytes()
+
+	// setup an IPLD loader/storer for blockstore 1
+	loader1 := makeLoader(bs1)
+	storer1 := makeStorer(bs1)
+
+	// setup an IPLD loader/storer for blockstore 2
+	loader2 := makeLoader(bs2)
+	storer2 := makeStorer(bs2)
+
+	td := newGsTestData(ctx, t)
+	requestor := New(ctx, td.gsnet1, td.bridge, loader1, storer1)
+	responder := New(ctx, td.gsnet2, td.bridge, loader2, storer2)
+	extensionName := graphsync.ExtensionName("Free for all")
+	responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		hookActions.ValidateRequest()
+		hookActions.SendExtensionData(graphsync.ExtensionData{
+			Name: extensionName,
+			Data: nil,
+		})
+	})
+	// make a go-ipld-prime link for the root UnixFS node
+	clink := cidlink.Link{Cid: nd.Cid()}
+
+	// create a selector for the whole UnixFS dag
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	// execute the traversal
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), clink, allSelector,
+		graphsync.ExtensionData{
+			Name: extensionName,
+			Data: nil,
+		})
+
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	responseErrors := testutil.CollectErrors(ctx, t, errChan)
+
+	// verify traversal was successful
+	if len(responseErrors) != 0 {
+		t.Fatal("Response should be successful but wasn't")
+	}
+
+	// setup a DagService for the second block store
+	dagService1 := merkledag.NewDAGService(blockservice.New(bs1, offline.Exchange(bs1)))
+
+	// load the root of the UnixFS DAG from the new blockstore
+	otherNode, err := dagService1.Get(ctx, nd.Cid())
+	if err != nil {
+		t.Fatal("should have been able to read received root node but didn't")
+	}
+
+	// Setup a UnixFS file reader
+	n, err := unixfile.NewUnixfsFile(ctx, dagService1, otherNode)
+	if err != nil {
+		t.Fatal("should have been able to setup UnixFS file but wasn't")
+	}
+
+	fn, ok := n.(files.File)
+	if !ok {
+		t.Fatal("file should be a regular file, but wasn't")
+	}
+
+	// Read the bytes for the UnixFS File
+	finalBytes, err := ioutil.ReadAll(fn)
+	if err != nil {
+		t.Fatal("should have been able to read all of unix FS file but wasn't")
+	}
+
+	// verify original bytes match final bytes!
+	if !reflect.DeepEqual(origBytes, finalBytes) {
+		t.Fatal("should have gotten same bytes written as read but didn't")
+	}
+
+}
+
+type gsTestData struct {
+	mn                       mocknet.Mocknet
+	ctx                      context.Context
+	host1                    host.Host
+	host2                    host.Host
+	gsnet1                   gsnet.GraphSyncNetwork
 	gsnet2                   gsnet.GraphSyncNetwork
 	blockStore1, blockStore2 map[ipld.Link][]byte
 	loader1, loader2         ipld.Loader
@@ -527,168 +2013,2436 @@ type gsTestData struct {
 	extensionResponse        graphsync.ExtensionData
 }
 
-func newGsTestData(ctx context.Context, t *testing.T) *gsTestData {
-	td := &gsTestData{ctx: ctx}
-	td.mn = mocknet.New(ctx)
-	var err error
-	// setup network
-	td.host1, err = td.mn.GenPeer()
+func newGsTestData(ctx context.Context, t testing.TB) *gsTestData {
+	td := &gsTestData{ctx: ctx}
+	td.mn = mocknet.New(ctx)
+	var err error
+	// setup network
+	td.host1, err = td.mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	td.host2, err = td.mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	err = td.mn.LinkAll()
+	if err != nil {
+		t.Fatal("error linking hosts")
+	}
+
+	td.gsnet1 = gsnet.NewFromLibp2pHost(td.host1)
+	td.gsnet2 = gsnet.NewFromLibp2pHost(td.host2)
+	td.blockStore1 = make(map[ipld.Link][]byte)
+	td.loader1, td.storer1 = testbridge.NewMockStore(td.blockStore1)
+	td.blockStore2 = make(map[ipld.Link][]byte)
+	td.loader2, td.storer2 = testbridge.NewMockStore(td.blockStore2)
+	td.bridge = ipldbridge.NewIPLDBridge()
+	// setup extension handlers
+	td.extensionData = testutil.RandomBytes(100)
+	td.extensionName = graphsync.ExtensionName("AppleSauce/McGee")
+	td.extension = graphsync.ExtensionData{
+		Name: td.extensionName,
+		Data: td.extensionData,
+	}
+	td.extensionResponseData = testutil.RandomBytes(100)
+	td.extensionResponse = graphsync.ExtensionData{
+		Name: td.extensionName,
+		Data: td.extensionResponseData,
+	}
+
+	return td
+}
+
+func (td *gsTestData) GraphSyncHost1(options ...Option) graphsync.GraphExchange {
+	return New(td.ctx, td.gsnet1, td.bridge, td.loader1, td.storer1, options...)
+}
+
+func (td *gsTestData) GraphSyncHost2(options ...Option) graphsync.GraphExchange {
+
+	return New(td.ctx, td.gsnet2, td.bridge, td.loader2, td.storer2, options...)
+}
+
+type receivedMessage struct {
+	message gsmsg.GraphSyncMessage
+	sender  peer.ID
+}
+
+// Receiver is an interface for receiving messages from the GraphSyncNetwork.
+type receiver struct {
+	messageReceived chan receivedMessage
+}
+
+func (r *receiver) ReceiveMessage(
+	ctx context.Context,
+	sender peer.ID,
+	incoming gsmsg.GraphSyncMessage) {
+
+	select {
+	case <-ctx.Done():
+	case r.messageReceived <- receivedMessage{incoming, sender}:
+	}
+}
+
+func (r *receiver) ReceiveError(err error) {
+}
+
+func (r *receiver) Connected(p peer.ID) {
+}
+
+func (r *receiver) Disconnected(p peer.ID) {
+}
+
+type blockChain struct {
+	genisisNode ipld.Node
+	genisisLink ipld.Link
+	middleNodes []ipld.Node
+	middleLinks []ipld.Link
+	tipNode     ipld.Node
+	tipLink     ipld.Link
+}
+
+func createBlock(nb ipldbridge.NodeBuilder, parents []ipld.Link, size int64) ipld.Node {
+	return nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+		mb.Insert(knb.CreateString("Parents"), vnb.CreateList(func(lb ipldbridge.ListBuilder, vnb ipldbridge.NodeBuilder) {
+			for _, parent := range parents {
+				lb.Append(vnb.CreateLink(parent))
+			}
+		}))
+		mb.Insert(knb.CreateString("Messages"), vnb.CreateList(func(lb ipldbridge.ListBuilder, vnb ipldbridge.NodeBuilder) {
+			lb.Append(vnb.CreateBytes(testutil.RandomBytes(size)))
+		}))
+	})
+}
+
+func setupBlockChain(
+	ctx context.Context,
+	t testing.TB,
+	storer ipldbridge.Storer,
+	bridge ipldbridge.IPLDBridge,
+	size int64,
+	blockChainLength int) *blockChain {
+	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
+	var genisisNode ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		genisisNode = createBlock(nb, []ipld.Link{}, size)
+	})
+	if err != nil {
+		t.Fatal("Error creating genesis block")
+	}
+	genesisLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, genisisNode, storer)
+	if err != nil {
+		t.Fatal("Error creating link to genesis block")
+	}
+	parent := genesisLink
+	middleNodes := make([]ipld.Node, 0, blockChainLength-2)
+	middleLinks := make([]ipld.Link, 0, blockChainLength-2)
+	for i := 0; i < blockChainLength-2; i++ {
+		var node ipld.Node
+		err := fluent.Recover(func() {
+			nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+			node = createBlock(nb, []ipld.Link{parent}, size)
+		})
+		if err != nil {
+			t.Fatal("Error creating middle block")
+		}
+		middleNodes = append(middleNodes, node)
+		link, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, node, storer)
+		if err != nil {
+			t.Fatal("Error creating link to middle block")
+		}
+		middleLinks = append(middleLinks, link)
+		parent = link
+	}
+	var tipNode ipld.Node
+	err = fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		tipNode = createBlock(nb, []ipld.Link{parent}, size)
+	})
+	if err != nil {
+		t.Fatal("Error creating tip block")
+	}
+	tipLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, tipNode, storer)
+	if err != nil {
+		t.Fatal("Error creating link to tip block")
+	}
+	return &blockChain{genisisNode, genesisLink, middleNodes, middleLinks, tipNode, tipLink}
+}
+
+func blockChainSelector(blockChainLength int) ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	return ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(blockChainLength),
+		ssb.ExploreFields(func(efsb ipldbridge.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Parents", ssb.ExploreAll(
+				ssb.ExploreRecursiveEdge()))
+		})).Node()
+}
+
+func TestUnixFSFetchFromCARv2(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	const unixfsChunkSize uint64 = 1 << 10
+	const unixfsLinksPerLevel = 1024
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	// import the fixture file to UnixFS in a scratch blockstore
+	importStore := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	importDAGService := merkledag.NewDAGService(blockservice.New(importStore, offline.Exchange(importStore)))
+	origBytes, err := ioutil.ReadFile(filepath.Join("fixtures", "lorem.txt"))
+	if err != nil {
+		t.Fatal("unable to read fixture file")
+	}
+	bufferedDS := ipldformat.NewBufferedDAG(ctx, importDAGService)
+	params := ihelper.DagBuilderParams{
+		Maxlinks:   unixfsLinksPerLevel,
+		RawLeaves:  true,
+		CidBuilder: nil,
+		Dagserv:    bufferedDS,
+	}
+	db, err := params.New(chunker.NewSizeSplitter(bytes.NewReader(origBytes), int64(unixfsChunkSize)))
+	if err != nil {
+		t.Fatal("unable to setup dag builder")
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal("unable to create unix fs node")
+	}
+	err = bufferedDS.Commit()
+	if err != nil {
+		t.Fatal("unable to commit unix fs node")
+	}
+
+	// write every imported block to a CARv2
+	keys, err := importStore.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal("unable to list imported blocks")
+	}
+	var blks []blocks.Block
+	for key := range keys {
+		blk, err := importStore.Get(key)
+		if err != nil {
+			t.Fatal("unable to read imported block")
+		}
+		blks = append(blks, blk)
+	}
+	dir, err := ioutil.TempDir("", "graphsync")
+	if err != nil {
+		t.Fatal("unable to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	carPath := filepath.Join(dir, "lorem.car")
+	err = testutil.WriteCARv2(carPath, []cid.Cid{nd.Cid()}, blks)
+	if err != nil {
+		t.Fatal("unable to write CARv2")
+	}
+
+	// serve the CARv2 directly
+	carLoader, closer, err := storeutil.LoaderForCARv2(carPath)
+	if err != nil {
+		t.Fatal("unable to open CARv2")
+	}
+	defer closer.Close()
+
+	td := newGsTestData(ctx, t)
+	bs1 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	requestor := New(ctx, td.gsnet1, td.bridge, storeutil.LoaderForBlockstore(bs1), storeutil.StorerForBlockstore(bs1))
+	responder := New(ctx, td.gsnet2, td.bridge, carLoader, td.storer2)
+	// unlimited recursion must be validated
+	responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		hookActions.ValidateRequest()
+	})
+
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), cidlink.Link{Cid: nd.Cid()}, allSelector)
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	responseErrors := testutil.CollectErrors(ctx, t, errChan)
+	if len(responseErrors) != 0 {
+		t.Fatal("Response should be successful but wasn't")
+	}
+
+	// read the file back from the requestor's blockstore
+	dagService1 := merkledag.NewDAGService(blockservice.New(bs1, offline.Exchange(bs1)))
+	otherNode, err := dagService1.Get(ctx, nd.Cid())
+	if err != nil {
+		t.Fatal("should have been able to read received root node but didn't")
+	}
+	n, err := unixfile.NewUnixfsFile(ctx, dagService1, otherNode)
+	if err != nil {
+		t.Fatal("should have been able to setup UnixFS file but wasn't")
+	}
+	fn, ok := n.(files.File)
+	if !ok {
+		t.Fatal("file should be a regular file, but wasn't")
+	}
+	finalBytes, err := ioutil.ReadAll(fn)
+	if err != nil {
+		t.Fatal("should have been able to read all of unix FS file but wasn't")
+	}
+	if !reflect.DeepEqual(origBytes, finalBytes) {
+		t.Fatal("should have gotten same bytes written as read but didn't")
+	}
+}
+
+func TestFetchFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	const unixfsChunkSize uint64 = 1 << 10
+	const unixfsLinksPerLevel = 1024
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	// import the fixture file to UnixFS on the responder
+	bs2 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dagService2 := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
+	origBytes, err := ioutil.ReadFile(filepath.Join("fixtures", "lorem.txt"))
+	if err != nil {
+		t.Fatal("unable to read fixture file")
+	}
+	bufferedDS := ipldformat.NewBufferedDAG(ctx, dagService2)
+	params := ihelper.DagBuilderParams{
+		Maxlinks:   unixfsLinksPerLevel,
+		RawLeaves:  true,
+		CidBuilder: nil,
+		Dagserv:    bufferedDS,
+	}
+	db, err := params.New(chunker.NewSizeSplitter(bytes.NewReader(origBytes), int64(unixfsChunkSize)))
+	if err != nil {
+		t.Fatal("unable to setup dag builder")
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal("unable to create unix fs node")
+	}
+	err = bufferedDS.Commit()
+	if err != nil {
+		t.Fatal("unable to commit unix fs node")
+	}
+
+	td := newGsTestData(ctx, t)
+	bs1 := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	requestor := New(ctx, td.gsnet1, td.bridge, storeutil.LoaderForBlockstore(bs1), storeutil.StorerForBlockstore(bs1))
+	New(ctx, td.gsnet2, td.bridge, storeutil.LoaderForBlockstore(bs2), storeutil.StorerForBlockstore(bs2))
+
+	file, err := requestor.FetchFile(ctx, td.host2.ID(), cidlink.Link{Cid: nd.Cid()})
+	if err != nil {
+		t.Fatal("should have fetched file")
+	}
+	defer file.Close()
+	finalBytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal("should have been able to read all of file")
+	}
+	if !reflect.DeepEqual(origBytes, finalBytes) {
+		t.Fatal("should have gotten same bytes written as read but didn't")
+	}
+
+	_, err = requestor.FetchFile(ctx, td.host2.ID(), cidlink.Link{Cid: testutil.GenerateCids(1)[0]})
+	if err == nil {
+		t.Fatal("should error fetching missing file")
+	}
+}
+
+func TestByteRange(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	_ = td.GraphSyncHost2()
+
+	// a large raw leaf on the responder
+	blk := blocks.NewBlock(testutil.RandomBytes(1000))
+	leaf := cidlink.Link{Cid: blk.Cid()}
+	td.blockStore2[leaf] = blk.RawData()
+
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	spec := ssb.Matcher().Node()
+
+	requestRange := func(r byterange.Request) ([]graphsync.ResponseProgress, []error) {
+		extension, err := byterange.NewExtension(r, td.bridge)
+		if err != nil {
+			t.Fatal("unable to encode byte range")
+		}
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), leaf, spec, extension)
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		return responses, errs
+	}
+
+	responses, errs := requestRange(byterange.Request{Offset: 100, Length: 100})
+	if len(errs) != 0 {
+		t.Fatal("should not have errored requesting byte range")
+	}
+	if len(responses) != 1 {
+		t.Fatal("should have received one response for byte range")
+	}
+	data, err := responses[0].Node.AsBytes()
+	if err != nil || !bytes.Equal(data, blk.RawData()[100:200]) {
+		t.Fatal("should have received bytes 100 to 200 of block")
+	}
+	if responses[0].LastBlock.Link != leaf {
+		t.Fatal("should have attributed byte range to leaf")
+	}
+	if _, ok := td.blockStore1[leaf]; ok {
+		t.Fatal("should not have stored partial block")
+	}
+
+	responses, errs = requestRange(byterange.Request{})
+	if len(errs) != 0 || len(responses) != 1 {
+		t.Fatal("should have received whole block")
+	}
+	data, err = responses[0].Node.AsBytes()
+	if err != nil || !bytes.Equal(data, blk.RawData()) {
+		t.Fatal("should have received whole block")
+	}
+
+	responses, errs = requestRange(byterange.Request{Offset: 1001})
+	if len(errs) != 1 || len(responses) != 0 {
+		t.Fatal("should have errored requesting range past end of block")
+	}
+
+	delete(td.blockStore2, leaf)
+	responses, errs = requestRange(byterange.Request{Offset: 100, Length: 100})
+	if len(errs) != 1 || len(responses) != 0 {
+		t.Fatal("should have errored requesting range of missing block")
+	}
+
+	// a range applies only to the root block, so a selector reaching past it
+	// is refused by both sides
+	td.blockStore2[leaf] = blk.RawData()
+	extension, err := byterange.NewExtension(byterange.Request{Offset: 100, Length: 100}, td.bridge)
+	if err != nil {
+		t.Fatal("unable to encode byte range")
+	}
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), leaf, allSelector, extension)
+	responses = testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	if len(responses) != 0 || len(errs) != 1 || errs[0] != byterange.ErrNotRoot {
+		t.Fatal("should have refused to request a range past the root block")
+	}
+
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet1.SetDelegate(r)
+	selectorData, err := td.bridge.EncodeNode(allSelector)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	message := gsmsg.New()
+	message.AddRequest(gsmsg.NewRequest(requestID, blk.Cid(), selectorData, graphsync.Priority(math.MaxInt32), extension))
+	td.gsnet1.SendMessage(ctx, td.host2.ID(), message)
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not receive response")
+	case received := <-r.messageReceived:
+		receivedResponses := received.message.Responses()
+		if len(receivedResponses) != 1 || receivedResponses[0].Status() != graphsync.RequestFailedUnknown {
+			t.Fatal("should have failed a request for a range past the root block")
+		}
+		if _, ok := receivedResponses[0].Extension(graphsync.ExtensionByteRange); ok {
+			t.Fatal("should not have sent a byte range past the root block")
+		}
+	}
+}
+
+func TestCancelReason(t *testing.T) {
+	// cancellableRequest starts a request, returning a function that cancels it
+	// with a reason
+	type cancellableRequest func(ctx context.Context, requestor graphsync.GraphExchange, p peer.ID, root ipld.Link, selector ipld.Node) (progressChan <-chan graphsync.ResponseProgress, errChan <-chan error, cancelRequest func(graphsync.CancelReason))
+
+	testCancel := func(t *testing.T, request cancellableRequest) []error {
+		ctx := context.Background()
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		td := newGsTestData(ctx, t)
+
+		// hold the response in progress until the request is cancelled
+		release := make(chan struct{})
+		blockingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return td.loader2(lnk, lnkCtx)
+		}
+		defer close(release)
+		requestor := td.GraphSyncHost1()
+		responder := New(ctx, td.gsnet2, td.bridge, blockingLoader, td.storer2)
+
+		started := make(chan struct{}, 1)
+		err := responder.RegisterRequestStartedHook(func(p peer.ID, request graphsync.RequestData) {
+			started <- struct{}{}
+		})
+		if err != nil {
+			t.Fatal("unable to register started hook")
+		}
+		type cancelledRequest struct {
+			p      peer.ID
+			reason graphsync.CancelReason
+		}
+		cancelled := make(chan cancelledRequest, 1)
+		err = responder.RegisterRequestCancelledHook(func(p peer.ID, request graphsync.RequestData, reason graphsync.CancelReason) {
+			cancelled <- cancelledRequest{p, reason}
+		})
+		if err != nil {
+			t.Fatal("unable to register cancelled hook")
+		}
+
+		blockChainLength := 20
+		blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+		spec := blockChainSelector(blockChainLength)
+
+		progressChan, errChan, cancelRequest := request(ctx, requestor, td.host2.ID(), blockChain.tipLink, spec)
+		select {
+		case <-ctx.Done():
+			t.Fatal("responder should have started request")
+		case <-started:
+		}
+		reason := graphsync.CancelReason{Code: graphsync.CancelReasonFoundElsewhere, Message: "fetched from another peer"}
+		cancelRequest(reason)
+		testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("responder should have run cancelled hook")
+		case received := <-cancelled:
+			if received.p != td.host1.ID() {
+				t.Fatal("cancelled hook received wrong peer")
+			}
+			if received.reason != reason {
+				t.Fatal("cancel reason did not round trip to responder")
+			}
+		}
+		return errs
+	}
+
+	t.Run("cancel with context", func(t *testing.T) {
+		testCancel(t, func(ctx context.Context, requestor graphsync.GraphExchange, p peer.ID, root ipld.Link, selector ipld.Node) (<-chan graphsync.ResponseProgress, <-chan error, func(graphsync.CancelReason)) {
+			requestCtx, cancelRequest := graphsync.WithCancelReason(ctx)
+			progressChan, errChan := requestor.Request(requestCtx, p, root, selector)
+			return progressChan, errChan, cancelRequest
+		})
+	})
+
+	t.Run("cancel by request ID", func(t *testing.T) {
+		requestID := graphsync.RequestID(rand.Int31())
+		errs := testCancel(t, func(ctx context.Context, gs graphsync.GraphExchange, p peer.ID, root ipld.Link, selector ipld.Node) (<-chan graphsync.ResponseProgress, <-chan error, func(graphsync.CancelReason)) {
+			progressChan, errChan := gs.Request(ctx, p, root, selector, graphsync.WithRequestID(requestID))
+			return progressChan, errChan, func(reason graphsync.CancelReason) {
+				if err := gs.Cancel(requestID, reason); err != nil {
+					t.Fatal("unable to cancel request")
+				}
+				if gs.Cancel(requestID, reason) != graphsync.ErrRequestNotFound {
+					t.Fatal("should not cancel a request that is no longer in progress")
+				}
+			}
+		})
+		if len(errs) != 1 || errs[0] != graphsync.ErrRequestCancelled {
+			t.Fatal("should have reported request was cancelled")
+		}
+	})
+}
+
+func TestCancelOnStoreFailure(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// the requestor's store fills up after a few blocks
+	storedBlocks := 3
+	var stored int32
+	fullStorer := func(lnkCtx ipldbridge.LinkContext) (io.Writer, ipldbridge.StoreCommitter, error) {
+		if atomic.AddInt32(&stored, 1) > int32(storedBlocks) {
+			return nil, nil, errors.New("disk full")
+		}
+		return td.storer1(lnkCtx)
+	}
+	requestor := New(ctx, td.gsnet1, td.bridge, td.loader1, fullStorer)
+
+	// the responder holds the response in progress after sending a few more
+	// blocks, until it is cancelled
+	var loaded int32
+	release := make(chan struct{})
+	defer close(release)
+	heldLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		if atomic.AddInt32(&loaded, 1) > int32(storedBlocks+2) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+		}
+		return td.loader2(lnk, lnkCtx)
+	}
+	responder := New(ctx, td.gsnet2, td.bridge, heldLoader, td.storer2)
+	cancelled := make(chan graphsync.CancelReason, 1)
+	err := responder.RegisterRequestCancelledHook(func(p peer.ID, request graphsync.RequestData, reason graphsync.CancelReason) {
+		cancelled <- reason
+	})
+	if err != nil {
+		t.Fatal("unable to register cancelled hook")
+	}
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have received a cancel")
+	case reason := <-cancelled:
+		if reason.Code != graphsync.CancelReasonStoreFailed {
+			t.Fatal("cancel should say the requestor could not store blocks")
+		}
+	}
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) == 0 {
+		t.Fatal("request should have failed")
+	}
+	if _, ok := errs[0].(graphsync.StoreError); !ok {
+		t.Fatal("request should have failed with a store error")
+	}
+	if len(td.blockStore1) != storedBlocks {
+		t.Fatal("should have stored the blocks the store had room for")
+	}
+}
+
+func TestResponseCompletedStats(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2()
+	type completedResponse struct {
+		p     peer.ID
+		root  cid.Cid
+		stats graphsync.TraversalStats
+	}
+	completed := make(chan completedResponse, 1)
+	err := responder.RegisterResponseCompletedHook(func(p peer.ID, request graphsync.RequestData, stats graphsync.TraversalStats) {
+		completed <- completedResponse{p, request.Root(), stats}
+	})
+	if err != nil {
+		t.Fatal("unable to register completed hook")
+	}
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
+	testutil.CollectResponses(ctx, t, progressChan)
+	testutil.CollectErrors(ctx, t, errChan)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have run completed hook")
+	case received := <-completed:
+		if received.p != td.host1.ID() || received.root != blockChain.tipLink.(cidlink.Link).Cid {
+			t.Fatal("completed hook received wrong request")
+		}
+		// each block is visited along with its list of parents, which is one
+		// path segment below it, and the next block is two below
+		expected := graphsync.TraversalStats{
+			NodesVisited: blockChainLength * 2,
+			BlocksSent:   blockChainLength,
+			MaxDepth:     blockChainLength*2 - 1,
+		}
+		if received.stats.Duration <= 0 {
+			t.Fatal("should have timed the response")
+		}
+		received.stats.Duration = 0
+		if received.stats != expected {
+			t.Fatalf("expected stats %+v, got %+v", expected, received.stats)
+		}
+	}
+}
+
+func TestResumeFromCursor(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	metrics := &fakeRequestMetrics{}
+	requestor := td.GraphSyncHost1(WithRequestMetrics(metrics))
+
+	// a responder too slow to finish within its max response duration, which
+	// keeps blocks it loaded in cache, so walking back to a cursor is quick
+	sl := &slowLoader{loader: td.loader2, delay: 5 * time.Millisecond}
+	New(ctx, td.gsnet2, td.bridge, sl.load, td.storer2,
+		MaxResponseDuration(100*time.Millisecond), SharedBlockCache(1<<20, time.Minute))
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	var extensions []graphsync.ExtensionData
+	attempts := 0
+	for {
+		attempts++
+		if attempts > 10 {
+			t.Fatal("did not finish resuming response")
+		}
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, extensions...)
+		testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		if len(errs) == 0 {
+			break
+		}
+		interrupted, ok := errs[0].(graphsync.InterruptedError)
+		if !ok {
+			t.Fatalf("expected an interrupted response, got %s", errs[0])
+		}
+		extensions = []graphsync.ExtensionData{graphsync.ResumeFrom(interrupted.Cursor)}
+	}
+	if attempts == 1 {
+		t.Fatal("response should have been interrupted")
+	}
+
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+	metrics.lk.Lock()
+	defer metrics.lk.Unlock()
+	if len(metrics.blocks) != blockChainLength {
+		t.Fatalf("expected %d blocks received once each, got %d", blockChainLength, len(metrics.blocks))
+	}
+}
+
+func TestResponseCompletedStatsPreferredOrder(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2()
+	completed := make(chan graphsync.TraversalStats, 1)
+	err := responder.RegisterResponseCompletedHook(func(p peer.ID, request graphsync.RequestData, stats graphsync.TraversalStats) {
+		completed <- stats
+	})
+	if err != nil {
+		t.Fatal("unable to register completed hook")
+	}
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	hintData, err := cidset.EncodeCidList([]cid.Cid{blockChain.middleLinks[3].(cidlink.Link).Cid}, td.bridge)
+	if err != nil {
+		t.Fatal("could not encode hints")
+	}
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength),
+		graphsync.ExtensionData{Name: graphsync.ExtensionPreferredOrder, Data: hintData})
+	testutil.CollectResponses(ctx, t, progressChan)
+	testutil.CollectErrors(ctx, t, errChan)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have run completed hook")
+	case stats := <-completed:
+		if stats.BlocksSent != blockChainLength {
+			t.Fatalf("expected %d blocks sent, got %d", blockChainLength, stats.BlocksSent)
+		}
+	}
+}
+
+func TestResumeAfterCancel(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	sl := &slowLoader{loader: td.loader2, delay: 5 * time.Millisecond}
+	responder := New(ctx, td.gsnet2, td.bridge, sl.load, td.storer2, SharedBlockCache(1<<20, time.Minute))
+	cancelled := make(chan struct{}, 1)
+	err := responder.RegisterRequestCancelledHook(func(p peer.ID, request graphsync.RequestData, reason graphsync.CancelReason) {
+		cancelled <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal("unable to register cancelled hook")
+	}
+	completed := make(chan graphsync.TraversalStats, 1)
+	err = responder.RegisterResponseCompletedHook(func(p peer.ID, request graphsync.RequestData, stats graphsync.TraversalStats) {
+		completed <- stats
+	})
+	if err != nil {
+		t.Fatal("unable to register completed hook")
+	}
+
+	blockChainLength := 50
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+	root := blockChain.tipLink.(cidlink.Link).Cid
+
+	// cancel partway, keeping every response received, even after cancelling
+	requestCtx, cancelRequest := context.WithCancel(ctx)
+	progressChan, errChan := requestor.Request(requestCtx, td.host2.ID(), blockChain.tipLink, spec)
+	var responses []graphsync.ResponseProgress
+	for response := range progressChan {
+		responses = append(responses, response)
+		if len(responses) == 20 {
+			cancelRequest()
+		}
+	}
+	cancelRequest()
+	for range errChan {
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have cancelled response")
+	case <-cancelled:
+	}
+
+	cursorData, err := cursor.FromResponses(root, spec, responses, td.bridge)
+	if err != nil {
+		t.Fatal("unable to make cursor")
+	}
+	c, err := cursor.DecodeCursor(cursorData, td.bridge)
+	if err != nil {
+		t.Fatal("unable to decode cursor")
+	}
+	if c.Blocks <= 0 || c.Blocks >= blockChainLength {
+		t.Fatalf("cursor should be partway through, but is at block %d", c.Blocks)
+	}
+
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.ResumeFrom(cursorData))
+	resumedResponses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(resumedResponses) != blockChainLength*2 {
+		t.Fatal("resumed request did not traverse all nodes")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have finished resumed response")
+	case stats := <-completed:
+		if stats.BlocksSent != blockChainLength-c.Blocks {
+			t.Fatalf("expected only the %d blocks after the cursor to be sent, got %d", blockChainLength-c.Blocks, stats.BlocksSent)
+		}
+	}
+}
+
+func TestVerifyConnectivity(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.VerifyConnectivity())
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if len(errs) != 0 {
+		t.Fatal("should not have errored verifying a connected DAG")
+	}
+
+	// a faulty responder that omits a block the selector requires, sends a
+	// block the selector never reaches, and still reports success
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet2.SetDelegate(r)
+	otherChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	omitted := otherChain.middleLinks[3]
+	orphan := blocks.NewBlock(testutil.RandomBytes(100))
+	go func() {
+		var message receivedMessage
+		select {
+		case <-ctx.Done():
+			return
+		case message = <-r.messageReceived:
+		}
+		request := message.message.Requests()[0]
+		links := append([]ipld.Link{otherChain.tipLink}, otherChain.middleLinks...)
+		var md metadata.Metadata
+		response := gsmsg.New()
+		for i := len(links) - 1; i >= 0; i-- {
+			if links[i] == omitted {
+				continue
+			}
+			c := links[i].(cidlink.Link).Cid
+			blk, _ := blocks.NewBlockWithCid(td.blockStore2[links[i]], c)
+			response.AddBlock(blk)
+			md = append(md, metadata.Item{Link: links[i], BlockPresent: true})
+		}
+		response.AddBlock(orphan)
+		md = append(md, metadata.Item{Link: cidlink.Link{Cid: orphan.Cid()}, BlockPresent: true})
+		mdData, _ := metadata.EncodeMetadata(md, td.bridge)
+		response.AddResponse(gsmsg.NewResponse(request.ID(), graphsync.RequestCompletedFull,
+			graphsync.ExtensionData{Name: graphsync.ExtensionMetadata, Data: mdData}))
+		_ = td.gsnet2.SendMessage(ctx, td.host1.ID(), response)
+	}()
+
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), otherChain.tipLink, spec, graphsync.VerifyConnectivity())
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	var connectivityErr graphsync.ConnectivityError
+	for _, err := range errs {
+		if asConnectivityErr, ok := err.(graphsync.ConnectivityError); ok {
+			connectivityErr = asConnectivityErr
+		}
+	}
+	if len(connectivityErr.Missing) != 1 || connectivityErr.Missing[0] != omitted {
+		t.Fatal("should have reported block omitted by responder as missing")
+	}
+	// blocks below the omitted one are cut off from the root too
+	expectedOrphans := map[ipld.Link]bool{cidlink.Link{Cid: orphan.Cid()}: true}
+	for _, link := range otherChain.middleLinks[:3] {
+		expectedOrphans[link] = true
+	}
+	if len(connectivityErr.Orphans) != len(expectedOrphans) {
+		t.Fatal("should have reported blocks the selector does not reach as orphans")
+	}
+	for _, link := range connectivityErr.Orphans {
+		if !expectedOrphans[link] {
+			t.Fatal("reported block the selector reaches as orphan")
+		}
+	}
+}
+
+// customLink is a link type of its own that can name its block by CID
+type customLink struct {
+	ipld.Link
+	c cid.Cid
+}
+
+func (cl customLink) Cid() cid.Cid { return cl.c }
+
+func TestCustomLinkTypes(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	td.GraphSyncHost2()
+
+	spec := blockChainSelector(blockChainLength)
+
+	tipCid := blockChain.tipLink.(cidlink.Link).Cid
+	root := customLink{Link: blockChain.tipLink, c: tipCid}
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), root, spec)
+
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+
+	// links that do not resolve to a CID fail the request instead of panicking
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), testbridge.NewMockLink(), spec)
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 1 || errs[0] != ipldbridge.ErrUnsupportedLinkType {
+		t.Fatal("should have failed with an unsupported link type")
+	}
+}
+
+func TestIdentityAndEmptyBlocks(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	td.GraphSyncHost2()
+
+	// the responder stores an empty block, but not the identity block, whose
+	// data is in its CID
+	emptyHash, err := mh.Sum(nil, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal("error hashing empty block")
+	}
+	emptyLink := cidlink.Link{Cid: cid.NewCidV1(cid.Raw, emptyHash)}
+	td.blockStore2[emptyLink] = []byte{}
+	identityHash, err := mh.Sum([]byte("inline"), mh.ID, -1)
+	if err != nil {
+		t.Fatal("error making identity CID")
+	}
+	identityLink := cidlink.Link{Cid: cid.NewCidV1(cid.Raw, identityHash)}
+
+	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
+	nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+	var root ipld.Node
+	err = fluent.Recover(func() {
+		root = createBlock(nb, []ipld.Link{emptyLink, identityLink}, 100)
+	})
+	if err != nil {
+		t.Fatal("error creating root")
+	}
+	rootLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, root, td.storer2)
+	if err != nil {
+		t.Fatal("error creating link to root")
+	}
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), rootLink, blockChainSelector(2))
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	loaded := make(map[ipld.Link]struct{})
+	for _, response := range responses {
+		loaded[response.LastBlock.Link] = struct{}{}
+	}
+	if _, ok := loaded[emptyLink]; !ok {
+		t.Fatal("did not traverse the empty block")
+	}
+	if _, ok := loaded[identityLink]; !ok {
+		t.Fatal("did not traverse the identity block")
+	}
+	if data, ok := td.blockStore1[emptyLink]; !ok || len(data) != 0 {
+		t.Fatal("did not store the empty block")
+	}
+}
+
+func TestRequestScratch(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+
+	// blocks large enough that each request is answered over several messages
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 20000, blockChainLength)
+
+	responder := td.GraphSyncHost2()
+
+	type seedKey struct{}
+
+	// the queued hook stores a value that the received hook, which runs later
+	// for the same request, reads back
+	err := responder.RegisterRequestQueuedHook(func(p peer.ID, requestData graphsync.RequestData) {
+		requestData.RequestScratch().Set(seedKey{}, requestData.ID())
+	})
+	if err != nil {
+		t.Fatal("Error setting up hook")
+	}
+	var seedsLk sync.Mutex
+	var seeds []interface{}
+	err = responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		seed, _ := hookActions.RequestScratch().Get(seedKey{})
+		seedsLk.Lock()
+		seeds = append(seeds, seed)
+		seedsLk.Unlock()
+		if scratch := requestData.RequestScratch(); scratch != hookActions.RequestScratch() {
+			hookActions.TerminateWithError(errors.New("hooks given different scratches"))
+		}
+	})
+	if err != nil {
+		t.Fatal("Error setting up hook")
+	}
+
+	// the response hook keeps a count across every response to a request
+	type countKey struct{}
+	var countsLk sync.Mutex
+	counts := make(map[graphsync.RequestID]int)
+	err = requestor.RegisterResponseReceivedHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		scratch := responseData.RequestScratch()
+		count, _ := scratch.Get(countKey{})
+		next := 1
+		if count != nil {
+			next = count.(int) + 1
+		}
+		scratch.Set(countKey{}, next)
+		countsLk.Lock()
+		counts[responseData.RequestID()] = next
+		countsLk.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error setting up hook")
+	}
+
+	spec := blockChainSelector(blockChainLength)
+	for i := 0; i < 2; i++ {
+		// blocks stored by the first request would let the second complete
+		// locally, before any response to it
+		for link := range td.blockStore1 {
+			delete(td.blockStore1, link)
+		}
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+		testutil.CollectResponses(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		if len(errs) != 0 {
+			t.Fatal("errors during traverse")
+		}
+	}
+
+	seedsLk.Lock()
+	defer seedsLk.Unlock()
+	if len(seeds) != 2 || seeds[0] == nil || seeds[1] == nil || seeds[0] == seeds[1] {
+		t.Fatal("received hooks did not read the values queued hooks stored for their requests")
+	}
+	countsLk.Lock()
+	defer countsLk.Unlock()
+	if len(counts) != 2 {
+		t.Fatal("response hooks did not run for each request")
+	}
+	for _, count := range counts {
+		if count < 2 {
+			t.Fatal("response hooks did not share a scratch across responses")
+		}
+	}
+}
+
+func TestPushSubtrees(t *testing.T) {
+	testCases := map[string]struct {
+		acceptPush   bool
+		hookAccepts  bool
+		expectPushed bool
+	}{
+		"accepted": {
+			acceptPush:   true,
+			hookAccepts:  true,
+			expectPushed: true,
+		},
+		"declined by hook": {
+			acceptPush:  true,
+			hookAccepts: false,
+		},
+		"not opted in": {
+			acceptPush:  false,
+			hookAccepts: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
+
+			requestor := td.GraphSyncHost1()
+
+			blockChainLength := 100
+			blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+			relatedLength := 10
+			related := setupBlockChain(ctx, t, td.storer2, td.bridge, 50, relatedLength)
+
+			responder := td.GraphSyncHost2()
+			err := responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+				hookActions.PushSubtrees(related.tipLink.(cidlink.Link).Cid)
+			})
+			if err != nil {
+				t.Fatal("Error setting up hook")
+			}
+			var offered []cid.Cid
+			err = requestor.RegisterPushReceivedHook(func(p peer.ID, responseData graphsync.ResponseData, roots []cid.Cid) bool {
+				offered = roots
+				return tc.hookAccepts
+			})
+			if err != nil {
+				t.Fatal("Error setting up hook")
+			}
+
+			var extensions []graphsync.ExtensionData
+			if tc.acceptPush {
+				extensions = append(extensions, graphsync.AcceptPush())
+			}
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength), extensions...)
+			responses := testutil.CollectResponses(ctx, t, progressChan)
+			errs := testutil.CollectErrors(ctx, t, errChan)
+			if len(errs) != 0 {
+				t.Fatal("errors during traverse")
+			}
+			if len(responses) != blockChainLength*2 {
+				t.Fatal("pushed subtrees should not be reported as responses")
+			}
+
+			if tc.acceptPush && (len(offered) != 1 || offered[0] != related.tipLink.(cidlink.Link).Cid) {
+				t.Fatal("push hook was not offered the pushed subtree")
+			}
+			expectedBlocks := blockChainLength
+			if tc.expectPushed {
+				expectedBlocks += relatedLength
+			}
+			if len(td.blockStore1) != expectedBlocks {
+				t.Fatalf("expected %d blocks stored, got %d", expectedBlocks, len(td.blockStore1))
+			}
+			_, hasRelated := td.blockStore1[related.tipLink]
+			if hasRelated != tc.expectPushed {
+				t.Fatal("pushed subtree stored when it should not have been, or not stored when it should")
+			}
+		})
+	}
+}
+
+// roundTripBenchmark sets up a requestor and a responder over mocknet, with
+// the responder holding requestCount block chains, and times fetching all of
+// them at once
+type roundTripBenchmark struct {
+	linkOptions      mocknet.LinkOptions
+	requestCount     int
+	blockSize        int64
+	chainLength      int
+	responderOptions []Option
+}
+
+func (rtb roundTripBenchmark) run(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := newGsTestData(ctx, b)
+	// links already exist, so link defaults would not apply to them
+	for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), td.host2.ID()) {
+		link.SetOptions(rtb.linkOptions)
+	}
+	requestor := td.GraphSyncHost1()
+	chains := make([]*blockChain, 0, rtb.requestCount)
+	for i := 0; i < rtb.requestCount; i++ {
+		chains = append(chains, setupBlockChain(ctx, b, td.storer2, td.bridge, rtb.blockSize, rtb.chainLength))
+	}
+	td.GraphSyncHost2(rtb.responderOptions...)
+	spec := blockChainSelector(rtb.chainLength)
+
+	b.SetBytes(rtb.blockSize * int64(rtb.chainLength*rtb.requestCount))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		failed := make(chan error, rtb.requestCount)
+		for _, chain := range chains {
+			wg.Add(1)
+			go func(chain *blockChain) {
+				defer wg.Done()
+				progressChan, errChan := requestor.Request(ctx, td.host2.ID(), chain.tipLink, spec)
+				for range progressChan {
+				}
+				for err := range errChan {
+					failed <- err
+				}
+			}(chain)
+		}
+		wg.Wait()
+		select {
+		case err := <-failed:
+			b.Fatalf("request failed: %s", err)
+		default:
+		}
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	networks := []struct {
+		name        string
+		linkOptions mocknet.LinkOptions
+	}{
+		{"unlimited", mocknet.LinkOptions{}},
+		{"10ms 100MB/s", mocknet.LinkOptions{Latency: 10 * time.Millisecond, Bandwidth: 100 << 20}},
+		{"50ms 10MB/s", mocknet.LinkOptions{Latency: 50 * time.Millisecond, Bandwidth: 10 << 20}},
+	}
+	for _, network := range networks {
+		for _, blockSize := range []int64{1 << 10, 64 << 10, 256 << 10} {
+			for _, chainLength := range []int{10, 100} {
+				name := fmt.Sprintf("%s/%dKiB blocks/%d long", network.name, blockSize>>10, chainLength)
+				b.Run(name, roundTripBenchmark{
+					linkOptions:  network.linkOptions,
+					requestCount: 1,
+					blockSize:    blockSize,
+					chainLength:  chainLength,
+				}.run)
+			}
+		}
+	}
+}
+
+func BenchmarkRoundTripTunables(b *testing.B) {
+	linkOptions := mocknet.LinkOptions{Latency: 10 * time.Millisecond, Bandwidth: 100 << 20}
+	for _, n := range []uint64{64 << 10, 512 << 10, 2 << 20} {
+		b.Run(fmt.Sprintf("message size/%dKiB", n>>10), roundTripBenchmark{
+			linkOptions:      linkOptions,
+			requestCount:     1,
+			blockSize:        64 << 10,
+			chainLength:      100,
+			responderOptions: []Option{MaxMessageBlockBytes(n)},
+		}.run)
+	}
+	for _, d := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond} {
+		b.Run(fmt.Sprintf("batch window/%s", d), roundTripBenchmark{
+			linkOptions:      linkOptions,
+			requestCount:     16,
+			blockSize:        1 << 10,
+			chainLength:      10,
+			responderOptions: []Option{ResponseBatchWindow(d)},
+		}.run)
+	}
+	for _, n := range []int{1, 6, 16} {
+		b.Run(fmt.Sprintf("concurrent responses/%d", n), roundTripBenchmark{
+			linkOptions:      linkOptions,
+			requestCount:     16,
+			blockSize:        16 << 10,
+			chainLength:      10,
+			responderOptions: []Option{MaxConcurrentResponses(n)},
+		}.run)
+	}
+}
+
+func TestPeerExtensions(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	graphSync1 := td.GraphSyncHost1()
+	graphSync2 := td.GraphSyncHost2(RejectReplayedRequests(time.Minute))
+	err := graphSync2.AdvertiseExtension(td.extensionName)
+	if err != nil {
+		t.Fatal("unable to advertise extension")
+	}
+	err = graphSync2.AdvertiseExtension(td.extensionName)
+	if err != graphsync.ErrExtensionAlreadyRegistered {
+		t.Fatal("should not advertise an extension twice")
+	}
+
+	supports := func(names []graphsync.ExtensionName, name graphsync.ExtensionName) bool {
+		for _, supported := range names {
+			if supported == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	names, err := graphSync1.PeerExtensions(ctx, td.host2.ID())
+	if err != nil {
+		t.Fatal("unable to query peer extensions")
+	}
+	if !supports(names, td.extensionName) || !supports(names, graphsync.ExtensionNonce) || !supports(names, graphsync.ExtensionByteRange) {
+		t.Fatal("peer did not advertise its extensions")
+	}
+
+	names, err = graphSync2.PeerExtensions(ctx, td.host1.ID())
+	if err != nil {
+		t.Fatal("unable to query peer extensions")
+	}
+	if supports(names, td.extensionName) || supports(names, graphsync.ExtensionNonce) || !supports(names, graphsync.ExtensionByteRange) {
+		t.Fatal("peer advertised wrong extensions")
+	}
+
+	// a peer that predates the extension fails the query like any other
+	// request it cannot handle
+	r := &receiver{
+		messageReceived: make(chan receivedMessage),
+	}
+	td.gsnet2.SetDelegate(r)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case received := <-r.messageReceived:
+			response := gsmsg.New()
+			for _, request := range received.message.Requests() {
+				response.AddResponse(gsmsg.NewResponse(request.ID(), graphsync.RequestFailedUnknown))
+			}
+			td.gsnet2.SendMessage(ctx, td.host1.ID(), response)
+		}
+	}()
+	_, err = graphSync1.PeerExtensions(ctx, td.host2.ID())
+	if err != graphsync.ErrExtensionsNotAdvertised {
+		t.Fatal("should have returned ErrExtensionsNotAdvertised for a peer that does not advertise")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// hold responses in progress until released
+	release := make(chan struct{})
+	blockingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return td.loader2(lnk, lnkCtx)
+	}
+	requestor := td.GraphSyncHost1()
+	responder := New(ctx, td.gsnet2, td.bridge, blockingLoader, td.storer2)
+
+	queued := make(chan graphsync.RequestID, 10)
+	err := responder.RegisterRequestQueuedHook(func(p peer.ID, request graphsync.RequestData) {
+		queued <- request.ID()
+	})
+	if err != nil {
+		t.Fatal("unable to register queued hook")
+	}
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+	requestID := graphsync.RequestID(42)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.WithRequestID(requestID))
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have queued request")
+	case queuedID := <-queued:
+		if queuedID != requestID {
+			t.Fatal("request should have been sent with the supplied ID")
+		}
+	}
+
+	// the ID is taken while the request is in progress
+	_, inUseErrChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.WithRequestID(requestID))
+	errs := testutil.CollectErrors(ctx, t, inUseErrChan)
+	if len(errs) != 1 || errs[0] != graphsync.ErrRequestIDInUse {
+		t.Fatal("should not reuse the ID of a request in progress")
+	}
+
+	// a repeat of a request still in flight, as from a requestor that
+	// restarted, carries on with the existing response
+	selectorData, err := td.bridge.EncodeNode(spec)
+	if err != nil {
+		t.Fatal("could not encode selector spec")
+	}
+	repeat := gsmsg.New()
+	repeat.AddRequest(gsmsg.NewRequest(requestID, blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32)))
+	td.gsnet1.SendMessage(ctx, td.host2.ID(), repeat)
+	// requests are processed in order, so once a later one is queued the
+	// repeat has been handled
+	later := gsmsg.New()
+	later.AddRequest(gsmsg.NewRequest(requestID+1, blockChain.tipLink.(cidlink.Link).Cid, selectorData, graphsync.Priority(math.MaxInt32)))
+	td.gsnet1.SendMessage(ctx, td.host2.ID(), later)
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have queued later request")
+	case queuedID := <-queued:
+		if queuedID != requestID+1 {
+			t.Fatal("responder should not have started a duplicate response")
+		}
+	}
+
+	close(release)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+
+	// once finished, the ID can be reissued
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.WithRequestID(requestID))
+	responses = testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("responder should have queued reissued request")
+	case queuedID := <-queued:
+		if queuedID != requestID {
+			t.Fatal("reissued request should have been sent with the supplied ID")
+		}
+	}
+}
+
+func TestFillsMissingSubtreeLocally(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	// the requestor has the subtree below a middle block, which the responder
+	// is missing
+	missing := 50
+	td.blockStore1[blockChain.genisisLink] = td.blockStore2[blockChain.genisisLink]
+	for _, link := range blockChain.middleLinks[:missing+1] {
+		td.blockStore1[link] = td.blockStore2[link]
+	}
+	delete(td.blockStore2, blockChain.middleLinks[missing])
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	paths := make(map[string]struct{})
+	for _, response := range responses {
+		paths[response.Path.String()] = struct{}{}
+	}
+	if len(paths) != len(responses) {
+		t.Fatal("repeated responses")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+}
+
+func TestFillLocallyStopsOnCancel(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	missing := 50
+	below := make(map[ipld.Link]struct{})
+	below[blockChain.genisisLink] = struct{}{}
+	td.blockStore1[blockChain.genisisLink] = td.blockStore2[blockChain.genisisLink]
+	for i, link := range blockChain.middleLinks[:missing+1] {
+		td.blockStore1[link] = td.blockStore2[link]
+		if i < missing {
+			below[link] = struct{}{}
+		}
+	}
+	delete(td.blockStore2, blockChain.middleLinks[missing])
+
+	// the request is cancelled as soon as it starts filling in the subtree
+	// the responder is missing
+	requestCtx, cancelRequest := context.WithCancel(ctx)
+	defer cancelRequest()
+	var lk sync.Mutex
+	belowLoads := 0
+	loader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		if _, ok := below[lnk]; ok {
+			lk.Lock()
+			belowLoads++
+			lk.Unlock()
+			cancelRequest()
+		}
+		return td.loader1(lnk, lnkCtx)
+	}
+	requestor := New(ctx, td.gsnet1, td.bridge, loader, td.storer1)
+	_ = td.GraphSyncHost2()
+
+	progressChan, errChan := requestor.Request(requestCtx, td.host2.ID(), blockChain.tipLink, spec)
+	for range progressChan {
+	}
+	for range errChan {
+	}
+	lk.Lock()
+	defer lk.Unlock()
+	if belowLoads == 0 {
+		t.Fatal("should have started filling in locally")
+	}
+	if belowLoads > 2 {
+		t.Fatalf("should have stopped filling in once cancelled, but loaded %d blocks", belowLoads)
+	}
+}
+
+func TestProgressPerBlock(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.ProgressPerBlock())
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength {
+		t.Fatal("did not report one event per block")
+	}
+	links := make(map[ipld.Link]struct{})
+	for _, response := range responses {
+		links[response.LastBlock.Link] = struct{}{}
+	}
+	if len(links) != blockChainLength {
+		t.Fatal("reported the same block more than once")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+}
+
+func TestFollowExpansions(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	responder := td.GraphSyncHost2()
+
+	blockChainLength := 50
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	// the responder asks every request to go ten blocks further
+	var requestsLk sync.Mutex
+	requests := 0
+	err := responder.RegisterRequestReceivedHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		requestsLk.Lock()
+		requests++
+		depth := 10 * (requests + 1)
+		requestsLk.Unlock()
+		expansion, err := td.bridge.EncodeNode(blockChainSelector(depth))
+		if err != nil {
+			hookActions.TerminateWithError(err)
+			return
+		}
+		hookActions.SendExtensionData(graphsync.ExtensionData{
+			Name: graphsync.ExtensionExpandSelector,
+			Data: expansion,
+		})
+	})
 	if err != nil {
-		t.Fatal("error generating host")
+		t.Fatal("Error setting up hook")
 	}
-	td.host2, err = td.mn.GenPeer()
+
+	t.Run("expansions are capped", func(t *testing.T) {
+		requestsLk.Lock()
+		requests = 0
+		requestsLk.Unlock()
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(10), graphsync.FollowExpansions(2))
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		testutil.VerifyEmptyErrors(ctx, t, errChan)
+		requestsLk.Lock()
+		received := requests
+		requestsLk.Unlock()
+		if received != 3 {
+			t.Fatal("did not follow exactly the allowed expansions")
+		}
+		// the last expansion followed reaches thirty blocks
+		if len(responses) != 30*2 {
+			t.Fatal("did not traverse the expanded selector")
+		}
+		paths := make(map[string]struct{})
+		for _, response := range responses {
+			paths[response.Path.String()] = struct{}{}
+		}
+		if len(paths) != len(responses) {
+			t.Fatal("repeated responses")
+		}
+	})
+
+	t.Run("expansions are ignored without FollowExpansions", func(t *testing.T) {
+		requestsLk.Lock()
+		requests = 0
+		requestsLk.Unlock()
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(10))
+		responses := testutil.CollectResponses(ctx, t, progressChan)
+		testutil.VerifyEmptyErrors(ctx, t, errChan)
+		requestsLk.Lock()
+		received := requests
+		requestsLk.Unlock()
+		if received != 1 {
+			t.Fatal("expanded a request not made to follow expansions")
+		}
+		if len(responses) != 10*2 {
+			t.Fatal("did not traverse the requested selector")
+		}
+	})
+}
+
+type fakeRequestMetrics struct {
+	lk        sync.Mutex
+	started   []map[string]string
+	blocks    []map[string]string
+	completed []map[string]string
+	statuses  []graphsync.ResponseStatusCode
+	cancelled []map[string]string
+}
+
+func (frm *fakeRequestMetrics) RequestStarted(labels map[string]string) {
+	frm.lk.Lock()
+	defer frm.lk.Unlock()
+	frm.started = append(frm.started, labels)
+}
+
+func (frm *fakeRequestMetrics) BlockReceived(labels map[string]string, size int) {
+	frm.lk.Lock()
+	defer frm.lk.Unlock()
+	if size > 0 {
+		frm.blocks = append(frm.blocks, labels)
+	}
+}
+
+func (frm *fakeRequestMetrics) RequestCompleted(labels map[string]string, status graphsync.ResponseStatusCode) {
+	frm.lk.Lock()
+	defer frm.lk.Unlock()
+	frm.completed = append(frm.completed, labels)
+	frm.statuses = append(frm.statuses, status)
+}
+
+func (frm *fakeRequestMetrics) RequestCancelled(labels map[string]string) {
+	frm.lk.Lock()
+	defer frm.lk.Unlock()
+	frm.cancelled = append(frm.cancelled, labels)
+}
+
+func TestMetricLabels(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	metrics := &fakeRequestMetrics{}
+	requestor := td.GraphSyncHost1(WithRequestMetrics(metrics))
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	labels := map[string]string{"tenant": "a"}
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength), graphsync.WithMetricLabels(labels))
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	verifyLabels := func(name string, received []map[string]string, count int, expected map[string]string) {
+		if len(received) != count {
+			t.Fatalf("expected %d %s events, got %d", count, name, len(received))
+		}
+		for _, labels := range received {
+			if !reflect.DeepEqual(labels, expected) {
+				t.Fatalf("%s event had labels %v, expected %v", name, labels, expected)
+			}
+		}
+	}
+
+	metrics.lk.Lock()
+	verifyLabels("started", metrics.started, 1, labels)
+	verifyLabels("block", metrics.blocks, blockChainLength, labels)
+	verifyLabels("completed", metrics.completed, 1, labels)
+	verifyLabels("cancelled", metrics.cancelled, 0, labels)
+	if metrics.statuses[0] != graphsync.RequestCompletedFull {
+		t.Fatal("did not report the status the request completed with")
+	}
+	metrics.started, metrics.blocks, metrics.completed = nil, nil, nil
+	metrics.lk.Unlock()
+
+	// a request without labels reports nil labels
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	metrics.lk.Lock()
+	defer metrics.lk.Unlock()
+	verifyLabels("started", metrics.started, 1, nil)
+	verifyLabels("completed", metrics.completed, 1, nil)
+}
+
+func TestRequestName(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// the responder never answers, so requests stay in progress
+	r := &receiver{
+		messageReceived: make(chan receivedMessage, 2),
+	}
+	td.gsnet2.SetDelegate(r)
+	metrics := &fakeRequestMetrics{}
+	requestor := td.GraphSyncHost1(WithRequestMetrics(metrics))
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	namedCtx, namedCancel := context.WithCancel(ctx)
+	defer namedCancel()
+	requestor.Request(namedCtx, td.host2.ID(), blockChain.tipLink, spec, graphsync.WithRequestName("catalog-sync"))
+	requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+
+	// both requests may be sent in one message
+	for received := 0; received < 2; {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive requests")
+		case message := <-r.messageReceived:
+			for _, request := range message.message.Requests() {
+				if _, ok := request.Extension(graphsync.ExtensionRequestName); ok {
+					t.Fatal("sent the request name to the responder")
+				}
+				received++
+			}
+		}
+	}
+
+	activeRequests := requestor.ActiveRequests()
+	if len(activeRequests) != 2 {
+		t.Fatal("did not list both requests as active")
+	}
+	root := blockChain.tipLink.(cidlink.Link).Cid
+	named, unnamed := activeRequests[0], activeRequests[1]
+	if named.Name != "catalog-sync" || named.Peer != td.host2.ID() || !named.Root.Equals(root) {
+		t.Fatal("did not list the named request correctly")
+	}
+	if unnamed.Name != "" || unnamed.Peer != td.host2.ID() || !unnamed.Root.Equals(root) {
+		t.Fatal("did not list the unnamed request correctly")
+	}
+
+	metrics.lk.Lock()
+	if len(metrics.started) != 2 ||
+		!reflect.DeepEqual(metrics.started[0], map[string]string{graphsync.RequestNameLabel: "catalog-sync"}) ||
+		metrics.started[1] != nil {
+		t.Fatal("did not label metrics with the request name")
+	}
+	metrics.lk.Unlock()
+
+	// a cancelled request is no longer listed
+	namedCancel()
+	for {
+		activeRequests = requestor.ActiveRequests()
+		if len(activeRequests) == 1 && activeRequests[0].ID == unnamed.ID {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("still listed the cancelled request")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// setupWideDAG stores a root linking directly to width leaf blocks
+func setupWideDAG(ctx context.Context, t testing.TB, storer ipldbridge.Storer, width int) ipld.Link {
+	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
+	nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+	var leaves []ipld.Link
+	var root ipld.Node
+	err := fluent.Recover(func() {
+		for i := 0; i < width; i++ {
+			leaf, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, createBlock(nb, nil, 100), storer)
+			if err != nil {
+				panic(err)
+			}
+			leaves = append(leaves, leaf)
+		}
+		root = createBlock(nb, leaves, 100)
+	})
 	if err != nil {
-		t.Fatal("error generating host")
+		t.Fatal("Error creating leaves")
 	}
-	err = td.mn.LinkAll()
+	rootLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, root, storer)
 	if err != nil {
-		t.Fatal("error linking hosts")
+		t.Fatal("Error creating link to root")
 	}
+	return rootLink
+}
 
-	td.gsnet1 = gsnet.NewFromLibp2pHost(td.host1)
-	td.gsnet2 = gsnet.NewFromLibp2pHost(td.host2)
-	td.blockStore1 = make(map[ipld.Link][]byte)
-	td.loader1, td.storer1 = testbridge.NewMockStore(td.blockStore1)
-	td.blockStore2 = make(map[ipld.Link][]byte)
-	td.loader2, td.storer2 = testbridge.NewMockStore(td.blockStore2)
-	td.bridge = ipldbridge.NewIPLDBridge()
-	// setup extension handlers
-	td.extensionData = testutil.RandomBytes(100)
-	td.extensionName = graphsync.ExtensionName("AppleSauce/McGee")
-	td.extension = graphsync.ExtensionData{
-		Name: td.extensionName,
-		Data: td.extensionData,
+// slowLoader delays every load, as a disk would, and tracks the most loads
+// in progress at once
+type slowLoader struct {
+	loader  ipldbridge.Loader
+	delay   time.Duration
+	lk      sync.Mutex
+	current int
+	max     int
+}
+
+func (sl *slowLoader) load(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+	sl.lk.Lock()
+	sl.current++
+	if sl.current > sl.max {
+		sl.max = sl.current
 	}
-	td.extensionResponseData = testutil.RandomBytes(100)
-	td.extensionResponse = graphsync.ExtensionData{
-		Name: td.extensionName,
-		Data: td.extensionResponseData,
+	sl.lk.Unlock()
+	time.Sleep(sl.delay)
+	sl.lk.Lock()
+	sl.current--
+	sl.lk.Unlock()
+	return sl.loader(link, linkContext)
+}
+
+func TestTraversalConcurrency(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// the requestor already has the whole DAG
+	width := 50
+	root := setupWideDAG(ctx, t, td.storer1, width)
+	for link, data := range td.blockStore1 {
+		td.blockStore2[link] = data
+	}
+	loader := &slowLoader{loader: td.loader1, delay: time.Millisecond}
+	requestor := New(ctx, td.gsnet1, td.bridge, loader.load, td.storer1)
+	_ = td.GraphSyncHost2()
+	spec := blockChainSelector(2)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), root, spec)
+	sequential := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	loader.lk.Lock()
+	if loader.max != 1 {
+		loader.lk.Unlock()
+		t.Fatal("should load one link at a time by default")
+	}
+	loader.max = 0
+	loader.lk.Unlock()
+
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), root, spec, graphsync.TraversalConcurrency(4))
+	concurrent := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	loader.lk.Lock()
+	maxLoads := loader.max
+	loader.lk.Unlock()
+	if maxLoads < 2 {
+		t.Fatal("did not load sibling links concurrently")
+	}
+	// the traversal's own load of a link missing locally may run alongside
+	// the prefetches
+	if maxLoads > 5 {
+		t.Fatal("loaded more links at once than allowed")
+	}
+	if len(concurrent) != len(sequential) {
+		t.Fatal("did not traverse the same nodes")
+	}
+	for i := range sequential {
+		if sequential[i].Path.String() != concurrent[i].Path.String() {
+			t.Fatal("did not visit nodes in the same order")
+		}
+	}
+}
+
+func BenchmarkTraversalConcurrency(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("concurrency/%d", n), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			td := newGsTestData(ctx, b)
+			// blocks from the responder arrive too late to matter, so the
+			// traversal reads a cache already holding a wide DAG, with the
+			// latency of a disk
+			for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), td.host2.ID()) {
+				link.SetOptions(mocknet.LinkOptions{Latency: 100 * time.Millisecond})
+			}
+			root := setupWideDAG(ctx, b, td.storer1, 200)
+			for link, data := range td.blockStore1 {
+				td.blockStore2[link] = data
+			}
+			loader := &slowLoader{loader: td.loader1, delay: 100 * time.Microsecond}
+			requestor := New(ctx, td.gsnet1, td.bridge, loader.load, td.storer1)
+			_ = td.GraphSyncHost2()
+			spec := blockChainSelector(2)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				progressChan, errChan := requestor.Request(ctx, td.host2.ID(), root, spec, graphsync.TraversalConcurrency(n))
+				for range progressChan {
+				}
+				for range errChan {
+				}
+			}
+		})
 	}
-
-	return td
 }
 
-func (td *gsTestData) GraphSyncHost1() graphsync.GraphExchange {
-	return New(td.ctx, td.gsnet1, td.bridge, td.loader1, td.storer1)
+// failingNetwork is a network whose messages fail to send once failing is
+// closed
+type failingNetwork struct {
+	gsnet.GraphSyncNetwork
+	failing chan struct{}
 }
 
-func (td *gsTestData) GraphSyncHost2() graphsync.GraphExchange {
+var errNetworkFailing = errors.New("network failing")
 
-	return New(td.ctx, td.gsnet2, td.bridge, td.loader2, td.storer2)
+func (fn *failingNetwork) NewMessageSender(ctx context.Context, p peer.ID) (gsnet.MessageSender, error) {
+	select {
+	case <-fn.failing:
+		return nil, errNetworkFailing
+	default:
+	}
+	sender, err := fn.GraphSyncNetwork.NewMessageSender(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &failingSender{sender, fn.failing}, nil
 }
 
-type receivedMessage struct {
-	message gsmsg.GraphSyncMessage
-	sender  peer.ID
+type failingSender struct {
+	gsnet.MessageSender
+	failing chan struct{}
 }
 
-// Receiver is an interface for receiving messages from the GraphSyncNetwork.
-type receiver struct {
-	messageReceived chan receivedMessage
+func (fs *failingSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	select {
+	case <-fs.failing:
+		return errNetworkFailing
+	default:
+	}
+	return fs.MessageSender.SendMsg(ctx, msg)
 }
 
-func (r *receiver) ReceiveMessage(
-	ctx context.Context,
-	sender peer.ID,
-	incoming gsmsg.GraphSyncMessage) {
+func TestUndeliverableResponseHook(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	// a slow loader keeps the response in progress when the network fails
+	loader := &slowLoader{loader: td.loader2, delay: 10 * time.Millisecond}
+	network := &failingNetwork{td.gsnet2, make(chan struct{})}
+	responder := New(ctx, network, td.bridge, loader.load, td.storer2)
+
+	type undeliverable struct {
+		p       peer.ID
+		request graphsync.RequestData
+		reason  error
+	}
+	undeliverables := make(chan undeliverable, 16)
+	err := responder.RegisterUndeliverableResponseHook(func(p peer.ID, request graphsync.RequestData, reason error) {
+		select {
+		case undeliverables <- undeliverable{p, request, reason}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal("unable to register hook")
+	}
 
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+
+	requestCtx, requestCancel := context.WithCancel(ctx)
+	defer requestCancel()
+	progressChan, _ := requestor.Request(requestCtx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength))
 	select {
 	case <-ctx.Done():
-	case r.messageReceived <- receivedMessage{incoming, sender}:
+		t.Fatal("did not receive any responses")
+	case <-progressChan:
+	}
+
+	close(network.failing)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("hook did not run for undeliverable responses")
+	case received := <-undeliverables:
+		if received.p != td.host1.ID() {
+			t.Fatal("hook ran for wrong peer")
+		}
+		if !received.request.Root().Equals(blockChain.tipLink.(cidlink.Link).Cid) {
+			t.Fatal("hook ran for wrong request")
+		}
+		if received.reason == nil {
+			t.Fatal("hook ran without a reason")
+		}
 	}
 }
 
-func (r *receiver) ReceiveError(err error) {
+type memoryCheckpointStore struct {
+	lk          sync.Mutex
+	checkpoints map[graphsync.RequestID]responsemanager.Checkpoint
 }
 
-func (r *receiver) Connected(p peer.ID) {
+func (mcs *memoryCheckpointStore) SaveCheckpoint(checkpoint responsemanager.Checkpoint) error {
+	mcs.lk.Lock()
+	defer mcs.lk.Unlock()
+	mcs.checkpoints[checkpoint.Request.ID()] = checkpoint
+	return nil
 }
 
-func (r *receiver) Disconnected(p peer.ID) {
+func (mcs *memoryCheckpointStore) DeleteCheckpoint(p peer.ID, requestID graphsync.RequestID) error {
+	mcs.lk.Lock()
+	defer mcs.lk.Unlock()
+	delete(mcs.checkpoints, requestID)
+	return nil
 }
 
-type blockChain struct {
-	genisisNode ipld.Node
-	genisisLink ipld.Link
-	middleNodes []ipld.Node
-	middleLinks []ipld.Link
-	tipNode     ipld.Node
-	tipLink     ipld.Link
+func (mcs *memoryCheckpointStore) Checkpoints() ([]responsemanager.Checkpoint, error) {
+	mcs.lk.Lock()
+	defer mcs.lk.Unlock()
+	checkpoints := make([]responsemanager.Checkpoint, 0, len(mcs.checkpoints))
+	for _, checkpoint := range mcs.checkpoints {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, nil
 }
 
-func createBlock(nb ipldbridge.NodeBuilder, parents []ipld.Link, size int64) ipld.Node {
-	return nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
-		mb.Insert(knb.CreateString("Parents"), vnb.CreateList(func(lb ipldbridge.ListBuilder, vnb ipldbridge.NodeBuilder) {
-			for _, parent := range parents {
-				lb.Append(vnb.CreateLink(parent))
-			}
-		}))
-		mb.Insert(knb.CreateString("Messages"), vnb.CreateList(func(lb ipldbridge.ListBuilder, vnb ipldbridge.NodeBuilder) {
-			lb.Append(vnb.CreateBytes(testutil.RandomBytes(size)))
-		}))
-	})
+// stallAfter loads the first n blocks, then fails every later load once ctx
+// is done
+func stallAfter(ctx context.Context, loader ipldbridge.Loader, n int32) ipldbridge.Loader {
+	var loads int32
+	return func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		if atomic.AddInt32(&loads, 1) > n {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return loader(link, linkContext)
+	}
 }
 
-func setupBlockChain(
-	ctx context.Context,
-	t *testing.T,
-	storer ipldbridge.Storer,
-	bridge ipldbridge.IPLDBridge,
-	size int64,
-	blockChainLength int) *blockChain {
-	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
-	var genisisNode ipld.Node
-	err := fluent.Recover(func() {
-		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
-		genisisNode = createBlock(nb, []ipld.Link{}, size)
+func TestResumeFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	var blocksSentLk sync.Mutex
+	blocksSent := 0
+	err := requestor.RegisterResponseReceivedHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		data, ok := responseData.Extension(graphsync.ExtensionMetadata)
+		if !ok {
+			return nil
+		}
+		md, err := metadata.DecodeMetadata(data, td.bridge)
+		if err != nil {
+			return err
+		}
+		blocksSentLk.Lock()
+		defer blocksSentLk.Unlock()
+		for _, item := range md {
+			if item.BlockPresent {
+				blocksSent++
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		t.Fatal("Error creating genesis block")
+		t.Fatal("unable to register hook")
 	}
-	genesisLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, genisisNode, storer)
+
+	blockChainLength := 100
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	store := &memoryCheckpointStore{checkpoints: make(map[graphsync.RequestID]responsemanager.Checkpoint)}
+
+	// the first responder sends part of the chain, then stops
+	stopAt := 40
+	responderCtx, stopResponder := context.WithCancel(ctx)
+	_ = New(responderCtx, td.gsnet2, td.bridge, stallAfter(responderCtx, td.loader2, int32(stopAt)), td.storer2,
+		WithCheckpointStore(store, 1))
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, blockChainSelector(blockChainLength), graphsync.Checkpointed())
+	var responses []graphsync.ResponseProgress
+	for len(responses) < stopAt*2 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive responses from the first responder")
+		case response := <-progressChan:
+			responses = append(responses, response)
+		}
+	}
+	for {
+		checkpoints, _ := store.Checkpoints()
+		if len(checkpoints) == 1 && checkpoints[0].Blocks == stopAt {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not save a checkpoint")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	stopResponder()
+
+	// a responder made with the same store after a restart carries on
+	responder := New(ctx, td.gsnet2, td.bridge, td.loader2, td.storer2, WithCheckpointStore(store, 1))
+	err = responder.ResumeCheckpoints()
 	if err != nil {
-		t.Fatal("Error creating link to genesis block")
+		t.Fatal("unable to resume checkpoints")
 	}
-	parent := genesisLink
-	middleNodes := make([]ipld.Node, 0, blockChainLength-2)
-	middleLinks := make([]ipld.Link, 0, blockChainLength-2)
-	for i := 0; i < blockChainLength-2; i++ {
-		var node ipld.Node
-		err := fluent.Recover(func() {
-			nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
-			node = createBlock(nb, []ipld.Link{parent}, size)
-		})
-		if err != nil {
-			t.Fatal("Error creating middle block")
+
+	responses = append(responses, testutil.CollectResponses(ctx, t, progressChan)...)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 0 {
+		t.Fatal("errors during traverse")
+	}
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	blocksSentLk.Lock()
+	if blocksSent != blockChainLength {
+		t.Fatal("responders should have sent each block once")
+	}
+	blocksSentLk.Unlock()
+	for {
+		checkpoints, _ := store.Checkpoints()
+		if len(checkpoints) == 0 {
+			break
 		}
-		middleNodes = append(middleNodes, node)
-		link, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, node, storer)
-		if err != nil {
-			t.Fatal("Error creating link to middle block")
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not delete the finished checkpoint")
+		case <-time.After(time.Millisecond):
 		}
-		middleLinks = append(middleLinks, link)
-		parent = link
 	}
-	var tipNode ipld.Node
-	err = fluent.Recover(func() {
-		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
-		tipNode = createBlock(nb, []ipld.Link{parent}, size)
-	})
+}
+
+func TestRequestFromAddr(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: td.host2.ID(), Addrs: td.host2.Addrs()})
+	if err != nil || len(addrs) == 0 {
+		t.Fatal("unable to build responder address")
+	}
+	progressChan, errChan := requestor.RequestFromAddr(ctx, addrs[0], blockChain.tipLink, spec)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+
+	// an address without a peer ID
+	progressChan, errChan = requestor.RequestFromAddr(ctx, td.host2.Addrs()[0], blockChain.tipLink, spec)
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 1 {
+		t.Fatal("should have failed the request")
+	}
+	if addrErr, ok := errs[0].(graphsync.AddrError); !ok || !addrErr.Addr.Equal(td.host2.Addrs()[0]) {
+		t.Fatal("did not fail with an address error")
+	}
+
+	// a peer with no link to the requestor cannot be dialed
+	unreachable, err := td.mn.GenPeer()
 	if err != nil {
-		t.Fatal("Error creating tip block")
+		t.Fatal("unable to generate peer")
 	}
-	tipLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, tipNode, storer)
+	addrs, err = peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: unreachable.ID(), Addrs: unreachable.Addrs()})
+	if err != nil || len(addrs) == 0 {
+		t.Fatal("unable to build unreachable address")
+	}
+	progressChan, errChan = requestor.RequestFromAddr(ctx, addrs[0], blockChain.tipLink, spec)
+	_ = testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) != 1 {
+		t.Fatal("should have failed the request")
+	}
+	if dialErr, ok := errs[0].(graphsync.DialError); !ok || dialErr.Peer != unreachable.ID() {
+		t.Fatal("did not fail with a dial error")
+	}
+}
+
+func TestCacheSelectorResults(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	dir, err := ioutil.TempDir("", "graphsync-results")
 	if err != nil {
-		t.Fatal("Error creating link to tip block")
+		t.Fatal("unable to create cache directory")
+	}
+	defer os.RemoveAll(dir)
+
+	var loads int32
+	countingLoader := func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		atomic.AddInt32(&loads, 1)
+		return td.loader2(link, linkContext)
+	}
+	requestor := td.GraphSyncHost1()
+	_ = New(ctx, td.gsnet2, td.bridge, countingLoader, td.storer2,
+		CacheSelectorResults(responseloader.NewDirResultCache(dir), 1<<20))
+
+	blockChainLength := 20
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if atomic.LoadInt32(&loads) != int32(blockChainLength) {
+		t.Fatal("first request should have loaded every block")
+	}
+
+	// the requestor starts over, so every block must come from the responder
+	for link := range td.blockStore1 {
+		delete(td.blockStore1, link)
+	}
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec)
+	responses = testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes from the cached result")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks from the cached result")
+	}
+	if atomic.LoadInt32(&loads) != int32(blockChainLength) {
+		t.Fatal("second request should have been served without loading blocks")
 	}
-	return &blockChain{genisisNode, genesisLink, middleNodes, middleLinks, tipNode, tipLink}
 }
 
-func blockChainSelector(blockChainLength int) ipld.Node {
-	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
-	return ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(blockChainLength),
-		ssb.ExploreFields(func(efsb ipldbridge.ExploreFieldsSpecBuilder) {
-			efsb.Insert("Parents", ssb.ExploreAll(
-				ssb.ExploreRecursiveEdge()))
-		})).Node()
+func TestContextLoader(t *testing.T) {
+	// slowLoader makes the first load it is asked for wait until its context
+	// is done, signalling when the wait starts and once it is aborted
+	slowLoader := func(loader ipldbridge.Loader, loading chan<- struct{}, aborted chan<- struct{}) ipldbridge.ContextLoader {
+		var once sync.Once
+		return func(ctx context.Context, link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+			slow := false
+			once.Do(func() { slow = true })
+			if !slow {
+				return loader(link, linkContext)
+			}
+			loading <- struct{}{}
+			<-ctx.Done()
+			aborted <- struct{}{}
+			return nil, ctx.Err()
+		}
+	}
+
+	testAbort := func(t *testing.T, setup func(td *gsTestData, loading chan<- struct{}, aborted chan<- struct{}) graphsync.GraphExchange) {
+		ctx := context.Background()
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		td := newGsTestData(ctx, t)
+		loading := make(chan struct{}, 1)
+		aborted := make(chan struct{}, 1)
+		requestor := setup(td, loading, aborted)
+
+		blockChainLength := 10
+		blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+		spec := blockChainSelector(blockChainLength)
+
+		requestCtx, cancelRequest := context.WithCancel(ctx)
+		progressChan, errChan := requestor.Request(requestCtx, td.host2.ID(), blockChain.tipLink, spec)
+		select {
+		case <-ctx.Done():
+			t.Fatal("should have started slow load")
+		case <-loading:
+		}
+		cancelRequest()
+		select {
+		case <-ctx.Done():
+			t.Fatal("cancelling the request should have aborted the slow load")
+		case <-aborted:
+		}
+		testutil.CollectResponses(ctx, t, progressChan)
+		testutil.CollectErrors(ctx, t, errChan)
+	}
+
+	t.Run("responder", func(t *testing.T) {
+		testAbort(t, func(td *gsTestData, loading chan<- struct{}, aborted chan<- struct{}) graphsync.GraphExchange {
+			_ = td.GraphSyncHost2(UseContextLoader(slowLoader(td.loader2, loading, aborted)))
+			return td.GraphSyncHost1()
+		})
+	})
+
+	t.Run("requestor", func(t *testing.T) {
+		testAbort(t, func(td *gsTestData, loading chan<- struct{}, aborted chan<- struct{}) graphsync.GraphExchange {
+			_ = td.GraphSyncHost2()
+			return td.GraphSyncHost1(UseContextLoader(slowLoader(td.loader1, loading, aborted)))
+		})
+	})
+}
+
+func TestRawPassthrough(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	_ = td.GraphSyncHost2()
+
+	blockChainLength := 10
+	blockChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	spec := blockChainSelector(blockChainLength)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.tipLink, spec, graphsync.RawPassthrough())
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	if len(responses) != blockChainLength*2 {
+		t.Fatal("did not traverse all nodes")
+	}
+	if len(td.blockStore1) != blockChainLength {
+		t.Fatal("did not store all blocks")
+	}
+	for link, data := range td.blockStore2 {
+		if !bytes.Equal(td.blockStore1[link], data) {
+			t.Fatal("stored block bytes differ from the responder's")
+		}
+	}
+
+	// a block whose bytes on the responder no longer match its cid is not sent
+	otherChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	corrupted := otherChain.middleLinks[3]
+	td.blockStore2[corrupted] = testutil.RandomBytes(100)
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), otherChain.tipLink, spec, graphsync.RawPassthrough())
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	if len(errs) == 0 {
+		t.Fatal("should have errored on a block the responder could not send intact")
+	}
+	if _, ok := td.blockStore1[corrupted]; ok {
+		t.Fatal("should not have stored the corrupted block")
+	}
+
+	// a block whose bytes in the local store do not match fails to load
+	localChain := setupBlockChain(ctx, t, td.storer2, td.bridge, 100, blockChainLength)
+	td.blockStore1[localChain.tipLink] = testutil.RandomBytes(100)
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), localChain.tipLink, spec, graphsync.RawPassthrough())
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	var mismatched bool
+	for _, err := range errs {
+		if mismatchErr, ok := err.(graphsync.BlockBytesMismatchError); ok {
+			mismatched = mismatchErr.Cid.Equals(localChain.tipLink.(cidlink.Link).Cid)
+		}
+	}
+	if !mismatched {
+		t.Fatal("should have reported the local block did not match its cid")
+	}
 }
@@ -42,7 +42,102 @@ func (rb *ipldBridge) Traverse(ctx context.Context, loader Loader, root ipld.Lin
 			LinkLoader:             loader,
 			LinkNodeBuilderChooser: defaultChooser,
 		},
-	}.WalkAdv(node, s, fn)
+	}.WalkAdv(node, uniqueInterestsSelector{s}, fn)
+}
+
+// uniqueInterestsSelector drops repeated interests from a selector. A union
+// selector lists the interests of all its members, so a field more than one
+// member explores would otherwise be walked once per member at every level.
+type uniqueInterestsSelector struct {
+	Selector
+}
+
+func (uis uniqueInterestsSelector) Interests() []ipld.PathSegment {
+	attn := uis.Selector.Interests()
+	if attn == nil {
+		return nil
+	}
+	seen := make(map[ipld.PathSegment]struct{}, len(attn))
+	unique := make([]ipld.PathSegment, 0, len(attn))
+	for _, ps := range attn {
+		if _, ok := seen[ps]; ok {
+			continue
+		}
+		seen[ps] = struct{}{}
+		unique = append(unique, ps)
+	}
+	return unique
+}
+
+func (uis uniqueInterestsSelector) Explore(n ipld.Node, p ipld.PathSegment) Selector {
+	next := uis.Selector.Explore(n, p)
+	if next == nil {
+		return nil
+	}
+	return uniqueInterestsSelector{next}
+}
+
+func (rb *ipldBridge) TraverseExploring(ctx context.Context, loader Loader, root ipld.Link, s Selector, fn ExploringVisitFn) error {
+	decision := &selectorDecision{}
+	return rb.Traverse(ctx, loader, root, explorationTrackingSelector{s, decision}, func(tp TraversalProgress, node ipld.Node, tr TraversalReason) error {
+		return fn(tp, node, tr, explores(decision.selector, node))
+	})
+}
+
+// selectorDecision is the selector a traversal most recently called Decide
+// on, which is the selector current at the node visited next.
+type selectorDecision struct {
+	selector Selector
+}
+
+// explorationTrackingSelector records each decision the traversal makes, so
+// the visit function that immediately follows it can find the selector that
+// applies to the node visited.
+type explorationTrackingSelector struct {
+	Selector
+	decision *selectorDecision
+}
+
+func (ets explorationTrackingSelector) Decide(n ipld.Node) bool {
+	ets.decision.selector = ets.Selector
+	return ets.Selector.Decide(n)
+}
+
+func (ets explorationTrackingSelector) Explore(n ipld.Node, p ipld.PathSegment) Selector {
+	next := ets.Selector.Explore(n, p)
+	if next == nil {
+		return nil
+	}
+	return explorationTrackingSelector{next, ets.decision}
+}
+
+// explores returns true if the selector continues the traversal into any of
+// the node's children.
+func explores(s Selector, n ipld.Node) bool {
+	switch n.ReprKind() {
+	case ipld.ReprKind_Map, ipld.ReprKind_List:
+	default:
+		return false
+	}
+	attn := s.Interests()
+	if attn != nil {
+		for _, ps := range attn {
+			if _, err := n.LookupSegment(ps); err == nil && s.Explore(n, ps) != nil {
+				return true
+			}
+		}
+		return false
+	}
+	for itr := ipldselector.NewSegmentIterator(n); !itr.Done(); {
+		ps, _, err := itr.Next()
+		if err != nil {
+			return false
+		}
+		if s.Explore(n, ps) != nil {
+			return true
+		}
+	}
+	return false
 }
 
 func (rb *ipldBridge) WalkMatching(node ipld.Node, s Selector, fn VisitFn) error {
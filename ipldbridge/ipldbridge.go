@@ -3,6 +3,7 @@ package ipldbridge
 import (
 	"context"
 	"errors"
+	"io"
 
 	"github.com/ipld/go-ipld-prime/fluent"
 
@@ -22,6 +23,25 @@ func ErrDoNotFollow() error {
 // Loader is an alias from ipld, in case it's renamed/moved.
 type Loader = ipld.Loader
 
+// ContextLoader is a Loader that is also given the context of the request it
+// loads for, so cancelling the request can abort a slow load, such as one
+// that fetches the block over a network.
+type ContextLoader func(ctx context.Context, lnk ipld.Link, lnkCtx LinkContext) (io.Reader, error)
+
+// BindContext makes a Loader that calls the ContextLoader with ctx
+func BindContext(ctx context.Context, loader ContextLoader) Loader {
+	return func(lnk ipld.Link, lnkCtx LinkContext) (io.Reader, error) {
+		return loader(ctx, lnk, lnkCtx)
+	}
+}
+
+// IgnoreContext makes a ContextLoader from a Loader that cannot be cancelled
+func IgnoreContext(loader Loader) ContextLoader {
+	return func(ctx context.Context, lnk ipld.Link, lnkCtx LinkContext) (io.Reader, error) {
+		return loader(lnk, lnkCtx)
+	}
+}
+
 // Storer is an alias from ipld, in case it's renamed/moved.
 type Storer = ipld.Storer
 
@@ -34,6 +54,11 @@ type VisitFn = ipldtraversal.VisitFn
 // AdvVisitFn is an alias from ipld, in case it's renamed/moved.
 type AdvVisitFn = ipldtraversal.AdvVisitFn
 
+// ExploringVisitFn is a visit function for traversals that also reports
+// whether the traversal will go on to explore beneath the visited node,
+// following any links under it.
+type ExploringVisitFn func(progress TraversalProgress, node ipld.Node, reason TraversalReason, explored bool) error
+
 // Selector is an alias from ipld, in case it's renamed/moved.
 type Selector = ipldselector.Selector
 
@@ -55,6 +80,14 @@ type TraversalProgress = ipldtraversal.Progress
 // TraversalReason is an alias from ipld, in case it's renamed/moved.
 type TraversalReason = ipldtraversal.VisitReason
 
+const (
+	// TraversalReasonSelectionMatch is an alias from ipld, in case it's renamed/moved.
+	TraversalReasonSelectionMatch = ipldtraversal.VisitReason_SelectionMatch
+
+	// TraversalReasonSelectionCandidate is an alias from ipld, in case it's renamed/moved.
+	TraversalReasonSelectionCandidate = ipldtraversal.VisitReason_SelectionCandidate
+)
+
 // NodeBuilder is an alias from the ipld fluent nodebuilder, in case it's moved
 type NodeBuilder = fluent.NodeBuilder
 
@@ -87,6 +120,10 @@ type IPLDBridge interface {
 	// visited.
 	Traverse(ctx context.Context, loader Loader, root ipld.Link, s Selector, fn AdvVisitFn) error
 
+	// TraverseExploring is like Traverse, but also tells the visit function
+	// whether the selector explores beneath each node visited.
+	TraverseExploring(ctx context.Context, loader Loader, root ipld.Link, s Selector, fn ExploringVisitFn) error
+
 	// WalkMatching is a wrapper around direct selector traversal
 	WalkMatching(node ipld.Node, s Selector, fn VisitFn) error
 }
@@ -0,0 +1,97 @@
+package ipldbridge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ErrUnsupportedLinkType means a link is neither a cidlink.Link nor a CidLink,
+// so graphsync cannot name the block it points to
+var ErrUnsupportedLinkType = errors.New("unsupported link type: graphsync needs links that resolve to a CID")
+
+// CidLink is implemented by custom link types that can be used with graphsync.
+// Graphsync messages name request roots and blocks by CID, and requestors
+// verify blocks by hashing them against their CID, so every link graphsync
+// sends or loads must resolve to one. cidlink.Link is supported without
+// implementing this.
+type CidLink interface {
+	ipld.Link
+	Cid() cid.Cid
+}
+
+// LinkCid returns the CID of the block a link points to, or
+// ErrUnsupportedLinkType if it does not resolve to a CID
+func LinkCid(lnk ipld.Link) (cid.Cid, error) {
+	switch asLink := lnk.(type) {
+	case cidlink.Link:
+		return asLink.Cid, nil
+	case CidLink:
+		return asLink.Cid(), nil
+	default:
+		return cid.Undef, ErrUnsupportedLinkType
+	}
+}
+
+// NormalizeLink returns the cidlink.Link for the block a link points to,
+// which graphsync uses to track blocks, so links of any supported type to the
+// same block are treated the same
+func NormalizeLink(lnk ipld.Link) (ipld.Link, error) {
+	c, err := LinkCid(lnk)
+	if err != nil {
+		return nil, err
+	}
+	return cidlink.Link{Cid: c}, nil
+}
+
+// BlockBytesMatch checks that data hashes to the CID of the block the link
+// points to
+func BlockBytesMatch(lnk ipld.Link, data []byte) bool {
+	c, err := LinkCid(lnk)
+	if err != nil {
+		return false
+	}
+	sum, err := c.Prefix().Sum(data)
+	return err == nil && sum.Equals(c)
+}
+
+// IdentityData returns the data of a block whose CID uses the identity
+// multihash, which holds the block itself rather than a hash of it
+func IdentityData(lnk ipld.Link) ([]byte, bool) {
+	c, err := LinkCid(lnk)
+	if err != nil || c.Prefix().MhType != mh.ID {
+		return nil, false
+	}
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil {
+		return nil, false
+	}
+	return decoded.Digest, true
+}
+
+// DecodeIdentityLinks wraps a loader so blocks with identity CIDs are decoded
+// from the CID, without asking the loader, which may not store them
+func DecodeIdentityLinks(loader Loader) Loader {
+	return func(lnk ipld.Link, lnkCtx LinkContext) (io.Reader, error) {
+		if data, ok := IdentityData(lnk); ok {
+			return bytes.NewReader(data), nil
+		}
+		return loader(lnk, lnkCtx)
+	}
+}
+
+// DecodeIdentityLinksContext is DecodeIdentityLinks for a ContextLoader
+func DecodeIdentityLinksContext(loader ContextLoader) ContextLoader {
+	return func(ctx context.Context, lnk ipld.Link, lnkCtx LinkContext) (io.Reader, error) {
+		if data, ok := IdentityData(lnk); ok {
+			return bytes.NewReader(data), nil
+		}
+		return loader(ctx, lnk, lnkCtx)
+	}
+}
@@ -12,6 +12,7 @@ import (
 // at the end if a complete response has been transmitted.
 type LinkTracker struct {
 	missingBlocks                     map[graphsync.RequestID]map[ipld.Link]struct{}
+	presentBlocks                     map[graphsync.RequestID]map[ipld.Link]struct{}
 	linksWithBlocksTraversedByRequest map[graphsync.RequestID][]ipld.Link
 	traversalsWithBlocksInProgress    map[ipld.Link]int
 }
@@ -20,6 +21,7 @@ type LinkTracker struct {
 func New() *LinkTracker {
 	return &LinkTracker{
 		missingBlocks:                     make(map[graphsync.RequestID]map[ipld.Link]struct{}),
+		presentBlocks:                     make(map[graphsync.RequestID]map[ipld.Link]struct{}),
 		linksWithBlocksTraversedByRequest: make(map[graphsync.RequestID][]ipld.Link),
 		traversalsWithBlocksInProgress:    make(map[ipld.Link]int),
 	}
@@ -41,12 +43,29 @@ func (lt *LinkTracker) IsKnownMissingLink(requestID graphsync.RequestID, link ip
 	return ok
 }
 
+// IsKnownPresentLink returns whether the given request recorded the given link as
+// having a block
+func (lt *LinkTracker) IsKnownPresentLink(requestID graphsync.RequestID, link ipld.Link) bool {
+	presentBlocks, ok := lt.presentBlocks[requestID]
+	if !ok {
+		return false
+	}
+	_, ok = presentBlocks[link]
+	return ok
+}
+
 // RecordLinkTraversal records that we traversed a link during a request, and
 // whether we had the block when we did it.
 func (lt *LinkTracker) RecordLinkTraversal(requestID graphsync.RequestID, link ipld.Link, hasBlock bool) {
 	if hasBlock {
 		lt.linksWithBlocksTraversedByRequest[requestID] = append(lt.linksWithBlocksTraversedByRequest[requestID], link)
 		lt.traversalsWithBlocksInProgress[link]++
+		presentBlocks, ok := lt.presentBlocks[requestID]
+		if !ok {
+			presentBlocks = make(map[ipld.Link]struct{})
+			lt.presentBlocks[requestID] = presentBlocks
+		}
+		presentBlocks[link] = struct{}{}
 	} else {
 		missingBlocks, ok := lt.missingBlocks[requestID]
 		if !ok {
@@ -63,6 +82,7 @@ func (lt *LinkTracker) FinishRequest(requestID graphsync.RequestID) (hasAllBlock
 	_, ok := lt.missingBlocks[requestID]
 	hasAllBlocks = !ok
 	delete(lt.missingBlocks, requestID)
+	delete(lt.presentBlocks, requestID)
 	links, ok := lt.linksWithBlocksTraversedByRequest[requestID]
 	if !ok {
 		return
@@ -17,7 +17,8 @@ import (
 // request terminated successfully.
 func IsTerminalSuccessCode(status graphsync.ResponseStatusCode) bool {
 	return status == graphsync.RequestCompletedFull ||
-		status == graphsync.RequestCompletedPartial
+		status == graphsync.RequestCompletedPartial ||
+		status == graphsync.RequestCompletedEmpty
 }
 
 // IsTerminalFailureCode returns true if the response code indicates the
@@ -26,7 +27,8 @@ func IsTerminalFailureCode(status graphsync.ResponseStatusCode) bool {
 	return status == graphsync.RequestFailedBusy ||
 		status == graphsync.RequestFailedContentNotFound ||
 		status == graphsync.RequestFailedLegal ||
-		status == graphsync.RequestFailedUnknown
+		status == graphsync.RequestFailedUnknown ||
+		status == graphsync.RequestFailedTimeout
 }
 
 // IsTerminalResponseCode returns true if the response code signals
@@ -111,9 +113,25 @@ func NewRequest(id graphsync.RequestID,
 	return newRequest(id, root, selector, priority, false, toExtensionsMap(extensions))
 }
 
-// CancelRequest request generates a request to cancel an in progress request
-func CancelRequest(id graphsync.RequestID) GraphSyncRequest {
-	return newRequest(id, cid.Cid{}, nil, 0, true, nil)
+// CancelRequest request generates a request to cancel an in progress request,
+// with any extensions, such as graphsync.ExtensionCancelReason, to send with it
+func CancelRequest(id graphsync.RequestID, extensions ...graphsync.ExtensionData) GraphSyncRequest {
+	return newRequest(id, cid.Cid{}, nil, 0, true, toExtensionsMap(extensions))
+}
+
+// AckRequest generates a request acknowledging the response message carrying
+// the given graphsync.ExtensionAck data for an in progress request
+func AckRequest(id graphsync.RequestID, ack []byte) GraphSyncRequest {
+	return newRequest(id, cid.Cid{}, nil, 0, false, map[string][]byte{
+		string(graphsync.ExtensionAck): ack,
+	})
+}
+
+// IsAck returns true if this request only acknowledges a response message for
+// an in progress request
+func (gsr GraphSyncRequest) IsAck() bool {
+	_, ok := gsr.Extension(graphsync.ExtensionAck)
+	return ok && !gsr.isCancel
 }
 
 func toExtensionsMap(extensions []graphsync.ExtensionData) (extensionsMap map[string][]byte) {
@@ -160,9 +178,14 @@ func newResponse(requestID graphsync.RequestID,
 func newMessageFromProto(pbm pb.Message) (GraphSyncMessage, error) {
 	gsm := newMsg()
 	for _, req := range pbm.Requests {
-		root, err := cid.Cast(req.Root)
-		if err != nil {
-			return nil, err
+		var root cid.Cid
+		// cancel, ack and supported extensions requests are sent without a root
+		if len(req.Root) != 0 {
+			var err error
+			root, err = cid.Cast(req.Root)
+			if err != nil {
+				return nil, err
+			}
 		}
 		gsm.AddRequest(newRequest(graphsync.RequestID(req.Id), root, req.Selector, graphsync.Priority(req.Priority), req.Cancel, req.GetExtensions()))
 	}
@@ -177,12 +200,19 @@ func newMessageFromProto(pbm pb.Message) (GraphSyncMessage, error) {
 			return nil, err
 		}
 
-		c, err := pref.Sum(b.GetData())
+		// an empty block's data is left out on the wire, but graphsync treats
+		// nil data as a missing block
+		data := b.GetData()
+		if data == nil {
+			data = []byte{}
+		}
+
+		c, err := pref.Sum(data)
 		if err != nil {
 			return nil, err
 		}
 
-		blk, err := blocks.NewBlockWithCid(b.GetData(), c)
+		blk, err := blocks.NewBlockWithCid(data, c)
 		if err != nil {
 			return nil, err
 		}
@@ -249,6 +279,17 @@ func FromPBReader(pbr ggio.Reader) (GraphSyncMessage, error) {
 	return newMessageFromProto(*pb)
 }
 
+// FromBytes deserializes a single protobuf message, without the length
+// prefix it is framed with on the network, into a GraphSyncMessage.
+func FromBytes(data []byte) (GraphSyncMessage, error) {
+	pb := new(pb.Message)
+	if err := pb.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return newMessageFromProto(*pb)
+}
+
 func (gsm *graphSyncMessage) ToProto() *pb.Message {
 	pbm := new(pb.Message)
 	pbm.Requests = make([]pb.Message_Request, 0, len(gsm.requests))
@@ -329,6 +370,15 @@ func (gsr GraphSyncRequest) Extension(name graphsync.ExtensionName) ([]byte, boo
 	return val, true
 }
 
+// ExtensionNames returns the names of all extensions on this request
+func (gsr GraphSyncRequest) ExtensionNames() []graphsync.ExtensionName {
+	names := make([]graphsync.ExtensionName, 0, len(gsr.extensions))
+	for name := range gsr.extensions {
+		names = append(names, graphsync.ExtensionName(name))
+	}
+	return names
+}
+
 // IsCancel returns true if this particular request is being cancelled
 func (gsr GraphSyncRequest) IsCancel() bool { return gsr.isCancel }
 
@@ -176,6 +176,40 @@ func TestRequestCancel(t *testing.T) {
 	}
 }
 
+func TestRequestCancelAndAckFromProto(t *testing.T) {
+	id := graphsync.RequestID(rand.Int31())
+	ackID := graphsync.RequestID(rand.Int31())
+	ack := testutil.RandomBytes(10)
+
+	gsm := New()
+	gsm.AddRequest(CancelRequest(id))
+	gsm.AddRequest(AckRequest(ackID, ack))
+
+	deserialized, err := newMessageFromProto(*gsm.ToProto())
+	if err != nil {
+		t.Fatal("Error deserializing protobuf message")
+	}
+	requests := deserialized.Requests()
+	if len(requests) != 2 {
+		t.Fatal("Did not deserialize requests")
+	}
+	for _, request := range requests {
+		switch request.ID() {
+		case id:
+			if !request.IsCancel() || request.IsAck() {
+				t.Fatal("Did not properly deserialize cancel request")
+			}
+		case ackID:
+			ackData, found := request.Extension(graphsync.ExtensionAck)
+			if request.IsCancel() || !request.IsAck() || !found || !reflect.DeepEqual(ackData, ack) {
+				t.Fatal("Did not properly deserialize ack request")
+			}
+		default:
+			t.Fatal("Deserialized unexpected request")
+		}
+	}
+}
+
 func TestToNetFromNetEquivalency(t *testing.T) {
 	root := testutil.GenerateCids(1)[0]
 	selector := testutil.RandomBytes(100)
@@ -0,0 +1,91 @@
+package message
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// MarshalRequest encodes a request, including its extensions, to an IPLD
+// map then serializes it to raw bytes (CBOR, with the default bridge), so it
+// can be persisted and reconstructed later with UnmarshalRequest. Fields and
+// extensions are written in a fixed order, so the same request always
+// produces the same bytes.
+func MarshalRequest(request GraphSyncRequest, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	extensionNames := make([]string, 0, len(request.extensions))
+	for name := range request.extensions {
+		extensionNames = append(extensionNames, name)
+	}
+	sort.Strings(extensionNames)
+
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+			mb.Insert(knb.CreateString("id"), vnb.CreateInt(int(request.id)))
+			if request.root.Defined() {
+				mb.Insert(knb.CreateString("root"), vnb.CreateLink(cidlink.Link{Cid: request.root}))
+			}
+			mb.Insert(knb.CreateString("selector"), vnb.CreateBytes(request.selector))
+			mb.Insert(knb.CreateString("priority"), vnb.CreateInt(int(request.priority)))
+			mb.Insert(knb.CreateString("cancel"), vnb.CreateBool(request.isCancel))
+			mb.Insert(knb.CreateString("extensions"), vnb.CreateMap(func(emb ipldbridge.MapBuilder, eknb ipldbridge.NodeBuilder, evnb ipldbridge.NodeBuilder) {
+				for _, name := range extensionNames {
+					emb.Insert(eknb.CreateString(name), evnb.CreateBytes(request.extensions[name]))
+				}
+			}))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
+
+// UnmarshalRequest reconstructs a request from the raw bytes generated by
+// MarshalRequest, first deserializing as a node and then assembling into
+// a request.
+func UnmarshalRequest(data []byte, ipldBridge ipldbridge.IPLDBridge) (GraphSyncRequest, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	var request GraphSyncRequest
+	var root ipld.Link
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		request.id = graphsync.RequestID(simpleNode.LookupString("id").AsInt())
+		if _, err := node.LookupString("root"); err == nil {
+			root = simpleNode.LookupString("root").AsLink()
+		}
+		request.selector = simpleNode.LookupString("selector").AsBytes()
+		request.priority = graphsync.Priority(simpleNode.LookupString("priority").AsInt())
+		request.isCancel = simpleNode.LookupString("cancel").AsBool()
+		extensionsNode := simpleNode.LookupString("extensions")
+		if extensionsNode.Length() > 0 {
+			request.extensions = make(map[string][]byte, extensionsNode.Length())
+			iterator := extensionsNode.MapIterator()
+			for !iterator.Done() {
+				name, value := iterator.Next()
+				request.extensions[name.AsString()] = value.AsBytes()
+			}
+		}
+	})
+	if err != nil {
+		return GraphSyncRequest{}, err
+	}
+	if root != nil {
+		asCidLink, ok := root.(cidlink.Link)
+		if !ok {
+			return GraphSyncRequest{}, fmt.Errorf("request root has no cid")
+		}
+		request.root = asCidLink.Cid
+	}
+	return request, nil
+}
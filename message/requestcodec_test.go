@@ -0,0 +1,57 @@
+package message
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestMarshalUnmarshalRequest(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	root := testutil.GenerateCids(1)[0]
+	selector := testutil.RandomBytes(100)
+	id := graphsync.RequestID(rand.Int31())
+	priority := graphsync.Priority(rand.Int31())
+	extension1 := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/awesome"),
+		Data: testutil.RandomBytes(100),
+	}
+	extension2 := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/even-more-awesome"),
+		Data: testutil.RandomBytes(100),
+	}
+	request := NewRequest(id, root, selector, priority, extension1, extension2)
+
+	encoded, err := MarshalRequest(request, bridge)
+	if err != nil {
+		t.Fatal("Error encoding request")
+	}
+	reencoded, err := MarshalRequest(NewRequest(id, root, selector, priority, extension2, extension1), bridge)
+	if err != nil || !reflect.DeepEqual(encoded, reencoded) {
+		t.Fatal("Encoding was not stable")
+	}
+	decoded, err := UnmarshalRequest(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding request")
+	}
+	if !reflect.DeepEqual(request, decoded) {
+		t.Fatal("Request changed during encoding and decoding")
+	}
+
+	cancel := CancelRequest(id)
+	encoded, err = MarshalRequest(cancel, bridge)
+	if err != nil {
+		t.Fatal("Error encoding cancel request")
+	}
+	decoded, err = UnmarshalRequest(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding cancel request")
+	}
+	if decoded.ID() != id || !decoded.IsCancel() || decoded.Root().Defined() {
+		t.Fatal("Cancel request changed during encoding and decoding")
+	}
+}
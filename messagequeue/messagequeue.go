@@ -7,6 +7,7 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 
+	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	logging "github.com/ipfs/go-log"
@@ -30,34 +31,118 @@ type MessageQueue struct {
 	network MessageNetwork
 	ctx     context.Context
 
-	outgoingWork chan struct{}
-	done         chan struct{}
+	done            chan struct{}
+	reportResponses ResponseReporter
+	coalesceWindow  time.Duration
+	maxBatch        int
 
 	// internal do not touch outside go routines
-	nextMessage        gsmsg.GraphSyncMessage
-	nextMessageLk      sync.RWMutex
+	lanesLk  sync.Mutex
+	lanes    []*lane
+	nextLane int
+	batches  uint64
+	latest   map[graphsync.RequestID]*batch
+}
+
+// lane sends messages on one stream to the peer
+type lane struct {
+	outgoingWork chan struct{}
+	next         *batch
+	// full messages, taken off next to start another rather than overfill
+	// them, waiting to be sent before it
+	full    []*batch
+	sending bool
+	sender  gsnet.MessageSender
+
+	// signalled when the next message should be sent without waiting out the
+	// coalescing window, as it is full or cancels a request
+	sendNow chan struct{}
+}
+
+// batch is a message waiting to be sent on a lane, along with the messages
+// for the same requests on other lanes that must be sent before it
+type batch struct {
+	seq                uint64
+	lane               *lane
+	message            gsmsg.GraphSyncMessage
 	processedNotifiers []chan struct{}
-	sender             gsnet.MessageSender
+	requestIDs         []graphsync.RequestID
+	after              []*batch
+	sent               chan struct{}
+}
+
+// Option configures a MessageQueue
+type Option func(*MessageQueue)
+
+// Streams sends messages to the peer over up to n streams instead of one, so
+// a large message being written to one stream does not hold up a small one
+// that could go out on another. Messages for the same request are still sent
+// in order. The default is 1.
+func Streams(n int) Option {
+	return func(mq *MessageQueue) {
+		for len(mq.lanes) < n {
+			mq.lanes = append(mq.lanes, newLane())
+		}
+	}
+}
+
+// CoalesceRequests waits window after a request is queued before sending it,
+// so requests queued in the meantime go out in the same message. A message is
+// sent without waiting out the window once it holds maxBatch requests, unless
+// maxBatch is zero, and requests queued after that go in another message.
+// Messages with responses or cancels are not held back.
+func CoalesceRequests(window time.Duration, maxBatch int) Option {
+	return func(mq *MessageQueue) {
+		mq.coalesceWindow = window
+		mq.maxBatch = maxBatch
+	}
+}
+
+// ResponseReporter is told of each message with responses a queue is done
+// with, along with the error that kept it from being sent, or nil if it was
+// sent. Messages still waiting when the queue shuts down, as it does when the
+// peer disconnects, are reported with graphsync.ErrSendAbandoned. It is
+// called from the goroutine sending messages, so it should not block.
+type ResponseReporter func(p peer.ID, responses []gsmsg.GraphSyncResponse, err error)
+
+// ReportResponses gives the queue a ResponseReporter to tell whether each
+// message with responses was sent.
+func ReportResponses(reporter ResponseReporter) Option {
+	return func(mq *MessageQueue) {
+		mq.reportResponses = reporter
+	}
 }
 
 // New creats a new MessageQueue.
-func New(ctx context.Context, p peer.ID, network MessageNetwork) *MessageQueue {
-	return &MessageQueue{
-		ctx:          ctx,
-		network:      network,
-		p:            p,
-		outgoingWork: make(chan struct{}, 1),
-		done:         make(chan struct{}),
+func New(ctx context.Context, p peer.ID, network MessageNetwork, options ...Option) *MessageQueue {
+	mq := &MessageQueue{
+		ctx:     ctx,
+		network: network,
+		p:       p,
+		done:    make(chan struct{}),
+		lanes:   []*lane{newLane()},
+		latest:  make(map[graphsync.RequestID]*batch),
+	}
+	for _, option := range options {
+		option(mq)
 	}
+	return mq
+}
+
+func newLane() *lane {
+	return &lane{outgoingWork: make(chan struct{}, 1), sendNow: make(chan struct{}, 1)}
 }
 
 // AddRequest adds an outgoing request to the message queue.
 func (mq *MessageQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest) {
 
-	if mq.mutateNextMessage(func(nextMessage gsmsg.GraphSyncMessage) {
+	if l := mq.mutateNextMessage([]graphsync.RequestID{graphSyncRequest.ID()}, func(nextMessage gsmsg.GraphSyncMessage) {
 		nextMessage.AddRequest(graphSyncRequest)
-	}, nil) {
-		mq.signalWork()
+	}, nil); l != nil {
+		l.signalWork()
+		if mq.coalesceWindow > 0 && (graphSyncRequest.IsCancel() || mq.maxBatch > 0 && mq.nextBatchFull(l)) {
+			l.signalSendNow()
+		}
 	}
 }
 
@@ -66,15 +151,19 @@ func (mq *MessageQueue) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest) {
 // sending will not block.
 func (mq *MessageQueue) AddResponses(responses []gsmsg.GraphSyncResponse, blks []blocks.Block) <-chan struct{} {
 	notificationChannel := make(chan struct{}, 1)
-	if mq.mutateNextMessage(func(nextMessage gsmsg.GraphSyncMessage) {
+	requestIDs := make([]graphsync.RequestID, 0, len(responses))
+	for _, response := range responses {
+		requestIDs = append(requestIDs, response.RequestID())
+	}
+	if l := mq.mutateNextMessage(requestIDs, func(nextMessage gsmsg.GraphSyncMessage) {
 		for _, response := range responses {
 			nextMessage.AddResponse(response)
 		}
 		for _, block := range blks {
 			nextMessage.AddBlock(block)
 		}
-	}, notificationChannel) {
-		mq.signalWork()
+	}, notificationChannel); l != nil {
+		l.signalWork()
 	}
 	return notificationChannel
 }
@@ -82,7 +171,9 @@ func (mq *MessageQueue) AddResponses(responses []gsmsg.GraphSyncResponse, blks [
 // Startup starts the processing of messages, and creates an initial message
 // based on the given initial wantlist.
 func (mq *MessageQueue) Startup() {
-	go mq.runQueue()
+	for _, l := range mq.lanes {
+		go mq.runQueue(l)
+	}
 }
 
 // Shutdown stops the processing of messages for a message queue.
@@ -90,125 +181,345 @@ func (mq *MessageQueue) Shutdown() {
 	close(mq.done)
 }
 
-func (mq *MessageQueue) runQueue() {
+func (mq *MessageQueue) runQueue(l *lane) {
 	for {
 		select {
-		case <-mq.outgoingWork:
-			mq.sendMessage()
+		case <-l.outgoingWork:
+			if mq.coalesceWindow > 0 {
+				mq.waitToCoalesce(l)
+			}
+			mq.sendMessage(l)
 		case <-mq.done:
-			if mq.sender != nil {
-				mq.sender.Close()
+			if l.sender != nil {
+				l.sender.Close()
 			}
+			mq.abandonPending(l)
 			return
 		case <-mq.ctx.Done():
-			if mq.sender != nil {
-				mq.sender.Reset()
+			if l.sender != nil {
+				l.sender.Reset()
 			}
+			mq.abandonPending(l)
 			return
 		}
 	}
 }
 
-func (mq *MessageQueue) mutateNextMessage(mutator func(gsmsg.GraphSyncMessage), processedNotifier chan struct{}) bool {
-	mq.nextMessageLk.Lock()
-	defer mq.nextMessageLk.Unlock()
-	if mq.nextMessage == nil {
-		mq.nextMessage = gsmsg.New()
+// mutateNextMessage adds to the next message for the given requests,
+// returning the lane it will be sent on if the message has content
+func (mq *MessageQueue) mutateNextMessage(requestIDs []graphsync.RequestID, mutator func(gsmsg.GraphSyncMessage), processedNotifier chan struct{}) *lane {
+	mq.lanesLk.Lock()
+	defer mq.lanesLk.Unlock()
+	var pending []*batch
+	for _, requestID := range requestIDs {
+		if b, ok := mq.latest[requestID]; ok {
+			pending = append(pending, b)
+		}
+	}
+	l := mq.selectLane(pending)
+	// a full message is sent as it is, so anything more starts another. Full
+	// messages are never held back, so its send now signal is not needed.
+	if mq.coalesceWindow > 0 && mq.nextBatchFullLocked(l) {
+		l.full = append(l.full, l.next)
+		l.next = nil
+		select {
+		case <-l.sendNow:
+		default:
+		}
+	}
+	if l.next == nil {
+		mq.batches++
+		l.next = &batch{
+			seq:     mq.batches,
+			lane:    l,
+			message: gsmsg.New(),
+			sent:    make(chan struct{}),
+		}
+	}
+	next := l.next
+	for _, b := range pending {
+		if b.lane != l && !next.isAfter(b) {
+			next.after = append(next.after, b)
+		}
+	}
+	for _, requestID := range requestIDs {
+		mq.latest[requestID] = next
 	}
-	mutator(mq.nextMessage)
+	next.requestIDs = append(next.requestIDs, requestIDs...)
+	mutator(next.message)
 	if processedNotifier != nil {
-		mq.processedNotifiers = append(mq.processedNotifiers, processedNotifier)
+		next.processedNotifiers = append(next.processedNotifiers, processedNotifier)
+	}
+	if next.message.Empty() {
+		return nil
+	}
+	return l
+}
+
+// selectLane picks the lane for a message whose requests have the given
+// messages still unsent. A message for requests with nothing unsent goes on
+// an idle lane if there is one. Otherwise it goes on a lane with a message for
+// one of its requests, chosen so the message waits only on messages queued
+// before it, which keeps lanes from waiting on each other.
+func (mq *MessageQueue) selectLane(pending []*batch) *lane {
+	if len(pending) == 0 && mq.coalesceWindow > 0 {
+		// join a message waiting out its window, rather than start another
+		for _, l := range mq.lanes {
+			if l.next != nil && !mq.nextBatchFullLocked(l) {
+				return l
+			}
+		}
+	}
+	if len(pending) == 0 {
+		for _, l := range mq.lanes {
+			if l.next == nil && !l.sending {
+				return l
+			}
+		}
+		l := mq.lanes[mq.nextLane]
+		mq.nextLane = (mq.nextLane + 1) % len(mq.lanes)
+		return l
+	}
+	var selected *lane
+	for _, b := range pending {
+		if b.lane.next == nil {
+			return b.lane
+		}
+		if selected == nil || b.lane.next.seq > selected.next.seq {
+			selected = b.lane
+		}
+	}
+	return selected
+}
+
+func (b *batch) isAfter(other *batch) bool {
+	for _, a := range b.after {
+		if a == other {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lane) signalSendNow() {
+	select {
+	case l.sendNow <- struct{}{}:
+	default:
+	}
+}
+
+// nextBatchFull is true if the lane's next message holds as many requests as
+// are coalesced into one
+func (mq *MessageQueue) nextBatchFull(l *lane) bool {
+	mq.lanesLk.Lock()
+	defer mq.lanesLk.Unlock()
+	return mq.nextBatchFullLocked(l)
+}
+
+func (mq *MessageQueue) nextBatchFullLocked(l *lane) bool {
+	return mq.maxBatch > 0 && l.next != nil && len(l.next.message.Requests()) >= mq.maxBatch
+}
+
+// waitToCoalesce holds back the lane's next message for the coalescing
+// window, unless it is full or has responses or cancels, or a full message is
+// waiting to go before it
+func (mq *MessageQueue) waitToCoalesce(l *lane) {
+	mq.lanesLk.Lock()
+	hold := len(l.full) == 0 && l.next != nil && len(l.next.message.Responses()) == 0 &&
+		!mq.nextBatchFullLocked(l) && !hasCancel(l.next.message)
+	mq.lanesLk.Unlock()
+	if !hold {
+		return
+	}
+	select {
+	case <-time.After(mq.coalesceWindow):
+	case <-l.sendNow:
+	case <-mq.done:
+	case <-mq.ctx.Done():
 	}
-	return !mq.nextMessage.Empty()
 }
 
-func (mq *MessageQueue) signalWork() {
+func hasCancel(message gsmsg.GraphSyncMessage) bool {
+	for _, request := range message.Requests() {
+		if request.IsCancel() {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lane) signalWork() {
 	select {
-	case mq.outgoingWork <- struct{}{}:
+	case l.outgoingWork <- struct{}{}:
 	default:
 	}
 }
 
-func (mq *MessageQueue) extractOutgoingMessage() gsmsg.GraphSyncMessage {
+func (mq *MessageQueue) extractOutgoingMessage(l *lane) *batch {
 	// grab outgoing message
-	mq.nextMessageLk.Lock()
-	message := mq.nextMessage
-	mq.nextMessage = nil
-	for _, processedNotifier := range mq.processedNotifiers {
+	mq.lanesLk.Lock()
+	var next *batch
+	if len(l.full) > 0 {
+		next = l.full[0]
+		l.full = l.full[1:]
+	} else {
+		next = l.next
+		l.next = nil
+		// a send now signal is for the message being taken, not the next one
 		select {
-		case processedNotifier <- struct{}{}:
+		case <-l.sendNow:
 		default:
 		}
-		close(processedNotifier)
 	}
-	mq.processedNotifiers = nil
-	mq.nextMessageLk.Unlock()
-	return message
+	if next != nil {
+		l.sending = true
+		for _, processedNotifier := range next.processedNotifiers {
+			select {
+			case processedNotifier <- struct{}{}:
+			default:
+			}
+			close(processedNotifier)
+		}
+		next.processedNotifiers = nil
+	}
+	mq.lanesLk.Unlock()
+	return next
+}
+
+// finishMessage marks a message as no longer waiting to be sent, whether or
+// not sending it succeeded
+func (mq *MessageQueue) finishMessage(l *lane, sent *batch) {
+	mq.lanesLk.Lock()
+	l.sending = false
+	for _, requestID := range sent.requestIDs {
+		if mq.latest[requestID] == sent {
+			delete(mq.latest, requestID)
+		}
+	}
+	// messages queued while this one was sent may share its work signal
+	if len(l.full) > 0 || l.next != nil {
+		l.signalWork()
+	}
+	mq.lanesLk.Unlock()
+	close(sent.sent)
+}
+
+// abandonPending reports the responses in a message the lane never started
+// sending as undelivered
+func (mq *MessageQueue) abandonPending(l *lane) {
+	mq.lanesLk.Lock()
+	pending := l.full
+	if l.next != nil {
+		pending = append(pending, l.next)
+	}
+	l.full = nil
+	l.next = nil
+	mq.lanesLk.Unlock()
+	for _, next := range pending {
+		mq.report(next.message, graphsync.ErrSendAbandoned)
+	}
+}
+
+// report tells the reporter, if any, whether a message's responses were sent
+func (mq *MessageQueue) report(message gsmsg.GraphSyncMessage, err error) {
+	if mq.reportResponses == nil {
+		return
+	}
+	responses := message.Responses()
+	if len(responses) == 0 {
+		return
+	}
+	mq.reportResponses(mq.p, responses, err)
 }
 
-func (mq *MessageQueue) sendMessage() {
-	message := mq.extractOutgoingMessage()
-	if message == nil || message.Empty() {
+func (mq *MessageQueue) sendMessage(l *lane) {
+	next := mq.extractOutgoingMessage(l)
+	if next == nil {
 		return
 	}
+	defer mq.finishMessage(l, next)
+	if next.message.Empty() {
+		return
+	}
+	mq.report(next.message, mq.deliver(l, next))
+}
 
-	err := mq.initializeSender()
+// deliver sends a message, returning why it could not be, if it was not sent
+func (mq *MessageQueue) deliver(l *lane, next *batch) error {
+	// earlier messages for the same requests on other lanes go first
+	for _, b := range next.after {
+		select {
+		case <-b.sent:
+		case <-mq.done:
+			return graphsync.ErrSendAbandoned
+		case <-mq.ctx.Done():
+			return graphsync.ErrSendAbandoned
+		}
+	}
+
+	err := mq.initializeSender(l)
 	if err != nil {
 		log.Infof("cant open message sender to peer %s: %s", mq.p, err)
 		// TODO: cant connect, what now?
-		return
+		return err
 	}
 
 	for i := 0; i < maxRetries; i++ { // try to send this message until we fail.
-		if mq.attemptSendAndRecovery(message) {
-			return
+		var retry bool
+		retry, err = mq.attemptSendAndRecovery(l, next.message)
+		if !retry {
+			return err
 		}
 	}
+	return err
 }
 
-func (mq *MessageQueue) initializeSender() error {
-	if mq.sender != nil {
+func (mq *MessageQueue) initializeSender(l *lane) error {
+	if l.sender != nil {
 		return nil
 	}
 	nsender, err := openSender(mq.ctx, mq.network, mq.p)
 	if err != nil {
 		return err
 	}
-	mq.sender = nsender
+	l.sender = nsender
 	return nil
 }
 
-func (mq *MessageQueue) attemptSendAndRecovery(message gsmsg.GraphSyncMessage) bool {
-	err := mq.sender.SendMsg(mq.ctx, message)
+// attemptSendAndRecovery sends a message, returning whether to try again and,
+// if it was not sent, why not
+func (mq *MessageQueue) attemptSendAndRecovery(l *lane, message gsmsg.GraphSyncMessage) (bool, error) {
+	err := l.sender.SendMsg(mq.ctx, message)
 	if err == nil {
-		return true
+		return false, nil
 	}
 
 	log.Infof("graphsync send error: %s", err)
-	mq.sender.Reset()
-	mq.sender = nil
+	l.sender.Reset()
+	l.sender = nil
 
 	select {
 	case <-mq.done:
-		return true
+		return false, graphsync.ErrSendAbandoned
 	case <-mq.ctx.Done():
-		return true
+		return false, graphsync.ErrSendAbandoned
 	case <-time.After(time.Millisecond * 100):
 		// wait 100ms in case disconnect notifications are still propogating
 		log.Warning("SendMsg errored but neither 'done' nor context.Done() were set")
 	}
 
-	err = mq.initializeSender()
+	sendErr := err
+	err = mq.initializeSender(l)
 	if err != nil {
 		log.Infof("couldnt open sender again after SendMsg(%s) failed: %s", mq.p, err)
 		// TODO(why): what do we do now?
 		// I think the *right* answer is to probably put the message we're
 		// trying to send back, and then return to waiting for new work or
 		// a disconnect.
-		return true
+		return false, err
 	}
 
-	return false
+	return true, sendErr
 }
 
 func openSender(ctx context.Context, network MessageNetwork, p peer.ID) (gsnet.MessageSender, error) {
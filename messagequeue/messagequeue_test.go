@@ -299,3 +299,186 @@ func TestDedupingMessages(t *testing.T) {
 		}
 	}
 }
+
+func TestCoalescingRequests(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	window := 100 * time.Millisecond
+	messageQueue := New(ctx, peer, messageNetwork, CoalesceRequests(window, 16))
+	messageQueue.Startup()
+	waitGroup.Add(1)
+	addRequests := func(n int) {
+		for i := 0; i < n; i++ {
+			messageQueue.AddRequest(gsmsg.NewRequest(graphsync.RequestID(rand.Int31()),
+				testutil.GenerateCids(1)[0], testutil.RandomBytes(100), graphsync.Priority(rand.Int31())))
+		}
+	}
+	verifySent := func(expectedRequests int, maxWait time.Duration) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("no messages were sent")
+		case <-time.After(maxWait):
+			t.Fatal("message was not sent in time")
+		case message := <-messagesSent:
+			if len(message.Requests()) != expectedRequests {
+				t.Fatal("Incorrect number of requests in message")
+			}
+		}
+	}
+
+	// requests made within the window share one message
+	start := time.Now()
+	addRequests(10)
+	verifySent(10, 2*window)
+	if time.Since(start) < window {
+		t.Fatal("message was sent before the window passed")
+	}
+
+	// a full batch does not wait for the window
+	addRequests(16)
+	verifySent(16, window/2)
+
+	// and requests past a full batch start another, rather than overfill it
+	addRequests(20)
+	verifySent(16, window/2)
+	start = time.Now()
+	verifySent(4, 2*window)
+	if time.Since(start) < window/2 {
+		t.Fatal("requests past a full batch did not wait for the window")
+	}
+
+	// a cancel goes out without waiting, with the requests before it
+	addRequests(3)
+	messageQueue.AddRequest(gsmsg.CancelRequest(graphsync.RequestID(rand.Int31())))
+	verifySent(4, window/2)
+}
+
+type fakeStreamNetwork struct {
+	sendersLk sync.Mutex
+	senders   []gsnet.MessageSender
+}
+
+func (fsn *fakeStreamNetwork) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+func (fsn *fakeStreamNetwork) NewMessageSender(context.Context, peer.ID) (gsnet.MessageSender, error) {
+	fsn.sendersLk.Lock()
+	defer fsn.sendersLk.Unlock()
+	sender := fsn.senders[0]
+	fsn.senders = fsn.senders[1:]
+	return sender, nil
+}
+
+func waitForLane(ctx context.Context, t *testing.T, messageQueue *MessageQueue, i int, sending bool) {
+	for {
+		messageQueue.lanesLk.Lock()
+		laneSending := messageQueue.lanes[i].sending
+		messageQueue.lanesLk.Unlock()
+		if laneSending == sending {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("stream did not change state")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestStreamPool(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	// sends block until the message is read, as they would writing a large
+	// message to a high latency stream
+	slowStream := make(chan gsmsg.GraphSyncMessage)
+	otherStream := make(chan gsmsg.GraphSyncMessage)
+	messageNetwork := &fakeStreamNetwork{senders: []gsnet.MessageSender{
+		&fakeMessageSender{nil, make(chan struct{}, 1), make(chan struct{}, 1), slowStream},
+		&fakeMessageSender{nil, make(chan struct{}, 1), make(chan struct{}, 1), otherStream},
+	}}
+
+	messageQueue := New(ctx, peer, messageNetwork, Streams(2))
+	messageQueue.Startup()
+	largeID := graphsync.RequestID(rand.Int31())
+	smallID := largeID + 1
+
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(largeID, graphsync.PartialResponse),
+	}, testutil.GenerateBlocksOfSize(1, 1000000))
+	waitForLane(ctx, t, messageQueue, 0, true)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(largeID, graphsync.RequestCompletedFull),
+	}, nil)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(smallID, graphsync.PartialResponse),
+	}, testutil.GenerateBlocksOfSize(1, 100))
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("small message was not sent while large message was in flight")
+	case message := <-otherStream:
+		responses := message.Responses()
+		if len(responses) != 1 || responses[0].RequestID() != smallID {
+			t.Fatal("incorrect responses sent on second stream")
+		}
+	}
+	waitForLane(ctx, t, messageQueue, 1, false)
+
+	// a message for requests with earlier messages on both streams waits for
+	// both of them
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(smallID, graphsync.PartialResponse),
+	}, testutil.GenerateBlocksOfSize(1, 100))
+	waitForLane(ctx, t, messageQueue, 1, true)
+	messageQueue.AddResponses([]gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(largeID, graphsync.RequestCompletedFull),
+		gsmsg.NewResponse(smallID, graphsync.RequestCompletedFull),
+	}, nil)
+	select {
+	case <-ctx.Done():
+		t.Fatal("small message was not sent while large message was in flight")
+	case message := <-otherStream:
+		if len(message.Responses()) != 1 {
+			t.Fatal("incorrect responses sent on second stream")
+		}
+	}
+	select {
+	case <-otherStream:
+		t.Fatal("message sent before earlier message for the same request")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("large request messages were not sent")
+		case message := <-slowStream:
+			responses := message.Responses()
+			if len(responses) != 1 || responses[0].RequestID() != largeID {
+				t.Fatal("incorrect responses sent on first stream")
+			}
+		}
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("message for requests on both streams was not sent")
+	case message := <-otherStream:
+		if len(message.Responses()) != 2 {
+			t.Fatal("incorrect responses sent on second stream")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// errMessageTooLarge means a message's length prefix is larger than any
+// message a peer may send. A length that large most likely means the prefix
+// itself is corrupt, so the stream cannot be read further.
+var errMessageTooLarge = errors.New("message length exceeds maximum message size")
+
+// frameReader reads the length prefixed messages sent on a stream, one frame
+// at a time, so a message that cannot be decoded can be skipped without
+// losing track of where the next one starts
+type frameReader struct {
+	r       *bufio.Reader
+	maxSize int
+	buf     []byte
+}
+
+func newFrameReader(r io.Reader, maxSize int) *frameReader {
+	return &frameReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// readFrame returns the bytes of the next message on the stream. Any error it
+// returns leaves the stream out of step with its framing, except io.EOF at
+// the end of the last message.
+func (fr *frameReader) readFrame() ([]byte, error) {
+	length64, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return nil, err
+	}
+	if length64 > uint64(fr.maxSize) {
+		return nil, errMessageTooLarge
+	}
+	length := int(length64)
+	if len(fr.buf) < length {
+		fr.buf = make([]byte, length)
+	}
+	frame := fr.buf[:length]
+	if _, err := io.ReadFull(fr.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
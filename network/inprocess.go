@@ -0,0 +1,126 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// InProcessNetwork links Transports in the same process to one another over
+// in memory pipes, so graphsync can run without a real network. Peers
+// connect the first time either opens a stream to the other, and never
+// disconnect.
+type InProcessNetwork struct {
+	lk         sync.Mutex
+	transports map[peer.ID]*inProcessTransport
+	connected  map[[2]peer.ID]struct{}
+}
+
+// NewInProcessNetwork creates an InProcessNetwork with no peers
+func NewInProcessNetwork() *InProcessNetwork {
+	return &InProcessNetwork{
+		transports: make(map[peer.ID]*inProcessTransport),
+		connected:  make(map[[2]peer.ID]struct{}),
+	}
+}
+
+// Transport returns the Transport for the given peer, adding the peer to the
+// network the first time
+func (ipn *InProcessNetwork) Transport(p peer.ID) Transport {
+	ipn.lk.Lock()
+	defer ipn.lk.Unlock()
+	transport, ok := ipn.transports[p]
+	if !ok {
+		transport = &inProcessTransport{network: ipn, p: p}
+		ipn.transports[p] = transport
+	}
+	return transport
+}
+
+// connect connects two peers if they are not already, and returns the handler
+// of the second
+func (ipn *InProcessNetwork) connect(from peer.ID, to peer.ID) (TransportHandler, error) {
+	ipn.lk.Lock()
+	remote, ok := ipn.transports[to]
+	if !ok {
+		ipn.lk.Unlock()
+		return nil, fmt.Errorf("peer %s is not on the network", to)
+	}
+	local := ipn.transports[from]
+	key := [2]peer.ID{from, to}
+	if to < from {
+		key = [2]peer.ID{to, from}
+	}
+	_, wasConnected := ipn.connected[key]
+	ipn.connected[key] = struct{}{}
+	localHandler, remoteHandler := local.handler, remote.handler
+	ipn.lk.Unlock()
+
+	if !wasConnected {
+		if localHandler != nil {
+			localHandler.Connected(to)
+		}
+		if remoteHandler != nil {
+			remoteHandler.Connected(from)
+		}
+	}
+	return remoteHandler, nil
+}
+
+type inProcessTransport struct {
+	network *InProcessNetwork
+	p       peer.ID
+	// guarded by the network's lock
+	handler TransportHandler
+}
+
+func (ipt *inProcessTransport) NewStream(ctx context.Context, p peer.ID) (Stream, error) {
+	handler, err := ipt.network.connect(ipt.p, p)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("peer %s is not handling streams", p)
+	}
+	local, remote := net.Pipe()
+	go handler.HandleStream(&pipeStream{Conn: remote, remotePeer: ipt.p})
+	return &pipeStream{Conn: local, remotePeer: p}, nil
+}
+
+func (ipt *inProcessTransport) Connect(ctx context.Context, info peer.AddrInfo) error {
+	_, err := ipt.network.connect(ipt.p, info.ID)
+	return err
+}
+
+func (ipt *inProcessTransport) SetHandler(handler TransportHandler) {
+	ipt.network.lk.Lock()
+	ipt.handler = handler
+	ipt.network.lk.Unlock()
+}
+
+// pipeStream is one end of an in memory pipe. Writes to a pipe wait for the
+// other end to read them, so everything written is sent once Close is called.
+type pipeStream struct {
+	net.Conn
+	remotePeer peer.ID
+}
+
+func (ps *pipeStream) FullClose() error {
+	return ps.Conn.Close()
+}
+
+func (ps *pipeStream) Reset() error {
+	return ps.Conn.Close()
+}
+
+func (ps *pipeStream) RemotePeer() peer.ID {
+	return ps.remotePeer
+}
+
+func (ps *pipeStream) Protocol() protocol.ID {
+	return ProtocolGraphsync
+}
@@ -30,6 +30,10 @@ type GraphSyncNetwork interface {
 	// ConnectTo establishes a connection to the given peer
 	ConnectTo(context.Context, peer.ID) error
 
+	// ConnectToAddrs establishes a connection to a peer at the given
+	// addresses, keeping them to reach the peer at later
+	ConnectToAddrs(context.Context, peer.AddrInfo) error
+
 	NewMessageSender(context.Context, peer.ID) (MessageSender, error)
 }
 
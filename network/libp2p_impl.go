@@ -2,12 +2,8 @@ package network
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"time"
 
-	ggio "github.com/gogo/protobuf/io"
-	gsmsg "github.com/ipfs/go-graphsync/message"
 	logging "github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -20,154 +16,85 @@ var log = logging.Logger("graphsync_network")
 
 var sendMessageTimeout = time.Minute * 10
 
-// NewFromLibp2pHost returns a GraphSyncNetwork supported by underlying Libp2p host.
-func NewFromLibp2pHost(host host.Host) GraphSyncNetwork {
-	graphSyncNetwork := libp2pGraphSyncNetwork{
-		host: host,
-	}
-
-	return &graphSyncNetwork
-}
-
-// libp2pGraphSyncNetwork transforms the libp2p host interface, which sends and receives
-// NetMessage objects, into the graphsync network interface.
-type libp2pGraphSyncNetwork struct {
-	host host.Host
-	// inbound messages from the network are forwarded to the receiver
-	receiver Receiver
-}
-
-type streamMessageSender struct {
-	s network.Stream
-}
+// Option defines the functional option type that can be used to configure
+// a GraphSyncNetwork
+type Option func(*transportGraphSyncNetwork)
 
-func (s *streamMessageSender) Close() error {
-	return helpers.FullClose(s.s)
-}
-
-func (s *streamMessageSender) Reset() error {
-	return s.s.Reset()
+// WithStreamMetrics reports the activity on every stream the network opens
+// or accepts to the given StreamMetrics
+func WithStreamMetrics(metrics StreamMetrics) Option {
+	return func(gsnet *transportGraphSyncNetwork) {
+		gsnet.metrics = metrics
+	}
 }
 
-func (s *streamMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
-	return msgToStream(ctx, s.s, msg)
+// NewFromLibp2pHost returns a GraphSyncNetwork supported by underlying Libp2p host.
+func NewFromLibp2pHost(host host.Host, options ...Option) GraphSyncNetwork {
+	return NewFromTransport(&libp2pTransport{host: host}, options...)
 }
 
-func msgToStream(ctx context.Context, s network.Stream, msg gsmsg.GraphSyncMessage) error {
-	log.Debugf("Outgoing message with %d requests, %d responses, and %d blocks",
-		len(msg.Requests()), len(msg.Responses()), len(msg.Blocks()))
-
-	deadline := time.Now().Add(sendMessageTimeout)
-	if dl, ok := ctx.Deadline(); ok {
-		deadline = dl
-	}
-	if err := s.SetWriteDeadline(deadline); err != nil {
-		log.Warningf("error setting deadline: %s", err)
-	}
-
-	switch s.Protocol() {
-	case ProtocolGraphsync:
-		if err := msg.ToNet(s); err != nil {
-			log.Debugf("error: %s", err)
-			return err
-		}
-	default:
-		return fmt.Errorf("unrecognized protocol on remote: %s", s.Protocol())
-	}
-
-	if err := s.SetWriteDeadline(time.Time{}); err != nil {
-		log.Warningf("error resetting deadline: %s", err)
-	}
-	return nil
+// libp2pTransport is a Transport over graphsync protocol streams on a libp2p
+// host
+type libp2pTransport struct {
+	host host.Host
 }
 
-func (gsnet *libp2pGraphSyncNetwork) NewMessageSender(ctx context.Context, p peer.ID) (MessageSender, error) {
-	s, err := gsnet.newStreamToPeer(ctx, p)
+func (lt *libp2pTransport) NewStream(ctx context.Context, p peer.ID) (Stream, error) {
+	s, err := lt.host.NewStream(ctx, p, ProtocolGraphsync)
 	if err != nil {
 		return nil, err
 	}
-
-	return &streamMessageSender{s: s}, nil
+	return libp2pStream{Stream: s, outbound: true}, nil
 }
 
-func (gsnet *libp2pGraphSyncNetwork) newStreamToPeer(ctx context.Context, p peer.ID) (network.Stream, error) {
-	return gsnet.host.NewStream(ctx, p, ProtocolGraphsync)
+func (lt *libp2pTransport) Connect(ctx context.Context, info peer.AddrInfo) error {
+	return lt.host.Connect(ctx, info)
 }
 
-func (gsnet *libp2pGraphSyncNetwork) SendMessage(
-	ctx context.Context,
-	p peer.ID,
-	outgoing gsmsg.GraphSyncMessage) error {
-
-	s, err := gsnet.newStreamToPeer(ctx, p)
-	if err != nil {
-		return err
-	}
-
-	if err = msgToStream(ctx, s, outgoing); err != nil {
-		s.Reset()
-		return err
-	}
-
-	// TODO(https://github.com/libp2p/go-libp2p-net/issues/28): Avoid this goroutine.
-	go helpers.AwaitEOF(s)
-	return s.Close()
-
+func (lt *libp2pTransport) SetHandler(handler TransportHandler) {
+	lt.host.SetStreamHandler(ProtocolGraphsync, func(s network.Stream) {
+		handler.HandleStream(libp2pStream{Stream: s})
+	})
+	lt.host.Network().Notify(&libp2pNotifee{handler: handler})
 }
 
-func (gsnet *libp2pGraphSyncNetwork) SetDelegate(r Receiver) {
-	gsnet.receiver = r
-	gsnet.host.SetStreamHandler(ProtocolGraphsync, gsnet.handleNewStream)
-	gsnet.host.Network().Notify((*libp2pGraphSyncNotifee)(gsnet))
+// libp2pStream adapts a libp2p stream to a Stream
+type libp2pStream struct {
+	network.Stream
+	// streams this end opened wait for the other end to close them after
+	// they are closed
+	outbound bool
 }
 
-func (gsnet *libp2pGraphSyncNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
-	return gsnet.host.Connect(ctx, peer.AddrInfo{ID: p})
+func (s libp2pStream) RemotePeer() peer.ID {
+	return s.Conn().RemotePeer()
 }
 
-// handleNewStream receives a new stream from the network.
-func (gsnet *libp2pGraphSyncNetwork) handleNewStream(s network.Stream) {
-	defer s.Close()
-
-	if gsnet.receiver == nil {
-		s.Reset()
-		return
-	}
-
-	reader := ggio.NewDelimitedReader(s, network.MessageSizeMax)
-	for {
-		received, err := gsmsg.FromPBReader(reader)
-		if err != nil {
-			if err != io.EOF {
-				s.Reset()
-				go gsnet.receiver.ReceiveError(err)
-				log.Debugf("graphsync net handleNewStream from %s error: %s", s.Conn().RemotePeer(), err)
-			}
-			return
-		}
-
-		p := s.Conn().RemotePeer()
-		ctx := context.Background()
-		log.Debugf("graphsync net handleNewStream from %s", s.Conn().RemotePeer())
-		gsnet.receiver.ReceiveMessage(ctx, p, received)
+func (s libp2pStream) Close() error {
+	if s.outbound {
+		// TODO(https://github.com/libp2p/go-libp2p-net/issues/28): Avoid this goroutine.
+		go helpers.AwaitEOF(s.Stream)
 	}
+	return s.Stream.Close()
 }
 
-type libp2pGraphSyncNotifee libp2pGraphSyncNetwork
+func (s libp2pStream) FullClose() error {
+	return helpers.FullClose(s.Stream)
+}
 
-func (nn *libp2pGraphSyncNotifee) libp2pGraphSyncNetwork() *libp2pGraphSyncNetwork {
-	return (*libp2pGraphSyncNetwork)(nn)
+type libp2pNotifee struct {
+	handler TransportHandler
 }
 
-func (nn *libp2pGraphSyncNotifee) Connected(n network.Network, v network.Conn) {
-	nn.libp2pGraphSyncNetwork().receiver.Connected(v.RemotePeer())
+func (nn *libp2pNotifee) Connected(n network.Network, v network.Conn) {
+	nn.handler.Connected(v.RemotePeer())
 }
 
-func (nn *libp2pGraphSyncNotifee) Disconnected(n network.Network, v network.Conn) {
-	nn.libp2pGraphSyncNetwork().receiver.Disconnected(v.RemotePeer())
+func (nn *libp2pNotifee) Disconnected(n network.Network, v network.Conn) {
+	nn.handler.Disconnected(v.RemotePeer())
 }
 
-func (nn *libp2pGraphSyncNotifee) OpenedStream(n network.Network, v network.Stream) {}
-func (nn *libp2pGraphSyncNotifee) ClosedStream(n network.Network, v network.Stream) {}
-func (nn *libp2pGraphSyncNotifee) Listen(n network.Network, a ma.Multiaddr)         {}
-func (nn *libp2pGraphSyncNotifee) ListenClose(n network.Network, a ma.Multiaddr)    {}
+func (nn *libp2pNotifee) OpenedStream(n network.Network, v network.Stream) {}
+func (nn *libp2pNotifee) ClosedStream(n network.Network, v network.Stream) {}
+func (nn *libp2pNotifee) Listen(n network.Network, a ma.Multiaddr)         {}
+func (nn *libp2pNotifee) ListenClose(n network.Network, a ma.Multiaddr)    {}
@@ -1,15 +1,18 @@
 package network
 
 import (
+	"bytes"
 	"context"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/testutil"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 )
@@ -20,6 +23,7 @@ type receiver struct {
 	lastMessage     gsmsg.GraphSyncMessage
 	lastSender      peer.ID
 	connectedPeers  chan peer.ID
+	errorsReceived  chan error
 }
 
 func (r *receiver) ReceiveMessage(
@@ -35,6 +39,9 @@ func (r *receiver) ReceiveMessage(
 }
 
 func (r *receiver) ReceiveError(err error) {
+	if r.errorsReceived != nil {
+		r.errorsReceived <- err
+	}
 }
 
 func (r *receiver) Connected(p peer.ID) {
@@ -151,3 +158,202 @@ func TestMessageSendAndReceive(t *testing.T) {
 	}
 
 }
+
+func TestSkipsMalformedMessages(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	host2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	err = mn.LinkAll()
+	if err != nil {
+		t.Fatal("error linking hosts")
+	}
+	gsnet2 := NewFromLibp2pHost(host2)
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+		errorsReceived:  make(chan error, 1),
+	}
+	gsnet2.SetDelegate(r)
+
+	err = mn.ConnectAllButSelf()
+	if err != nil {
+		t.Fatal("Unable to connect peers")
+	}
+	s, err := host1.NewStream(ctx, host2.ID(), ProtocolGraphsync)
+	if err != nil {
+		t.Fatal("Unable to open stream")
+	}
+	defer s.Close()
+
+	expectMessage := func(id graphsync.RequestID) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive message sent")
+		case <-r.messageReceived:
+		}
+		requests := r.lastMessage.Requests()
+		if len(requests) != 1 || requests[0].ID() != id {
+			t.Fatal("received wrong message")
+		}
+	}
+
+	root := testutil.GenerateCids(1)[0]
+	id1 := graphsync.RequestID(rand.Int31())
+	good1 := gsmsg.New()
+	good1.AddRequest(gsmsg.NewRequest(id1, root, testutil.RandomBytes(100), graphsync.Priority(rand.Int31())))
+	err = good1.ToNet(s)
+	if err != nil {
+		t.Fatal("Unable to send message")
+	}
+	expectMessage(id1)
+
+	// a correctly framed message whose contents are not valid protobuf: field
+	// 1 with the nonexistent wire type 7
+	_, err = s.Write([]byte{3, 0x0f, 0x0f, 0x0f})
+	if err != nil {
+		t.Fatal("Unable to send corrupt message")
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not report corrupt message")
+	case <-r.errorsReceived:
+	}
+
+	id2 := graphsync.RequestID(rand.Int31())
+	good2 := gsmsg.New()
+	good2.AddRequest(gsmsg.NewRequest(id2, root, testutil.RandomBytes(100), graphsync.Priority(rand.Int31())))
+	err = good2.ToNet(s)
+	if err != nil {
+		t.Fatal("Unable to send message")
+	}
+	expectMessage(id2)
+}
+
+type streamClose struct {
+	p            peer.ID
+	bytesRead    uint64
+	bytesWritten uint64
+}
+
+type recordingStreamMetrics struct {
+	lk           sync.Mutex
+	opened       []network.Direction
+	bytesRead    uint64
+	bytesWritten uint64
+	closed       chan streamClose
+}
+
+func (rsm *recordingStreamMetrics) StreamOpened(p peer.ID, direction network.Direction) {
+	rsm.lk.Lock()
+	rsm.opened = append(rsm.opened, direction)
+	rsm.lk.Unlock()
+}
+
+func (rsm *recordingStreamMetrics) StreamRead(p peer.ID, n int) {
+	rsm.lk.Lock()
+	rsm.bytesRead += uint64(n)
+	rsm.lk.Unlock()
+}
+
+func (rsm *recordingStreamMetrics) StreamWritten(p peer.ID, n int) {
+	rsm.lk.Lock()
+	rsm.bytesWritten += uint64(n)
+	rsm.lk.Unlock()
+}
+
+func (rsm *recordingStreamMetrics) StreamClosed(p peer.ID, bytesRead uint64, bytesWritten uint64, lifetime time.Duration) {
+	rsm.closed <- streamClose{p, bytesRead, bytesWritten}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	host1, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	host2, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal("error generating host")
+	}
+	err = mn.LinkAll()
+	if err != nil {
+		t.Fatal("error linking hosts")
+	}
+	metrics1 := &recordingStreamMetrics{closed: make(chan streamClose, 1)}
+	metrics2 := &recordingStreamMetrics{closed: make(chan streamClose, 1)}
+	gsnet1 := NewFromLibp2pHost(host1, WithStreamMetrics(metrics1))
+	gsnet2 := NewFromLibp2pHost(host2, WithStreamMetrics(metrics2))
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	id := graphsync.RequestID(rand.Int31())
+	sent := gsmsg.New()
+	sent.AddRequest(gsmsg.NewRequest(id, testutil.GenerateCids(1)[0], testutil.RandomBytes(100), graphsync.Priority(0)))
+	var framed bytes.Buffer
+	err = sent.ToNet(&framed)
+	if err != nil {
+		t.Fatal("unable to serialize message")
+	}
+	expectedBytes := uint64(framed.Len())
+
+	err = gsnet1.SendMessage(ctx, host2.ID(), sent)
+	if err != nil {
+		t.Fatal("unable to send message")
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not receive message sent")
+	case <-r.messageReceived:
+	}
+
+	var senderClose, receiverClose streamClose
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not close sending stream")
+	case senderClose = <-metrics1.closed:
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("did not close receiving stream")
+	case receiverClose = <-metrics2.closed:
+	}
+
+	if senderClose.p != host2.ID() || senderClose.bytesWritten != expectedBytes {
+		t.Fatal("sending stream did not report bytes written to receiver")
+	}
+	if receiverClose.p != host1.ID() || receiverClose.bytesRead != expectedBytes || receiverClose.bytesWritten != 0 {
+		t.Fatal("receiving stream did not report bytes read from sender")
+	}
+
+	metrics1.lk.Lock()
+	defer metrics1.lk.Unlock()
+	metrics2.lk.Lock()
+	defer metrics2.lk.Unlock()
+	if !reflect.DeepEqual(metrics1.opened, []network.Direction{network.DirOutbound}) ||
+		!reflect.DeepEqual(metrics2.opened, []network.Direction{network.DirInbound}) {
+		t.Fatal("did not report stream opens")
+	}
+	if metrics1.bytesWritten != expectedBytes || metrics2.bytesRead != expectedBytes {
+		t.Fatal("per write and read hooks did not add up to message size")
+	}
+}
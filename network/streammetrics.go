@@ -0,0 +1,111 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// StreamMetrics is notified of activity on every graphsync stream, at the
+// transport level -- byte counts include message framing, not just the
+// messages themselves.
+type StreamMetrics interface {
+	// StreamOpened is called when a stream to or from the peer opens
+	StreamOpened(p peer.ID, direction network.Direction)
+
+	// StreamRead is called for each read of n bytes from a stream
+	StreamRead(p peer.ID, n int)
+
+	// StreamWritten is called for each write of n bytes to a stream
+	StreamWritten(p peer.ID, n int)
+
+	// StreamClosed is called once when a stream is closed or reset, with the
+	// total bytes read from and written to it, and how long it was open
+	StreamClosed(p peer.ID, bytesRead uint64, bytesWritten uint64, lifetime time.Duration)
+}
+
+// NoopStreamMetrics is the default StreamMetrics, which ignores all events
+type NoopStreamMetrics struct{}
+
+// StreamOpened does nothing
+func (NoopStreamMetrics) StreamOpened(peer.ID, network.Direction) {}
+
+// StreamRead does nothing
+func (NoopStreamMetrics) StreamRead(peer.ID, int) {}
+
+// StreamWritten does nothing
+func (NoopStreamMetrics) StreamWritten(peer.ID, int) {}
+
+// StreamClosed does nothing
+func (NoopStreamMetrics) StreamClosed(peer.ID, uint64, uint64, time.Duration) {}
+
+// meteredStream reports reads, writes, and the close of a stream to
+// StreamMetrics
+type meteredStream struct {
+	// updated atomically, so kept first to stay 64-bit aligned on 32-bit
+	// platforms
+	bytesRead    uint64
+	bytesWritten uint64
+
+	Stream
+	p         peer.ID
+	metrics   StreamMetrics
+	opened    time.Time
+	closeOnce sync.Once
+}
+
+func newMeteredStream(s Stream, direction network.Direction, metrics StreamMetrics) *meteredStream {
+	ms := &meteredStream{
+		Stream:  s,
+		p:       s.RemotePeer(),
+		metrics: metrics,
+		opened:  time.Now(),
+	}
+	metrics.StreamOpened(ms.p, direction)
+	return ms
+}
+
+func (ms *meteredStream) Read(b []byte) (int, error) {
+	n, err := ms.Stream.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&ms.bytesRead, uint64(n))
+		ms.metrics.StreamRead(ms.p, n)
+	}
+	return n, err
+}
+
+func (ms *meteredStream) Write(b []byte) (int, error) {
+	n, err := ms.Stream.Write(b)
+	if n > 0 {
+		atomic.AddUint64(&ms.bytesWritten, uint64(n))
+		ms.metrics.StreamWritten(ms.p, n)
+	}
+	return n, err
+}
+
+func (ms *meteredStream) Close() error {
+	err := ms.Stream.Close()
+	ms.closed()
+	return err
+}
+
+func (ms *meteredStream) FullClose() error {
+	err := ms.Stream.FullClose()
+	ms.closed()
+	return err
+}
+
+func (ms *meteredStream) Reset() error {
+	err := ms.Stream.Reset()
+	ms.closed()
+	return err
+}
+
+func (ms *meteredStream) closed() {
+	ms.closeOnce.Do(func() {
+		ms.metrics.StreamClosed(ms.p, atomic.LoadUint64(&ms.bytesRead), atomic.LoadUint64(&ms.bytesWritten), time.Since(ms.opened))
+	})
+}
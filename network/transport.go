@@ -0,0 +1,237 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Stream is a single stream of bytes between two peers, which carries
+// graphsync messages in one direction
+type Stream interface {
+	io.Reader
+	io.Writer
+
+	// SetWriteDeadline sets the time after which writes fail, with the zero
+	// time meaning no deadline
+	SetWriteDeadline(time.Time) error
+
+	// Close closes the stream once everything written has been sent, without
+	// waiting for the other end to read it
+	Close() error
+
+	// FullClose closes the stream and waits for the other end to close it
+	// too, resetting it if the other end does not
+	FullClose() error
+
+	// Reset closes the stream at once in both directions, dropping anything
+	// not yet sent
+	Reset() error
+
+	// RemotePeer is the peer at the other end of the stream
+	RemotePeer() peer.ID
+
+	// Protocol is the protocol the stream was opened for
+	Protocol() protocol.ID
+}
+
+// Transport is the connectivity a GraphSyncNetwork is built on: streams to
+// and from peers, and notice of peers connecting and disconnecting.
+type Transport interface {
+	// NewStream opens a stream to the given peer, connecting to it first if
+	// need be
+	NewStream(context.Context, peer.ID) (Stream, error)
+
+	// Connect establishes a connection to a peer, at the given addresses if
+	// there are any
+	Connect(context.Context, peer.AddrInfo) error
+
+	// SetHandler registers the TransportHandler to pass streams opened by
+	// other peers, and connection events, to
+	SetHandler(TransportHandler)
+}
+
+// TransportHandler handles what a Transport receives from other peers
+type TransportHandler interface {
+	// HandleStream reads a stream another peer opened, closing it when done
+	HandleStream(Stream)
+
+	Connected(p peer.ID)
+	Disconnected(p peer.ID)
+}
+
+// NewFromTransport returns a GraphSyncNetwork that sends and receives messages
+// over streams from the given Transport.
+func NewFromTransport(transport Transport, options ...Option) GraphSyncNetwork {
+	graphSyncNetwork := transportGraphSyncNetwork{
+		transport: transport,
+		metrics:   NoopStreamMetrics{},
+	}
+	for _, option := range options {
+		option(&graphSyncNetwork)
+	}
+
+	return &graphSyncNetwork
+}
+
+// transportGraphSyncNetwork transforms a Transport, which sends and receives
+// bytes on streams, into the graphsync network interface.
+type transportGraphSyncNetwork struct {
+	transport Transport
+	// inbound messages from the network are forwarded to the receiver
+	receiver Receiver
+	metrics  StreamMetrics
+}
+
+type streamMessageSender struct {
+	s Stream
+}
+
+func (s *streamMessageSender) Close() error {
+	return s.s.FullClose()
+}
+
+func (s *streamMessageSender) Reset() error {
+	return s.s.Reset()
+}
+
+func (s *streamMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	return msgToStream(ctx, s.s, msg)
+}
+
+func msgToStream(ctx context.Context, s Stream, msg gsmsg.GraphSyncMessage) error {
+	log.Debugf("Outgoing message with %d requests, %d responses, and %d blocks",
+		len(msg.Requests()), len(msg.Responses()), len(msg.Blocks()))
+
+	deadline := time.Now().Add(sendMessageTimeout)
+	if dl, ok := ctx.Deadline(); ok {
+		deadline = dl
+	}
+	if err := s.SetWriteDeadline(deadline); err != nil {
+		log.Warningf("error setting deadline: %s", err)
+	}
+
+	switch s.Protocol() {
+	case ProtocolGraphsync:
+		if err := msg.ToNet(s); err != nil {
+			log.Debugf("error: %s", err)
+			return err
+		}
+	default:
+		return fmt.Errorf("unrecognized protocol on remote: %s", s.Protocol())
+	}
+
+	if err := s.SetWriteDeadline(time.Time{}); err != nil {
+		log.Warningf("error resetting deadline: %s", err)
+	}
+	return nil
+}
+
+func (gsnet *transportGraphSyncNetwork) NewMessageSender(ctx context.Context, p peer.ID) (MessageSender, error) {
+	s, err := gsnet.newStreamToPeer(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamMessageSender{s: s}, nil
+}
+
+func (gsnet *transportGraphSyncNetwork) newStreamToPeer(ctx context.Context, p peer.ID) (Stream, error) {
+	s, err := gsnet.transport.NewStream(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return newMeteredStream(s, network.DirOutbound, gsnet.metrics), nil
+}
+
+func (gsnet *transportGraphSyncNetwork) SendMessage(
+	ctx context.Context,
+	p peer.ID,
+	outgoing gsmsg.GraphSyncMessage) error {
+
+	s, err := gsnet.newStreamToPeer(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	if err = msgToStream(ctx, s, outgoing); err != nil {
+		s.Reset()
+		return err
+	}
+
+	return s.Close()
+}
+
+func (gsnet *transportGraphSyncNetwork) SetDelegate(r Receiver) {
+	gsnet.receiver = r
+	gsnet.transport.SetHandler((*transportHandler)(gsnet))
+}
+
+func (gsnet *transportGraphSyncNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	return gsnet.transport.Connect(ctx, peer.AddrInfo{ID: p})
+}
+
+// ConnectToAddrs connects using the given addresses, which the transport may
+// keep to reach the peer at later
+func (gsnet *transportGraphSyncNetwork) ConnectToAddrs(ctx context.Context, info peer.AddrInfo) error {
+	return gsnet.transport.Connect(ctx, info)
+}
+
+// transportHandler receives streams and connection events from the transport
+type transportHandler transportGraphSyncNetwork
+
+func (th *transportHandler) transportGraphSyncNetwork() *transportGraphSyncNetwork {
+	return (*transportGraphSyncNetwork)(th)
+}
+
+// HandleStream receives a new stream from the network.
+func (th *transportHandler) HandleStream(stream Stream) {
+	gsnet := th.transportGraphSyncNetwork()
+	s := newMeteredStream(stream, network.DirInbound, gsnet.metrics)
+	defer s.Close()
+
+	if gsnet.receiver == nil {
+		s.Reset()
+		return
+	}
+
+	p := s.RemotePeer()
+	reader := newFrameReader(s, network.MessageSizeMax)
+	for {
+		frame, err := reader.readFrame()
+		if err != nil {
+			if err != io.EOF {
+				s.Reset()
+				go gsnet.receiver.ReceiveError(err)
+				log.Debugf("graphsync net handleNewStream from %s error: %s", p, err)
+			}
+			return
+		}
+		// the whole frame has been read, so a message that cannot be decoded
+		// is skipped without disturbing other requests on the stream
+		received, err := gsmsg.FromBytes(frame)
+		if err != nil {
+			go gsnet.receiver.ReceiveError(err)
+			log.Debugf("graphsync net handleNewStream from %s skipped malformed message: %s", p, err)
+			continue
+		}
+
+		ctx := context.Background()
+		log.Debugf("graphsync net handleNewStream from %s", p)
+		gsnet.receiver.ReceiveMessage(ctx, p, received)
+	}
+}
+
+func (th *transportHandler) Connected(p peer.ID) {
+	th.transportGraphSyncNetwork().receiver.Connected(p)
+}
+
+func (th *transportHandler) Disconnected(p peer.ID) {
+	th.transportGraphSyncNetwork().receiver.Disconnected(p)
+}
@@ -0,0 +1,175 @@
+package nonce
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const nonceSize = 16
+
+var (
+	// ErrStaleNonce means a request's nonce timestamp is outside the window
+	// the responder accepts
+	ErrStaleNonce = errors.New("request nonce is stale")
+	// ErrDuplicateNonce means a request reused a nonce already seen from the
+	// same peer within the window, and is likely a replay
+	ErrDuplicateNonce = errors.New("request nonce was already used")
+	// ErrMissingNonce means a request sent to a responder that requires nonces
+	// did not have one
+	ErrMissingNonce = errors.New("request has no nonce")
+)
+
+// Nonce is a random value and timestamp that identifies a single request, sent
+// in the graphsync.ExtensionNonce extension
+type Nonce struct {
+	Value     []byte
+	Timestamp time.Time
+}
+
+// New generates a fresh nonce for the current time
+func New() (Nonce, error) {
+	value := make([]byte, nonceSize)
+	_, err := rand.Read(value)
+	if err != nil {
+		return Nonce{}, err
+	}
+	return Nonce{value, time.Now()}, nil
+}
+
+// NewExtension generates a fresh nonce and encodes it as extension data to
+// send with a request
+func NewExtension(ipldBridge ipldbridge.IPLDBridge) (graphsync.ExtensionData, error) {
+	n, err := New()
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	data, err := EncodeNonce(n, ipldBridge)
+	if err != nil {
+		return graphsync.ExtensionData{}, err
+	}
+	return graphsync.ExtensionData{Name: graphsync.ExtensionNonce, Data: data}, nil
+}
+
+// DecodeNonce assembles a nonce from a raw byte array, first deserializing
+// as a node and then assembling into a nonce struct.
+func DecodeNonce(data []byte, ipldBridge ipldbridge.IPLDBridge) (Nonce, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return Nonce{}, err
+	}
+	var n Nonce
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		n.Value = simpleNode.LookupString("value").AsBytes()
+		n.Timestamp = time.Unix(0, int64(simpleNode.LookupString("timestamp").AsInt()))
+	})
+	if err != nil {
+		return Nonce{}, err
+	}
+	return n, nil
+}
+
+// EncodeNonce encodes a nonce to an IPLD node then serializes to raw bytes
+func EncodeNonce(n Nonce, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateMap(func(mb ipldbridge.MapBuilder, knb ipldbridge.NodeBuilder, vnb ipldbridge.NodeBuilder) {
+			mb.Insert(knb.CreateString("value"), vnb.CreateBytes(n.Value))
+			mb.Insert(knb.CreateString("timestamp"), vnb.CreateInt(int(n.Timestamp.UnixNano())))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
+
+// ReplayGuard rejects incoming requests whose nonce is stale or has already
+// been seen from the same peer. It remembers the nonces from each peer for the
+// length of its window, which also bounds how far a nonce's timestamp may be
+// from the responder's clock.
+type ReplayGuard struct {
+	window       time.Duration
+	ipldBridge   ipldbridge.IPLDBridge
+	now          func() time.Time
+	requireNonce bool
+
+	seenLk sync.Mutex
+	seen   map[peer.ID]map[string]time.Time
+}
+
+// NewReplayGuard creates a ReplayGuard that accepts nonces within the given
+// window of the current time.
+func NewReplayGuard(window time.Duration, ipldBridge ipldbridge.IPLDBridge) *ReplayGuard {
+	return &ReplayGuard{
+		window:     window,
+		ipldBridge: ipldBridge,
+		now:        time.Now,
+		seen:       make(map[peer.ID]map[string]time.Time),
+	}
+}
+
+// RequireNonce makes the guard also terminate requests that have no nonce,
+// which otherwise pass through it unchecked.
+func (rg *ReplayGuard) RequireNonce() {
+	rg.requireNonce = true
+}
+
+// RequestReceivedHook is a graphsync.OnRequestReceivedHook that terminates
+// requests with a stale or duplicate nonce. Unless the guard requires nonces,
+// requests without one are left to other hooks, so a request signing scheme
+// should cover the nonce extension for replays to be detected.
+func (rg *ReplayGuard) RequestReceivedHook(p peer.ID, request graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+	data, ok := request.Extension(graphsync.ExtensionNonce)
+	if !ok {
+		if rg.requireNonce {
+			hookActions.TerminateWithError(ErrMissingNonce)
+		}
+		return
+	}
+	n, err := DecodeNonce(data, rg.ipldBridge)
+	if err != nil {
+		hookActions.TerminateWithError(err)
+		return
+	}
+	err = rg.checkNonce(p, n)
+	if err != nil {
+		hookActions.TerminateWithError(err)
+	}
+}
+
+func (rg *ReplayGuard) checkNonce(p peer.ID, n Nonce) error {
+	now := rg.now()
+	if n.Timestamp.Before(now.Add(-rg.window)) || n.Timestamp.After(now.Add(rg.window)) {
+		return ErrStaleNonce
+	}
+
+	rg.seenLk.Lock()
+	defer rg.seenLk.Unlock()
+	seenForPeer, ok := rg.seen[p]
+	if !ok {
+		seenForPeer = make(map[string]time.Time)
+		rg.seen[p] = seenForPeer
+	}
+	// forget nonces old enough to be rejected as stale anyway
+	for value, timestamp := range seenForPeer {
+		if timestamp.Before(now.Add(-rg.window)) {
+			delete(seenForPeer, value)
+		}
+	}
+	if _, ok := seenForPeer[string(n.Value)]; ok {
+		return ErrDuplicateNonce
+	}
+	seenForPeer[string(n.Value)] = n.Timestamp
+	return nil
+}
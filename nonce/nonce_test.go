@@ -0,0 +1,123 @@
+package nonce
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type fakeHookActions struct {
+	err error
+}
+
+func (fha *fakeHookActions) SendExtensionData(graphsync.ExtensionData)           {}
+func (fha *fakeHookActions) SendPersistentExtensionData(graphsync.ExtensionData) {}
+func (fha *fakeHookActions) TerminateWithError(err error)                        { fha.err = err }
+func (fha *fakeHookActions) ValidateRequest()                                    {}
+func (fha *fakeHookActions) RequestScratch() graphsync.RequestScratch            { return nil }
+func (fha *fakeHookActions) PushSubtrees(...cid.Cid)                             {}
+func (fha *fakeHookActions) Redirect(cid.Cid)                                    {}
+
+// fakeRequestData presents a request to the hook the way a responder does
+type fakeRequestData struct {
+	gsmsg.GraphSyncRequest
+}
+
+func (frd fakeRequestData) RequestScratch() graphsync.RequestScratch {
+	return graphsync.NewRequestScratch()
+}
+
+func TestDecodeEncodeNonce(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	n, err := New()
+	if err != nil {
+		t.Fatal("Error generating nonce")
+	}
+	encoded, err := EncodeNonce(n, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeNonce(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if !reflect.DeepEqual(n.Value, decoded.Value) || !n.Timestamp.Equal(decoded.Timestamp) {
+		t.Fatal("Nonce changed during encoding and decoding")
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	bridge := ipldbridge.NewIPLDBridge()
+	peers := testutil.GeneratePeers(2)
+	root := testutil.GenerateCids(1)[0]
+	now := time.Now()
+	window := time.Minute
+	replayGuard := NewReplayGuard(window, bridge)
+	replayGuard.now = func() time.Time { return now }
+
+	requestWithNonce := func(n Nonce) gsmsg.GraphSyncRequest {
+		data, err := EncodeNonce(n, bridge)
+		if err != nil {
+			t.Fatal("Error encoding nonce")
+		}
+		return gsmsg.NewRequest(graphsync.RequestID(1), root, nil, 0, graphsync.ExtensionData{
+			Name: graphsync.ExtensionNonce,
+			Data: data,
+		})
+	}
+	runHook := func(request gsmsg.GraphSyncRequest, p int) error {
+		hookActions := &fakeHookActions{}
+		replayGuard.RequestReceivedHook(peers[p], fakeRequestData{request}, hookActions)
+		return hookActions.err
+	}
+
+	n, err := New()
+	if err != nil {
+		t.Fatal("Error generating nonce")
+	}
+	n.Timestamp = now
+	request := requestWithNonce(n)
+	if runHook(request, 0) != nil {
+		t.Fatal("Should have accepted fresh request")
+	}
+	if runHook(request, 0) != ErrDuplicateNonce {
+		t.Fatal("Should have rejected replayed request")
+	}
+	if runHook(request, 1) != nil {
+		t.Fatal("Should track nonces separately for each peer")
+	}
+
+	fresh, err := New()
+	if err != nil {
+		t.Fatal("Error generating nonce")
+	}
+	fresh.Timestamp = now
+	if runHook(requestWithNonce(fresh), 0) != nil {
+		t.Fatal("Should have accepted request with fresh nonce")
+	}
+
+	stale := Nonce{testutil.RandomBytes(nonceSize), now.Add(-2 * window)}
+	if runHook(requestWithNonce(stale), 0) != ErrStaleNonce {
+		t.Fatal("Should have rejected request with stale nonce")
+	}
+
+	if runHook(gsmsg.NewRequest(graphsync.RequestID(2), root, nil, 0), 0) != nil {
+		t.Fatal("Should leave requests without nonce to other hooks")
+	}
+	replayGuard.RequireNonce()
+	if runHook(gsmsg.NewRequest(graphsync.RequestID(3), root, nil, 0), 0) != ErrMissingNonce {
+		t.Fatal("Should have rejected request without nonce once nonces are required")
+	}
+
+	// once the window passes, the nonce is forgotten but now stale
+	now = now.Add(2 * window)
+	if runHook(request, 0) != ErrStaleNonce {
+		t.Fatal("Should have rejected replayed request after window")
+	}
+}
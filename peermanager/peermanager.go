@@ -89,6 +89,18 @@ func (pm *PeerManager) GetProcess(
 	return pqi.process
 }
 
+// Process returns the process for the given peer, if it has one, without
+// creating it
+func (pm *PeerManager) Process(p peer.ID) (PeerProcess, bool) {
+	pm.peerProcessesLk.RLock()
+	defer pm.peerProcessesLk.RUnlock()
+	pqi, ok := pm.peerProcesses[p]
+	if !ok {
+		return nil, false
+	}
+	return pqi.process, true
+}
+
 func (pm *PeerManager) getOrCreate(p peer.ID) *peerProcessInstance {
 	pqi, ok := pm.peerProcesses[p]
 	if !ok {
@@ -0,0 +1,49 @@
+package persistentextensions
+
+import (
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+)
+
+// DecodeNames assembles the list of persistent extension names from a raw
+// byte array, first deserializing as a node and then reading a list of strings.
+func DecodeNames(data []byte, ipldBridge ipldbridge.IPLDBridge) ([]graphsync.ExtensionName, error) {
+	node, err := ipldBridge.DecodeNode(data)
+	if err != nil {
+		return nil, err
+	}
+	var names []graphsync.ExtensionName
+	err = fluent.Recover(func() {
+		simpleNode := fluent.WrapNode(node)
+		iterator := simpleNode.ListIterator()
+		for !iterator.Done() {
+			_, item := iterator.Next()
+			names = append(names, graphsync.ExtensionName(item.AsString()))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// EncodeNames encodes a list of persistent extension names to an IPLD node
+// then serializes to raw bytes
+func EncodeNames(names []graphsync.ExtensionName, ipldBridge ipldbridge.IPLDBridge) ([]byte, error) {
+	var node ipld.Node
+	err := fluent.Recover(func() {
+		nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+		node = nb.CreateList(func(lb ipldbridge.ListBuilder, nb ipldbridge.NodeBuilder) {
+			for _, name := range names {
+				lb.Append(nb.CreateString(string(name)))
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ipldBridge.EncodeNode(node)
+}
@@ -0,0 +1,25 @@
+package persistentextensions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testbridge"
+)
+
+func TestDecodeEncodeNames(t *testing.T) {
+	names := []graphsync.ExtensionName{"graphsync/awesome", "graphsync/even-more-awesome"}
+	bridge := testbridge.NewMockIPLDBridge()
+	encoded, err := EncodeNames(names, bridge)
+	if err != nil {
+		t.Fatal("Error encoding")
+	}
+	decoded, err := DecodeNames(encoded, bridge)
+	if err != nil {
+		t.Fatal("Error decoding")
+	}
+	if !reflect.DeepEqual(names, decoded) {
+		t.Fatal("Names changed during encoding and decoding")
+	}
+}
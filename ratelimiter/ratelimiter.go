@@ -0,0 +1,50 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter paces a stream of byte transfers so that, over time, they do
+// not exceed a fixed number of bytes per second.
+type RateLimiter struct {
+	bytesPerSec uint64
+
+	nextLk sync.Mutex
+	next   time.Time
+}
+
+// New returns a new RateLimiter for the given number of bytes per second.
+func New(bytesPerSec uint64) *RateLimiter {
+	return &RateLimiter{bytesPerSec: bytesPerSec}
+}
+
+// Wait blocks until n more bytes can be transferred without exceeding
+// the rate limit, or until the context is cancelled. Each transfer is charged
+// before Wait returns, so the total time to transfer a payload is
+// always at least its size divided by the rate.
+func (rl *RateLimiter) Wait(ctx context.Context, n int) error {
+	if n <= 0 || rl.bytesPerSec == 0 {
+		return nil
+	}
+	cost := time.Duration(uint64(n) * uint64(time.Second) / rl.bytesPerSec)
+
+	rl.nextLk.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	rl.next = rl.next.Add(cost)
+	wait := rl.next.Sub(now)
+	rl.nextLk.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPacesTransfers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	rateLimiter := New(10000)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		err := rateLimiter.Wait(ctx, 1000)
+		if err != nil {
+			t.Fatal("should not have errored waiting")
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 500*time.Millisecond {
+		t.Fatal("should have taken at least size / rate to transfer")
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	rateLimiter := New(1)
+
+	err := rateLimiter.Wait(ctx, 1000)
+	if err == nil {
+		t.Fatal("should have errored when context was cancelled")
+	}
+}
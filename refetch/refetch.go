@@ -0,0 +1,138 @@
+// Package refetch checks that fetching the same root and selector more than
+// once, from one peer or from several, yields the same blocks, so data can be
+// shown to be distributed reproducibly.
+package refetch
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/metadata"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Source is an exchange to fetch with and the peer to fetch from
+type Source struct {
+	Exchange graphsync.GraphExchange
+	Peer     peer.ID
+}
+
+// Divergence lists the blocks sent for one of two fetches of the same root
+// and selector but not for the other
+type Divergence struct {
+	OnlyFirst  []cid.Cid
+	OnlySecond []cid.Cid
+}
+
+// Diverged is true if the two fetches were not sent the same blocks
+func (d Divergence) Diverged() bool {
+	return len(d.OnlyFirst) != 0 || len(d.OnlySecond) != 0
+}
+
+// Compare fetches root with the selector from the first source and then from
+// the second, and returns the blocks sent for one fetch but not the other.
+// The blocks sent are those listed in the response metadata, including any
+// the traversal never reaches. The extensions are sent with both fetches, and
+// the first error either fetch reports is returned.
+//
+// Each source's exchange should be made for the comparison, with an empty
+// store, and the two sources may name the same peer. A fetch of blocks the
+// exchange already stores finishes locally, without waiting for what the
+// responder sends, and Compare registers a response hook on each exchange
+// that records every response it receives.
+func Compare(ctx context.Context, bridge ipldbridge.IPLDBridge, first Source, second Source, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (Divergence, error) {
+	firstBlocks, err := fetch(ctx, bridge, first, root, selector, extensions)
+	if err != nil {
+		return Divergence{}, err
+	}
+	secondBlocks, err := fetch(ctx, bridge, second, root, selector, extensions)
+	if err != nil {
+		return Divergence{}, err
+	}
+	return Divergence{
+		OnlyFirst:  difference(firstBlocks, secondBlocks),
+		OnlySecond: difference(secondBlocks, firstBlocks),
+	}, nil
+}
+
+// fetch makes a single request and returns the blocks sent for it
+func fetch(ctx context.Context, bridge ipldbridge.IPLDBridge, source Source, root ipld.Link, selector ipld.Node, extensions []graphsync.ExtensionData) (map[cid.Cid]struct{}, error) {
+	var receivedLk sync.Mutex
+	received := make(map[cid.Cid]struct{})
+	err := source.Exchange.RegisterResponseReceivedHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		receivedLk.Lock()
+		defer receivedLk.Unlock()
+		recordSent(bridge, responseData, received)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	progress, errs := source.Exchange.Request(ctx, source.Peer, root, selector, extensions...)
+	var fetchErr error
+	for progress != nil || errs != nil {
+		select {
+		case _, ok := <-progress:
+			if !ok {
+				progress = nil
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if fetchErr == nil {
+				fetchErr = err
+			}
+		}
+	}
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	receivedLk.Lock()
+	defer receivedLk.Unlock()
+	return received, nil
+}
+
+// recordSent adds the blocks a response's metadata says were sent to the set
+func recordSent(bridge ipldbridge.IPLDBridge, responseData graphsync.ResponseData, sent map[cid.Cid]struct{}) {
+	data, ok := responseData.Extension(graphsync.ExtensionMetadata)
+	if !ok {
+		return
+	}
+	md, err := metadata.DecodeMetadata(data, bridge)
+	if err != nil {
+		return
+	}
+	for _, item := range md {
+		if !item.BlockPresent {
+			continue
+		}
+		blockCid, err := ipldbridge.LinkCid(item.Link)
+		if err != nil {
+			continue
+		}
+		sent[blockCid] = struct{}{}
+	}
+}
+
+// difference returns the cids in a but not b, in a stable order
+func difference(a map[cid.Cid]struct{}, b map[cid.Cid]struct{}) []cid.Cid {
+	var cids []cid.Cid
+	for c := range a {
+		if _, ok := b[c]; !ok {
+			cids = append(cids, c)
+		}
+	}
+	sort.Slice(cids, func(i, j int) bool {
+		return cids[i].KeyString() < cids[j].KeyString()
+	})
+	return cids
+}
@@ -0,0 +1,150 @@
+package refetch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metadata"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/refetch"
+	"github.com/ipfs/go-graphsync/testbridge"
+	"github.com/ipfs/go-graphsync/testutil"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// extraBlockResponder answers every request with the blocks it is given in
+// order, followed by a block no selector reaches
+type extraBlockResponder struct {
+	ctx   context.Context
+	net   gsnet.GraphSyncNetwork
+	store map[ipld.Link][]byte
+	links []ipld.Link
+	extra blocks.Block
+}
+
+func (ebr *extraBlockResponder) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	for _, request := range incoming.Requests() {
+		if request.IsCancel() {
+			continue
+		}
+		var md metadata.Metadata
+		response := gsmsg.New()
+		for _, link := range ebr.links {
+			blk, _ := blocks.NewBlockWithCid(ebr.store[link], link.(cidlink.Link).Cid)
+			response.AddBlock(blk)
+			md = append(md, metadata.Item{Link: link, BlockPresent: true})
+		}
+		response.AddBlock(ebr.extra)
+		md = append(md, metadata.Item{Link: cidlink.Link{Cid: ebr.extra.Cid()}, BlockPresent: true})
+		mdData, _ := metadata.EncodeMetadata(md, ipldbridge.NewIPLDBridge())
+		response.AddResponse(gsmsg.NewResponse(request.ID(), graphsync.RequestCompletedFull,
+			graphsync.ExtensionData{Name: graphsync.ExtensionMetadata, Data: mdData}))
+		_ = ebr.net.SendMessage(ebr.ctx, sender, response)
+	}
+}
+
+func (ebr *extraBlockResponder) ReceiveError(err error) {}
+
+func (ebr *extraBlockResponder) Connected(p peer.ID) {}
+
+func (ebr *extraBlockResponder) Disconnected(p peer.ID) {}
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	mn := mocknet.New(ctx)
+	newNetwork := func() (peer.ID, gsnet.GraphSyncNetwork) {
+		host, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal("error generating host")
+		}
+		if err := mn.LinkAll(); err != nil {
+			t.Fatal("error linking hosts")
+		}
+		return host.ID(), gsnet.NewFromLibp2pHost(host)
+	}
+	bridge := ipldbridge.NewIPLDBridge()
+
+	// a root linking to two leaves, stored on the responder
+	responderStore := make(map[ipld.Link][]byte)
+	responderLoader, responderStorer := testbridge.NewMockStore(responderStore)
+	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
+	nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+	var leafLinks []ipld.Link
+	for _, leaf := range []string{"apple", "banana"} {
+		leafLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, nb.CreateString(leaf), responderStorer)
+		if err != nil {
+			t.Fatal("error storing leaf")
+		}
+		leafLinks = append(leafLinks, leafLink)
+	}
+	root := nb.CreateList(func(lb fluent.ListBuilder, vnb fluent.NodeBuilder) {
+		for _, leafLink := range leafLinks {
+			lb.Append(vnb.CreateLink(leafLink))
+		}
+	})
+	rootLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, root, responderStorer)
+	if err != nil {
+		t.Fatal("error storing root")
+	}
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(10),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	// each fetch is made by a requestor of its own, with an empty store
+	newRequestor := func(p peer.ID) refetch.Source {
+		_, net := newNetwork()
+		loader, storer := testbridge.NewMockStore(make(map[ipld.Link][]byte))
+		return refetch.Source{Exchange: gsimpl.New(ctx, net, bridge, loader, storer), Peer: p}
+	}
+	responder, responderNet := newNetwork()
+	_ = gsimpl.New(ctx, responderNet, bridge, responderLoader, responderStorer)
+	misbehaving, misbehavingNet := newNetwork()
+	extra := blocks.NewBlock(testutil.RandomBytes(100))
+	misbehavingNet.SetDelegate(&extraBlockResponder{
+		ctx:   ctx,
+		net:   misbehavingNet,
+		store: responderStore,
+		links: append([]ipld.Link{rootLink}, leafLinks...),
+		extra: extra,
+	})
+
+	divergence, err := refetch.Compare(ctx, bridge, newRequestor(responder), newRequestor(responder), rootLink, allSelector)
+	if err != nil {
+		t.Fatal("error comparing fetches from the same peer")
+	}
+	if divergence.Diverged() {
+		t.Fatal("fetching twice from the same peer should not diverge")
+	}
+
+	divergence, err = refetch.Compare(ctx, bridge, newRequestor(responder), newRequestor(misbehaving), rootLink, allSelector)
+	if err != nil {
+		t.Fatal("error comparing fetches from different peers")
+	}
+	if !divergence.Diverged() {
+		t.Fatal("should have caught the extra block")
+	}
+	if len(divergence.OnlyFirst) != 0 {
+		t.Fatal("reported blocks missing from the misbehaving responder")
+	}
+	if len(divergence.OnlySecond) != 1 || !divergence.OnlySecond[0].Equals(extra.Cid()) {
+		t.Fatal("did not report the extra block")
+	}
+}
@@ -29,7 +29,9 @@ type AsyncLoader struct {
 	incomingMessages chan loaderMessage
 	outgoingMessages chan loaderMessage
 
-	activeRequests   map[graphsync.RequestID]bool
+	// the contexts of requests in progress, which loads from the local store
+	// are made with
+	activeRequests   map[graphsync.RequestID]context.Context
 	loadAttemptQueue *loadattemptqueue.LoadAttemptQueue
 	responseCache    *responsecache.ResponseCache
 }
@@ -37,33 +39,54 @@ type AsyncLoader struct {
 // New initializes a new link loading manager for asynchronous loads from the given context
 // and local store loading and storing function
 func New(ctx context.Context, loader ipld.Loader, storer ipld.Storer) *AsyncLoader {
+	return NewWithContextLoader(ctx, ipldbridge.IgnoreContext(loader), storer)
+}
+
+// NewWithContextLoader is like New, but loads from the local store with the
+// context the request was started with, so cancelling it aborts slow loads
+func NewWithContextLoader(ctx context.Context, loader ipldbridge.ContextLoader, storer ipld.Storer) *AsyncLoader {
 	unverifiedBlockStore := unverifiedblockstore.New(storer)
 	responseCache := responsecache.New(unverifiedBlockStore)
-	loadAttemptQueue := loadattemptqueue.New(func(requestID graphsync.RequestID, link ipld.Link) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	al := &AsyncLoader{
+		ctx:              ctx,
+		cancel:           cancel,
+		incomingMessages: make(chan loaderMessage),
+		outgoingMessages: make(chan loaderMessage),
+		activeRequests:   make(map[graphsync.RequestID]context.Context),
+		responseCache:    responseCache,
+	}
+	al.loadAttemptQueue = loadattemptqueue.New(func(requestID graphsync.RequestID, link ipld.Link) types.AsyncLoadResult {
 		// load from response cache
 		data, err := responseCache.AttemptLoad(requestID, link)
 		if data == nil && err == nil {
 			// fall back to local store
-			stream, loadErr := loader(link, ipldbridge.LinkContext{})
+			stream, loadErr := loader(al.requestContext(requestID), link, ipldbridge.LinkContext{})
 			if stream != nil && loadErr == nil {
 				localData, loadErr := ioutil.ReadAll(stream)
 				if loadErr == nil && localData != nil {
-					return localData, nil
+					// a block the responder listed as sent but that is not in
+					// the cache was never received, most likely because the
+					// responder sent it for another request
+					return types.AsyncLoadResult{
+						Data:    localData,
+						NotSent: responseCache.IsKnownPresentLink(requestID, link),
+					}
 				}
 			}
 		}
-		return data, err
+		return types.AsyncLoadResult{Data: data, Err: err}
 	})
-	ctx, cancel := context.WithCancel(ctx)
-	return &AsyncLoader{
-		ctx:              ctx,
-		cancel:           cancel,
-		incomingMessages: make(chan loaderMessage),
-		outgoingMessages: make(chan loaderMessage),
-		activeRequests:   make(map[graphsync.RequestID]bool),
-		responseCache:    responseCache,
-		loadAttemptQueue: loadAttemptQueue,
+	return al
+}
+
+// requestContext returns the context to load from the local store with for a
+// request, which is the loader's own once the request is no longer in progress
+func (al *AsyncLoader) requestContext(requestID graphsync.RequestID) context.Context {
+	if ctx, ok := al.activeRequests[requestID]; ok {
+		return ctx
 	}
+	return al.ctx
 }
 
 // Startup starts processing of messages
@@ -78,11 +101,12 @@ func (al *AsyncLoader) Shutdown() {
 }
 
 // StartRequest indicates the given request has started and the manager should
-// continually attempt to load links for this request as new responses come in
-func (al *AsyncLoader) StartRequest(requestID graphsync.RequestID) {
+// continually attempt to load links for this request as new responses come in.
+// Loads from the local store for the request are made with the given context.
+func (al *AsyncLoader) StartRequest(ctx context.Context, requestID graphsync.RequestID) {
 	select {
 	case <-al.ctx.Done():
-	case al.incomingMessages <- &startRequestMessage{requestID}:
+	case al.incomingMessages <- &startRequestMessage{ctx, requestID}:
 	}
 }
 
@@ -137,6 +161,7 @@ type newResponsesAvailableMessage struct {
 }
 
 type startRequestMessage struct {
+	ctx       context.Context
 	requestID graphsync.RequestID
 }
 
@@ -182,12 +207,12 @@ func (al *AsyncLoader) messageQueueWorker() {
 }
 
 func (lrm *loadRequestMessage) handle(al *AsyncLoader) {
-	retry := al.activeRequests[lrm.requestID]
+	_, retry := al.activeRequests[lrm.requestID]
 	al.loadAttemptQueue.AttemptLoad(lrm.loadRequest, retry)
 }
 
 func (srm *startRequestMessage) handle(al *AsyncLoader) {
-	al.activeRequests[srm.requestID] = true
+	al.activeRequests[srm.requestID] = srm.ctx
 }
 
 func (frm *finishRequestMessage) handle(al *AsyncLoader) {
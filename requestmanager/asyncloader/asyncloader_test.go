@@ -225,7 +225,7 @@ func TestAsyncLoadInitialLoadIndeterminateThenSucceeds(t *testing.T) {
 	asyncLoader.Startup()
 
 	requestID := graphsync.RequestID(rand.Int31())
-	asyncLoader.StartRequest(requestID)
+	asyncLoader.StartRequest(ctx, requestID)
 	resultChan := asyncLoader.AsyncLoad(requestID, link)
 
 	select {
@@ -287,7 +287,7 @@ func TestAsyncLoadInitialLoadIndeterminateThenFails(t *testing.T) {
 	asyncLoader.Startup()
 
 	requestID := graphsync.RequestID(rand.Int31())
-	asyncLoader.StartRequest(requestID)
+	asyncLoader.StartRequest(ctx, requestID)
 	resultChan := asyncLoader.AsyncLoad(requestID, link)
 
 	select {
@@ -344,7 +344,7 @@ func TestAsyncLoadInitialLoadIndeterminateThenRequestFinishes(t *testing.T) {
 	asyncLoader.Startup()
 
 	requestID := graphsync.RequestID(rand.Int31())
-	asyncLoader.StartRequest(requestID)
+	asyncLoader.StartRequest(ctx, requestID)
 	resultChan := asyncLoader.AsyncLoad(requestID, link)
 
 	select {
@@ -447,3 +447,65 @@ func TestAsyncLoadTwiceLoadsLocallySecondTime(t *testing.T) {
 		t.Fatal("should have stored block but didn't")
 	}
 }
+
+func TestAsyncLoadLocallyWhenResponderSkipsBlock(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	blockStore := make(map[ipld.Link][]byte)
+	loader, storer := testbridge.NewMockStore(blockStore)
+	block := testutil.GenerateBlocksOfSize(1, 100)[0]
+	writer, commit, err := storer(ipldbridge.LinkContext{})
+	_, err = writer.Write(block.RawData())
+	if err != nil {
+		t.Fatal("could not seed block store")
+	}
+	link := cidlink.Link{Cid: block.Cid()}
+	err = commit(link)
+	if err != nil {
+		t.Fatal("could not seed block store")
+	}
+
+	asyncLoader := New(ctx, loader, storer)
+	asyncLoader.Startup()
+
+	// the responder lists the block as sent, but does not send it
+	requestID := graphsync.RequestID(rand.Int31())
+	responses := map[graphsync.RequestID]metadata.Metadata{
+		requestID: metadata.Metadata{
+			metadata.Item{
+				Link:         link,
+				BlockPresent: true,
+			},
+		},
+	}
+	asyncLoader.ProcessResponse(responses, nil)
+	resultChan := asyncLoader.AsyncLoad(requestID, link)
+
+	select {
+	case result := <-resultChan:
+		if result.Err != nil {
+			t.Fatal("should not have sent an error")
+		}
+		if !reflect.DeepEqual(result.Data, block.RawData()) {
+			t.Fatal("should have loaded block from local store")
+		}
+		if !result.NotSent {
+			t.Fatal("should have noted the block was not sent")
+		}
+	case <-ctx.Done():
+		t.Fatal("should have closed response channel")
+	}
+
+	// a block loaded locally before the responder lists it is not flagged
+	otherRequestID := requestID + 1
+	resultChan = asyncLoader.AsyncLoad(otherRequestID, link)
+	select {
+	case result := <-resultChan:
+		if result.Data == nil || result.NotSent {
+			t.Fatal("should have loaded block locally without noting it as not sent")
+		}
+	case <-ctx.Done():
+		t.Fatal("should have closed response channel")
+	}
+}
@@ -26,10 +26,10 @@ func NewLoadRequest(requestID graphsync.RequestID,
 
 // LoadAttempter attempts to load a link to an array of bytes
 // it has three results:
-// bytes present, error nil = success
-// bytes nil, error present = error
-// bytes nil, error nil = did not load, but try again later
-type LoadAttempter func(graphsync.RequestID, ipld.Link) ([]byte, error)
+// data present, error nil = success
+// data nil, error present = error
+// data nil, error nil = did not load, but try again later
+type LoadAttempter func(graphsync.RequestID, ipld.Link) types.AsyncLoadResult
 
 // LoadAttemptQueue attempts to load using the load attempter, and then can
 // place requests on a retry queue
@@ -48,14 +48,14 @@ func New(loadAttempter LoadAttempter) *LoadAttemptQueue {
 // AttemptLoad attempts to loads the given load request, and if retry is true
 // it saves the loadrequest for retrying later
 func (laq *LoadAttemptQueue) AttemptLoad(lr LoadRequest, retry bool) {
-	response, err := laq.loadAttempter(lr.requestID, lr.link)
-	if err != nil {
-		lr.resultChan <- types.AsyncLoadResult{Data: nil, Err: err}
+	result := laq.loadAttempter(lr.requestID, lr.link)
+	if result.Err != nil {
+		lr.resultChan <- types.AsyncLoadResult{Data: nil, Err: result.Err}
 		close(lr.resultChan)
 		return
 	}
-	if response != nil {
-		lr.resultChan <- types.AsyncLoadResult{Data: response, Err: nil}
+	if result.Data != nil {
+		lr.resultChan <- result
 		close(lr.resultChan)
 		return
 	}
@@ -64,10 +64,23 @@ func (rc *ResponseCache) AttemptLoad(requestID graphsync.RequestID, link ipld.Li
 	if rc.linkTracker.IsKnownMissingLink(requestID, link) {
 		return nil, fmt.Errorf("Remote Peer Is Missing Block: %s", link.String())
 	}
-	data, _ := rc.unverifiedBlockStore.VerifyBlock(link)
+	data, err := rc.unverifiedBlockStore.VerifyBlock(link)
+	// a block not received yet may still arrive, but one that cannot be
+	// stored fails the load
+	if _, ok := err.(graphsync.StoreError); ok {
+		return nil, err
+	}
 	return data, nil
 }
 
+// IsKnownPresentLink returns whether a response for the given request listed
+// the given link as having its block sent
+func (rc *ResponseCache) IsKnownPresentLink(requestID graphsync.RequestID, link ipld.Link) bool {
+	rc.responseCacheLk.RLock()
+	defer rc.responseCacheLk.RUnlock()
+	return rc.linkTracker.IsKnownPresentLink(requestID, link)
+}
+
 // ProcessResponse processes incoming response data, adding unverified blocks,
 // and tracking link metadata from a remote peer
 func (rc *ResponseCache) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
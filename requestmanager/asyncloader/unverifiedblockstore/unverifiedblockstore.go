@@ -3,6 +3,7 @@ package unverifiedblockstore
 import (
 	"fmt"
 
+	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	ipld "github.com/ipld/go-ipld-prime"
 )
@@ -41,23 +42,28 @@ func (ubs *UnverifiedBlockStore) PruneBlocks(shouldPrune func(ipld.Link) bool) {
 
 // VerifyBlock verifies the data for the given link as being part of a traversal,
 // removes it from the unverified store, and writes it to permaneant storage.
+// A failure to write it is returned as a graphsync.StoreError.
 func (ubs *UnverifiedBlockStore) VerifyBlock(lnk ipld.Link) ([]byte, error) {
 	data, ok := ubs.inMemoryBlocks[lnk]
 	if !ok {
 		return nil, fmt.Errorf("Block not found")
 	}
 	delete(ubs.inMemoryBlocks, lnk)
+	if err := ubs.store(lnk, data); err != nil {
+		c, _ := ipldbridge.LinkCid(lnk)
+		return nil, graphsync.StoreError{Cid: c, Err: err}
+	}
+	return data, nil
+}
+
+func (ubs *UnverifiedBlockStore) store(lnk ipld.Link, data []byte) error {
 	buffer, committer, err := ubs.storer(ipldbridge.LinkContext{})
 	if err != nil {
-		return nil, err
+		return err
 	}
 	_, err = buffer.Write(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = committer(lnk)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	return committer(lnk)
 }
@@ -18,13 +18,20 @@ type AsyncLoadFn func(graphsync.RequestID, ipld.Link) <-chan types.AsyncLoadResu
 
 // WrapAsyncLoader creates a regular ipld link laoder from an asynchronous load
 // function, with the given cancellation context, for the given requests, and will
-// transmit load errors on the given channel
+// transmit load errors on the given channel. Warnings about loads that succeed
+// are passed to onWarning, if it is not nil.
 func WrapAsyncLoader(
 	ctx context.Context,
 	asyncLoadFn AsyncLoadFn,
 	requestID graphsync.RequestID,
-	errorChan chan error) ipld.Loader {
+	errorChan chan error,
+	onWarning func(graphsync.Warning)) ipld.Loader {
 	return func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		// responses track blocks by cidlink.Link, so custom link types are
+		// looked up by the CID they resolve to
+		if _, ok := link.(ipldbridge.CidLink); ok {
+			link, _ = ipldbridge.NormalizeLink(link)
+		}
 		resultChan := asyncLoadFn(requestID, link)
 		select {
 		case <-ctx.Done():
@@ -38,6 +45,9 @@ func WrapAsyncLoader(
 					return nil, ipldbridge.ErrDoNotFollow()
 				}
 			}
+			if result.NotSent && onWarning != nil {
+				onWarning(graphsync.Warning{Code: graphsync.WarningBlockNotSent, Link: link})
+			}
 			return bytes.NewReader(result.Data), nil
 		}
 	}
@@ -40,7 +40,7 @@ func TestWrappedAsyncLoaderReturnsValues(t *testing.T) {
 	asyncLoadFn := makeAsyncLoadFn(responseChan, calls)
 	errChan := make(chan error)
 	requestID := graphsync.RequestID(rand.Int31())
-	loader := WrapAsyncLoader(ctx, asyncLoadFn, requestID, errChan)
+	loader := WrapAsyncLoader(ctx, asyncLoadFn, requestID, errChan, nil)
 
 	link := testbridge.NewMockLink()
 	data := testutil.RandomBytes(100)
@@ -67,7 +67,7 @@ func TestWrappedAsyncLoaderSideChannelsErrors(t *testing.T) {
 	asyncLoadFn := makeAsyncLoadFn(responseChan, calls)
 	errChan := make(chan error, 1)
 	requestID := graphsync.RequestID(rand.Int31())
-	loader := WrapAsyncLoader(ctx, asyncLoadFn, requestID, errChan)
+	loader := WrapAsyncLoader(ctx, asyncLoadFn, requestID, errChan, nil)
 
 	link := testbridge.NewMockLink()
 	err := errors.New("something went wrong")
@@ -96,7 +96,7 @@ func TestWrappedAsyncLoaderContextCancels(t *testing.T) {
 	asyncLoadFn := makeAsyncLoadFn(responseChan, calls)
 	errChan := make(chan error, 1)
 	requestID := graphsync.RequestID(rand.Int31())
-	loader := WrapAsyncLoader(subCtx, asyncLoadFn, requestID, errChan)
+	loader := WrapAsyncLoader(subCtx, asyncLoadFn, requestID, errChan, nil)
 	link := testbridge.NewMockLink()
 	resultsChan := make(chan struct {
 		io.Reader
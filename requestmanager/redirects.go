@@ -0,0 +1,87 @@
+package requestmanager
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// redirectFromResponse returns the root a response redirects its request
+// to, if it names a valid one
+func redirectFromResponse(response gsmsg.GraphSyncResponse) (graphsync.RedirectError, bool) {
+	data, ok := response.Extension(graphsync.ExtensionRedirect)
+	if !ok {
+		return graphsync.RedirectError{}, false
+	}
+	root, err := cid.Cast(data)
+	if err != nil {
+		log.Infof("Unable to decode redirect for request %d: %s", response.RequestID(), err)
+		return graphsync.RedirectError{}, false
+	}
+	return graphsync.RedirectError{Root: root}, true
+}
+
+// followRedirects makes a request for root with send, and makes it again for
+// the root the responder redirects it to, up to maxRedirects times. Progress
+// is passed on as it arrives, but errors are held until a request finishes,
+// since those of a redirected request are dropped.
+func followRedirects(ctx context.Context, maxRedirects int, root ipld.Link,
+	send func(root ipld.Link, redirected bool) (<-chan graphsync.ResponseProgress, <-chan error)) (<-chan graphsync.ResponseProgress, <-chan error) {
+	returnedResponses := make(chan graphsync.ResponseProgress)
+	returnedErrors := make(chan error)
+	go func() {
+		defer close(returnedErrors)
+		var errs []error
+		func() {
+			defer close(returnedResponses)
+			for redirects := 0; ; redirects++ {
+				incomingResponses, incomingErrors := send(root, redirects > 0)
+				var redirect *graphsync.RedirectError
+				errs = nil
+				for incomingResponses != nil || incomingErrors != nil {
+					select {
+					case response, ok := <-incomingResponses:
+						if !ok {
+							incomingResponses = nil
+							continue
+						}
+						select {
+						case returnedResponses <- response:
+						case <-ctx.Done():
+							drain(incomingResponses, incomingErrors)
+							return
+						}
+					case err, ok := <-incomingErrors:
+						if !ok {
+							incomingErrors = nil
+							continue
+						}
+						if re, isRedirect := err.(graphsync.RedirectError); isRedirect && redirects < maxRedirects {
+							redirect = &re
+						}
+						errs = append(errs, err)
+					}
+				}
+				if redirect == nil {
+					return
+				}
+				log.Debugf("Following redirect to %s", redirect.Root)
+				root = cidlink.Link{Cid: redirect.Root}
+			}
+		}()
+		// errors are sent after all responses, as they are held until the
+		// last request finishes anyway
+		for _, err := range errs {
+			select {
+			case returnedErrors <- err:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return returnedResponses, returnedErrors
+}
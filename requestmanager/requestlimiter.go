@@ -0,0 +1,191 @@
+package requestmanager
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// requestLimiter holds back requests beyond a limit on how many are in
+// progress in total and to any one peer, until earlier ones finish. A request
+// goes ahead only once both limits allow it. Waiting requests go ahead in the
+// order they were made, except that one waiting on a busy peer does not hold
+// up requests to other peers.
+type requestLimiter struct {
+	ctx context.Context
+	// zero means no limit
+	maxTotal   int
+	maxPerPeer int
+
+	lk      sync.Mutex
+	total   int
+	perPeer map[peer.ID]int
+	waiting []*waitingRequest
+}
+
+type waitingRequest struct {
+	p peer.ID
+	// closed once the request may go ahead
+	ready chan struct{}
+}
+
+func newRequestLimiter(ctx context.Context, maxTotal int, maxPerPeer int) *requestLimiter {
+	return &requestLimiter{
+		ctx:        ctx,
+		maxTotal:   maxTotal,
+		maxPerPeer: maxPerPeer,
+		perPeer:    make(map[peer.ID]int),
+	}
+}
+
+// limitRequest returns channels right away for a request to p, and makes the
+// request with send once the limits allow it, passing on what it returns. The
+// request counts against the limits until both its channels are closed. A
+// request whose context ends while it waits is never made, and its channels
+// are closed.
+func (rl *requestLimiter) limitRequest(ctx context.Context, p peer.ID,
+	send func() (<-chan graphsync.ResponseProgress, <-chan error)) (<-chan graphsync.ResponseProgress, <-chan error) {
+	returnedResponses := make(chan graphsync.ResponseProgress)
+	returnedErrors := make(chan error)
+	// the place in line is taken before returning, so requests wait in the
+	// order they were made
+	wr := rl.reserve(p)
+	go func() {
+		defer close(returnedResponses)
+		defer close(returnedErrors)
+		if !rl.wait(ctx, wr) {
+			return
+		}
+		defer rl.release(p)
+		incomingResponses, incomingErrors := send()
+		for incomingResponses != nil || incomingErrors != nil {
+			select {
+			case response, ok := <-incomingResponses:
+				if !ok {
+					incomingResponses = nil
+					continue
+				}
+				select {
+				case returnedResponses <- response:
+				case <-ctx.Done():
+					drain(incomingResponses, incomingErrors)
+					return
+				case <-rl.ctx.Done():
+					return
+				}
+			case err, ok := <-incomingErrors:
+				if !ok {
+					incomingErrors = nil
+					continue
+				}
+				select {
+				case returnedErrors <- err:
+				case <-ctx.Done():
+					drain(incomingResponses, incomingErrors)
+					return
+				case <-rl.ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return returnedResponses, returnedErrors
+}
+
+// drain waits for a request whose context ended to finish, so it counts
+// against the limits until it does
+func drain(incomingResponses <-chan graphsync.ResponseProgress, incomingErrors <-chan error) {
+	for incomingResponses != nil || incomingErrors != nil {
+		select {
+		case _, ok := <-incomingResponses:
+			if !ok {
+				incomingResponses = nil
+			}
+		case _, ok := <-incomingErrors:
+			if !ok {
+				incomingErrors = nil
+			}
+		}
+	}
+}
+
+// reserve lets a request to p go ahead if it fits, returning nil, or else
+// puts it in line
+func (rl *requestLimiter) reserve(p peer.ID) *waitingRequest {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	if rl.fits(p) {
+		rl.take(p)
+		return nil
+	}
+	wr := &waitingRequest{p: p, ready: make(chan struct{})}
+	rl.waiting = append(rl.waiting, wr)
+	return wr
+}
+
+// wait waits until a request put in line may go ahead, returning false if
+// the context ends first
+func (rl *requestLimiter) wait(ctx context.Context, wr *waitingRequest) bool {
+	if wr == nil {
+		return true
+	}
+	select {
+	case <-wr.ready:
+		return true
+	case <-ctx.Done():
+	case <-rl.ctx.Done():
+	}
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	select {
+	case <-wr.ready:
+		// it was let through as the context ended
+		rl.releaseLocked(wr.p)
+	default:
+		for i, other := range rl.waiting {
+			if other == wr {
+				rl.waiting = append(rl.waiting[:i], rl.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return false
+}
+
+// release frees the place of a finished request to p, letting through any
+// waiting requests that now fit
+func (rl *requestLimiter) release(p peer.ID) {
+	rl.lk.Lock()
+	rl.releaseLocked(p)
+	rl.lk.Unlock()
+}
+
+func (rl *requestLimiter) releaseLocked(p peer.ID) {
+	rl.total--
+	rl.perPeer[p]--
+	if rl.perPeer[p] <= 0 {
+		delete(rl.perPeer, p)
+	}
+	waiting := rl.waiting
+	rl.waiting = nil
+	for _, wr := range waiting {
+		if rl.fits(wr.p) {
+			rl.take(wr.p)
+			close(wr.ready)
+		} else {
+			rl.waiting = append(rl.waiting, wr)
+		}
+	}
+}
+
+func (rl *requestLimiter) fits(p peer.ID) bool {
+	return (rl.maxTotal <= 0 || rl.total < rl.maxTotal) &&
+		(rl.maxPerPeer <= 0 || rl.perPeer[p] < rl.maxPerPeer)
+}
+
+func (rl *requestLimiter) take(p peer.ID) {
+	rl.total++
+	rl.perPeer[p]++
+}
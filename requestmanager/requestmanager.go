@@ -1,50 +1,149 @@
 package requestmanager
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"sort"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/byterange"
+	"github.com/ipfs/go-graphsync/cancelreason"
+	"github.com/ipfs/go-graphsync/cidset"
 	ipldbridge "github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/persistentextensions"
 	"github.com/ipfs/go-graphsync/requestmanager/loader"
 	"github.com/ipfs/go-graphsync/requestmanager/types"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-ipld-prime"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 var log = logging.Logger("graphsync")
 
+var (
+	errNoByteRange  = errors.New("request failed: responder sent no byte range")
+	errBadByteRange = errors.New("request failed: whole block does not match its cid")
+)
+
 const (
 	// maxPriority is the max priority as defined by the bitswap protocol
 	maxPriority = graphsync.Priority(math.MaxInt32)
+	// how deep each subtree a responder pushes is followed, matching how deep
+	// responders push them
+	pushedSubtreeDepth = 100
 )
 
 type inProgressRequestStatus struct {
-	ctx          context.Context
-	cancelFn     func()
-	p            peer.ID
-	networkError chan error
+	// ctx ends once the request finishes in any way, while abortCtx, if set,
+	// ends only if the request is cancelled before it finishes, as by the
+	// caller or a hook
+	ctx                  context.Context
+	cancelFn             func()
+	abortCtx             context.Context
+	abortFn              func()
+	p                    peer.ID
+	networkError         chan error
+	persistentExtensions map[graphsync.ExtensionName][]byte
+	receivedBlock        bool
+	minProgressTimer     *time.Timer
+	connectivity         *connectivityCheck
+	scratch              graphsync.RequestScratch
+	// byteRange receives the bytes sent for a byte range request, and is nil
+	// for other requests
+	byteRange chan byterange.Response
+	// pushed receives the roots of subtrees the responder pushes once they are
+	// accepted, and is nil for requests not made with graphsync.AcceptPush
+	pushed chan []cid.Cid
+	// supportedExtensions receives the extensions a peer says it supports, and
+	// is nil for requests other than extension queries
+	supportedExtensions chan []graphsync.ExtensionName
+	// expansions tracks the selector expansions the responder asks for, and
+	// is nil for requests not made with graphsync.FollowExpansions
+	expansions *selectorExpansions
+	// labels are attached to every metric reported for the request
+	labels map[string]string
+	root   cid.Cid
+	// name is the name given with graphsync.WithRequestName, if any
+	name string
+}
+
+// describe identifies a request in log messages by its ID and, if it has one,
+// its name
+func (irs *inProgressRequestStatus) describe(requestID graphsync.RequestID) string {
+	if irs.name == "" {
+		return fmt.Sprintf("%d", requestID)
+	}
+	return fmt.Sprintf("%d (%s)", requestID, irs.name)
+}
+
+// responseWithPersistentExtensions presents a response to hooks along with
+// the data for any persistent extensions sent earlier for the same request
+type responseWithPersistentExtensions struct {
+	gsmsg.GraphSyncResponse
+	persistentExtensions map[graphsync.ExtensionName][]byte
+}
+
+// Extension returns the content for an extension on a response, or for a
+// persistent extension sent on an earlier response, or errors
+// if extension is not present
+func (rwpe responseWithPersistentExtensions) Extension(name graphsync.ExtensionName) ([]byte, bool) {
+	data, ok := rwpe.GraphSyncResponse.Extension(name)
+	if ok {
+		return data, true
+	}
+	data, ok = rwpe.persistentExtensions[name]
+	return data, ok
+}
+
+// responseWithScratch presents a response to hooks along with the scratch
+// they share for its request
+type responseWithScratch struct {
+	responseWithPersistentExtensions
+	scratch graphsync.RequestScratch
+}
+
+// RequestScratch returns the scratch shared by hooks for the request
+func (rws responseWithScratch) RequestScratch() graphsync.RequestScratch {
+	return rws.scratch
 }
 
 type responseHook struct {
 	hook graphsync.OnResponseReceivedHook
 }
 
+type pushHook struct {
+	hook graphsync.OnPushReceivedHook
+}
+
 // PeerHandler is an interface that can send requests to peers
 type PeerHandler interface {
 	SendRequest(p peer.ID, graphSyncRequest gsmsg.GraphSyncRequest)
 }
 
+// PeerConnector is an interface that can establish a connection to a peer
+type PeerConnector interface {
+	ConnectTo(context.Context, peer.ID) error
+}
+
 // AsyncLoader is an interface for loading links asynchronously, returning
 // results as new responses are processed
 type AsyncLoader interface {
-	StartRequest(requestID graphsync.RequestID)
+	StartRequest(ctx context.Context, requestID graphsync.RequestID)
 	ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
 		blks []blocks.Block)
 	AsyncLoad(requestID graphsync.RequestID, link ipld.Link) <-chan types.AsyncLoadResult
@@ -60,12 +159,18 @@ type RequestManager struct {
 	messages    chan requestManagerMessage
 	ipldBridge  ipldbridge.IPLDBridge
 	peerHandler PeerHandler
+	connector   PeerConnector
+	dialTimeout time.Duration
 	rc          *responseCollector
 	asyncLoader AsyncLoader
+	localLoader ipldbridge.ContextLoader
+	metrics     RequestMetrics
+	limiter     *requestLimiter
 	// dont touch out side of run loop
 	nextRequestID             graphsync.RequestID
 	inProgressRequestStatuses map[graphsync.RequestID]*inProgressRequestStatus
 	responseHooks             []responseHook
+	pushHooks                 []pushHook
 }
 
 type requestManagerMessage interface {
@@ -82,6 +187,7 @@ func New(ctx context.Context, asyncLoader AsyncLoader, ipldBridge ipldbridge.IPL
 		asyncLoader:               asyncLoader,
 		rc:                        newResponseCollector(ctx),
 		messages:                  make(chan requestManagerMessage, 16),
+		metrics:                   NoopRequestMetrics{},
 		inProgressRequestStatuses: make(map[graphsync.RequestID]*inProgressRequestStatus),
 	}
 }
@@ -91,6 +197,53 @@ func (rm *RequestManager) SetDelegate(peerHandler PeerHandler) {
 	rm.peerHandler = peerHandler
 }
 
+// ConnectBeforeRequests makes the request manager establish a connection to
+// a peer, waiting at most dialTimeout, or with no limit if it is zero, before
+// sending a request. The dial happens after the request's channels are
+// returned, and failures are returned as a graphsync.DialError on the
+// request's error channel. It must be called before Startup.
+func (rm *RequestManager) ConnectBeforeRequests(connector PeerConnector, dialTimeout time.Duration) {
+	rm.connector = connector
+	rm.dialTimeout = dialTimeout
+}
+
+// SetMaxBufferedProgress cancels any request whose caller has not read more
+// than n of its progress events, returning graphsync.ErrProgressNotRead on
+// its error channel, so a caller that stops reading progress does not leave
+// the request running and buffering. It must be called before Startup.
+func (rm *RequestManager) SetMaxBufferedProgress(n int) {
+	rm.rc.maxBufferedResponses = n
+}
+
+// SetRequestLimits holds back requests made while maxTotal requests are in
+// progress, or maxPerPeer to the same peer, until earlier ones finish. A
+// request goes ahead only once both limits allow it, and zero means no limit.
+// A request counts against the limits until its channels are closed, and ones
+// held back are not yet active or cancellable by peer. It must be called
+// before Startup.
+func (rm *RequestManager) SetRequestLimits(maxTotal int, maxPerPeer int) {
+	rm.limiter = newRequestLimiter(rm.ctx, maxTotal, maxPerPeer)
+}
+
+// SetLocalLoader gives the request manager the loader for the local store,
+// which requests made with graphsync.VerifyConnectivity traverse again once
+// they finish. It must be called before Startup.
+func (rm *RequestManager) SetLocalLoader(loader ipldbridge.Loader) {
+	rm.localLoader = ipldbridge.IgnoreContext(loader)
+}
+
+// SetLocalContextLoader is like SetLocalLoader, but the loader is given the
+// context of the request it loads for. It must be called before Startup.
+func (rm *RequestManager) SetLocalContextLoader(loader ipldbridge.ContextLoader) {
+	rm.localLoader = loader
+}
+
+// SetRequestMetrics gives the request manager a RequestMetrics to notify of
+// the progress of every request. It must be called before Startup.
+func (rm *RequestManager) SetRequestMetrics(metrics RequestMetrics) {
+	rm.metrics = metrics
+}
+
 type inProgressRequest struct {
 	requestID     graphsync.RequestID
 	incoming      chan graphsync.ResponseProgress
@@ -98,6 +251,7 @@ type inProgressRequest struct {
 }
 
 type newRequestMessage struct {
+	ctx                   context.Context
 	p                     peer.ID
 	root                  ipld.Link
 	selector              ipld.Node
@@ -107,6 +261,44 @@ type newRequestMessage struct {
 
 // SendRequest initiates a new GraphSync request to the given peer.
 func (rm *RequestManager) SendRequest(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	maxRedirects, extensions, err := extractFollowRedirects(extensions)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	if maxRedirects > 0 {
+		return followRedirects(ctx, maxRedirects, root, func(root ipld.Link, redirected bool) (<-chan graphsync.ResponseProgress, <-chan error) {
+			requestExtensions := extensions
+			if redirected {
+				var err error
+				requestExtensions, err = refreshNonce(extensions, rm.ipldBridge)
+				if err != nil {
+					return rm.singleErrorResponse(err)
+				}
+			}
+			return rm.sendLimitedRequest(ctx, p, root, selector, requestExtensions...)
+		})
+	}
+	return rm.sendLimitedRequest(ctx, p, root, selector, extensions...)
+}
+
+func (rm *RequestManager) sendLimitedRequest(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if rm.limiter != nil {
+		return rm.limiter.limitRequest(ctx, p, func() (<-chan graphsync.ResponseProgress, <-chan error) {
+			return rm.sendRequest(ctx, p, root, selector, extensions...)
+		})
+	}
+	return rm.sendRequest(ctx, p, root, selector, extensions...)
+}
+
+func (rm *RequestManager) sendRequest(ctx context.Context,
 	p peer.ID,
 	root ipld.Link,
 	selector ipld.Node,
@@ -114,11 +306,76 @@ func (rm *RequestManager) SendRequest(ctx context.Context,
 	if _, err := rm.ipldBridge.ParseSelector(selector); err != nil {
 		return rm.singleErrorResponse(fmt.Errorf("Invalid Selector Spec"))
 	}
+	if rm.connector != nil {
+		return rm.dialThenSend(ctx, p, func() (<-chan graphsync.ResponseProgress, <-chan error) {
+			return rm.startRequest(ctx, p, root, selector, extensions...)
+		})
+	}
+	return rm.startRequest(ctx, p, root, selector, extensions...)
+}
+
+// dialThenSend returns channels right away, and dials p in the background
+// before making the request with send, passing on what it returns. A failed
+// dial is returned as a graphsync.DialError.
+func (rm *RequestManager) dialThenSend(ctx context.Context, p peer.ID,
+	send func() (<-chan graphsync.ResponseProgress, <-chan error)) (<-chan graphsync.ResponseProgress, <-chan error) {
+	returnedResponses := make(chan graphsync.ResponseProgress)
+	returnedErrors := make(chan error)
+	go func() {
+		defer close(returnedResponses)
+		defer close(returnedErrors)
+		if err := rm.connect(ctx, p); err != nil {
+			select {
+			case returnedErrors <- graphsync.DialError{Peer: p, Err: err}:
+			case <-ctx.Done():
+			case <-rm.ctx.Done():
+			}
+			return
+		}
+		incomingResponses, incomingErrors := send()
+		for incomingResponses != nil || incomingErrors != nil {
+			select {
+			case response, ok := <-incomingResponses:
+				if !ok {
+					incomingResponses = nil
+					continue
+				}
+				select {
+				case returnedResponses <- response:
+				case <-ctx.Done():
+					drain(incomingResponses, incomingErrors)
+					return
+				case <-rm.ctx.Done():
+					return
+				}
+			case err, ok := <-incomingErrors:
+				if !ok {
+					incomingErrors = nil
+					continue
+				}
+				select {
+				case returnedErrors <- err:
+				case <-ctx.Done():
+					drain(incomingResponses, incomingErrors)
+					return
+				case <-rm.ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return returnedResponses, returnedErrors
+}
 
+func (rm *RequestManager) startRequest(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
 	inProgressRequestChan := make(chan inProgressRequest)
 
 	select {
-	case rm.messages <- &newRequestMessage{p, root, selector, extensions, inProgressRequestChan}:
+	case rm.messages <- &newRequestMessage{ctx, p, root, selector, extensions, inProgressRequestChan}:
 	case <-rm.ctx.Done():
 		return rm.emptyResponse()
 	case <-ctx.Done():
@@ -134,13 +391,77 @@ func (rm *RequestManager) SendRequest(ctx context.Context,
 	return rm.rc.collectResponses(ctx,
 		receivedInProgressRequest.incoming,
 		receivedInProgressRequest.incomingError,
-		func() {
+		func(reason graphsync.CancelReason) {
 			rm.cancelRequest(receivedInProgressRequest.requestID,
 				receivedInProgressRequest.incoming,
-				receivedInProgressRequest.incomingError)
+				receivedInProgressRequest.incomingError,
+				reason)
 		})
 }
 
+type extensionsQuery struct {
+	requestID           graphsync.RequestID
+	supportedExtensions chan []graphsync.ExtensionName
+	networkError        chan error
+}
+
+type extensionsQueryMessage struct {
+	p                   peer.ID
+	extensionsQueryChan chan<- extensionsQuery
+}
+
+// PeerExtensions asks a peer which extensions it supports as a responder,
+// returning graphsync.ErrExtensionsNotAdvertised if it does not say.
+func (rm *RequestManager) PeerExtensions(ctx context.Context, p peer.ID) ([]graphsync.ExtensionName, error) {
+	if rm.connector != nil {
+		if err := rm.connect(ctx, p); err != nil {
+			return nil, graphsync.DialError{Peer: p, Err: err}
+		}
+	}
+
+	extensionsQueryChan := make(chan extensionsQuery)
+	select {
+	case rm.messages <- &extensionsQueryMessage{p, extensionsQueryChan}:
+	case <-rm.ctx.Done():
+		return nil, rm.ctx.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var query extensionsQuery
+	select {
+	case <-rm.ctx.Done():
+		return nil, rm.ctx.Err()
+	case query = <-extensionsQueryChan:
+	}
+	defer func() {
+		select {
+		case <-rm.ctx.Done():
+		case rm.messages <- &terminateRequestMessage{query.requestID}:
+		}
+	}()
+
+	select {
+	case names := <-query.supportedExtensions:
+		return names, nil
+	case <-query.networkError:
+		return nil, graphsync.ErrExtensionsNotAdvertised
+	case <-rm.ctx.Done():
+		return nil, rm.ctx.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (rm *RequestManager) connect(ctx context.Context, p peer.ID) error {
+	dialCtx := ctx
+	if rm.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, rm.dialTimeout)
+		defer cancel()
+	}
+	return rm.connector.ConnectTo(dialCtx, p)
+}
+
 func (rm *RequestManager) emptyResponse() (chan graphsync.ResponseProgress, chan error) {
 	ch := make(chan graphsync.ResponseProgress)
 	close(ch)
@@ -160,15 +481,17 @@ func (rm *RequestManager) singleErrorResponse(err error) (chan graphsync.Respons
 
 type cancelRequestMessage struct {
 	requestID graphsync.RequestID
+	reason    graphsync.CancelReason
 }
 
 func (rm *RequestManager) cancelRequest(requestID graphsync.RequestID,
 	incomingResponses chan graphsync.ResponseProgress,
-	incomingErrors chan error) {
+	incomingErrors chan error,
+	reason graphsync.CancelReason) {
 	cancelMessageChannel := rm.messages
 	for cancelMessageChannel != nil || incomingResponses != nil || incomingErrors != nil {
 		select {
-		case cancelMessageChannel <- &cancelRequestMessage{requestID}:
+		case cancelMessageChannel <- &cancelRequestMessage{requestID, reason}:
 			cancelMessageChannel = nil
 		// clear out any remaining responses, in case and "incoming reponse"
 		// messages get processed before our cancel message
@@ -186,6 +509,72 @@ func (rm *RequestManager) cancelRequest(requestID graphsync.RequestID,
 	}
 }
 
+type cancelRequestByIDMessage struct {
+	requestID graphsync.RequestID
+	reason    graphsync.CancelReason
+	response  chan error
+}
+
+// CancelRequest cancels the in progress request with the given ID, sending
+// the reason to the responder and graphsync.ErrRequestCancelled to the
+// request's error channel
+func (rm *RequestManager) CancelRequest(requestID graphsync.RequestID, reason graphsync.CancelReason) error {
+	response := make(chan error, 1)
+	select {
+	case rm.messages <- &cancelRequestByIDMessage{requestID, reason, response}:
+	case <-rm.ctx.Done():
+		return rm.ctx.Err()
+	}
+	select {
+	case err := <-response:
+		return err
+	case <-rm.ctx.Done():
+		return rm.ctx.Err()
+	}
+}
+
+type cancelPeerMessage struct {
+	p        peer.ID
+	response chan int
+}
+
+// CancelPeer cancels every in progress request to the given peer, as
+// CancelRequest does, and returns how many it cancelled
+func (rm *RequestManager) CancelPeer(p peer.ID) int {
+	response := make(chan int, 1)
+	select {
+	case rm.messages <- &cancelPeerMessage{p, response}:
+	case <-rm.ctx.Done():
+		return 0
+	}
+	select {
+	case cancelled := <-response:
+		return cancelled
+	case <-rm.ctx.Done():
+		return 0
+	}
+}
+
+type activeRequestsMessage struct {
+	response chan []graphsync.ActiveRequest
+}
+
+// ActiveRequests returns a snapshot of the requests in progress
+func (rm *RequestManager) ActiveRequests() []graphsync.ActiveRequest {
+	response := make(chan []graphsync.ActiveRequest, 1)
+	select {
+	case rm.messages <- &activeRequestsMessage{response}:
+	case <-rm.ctx.Done():
+		return nil
+	}
+	select {
+	case activeRequests := <-response:
+		return activeRequests
+	case <-rm.ctx.Done():
+		return nil
+	}
+}
+
 type processResponseMessage struct {
 	p         peer.ID
 	responses []gsmsg.GraphSyncResponse
@@ -211,6 +600,16 @@ func (rm *RequestManager) RegisterHook(
 	}
 }
 
+// RegisterPushHook registers a hook that decides whether to accept subtrees
+// responders offer to push
+func (rm *RequestManager) RegisterPushHook(
+	hook graphsync.OnPushReceivedHook) {
+	select {
+	case rm.messages <- &pushHook{hook}:
+	case <-rm.ctx.Done():
+	}
+}
+
 // Startup starts processing for the WantManager.
 func (rm *RequestManager) Startup() {
 	go rm.run()
@@ -238,7 +637,7 @@ func (rm *RequestManager) run() {
 
 func (rm *RequestManager) cleanupInProcessRequests() {
 	for _, requestStatus := range rm.inProgressRequestStatuses {
-		requestStatus.cancelFn()
+		requestStatus.abort()
 	}
 }
 
@@ -246,11 +645,24 @@ type terminateRequestMessage struct {
 	requestID graphsync.RequestID
 }
 
-func (nrm *newRequestMessage) handle(rm *RequestManager) {
-	requestID := rm.nextRequestID
-	rm.nextRequestID++
+type noInitialResponseMessage struct {
+	requestID graphsync.RequestID
+}
+
+type storeFailedMessage struct {
+	requestID graphsync.RequestID
+	err       graphsync.StoreError
+}
 
-	inProgressChan, inProgressErr := rm.setupRequest(requestID, nrm.p, nrm.root, nrm.selector, nrm.extensions)
+func (nrm *newRequestMessage) handle(rm *RequestManager) {
+	var inProgressChan chan graphsync.ResponseProgress
+	var inProgressErr chan error
+	requestID, extensions, err := rm.chooseRequestID(nrm.extensions)
+	if err != nil {
+		inProgressChan, inProgressErr = rm.singleErrorResponse(err)
+	} else {
+		inProgressChan, inProgressErr = rm.setupRequest(nrm.ctx, requestID, nrm.p, nrm.root, nrm.selector, extensions)
+	}
 
 	select {
 	case nrm.inProgressRequestChan <- inProgressRequest{
@@ -262,7 +674,85 @@ func (nrm *newRequestMessage) handle(rm *RequestManager) {
 	}
 }
 
+// chooseRequestID returns the ID a request was made with, removing the
+// requestor-only extension that carries it, or else picks the next free one
+func (rm *RequestManager) chooseRequestID(extensions []graphsync.ExtensionData) (graphsync.RequestID, []graphsync.ExtensionData, error) {
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionRequestID {
+			continue
+		}
+		if len(extension.Data) != 4 {
+			return 0, nil, fmt.Errorf("invalid request ID")
+		}
+		requestID := graphsync.RequestID(binary.BigEndian.Uint32(extension.Data))
+		if _, ok := rm.inProgressRequestStatuses[requestID]; ok {
+			return 0, nil, graphsync.ErrRequestIDInUse
+		}
+		return requestID, removeExtension(extensions, graphsync.ExtensionRequestID), nil
+	}
+	return rm.nextFreeRequestID(), extensions, nil
+}
+
+// nextFreeRequestID picks the next request ID, skipping any a caller chose
+// for a request still in progress
+func (rm *RequestManager) nextFreeRequestID() graphsync.RequestID {
+	for {
+		requestID := rm.nextRequestID
+		rm.nextRequestID++
+		if _, ok := rm.inProgressRequestStatuses[requestID]; !ok {
+			return requestID
+		}
+	}
+}
+
+func (arm *activeRequestsMessage) handle(rm *RequestManager) {
+	activeRequests := make([]graphsync.ActiveRequest, 0, len(rm.inProgressRequestStatuses))
+	for requestID, requestStatus := range rm.inProgressRequestStatuses {
+		// extension queries are not requests the caller made
+		if requestStatus.supportedExtensions != nil {
+			continue
+		}
+		activeRequests = append(activeRequests, graphsync.ActiveRequest{
+			ID:   requestID,
+			Peer: requestStatus.p,
+			Root: requestStatus.root,
+			Name: requestStatus.name,
+		})
+	}
+	sort.Slice(activeRequests, func(i, j int) bool {
+		return activeRequests[i].ID < activeRequests[j].ID
+	})
+	arm.response <- activeRequests
+}
+
+func (eqm *extensionsQueryMessage) handle(rm *RequestManager) {
+	requestID := rm.nextFreeRequestID()
+
+	ctx, cancel := context.WithCancel(rm.ctx)
+	requestStatus := &inProgressRequestStatus{
+		ctx: ctx, cancelFn: cancel, p: eqm.p, networkError: make(chan error, 1),
+		scratch:             graphsync.NewRequestScratch(),
+		supportedExtensions: make(chan []graphsync.ExtensionName, 1),
+	}
+	rm.inProgressRequestStatuses[requestID] = requestStatus
+	rm.asyncLoader.StartRequest(requestStatus.ctx, requestID)
+	rm.peerHandler.SendRequest(eqm.p, gsmsg.NewRequest(requestID, cid.Undef, nil, maxPriority,
+		graphsync.ExtensionData{Name: graphsync.ExtensionSupportedExtensions}))
+
+	select {
+	case eqm.extensionsQueryChan <- extensionsQuery{
+		requestID:           requestID,
+		supportedExtensions: requestStatus.supportedExtensions,
+		networkError:        requestStatus.networkError,
+	}:
+	case <-rm.ctx.Done():
+	}
+}
+
 func (trm *terminateRequestMessage) handle(rm *RequestManager) {
+	if requestStatus, ok := rm.inProgressRequestStatuses[trm.requestID]; ok && requestStatus.minProgressTimer != nil {
+		requestStatus.minProgressTimer.Stop()
+	}
 	delete(rm.inProgressRequestStatuses, trm.requestID)
 	rm.asyncLoader.CleanupRequest(trm.requestID)
 }
@@ -273,23 +763,179 @@ func (crm *cancelRequestMessage) handle(rm *RequestManager) {
 		return
 	}
 
-	rm.peerHandler.SendRequest(inProgressRequestStatus.p, gsmsg.CancelRequest(crm.requestID))
+	rm.peerHandler.SendRequest(inProgressRequestStatus.p, rm.cancelRequestWithReason(crm.requestID, inProgressRequestStatus, crm.reason))
+	rm.metrics.RequestCancelled(inProgressRequestStatus.labels)
 	delete(rm.inProgressRequestStatuses, crm.requestID)
-	inProgressRequestStatus.cancelFn()
+	inProgressRequestStatus.abort()
+}
+
+func (crm *cancelRequestByIDMessage) handle(rm *RequestManager) {
+	requestStatus, ok := rm.inProgressRequestStatuses[crm.requestID]
+	if !ok {
+		crm.response <- graphsync.ErrRequestNotFound
+		return
+	}
+	rm.abortRequest(crm.requestID, requestStatus, crm.reason)
+	crm.response <- nil
+}
+
+func (cpm *cancelPeerMessage) handle(rm *RequestManager) {
+	cancelled := 0
+	for requestID, requestStatus := range rm.inProgressRequestStatuses {
+		// extension queries are not requests the caller made
+		if requestStatus.p != cpm.p || requestStatus.supportedExtensions != nil {
+			continue
+		}
+		rm.abortRequest(requestID, requestStatus, graphsync.CancelReason{})
+		cancelled++
+	}
+	cpm.response <- cancelled
+}
+
+// abortRequest ends a request the requestor cancelled, telling the responder
+// and sending graphsync.ErrRequestCancelled to the request's error channel
+func (rm *RequestManager) abortRequest(requestID graphsync.RequestID, requestStatus *inProgressRequestStatus, reason graphsync.CancelReason) {
+	select {
+	case requestStatus.networkError <- graphsync.ErrRequestCancelled:
+	default:
+	}
+	rm.peerHandler.SendRequest(requestStatus.p, rm.cancelRequestWithReason(requestID, requestStatus, reason))
+	rm.metrics.RequestCancelled(requestStatus.labels)
+	delete(rm.inProgressRequestStatuses, requestID)
+	requestStatus.abort()
+}
+
+// cancelRequestWithReason builds a cancel request telling the responder why
+// the request was cancelled, or a plain cancel if the reason cannot be encoded
+func (rm *RequestManager) cancelRequestWithReason(requestID graphsync.RequestID, requestStatus *inProgressRequestStatus, reason graphsync.CancelReason) gsmsg.GraphSyncRequest {
+	reasonData, err := cancelreason.EncodeCancelReason(reason, rm.ipldBridge)
+	if err != nil {
+		log.Infof("Unable to encode cancel reason for request %s: %s", requestStatus.describe(requestID), err)
+		return gsmsg.CancelRequest(requestID)
+	}
+	return gsmsg.CancelRequest(requestID, graphsync.ExtensionData{Name: graphsync.ExtensionCancelReason, Data: reasonData})
+}
+
+func (nirm *noInitialResponseMessage) handle(rm *RequestManager) {
+	requestStatus, ok := rm.inProgressRequestStatuses[nirm.requestID]
+	if !ok || requestStatus.receivedBlock {
+		return
+	}
+	select {
+	case requestStatus.networkError <- graphsync.ErrNoInitialResponse:
+	default:
+	}
+	rm.peerHandler.SendRequest(requestStatus.p, rm.cancelRequestWithReason(nirm.requestID, requestStatus, graphsync.CancelReason{
+		Code:    graphsync.CancelReasonTimeout,
+		Message: graphsync.ErrNoInitialResponse.Error(),
+	}))
+	rm.metrics.RequestCancelled(requestStatus.labels)
+	delete(rm.inProgressRequestStatuses, nirm.requestID)
+	requestStatus.abort()
+}
+
+// handle cancels a request with the responder as soon as a block received for
+// it cannot be stored, rather than letting the responder send blocks that
+// cannot be stored either. The traversal fails on its own.
+func (sfm *storeFailedMessage) handle(rm *RequestManager) {
+	requestStatus, ok := rm.inProgressRequestStatuses[sfm.requestID]
+	if !ok {
+		return
+	}
+	if requestStatus.minProgressTimer != nil {
+		requestStatus.minProgressTimer.Stop()
+	}
+	rm.peerHandler.SendRequest(requestStatus.p, rm.cancelRequestWithReason(sfm.requestID, requestStatus, graphsync.CancelReason{
+		Code:    graphsync.CancelReasonStoreFailed,
+		Message: sfm.err.Error(),
+	}))
+	rm.metrics.RequestCancelled(requestStatus.labels)
+	delete(rm.inProgressRequestStatuses, sfm.requestID)
 }
 
 func (prm *processResponseMessage) handle(rm *RequestManager) {
+	// responses for requests no longer in progress are not acknowledged, so
+	// the responder stops sending them
 	filteredResponses := rm.filterResponsesForPeer(prm.responses, prm.p)
+	rm.acknowledgeResponses(filteredResponses, prm.p)
 	filteredResponses = rm.processExtensions(filteredResponses, prm.p)
 	responseMetadata := metadataForResponses(filteredResponses, rm.ipldBridge)
+	rm.recordReceivedBlocks(responseMetadata, prm.blks)
 	rm.asyncLoader.ProcessResponse(responseMetadata, prm.blks)
+	rm.processByteRanges(filteredResponses)
+	rm.processSupportedExtensions(filteredResponses)
+	rm.processExpansions(filteredResponses)
 	rm.processTerminations(filteredResponses)
 }
 
+// recordReceivedBlocks notes which requests have received a block, so they
+// are no longer subject to a minimum progress interval, and reports the blocks
+// to metrics
+func (rm *RequestManager) recordReceivedBlocks(responseMetadata map[graphsync.RequestID]metadata.Metadata, blks []blocks.Block) {
+	blockSizes := make(map[cid.Cid]int, len(blks))
+	for _, blk := range blks {
+		blockSizes[blk.Cid()] = len(blk.RawData())
+	}
+	for requestID, md := range responseMetadata {
+		requestStatus, ok := rm.inProgressRequestStatuses[requestID]
+		if !ok {
+			continue
+		}
+		for _, item := range md {
+			if !item.BlockPresent {
+				continue
+			}
+			c, err := ipldbridge.LinkCid(item.Link)
+			if err != nil {
+				continue
+			}
+			if size, ok := blockSizes[c]; ok {
+				rm.metrics.BlockReceived(requestStatus.labels, size)
+			}
+		}
+		if requestStatus.connectivity != nil {
+			for _, item := range md {
+				if item.BlockPresent {
+					requestStatus.connectivity.recordReceived(item.Link)
+				}
+			}
+		}
+		if requestStatus.receivedBlock {
+			continue
+		}
+		for _, item := range md {
+			if item.BlockPresent {
+				requestStatus.receivedBlock = true
+				if requestStatus.minProgressTimer != nil {
+					requestStatus.minProgressTimer.Stop()
+				}
+				break
+			}
+		}
+	}
+}
+
 func (rh *responseHook) handle(rm *RequestManager) {
 	rm.responseHooks = append(rm.responseHooks, *rh)
 }
 
+func (ph *pushHook) handle(rm *RequestManager) {
+	rm.pushHooks = append(rm.pushHooks, *ph)
+}
+
+// acknowledgeResponses sends back the message sequence number, if the responder
+// sent one, so the responder can send more messages. Every response in a
+// message carries the same sequence number, so one ack covers the message.
+func (rm *RequestManager) acknowledgeResponses(responses []gsmsg.GraphSyncResponse, p peer.ID) {
+	for _, response := range responses {
+		ackData, ok := response.Extension(graphsync.ExtensionAck)
+		if ok {
+			rm.peerHandler.SendRequest(p, gsmsg.AckRequest(response.RequestID(), ackData))
+			return
+		}
+	}
+}
+
 func (rm *RequestManager) filterResponsesForPeer(responses []gsmsg.GraphSyncResponse, p peer.ID) []gsmsg.GraphSyncResponse {
 	responsesForPeer := make([]gsmsg.GraphSyncResponse, 0, len(responses))
 	for _, response := range responses {
@@ -314,40 +960,236 @@ func (rm *RequestManager) processExtensions(responses []gsmsg.GraphSyncResponse,
 }
 
 func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg.GraphSyncResponse) bool {
+	requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+	responseData := responseWithScratch{rm.applyPersistentExtensions(requestStatus, response), requestStatus.scratch}
 	for _, responseHook := range rm.responseHooks {
-		err := responseHook.hook(p, response)
+		err := responseHook.hook(p, responseData)
 		if err != nil {
-			requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
 			responseError := rm.generateResponseErrorFromStatus(graphsync.RequestFailedUnknown)
 			select {
 			case requestStatus.networkError <- responseError:
 			case <-requestStatus.ctx.Done():
 			}
-			requestStatus.cancelFn()
+			requestStatus.abort()
 			return false
 		}
 	}
+	if requestStatus.pushed != nil {
+		rm.processPushOffer(p, requestStatus, responseData)
+	}
 	return true
 }
 
+// processPushOffer asks push hooks whether to accept the subtrees a response
+// offers to push, and hands accepted roots to the request's traversal
+func (rm *RequestManager) processPushOffer(p peer.ID, requestStatus *inProgressRequestStatus, responseData graphsync.ResponseData) {
+	pushedData, ok := responseData.Extension(graphsync.ExtensionPushedSubtrees)
+	if !ok {
+		return
+	}
+	roots, err := cidset.DecodeCidList(pushedData, rm.ipldBridge)
+	if err != nil {
+		log.Infof("Unable to decode pushed subtrees for request %s: %s", requestStatus.describe(responseData.RequestID()), err)
+		return
+	}
+	for _, pushHook := range rm.pushHooks {
+		if !pushHook.hook(p, responseData, roots) {
+			return
+		}
+	}
+	select {
+	case requestStatus.pushed <- roots:
+	default:
+	}
+}
+
+func (rm *RequestManager) applyPersistentExtensions(requestStatus *inProgressRequestStatus, response gsmsg.GraphSyncResponse) responseWithPersistentExtensions {
+	namesData, ok := response.Extension(graphsync.ExtensionPersistentExtensions)
+	if ok {
+		names, err := persistentextensions.DecodeNames(namesData, rm.ipldBridge)
+		if err != nil {
+			log.Infof("Unable to decode persistent extensions for request %s: %s", requestStatus.describe(response.RequestID()), err)
+		}
+		for _, name := range names {
+			data, ok := response.Extension(name)
+			if !ok {
+				continue
+			}
+			if requestStatus.persistentExtensions == nil {
+				requestStatus.persistentExtensions = make(map[graphsync.ExtensionName][]byte)
+			}
+			requestStatus.persistentExtensions[name] = data
+		}
+	}
+	return responseWithPersistentExtensions{response, requestStatus.persistentExtensions}
+}
+
+// processByteRanges hands the bytes sent for byte range requests to the
+// requests waiting on them. A byte range request that completes without them
+// fails, as the responder does not support the extension.
+func (rm *RequestManager) processByteRanges(responses []gsmsg.GraphSyncResponse) {
+	for _, response := range responses {
+		requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+		if requestStatus.byteRange == nil {
+			continue
+		}
+		rangeData, ok := response.Extension(graphsync.ExtensionByteRange)
+		if !ok {
+			if response.Status() == graphsync.RequestCompletedFull {
+				select {
+				case requestStatus.networkError <- errNoByteRange:
+				default:
+				}
+			}
+			continue
+		}
+		byteRange, err := byterange.DecodeResponse(rangeData, rm.ipldBridge)
+		if err != nil {
+			log.Infof("Unable to decode byte range for request %s: %s", requestStatus.describe(response.RequestID()), err)
+			select {
+			case requestStatus.networkError <- err:
+			default:
+			}
+			continue
+		}
+		select {
+		case requestStatus.byteRange <- byteRange:
+		default:
+		}
+	}
+}
+
+// processSupportedExtensions hands the extensions a peer says it supports to
+// the queries waiting on them. A query that completes without them fails, as
+// the peer does not advertise its extensions.
+func (rm *RequestManager) processSupportedExtensions(responses []gsmsg.GraphSyncResponse) {
+	for _, response := range responses {
+		requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+		if requestStatus.supportedExtensions == nil {
+			continue
+		}
+		namesData, ok := response.Extension(graphsync.ExtensionSupportedExtensions)
+		if !ok {
+			if response.Status() == graphsync.RequestCompletedFull {
+				select {
+				case requestStatus.networkError <- graphsync.ErrExtensionsNotAdvertised:
+				default:
+				}
+			}
+			continue
+		}
+		names, err := persistentextensions.DecodeNames(namesData, rm.ipldBridge)
+		if err != nil {
+			log.Infof("Unable to decode supported extensions for request %s: %s", requestStatus.describe(response.RequestID()), err)
+			select {
+			case requestStatus.networkError <- err:
+			default:
+			}
+			continue
+		}
+		select {
+		case requestStatus.supportedExtensions <- names:
+		default:
+		}
+	}
+}
+
+// processExpansions records the selector expansions responders ask for on
+// requests that follow them
+func (rm *RequestManager) processExpansions(responses []gsmsg.GraphSyncResponse) {
+	for _, response := range responses {
+		requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+		if requestStatus.expansions == nil {
+			continue
+		}
+		specData, ok := response.Extension(graphsync.ExtensionExpandSelector)
+		if !ok {
+			continue
+		}
+		spec, err := rm.ipldBridge.DecodeNode(specData)
+		if err == nil {
+			_, err = rm.ipldBridge.ParseSelector(spec)
+		}
+		if err != nil {
+			log.Infof("Unable to decode selector expansion for request %s: %s", requestStatus.describe(response.RequestID()), err)
+			continue
+		}
+		requestStatus.expansions.pending = spec
+	}
+}
+
 func (rm *RequestManager) processTerminations(responses []gsmsg.GraphSyncResponse) {
 	for _, response := range responses {
 		if gsmsg.IsTerminalResponseCode(response.Status()) {
-			if gsmsg.IsTerminalFailureCode(response.Status()) {
-				requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+			requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+			failed := gsmsg.IsTerminalFailureCode(response.Status())
+			if failed {
 				responseError := rm.generateResponseErrorFromStatus(response.Status())
+				if redirect, ok := redirectFromResponse(response); ok {
+					responseError = redirect
+				} else if data, ok := response.Extension(graphsync.ExtensionCursor); ok {
+					responseError = graphsync.InterruptedError{Err: responseError, Cursor: data}
+				}
 				select {
 				case requestStatus.networkError <- responseError:
 				case <-requestStatus.ctx.Done():
 				}
 				requestStatus.cancelFn()
 			}
+			// a request being expanded stays in progress, to be sent again
+			expanding := requestStatus.expansions.complete(!failed)
 			rm.asyncLoader.CompleteResponsesFor(response.RequestID())
-			delete(rm.inProgressRequestStatuses, response.RequestID())
+			if !expanding {
+				rm.metrics.RequestCompleted(requestStatus.labels, response.Status())
+				delete(rm.inProgressRequestStatuses, response.RequestID())
+			}
 		}
 	}
 }
 
+type expandRequestMessage struct {
+	requestID graphsync.RequestID
+	spec      ipld.Node
+	response  chan bool
+}
+
+// handle sends a request the responder asked to expand again, with the
+// expanded selector, once its traversal of the earlier responses is done
+func (erm *expandRequestMessage) handle(rm *RequestManager) {
+	requestStatus, ok := rm.inProgressRequestStatuses[erm.requestID]
+	if !ok || requestStatus.ctx.Err() != nil {
+		erm.response <- false
+		return
+	}
+	request, err := requestStatus.expansions.request(erm.requestID, erm.spec, rm.ipldBridge)
+	if err != nil {
+		log.Infof("Unable to expand request %s: %s", requestStatus.describe(erm.requestID), err)
+		erm.response <- false
+		return
+	}
+	rm.asyncLoader.CleanupRequest(erm.requestID)
+	rm.asyncLoader.StartRequest(requestStatus.ctx, erm.requestID)
+	rm.peerHandler.SendRequest(requestStatus.p, request)
+	erm.response <- true
+}
+
+// expandRequest sends the request again with the expanded selector, returning
+// false if the request has ended in the meantime
+func (rm *RequestManager) expandRequest(requestID graphsync.RequestID, spec ipld.Node) bool {
+	response := make(chan bool, 1)
+	select {
+	case rm.messages <- &expandRequestMessage{requestID, spec, response}:
+	case <-rm.ctx.Done():
+		return false
+	}
+	select {
+	case expanded := <-response:
+		return expanded
+	case <-rm.ctx.Done():
+		return false
+	}
+}
+
 func (rm *RequestManager) generateResponseErrorFromStatus(status graphsync.ResponseStatusCode) error {
 	switch status {
 	case graphsync.RequestFailedBusy:
@@ -358,12 +1200,14 @@ func (rm *RequestManager) generateResponseErrorFromStatus(status graphsync.Respo
 		return fmt.Errorf("Request Failed - For Legal Reasons")
 	case graphsync.RequestFailedUnknown:
 		return fmt.Errorf("Request Failed - Unknown Reason")
+	case graphsync.RequestFailedTimeout:
+		return fmt.Errorf("Request Failed - Responder Timed Out")
 	default:
 		return fmt.Errorf("Unknown")
 	}
 }
 
-func (rm *RequestManager) setupRequest(requestID graphsync.RequestID, p peer.ID, root ipld.Link, selectorSpec ipld.Node, extensions []graphsync.ExtensionData) (chan graphsync.ResponseProgress, chan error) {
+func (rm *RequestManager) setupRequest(requestCtx context.Context, requestID graphsync.RequestID, p peer.ID, root ipld.Link, selectorSpec ipld.Node, extensions []graphsync.ExtensionData) (chan graphsync.ResponseProgress, chan error) {
 	selectorBytes, err := rm.ipldBridge.EncodeNode(selectorSpec)
 	if err != nil {
 		return rm.singleErrorResponse(err)
@@ -372,43 +1216,503 @@ func (rm *RequestManager) setupRequest(requestID graphsync.RequestID, p peer.ID,
 	if err != nil {
 		return rm.singleErrorResponse(err)
 	}
-	asCidLink, ok := root.(cidlink.Link)
-	if !ok {
-		return rm.singleErrorResponse(fmt.Errorf("request failed: link has no cid"))
+	rootCid, err := ipldbridge.LinkCid(root)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	minProgressInterval, extensions, err := extractMinProgressInterval(extensions)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	var connectivity *connectivityCheck
+	if hasExtension(extensions, graphsync.ExtensionVerifyConnectivity) {
+		if rm.localLoader == nil {
+			return rm.singleErrorResponse(fmt.Errorf("cannot verify connectivity without a local loader"))
+		}
+		connectivity = &connectivityCheck{}
+		extensions = removeExtension(extensions, graphsync.ExtensionVerifyConnectivity)
+	}
+	maxExpansions, extensions, err := extractFollowExpansions(extensions)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	labels, extensions, err := extractMetricLabels(extensions)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	name, extensions := extractRequestName(extensions)
+	if name != "" {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[graphsync.RequestNameLabel] = name
+	}
+	concurrency, extensions, err := extractTraversalConcurrency(extensions)
+	if err != nil {
+		return rm.singleErrorResponse(err)
+	}
+	var progress *blockProgress
+	if hasExtension(extensions, graphsync.ExtensionProgressPerBlock) {
+		progress = newBlockProgress(root)
+		extensions = removeExtension(extensions, graphsync.ExtensionProgressPerBlock)
+	}
+	// a range applies only to the root block
+	if hasExtension(extensions, graphsync.ExtensionByteRange) && !byterange.SelectsRootOnly(selectorSpec) {
+		return rm.singleErrorResponse(byterange.ErrNotRoot)
 	}
 	networkErrorChan := make(chan error, 1)
-	ctx, cancel := context.WithCancel(rm.ctx)
-	rm.inProgressRequestStatuses[requestID] = &inProgressRequestStatus{
-		ctx, cancel, p, networkErrorChan,
+	abortCtx, abort := context.WithCancel(rm.ctx)
+	ctx, cancel := context.WithCancel(abortCtx)
+	requestStatus := &inProgressRequestStatus{
+		ctx: ctx, cancelFn: cancel, abortCtx: abortCtx, abortFn: abort, p: p, networkError: networkErrorChan,
+		connectivity: connectivity, scratch: graphsync.NewRequestScratch(),
+		labels: labels, root: rootCid, name: name,
+	}
+	if minProgressInterval > 0 {
+		requestStatus.minProgressTimer = time.AfterFunc(minProgressInterval, func() {
+			select {
+			case rm.messages <- &noInitialResponseMessage{requestID}:
+			case <-ctx.Done():
+			}
+		})
+	}
+	isByteRange := hasExtension(extensions, graphsync.ExtensionByteRange)
+	if isByteRange {
+		requestStatus.byteRange = make(chan byterange.Response, 1)
 	}
-	rm.asyncLoader.StartRequest(requestID)
-	rm.peerHandler.SendRequest(p, gsmsg.NewRequest(requestID, asCidLink.Cid, selectorBytes, maxPriority, extensions...))
-	return rm.executeTraversal(ctx, requestID, root, selector, networkErrorChan)
+	if hasExtension(extensions, graphsync.ExtensionAcceptPush) {
+		requestStatus.pushed = make(chan []cid.Cid, 1)
+	}
+	if maxExpansions > 0 && !isByteRange {
+		requestStatus.expansions = newSelectorExpansions(rootCid, selectorSpec, extensions, maxExpansions)
+	}
+	rm.inProgressRequestStatuses[requestID] = requestStatus
+	rm.asyncLoader.StartRequest(requestStatus.ctx, requestID)
+	rm.peerHandler.SendRequest(p, gsmsg.NewRequest(requestID, rootCid, selectorBytes, maxPriority, extensions...))
+	rm.metrics.RequestStarted(labels)
+	if isByteRange {
+		return rm.executeByteRange(ctx, requestID, root, requestStatus.byteRange, networkErrorChan)
+	}
+	var prefetch *localPrefetcher
+	if concurrency > 1 && rm.localLoader != nil {
+		prefetch = newLocalPrefetcher(ctx, ipldbridge.BindContext(ctx, rm.localLoader), concurrency)
+	}
+	passthrough := hasExtension(extensions, graphsync.ExtensionRawPassthrough)
+	return rm.executeTraversal(ctx, abortCtx, requestCtx, requestID, root, selector, networkErrorChan, connectivity, requestStatus.pushed, progress, requestStatus.expansions, prefetch, passthrough)
 }
 
-func (rm *RequestManager) executeTraversal(
+// extractFollowRedirects removes the requestor-only follow redirects
+// extension, so it is not sent, and returns the most redirects to follow
+func extractFollowRedirects(extensions []graphsync.ExtensionData) (int, []graphsync.ExtensionData, error) {
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionFollowRedirects {
+			continue
+		}
+		if len(extension.Data) != 4 {
+			return 0, nil, fmt.Errorf("invalid max redirects")
+		}
+		maxRedirects := int(binary.BigEndian.Uint32(extension.Data))
+		return maxRedirects, removeExtension(extensions, graphsync.ExtensionFollowRedirects), nil
+	}
+	return 0, extensions, nil
+}
+
+// extractFollowExpansions removes the requestor-only follow expansions
+// extension, so it is not sent, and returns the most expansions to follow
+func extractFollowExpansions(extensions []graphsync.ExtensionData) (int, []graphsync.ExtensionData, error) {
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionFollowExpansions {
+			continue
+		}
+		if len(extension.Data) != 4 {
+			return 0, nil, fmt.Errorf("invalid max expansions")
+		}
+		maxExpansions := int(binary.BigEndian.Uint32(extension.Data))
+		return maxExpansions, removeExtension(extensions, graphsync.ExtensionFollowExpansions), nil
+	}
+	return 0, extensions, nil
+}
+
+// extractTraversalConcurrency removes the requestor-only traversal concurrency
+// extension, so it is not sent, and returns the most concurrent loads
+func extractTraversalConcurrency(extensions []graphsync.ExtensionData) (int, []graphsync.ExtensionData, error) {
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionTraversalConcurrency {
+			continue
+		}
+		if len(extension.Data) != 4 {
+			return 0, nil, fmt.Errorf("invalid traversal concurrency")
+		}
+		concurrency := int(binary.BigEndian.Uint32(extension.Data))
+		return concurrency, removeExtension(extensions, graphsync.ExtensionTraversalConcurrency), nil
+	}
+	return 0, extensions, nil
+}
+
+// extractMetricLabels removes the requestor-only metric labels extension, so
+// it is not sent, and returns its labels
+func extractMetricLabels(extensions []graphsync.ExtensionData) (map[string]string, []graphsync.ExtensionData, error) {
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionMetricLabels {
+			continue
+		}
+		var labels map[string]string
+		if err := json.Unmarshal(extension.Data, &labels); err != nil {
+			return nil, nil, fmt.Errorf("invalid metric labels: %s", err)
+		}
+		return labels, removeExtension(extensions, graphsync.ExtensionMetricLabels), nil
+	}
+	return nil, extensions, nil
+}
+
+// extractRequestName removes the requestor-only request name extension, so it
+// is not sent, and returns the name
+func extractRequestName(extensions []graphsync.ExtensionData) (string, []graphsync.ExtensionData) {
+	for _, extension := range extensions {
+		if extension.Name == graphsync.ExtensionRequestName {
+			return string(extension.Data), removeExtension(extensions, graphsync.ExtensionRequestName)
+		}
+	}
+	return "", extensions
+}
+
+// extractMinProgressInterval removes the requestor-only min progress interval
+// extension, so it is not sent, and returns its duration
+func extractMinProgressInterval(extensions []graphsync.ExtensionData) (time.Duration, []graphsync.ExtensionData, error) {
+	var minProgressInterval time.Duration
+	remaining := make([]graphsync.ExtensionData, 0, len(extensions))
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionMinProgressInterval {
+			remaining = append(remaining, extension)
+			continue
+		}
+		if len(extension.Data) != 8 {
+			return 0, nil, fmt.Errorf("invalid min progress interval")
+		}
+		minProgressInterval = time.Duration(binary.BigEndian.Uint64(extension.Data))
+	}
+	return minProgressInterval, remaining, nil
+}
+
+func hasExtension(extensions []graphsync.ExtensionData, name graphsync.ExtensionName) bool {
+	for _, extension := range extensions {
+		if extension.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeExtension removes a requestor-only extension, so it is not sent
+func removeExtension(extensions []graphsync.ExtensionData, name graphsync.ExtensionName) []graphsync.ExtensionData {
+	remaining := make([]graphsync.ExtensionData, 0, len(extensions))
+	for _, extension := range extensions {
+		if extension.Name != name {
+			remaining = append(remaining, extension)
+		}
+	}
+	return remaining
+}
+
+// executeByteRange waits for the bytes sent for a byte range request instead
+// of traversing, and returns them as a single bytes node at the root. Only a
+// range covering the whole block can be verified, so the bytes are not stored.
+func (rm *RequestManager) executeByteRange(
 	ctx context.Context,
 	requestID graphsync.RequestID,
 	root ipld.Link,
-	selector ipldbridge.Selector,
+	byteRangeChan chan byterange.Response,
 	networkErrorChan chan error,
 ) (chan graphsync.ResponseProgress, chan error) {
 	inProgressChan := make(chan graphsync.ResponseProgress)
 	inProgressErr := make(chan error)
-	loaderFn := loader.WrapAsyncLoader(ctx, rm.asyncLoader.AsyncLoad, requestID, inProgressErr)
-	visitor := visitToChannel(ctx, inProgressChan)
 	go func() {
-		rm.ipldBridge.Traverse(ctx, loaderFn, root, selector, visitor)
+		var err error
 		select {
-		case networkError := <-networkErrorChan:
+		case byteRange := <-byteRangeChan:
+			if !byteRange.Partial {
+				err = verifyWholeBlock(root, byteRange.Data)
+				if err != nil {
+					break
+				}
+			}
+			var node ipld.Node
+			node, err = ipldfree.NodeBuilder().CreateBytes(byteRange.Data)
+			if err != nil {
+				break
+			}
+			progress := graphsync.ResponseProgress{Node: node}
+			progress.LastBlock.Link = root
+			select {
+			case <-ctx.Done():
+			case inProgressChan <- progress:
+			}
+		case err = <-networkErrorChan:
+		case <-ctx.Done():
+			// a failed request is cancelled as its error is sent
+			select {
+			case err = <-networkErrorChan:
+			default:
+			}
+		}
+		if err != nil {
 			select {
 			case <-rm.ctx.Done():
-			case inProgressErr <- networkError:
+			case inProgressErr <- err:
 			}
-		default:
 		}
+		select {
+		case <-rm.ctx.Done():
+		case rm.messages <- &terminateRequestMessage{requestID}:
+		}
+		close(inProgressChan)
+		close(inProgressErr)
+	}()
+	return inProgressChan, inProgressErr
+}
+
+// loadPushedSubtrees loads the blocks a responder pushed under roots, so they
+// are verified and stored, without reporting them as responses. Pushed
+// content is speculative, so blocks the responder did not send are skipped.
+func (rm *RequestManager) loadPushedSubtrees(ctx context.Context, requestID graphsync.RequestID, roots []cid.Cid, connectivity *connectivityCheck) {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	spec := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(pushedSubtreeDepth),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	selector, err := rm.ipldBridge.ParseSelector(spec)
+	if err != nil {
+		log.Warningf("Unable to parse selector for pushed subtrees: %s", err)
+		return
+	}
+	pushedLoader := func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
 		select {
 		case <-ctx.Done():
+			return nil, ctx.Err()
+		case result := <-rm.asyncLoader.AsyncLoad(requestID, link):
+			if result.Err != nil {
+				return nil, result.Err
+			}
+			if connectivity != nil {
+				connectivity.recordPushed(link)
+			}
+			return bytes.NewReader(result.Data), nil
+		}
+	}
+	for _, root := range roots {
+		err := rm.ipldBridge.Traverse(ctx, pushedLoader, cidlink.Link{Cid: root}, selector, func(ipldbridge.TraversalProgress, ipld.Node, ipldbridge.TraversalReason) error {
+			return nil
+		})
+		if err != nil {
+			log.Infof("Unable to load pushed subtree %s for request %d: %s", root, requestID, err)
+		}
+	}
+}
+
+// canFillLocally checks whether a traversal left incomplete by the responder
+// should be retried with the local store filling in blocks the responder did
+// not send. Requests the requestor itself gave up on are not retried.
+func (rm *RequestManager) canFillLocally(networkError error) bool {
+	return rm.localLoader != nil &&
+		networkError != graphsync.ErrRequestCancelled && networkError != graphsync.ErrNoInitialResponse
+}
+
+// abort ends a request cancelled before it finished, which, unlike cancelFn,
+// also stops it filling in locally
+func (rs *inProgressRequestStatus) abort() {
+	if rs.abortFn != nil {
+		rs.abortFn()
+	}
+	rs.cancelFn()
+}
+
+// fillLocally traverses again once the responder is done, loading each link
+// from what the responder sent or else from the local store, and reports the
+// nodes the first traversal did not reach. It stops once the request is
+// aborted or the context it was made with is done.
+func (rm *RequestManager) fillLocally(abortCtx context.Context, requestCtx context.Context, requestID graphsync.RequestID, root ipld.Link, selector ipldbridge.Selector, visited visitedPaths, progress *blockProgress, passthrough bool, inProgressChan chan graphsync.ResponseProgress) error {
+	// a request already cancelled is not filled in
+	if err := abortCtx.Err(); err != nil {
+		return err
+	}
+	if err := requestCtx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(abortCtx)
+	defer cancel()
+	go func() {
+		select {
+		case <-requestCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	fillLoader := func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		if _, ok := link.(ipldbridge.CidLink); ok {
+			link, _ = ipldbridge.NormalizeLink(link)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rm.ctx.Done():
+			return nil, rm.ctx.Err()
+		case result := <-rm.asyncLoader.AsyncLoad(requestID, link):
+			if result.Err == nil {
+				return bytes.NewReader(result.Data), nil
+			}
+			return rm.localLoader(ctx, link, linkContext)
+		}
+	}
+	if passthrough {
+		fillLoader = verifyBlockBytes(ctx, fillLoader, nil)
+	}
+	return rm.ipldBridge.TraverseExploring(ctx, fillLoader, root, selector, visited.skip(progress.wrapVisitor(visitToChannel(ctx, inProgressChan, nil))))
+}
+
+// verifyWholeBlock checks bytes the responder says are the whole of the root
+// block against its CID
+func verifyWholeBlock(root ipld.Link, data []byte) error {
+	c, err := ipldbridge.LinkCid(root)
+	if err != nil {
+		return err
+	}
+	expected, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !expected.Equals(c) {
+		return errBadByteRange
+	}
+	return nil
+}
+
+func (rm *RequestManager) executeTraversal(
+	ctx context.Context,
+	abortCtx context.Context,
+	requestCtx context.Context,
+	requestID graphsync.RequestID,
+	root ipld.Link,
+	selector ipldbridge.Selector,
+	networkErrorChan chan error,
+	connectivity *connectivityCheck,
+	pushed chan []cid.Cid,
+	progress *blockProgress,
+	expansions *selectorExpansions,
+	prefetch *localPrefetcher,
+	passthrough bool,
+) (chan graphsync.ResponseProgress, chan error) {
+	inProgressChan := make(chan graphsync.ResponseProgress)
+	inProgressErr := make(chan error)
+	decodeTracker := &blockDecodeTracker{}
+	warnings := &warningTracker{}
+	visited := make(visitedPaths)
+	visitor := warnings.wrapVisitor(decodeTracker.wrapVisitor(prefetch.wrapVisitor(visited.record(progress.wrapVisitor(visitToChannel(ctx, inProgressChan, warnings))))))
+	go func() {
+		var err error
+		var failed bool
+		for {
+			// load errors are held back until the traversal ends, in case the
+			// local store can fill in the links
+			loadErrorChan := make(chan error)
+			var loadErrors []error
+			var storeFailed bool
+			loadErrorsDone := make(chan struct{})
+			go func() {
+				for err := range loadErrorChan {
+					if storeErr, ok := err.(graphsync.StoreError); ok && !storeFailed {
+						storeFailed = true
+						select {
+						case <-rm.ctx.Done():
+						case rm.messages <- &storeFailedMessage{requestID, storeErr}:
+						}
+					}
+					loadErrors = append(loadErrors, err)
+				}
+				close(loadErrorsDone)
+			}()
+			loaderFn := loader.WrapAsyncLoader(ctx, rm.asyncLoader.AsyncLoad, requestID, loadErrorChan, warnings.record)
+			loaderFn = prefetch.wrapLoader(loaderFn)
+			if passthrough {
+				loaderFn = verifyBlockBytes(ctx, loaderFn, loadErrorChan)
+			}
+			loaderFn = decodeTracker.wrapLoader(loaderFn)
+			err = rm.ipldBridge.TraverseExploring(ctx, loaderFn, root, selector, visitor)
+			close(loadErrorChan)
+			<-loadErrorsDone
+			if err != nil && decodeTracker.pending != nil {
+				select {
+				case <-ctx.Done():
+				case inProgressErr <- decodeTracker.decodeError(err):
+				}
+			}
+			// whether to expand is only known once the responder completes
+			// the request, which may be after the traversal ends
+			var expandedSpec ipld.Node
+			if expansions != nil && err == nil {
+				select {
+				case expandedSpec = <-expansions.next:
+				case <-ctx.Done():
+				}
+			}
+			// the responder failing the request leaves the DAG incomplete, but load
+			// errors may be a responder wrongly claiming success. Either way, the
+			// local store may have what the responder did not send.
+			failed = false
+			var networkError error
+			select {
+			case networkError = <-networkErrorChan:
+				failed = true
+			default:
+			}
+			// a request cancelled because blocks cannot be stored has nothing
+			// more coming from the responder to fill in with
+			if (failed || len(loadErrors) > 0) && !storeFailed && rm.canFillLocally(networkError) &&
+				rm.fillLocally(abortCtx, requestCtx, requestID, root, selector, visited, progress, passthrough, inProgressChan) == nil {
+				failed = false
+				networkError = nil
+				loadErrors = nil
+			}
+			for _, loadError := range loadErrors {
+				select {
+				case <-rm.ctx.Done():
+				case inProgressErr <- loadError:
+				}
+			}
+			if networkError != nil {
+				select {
+				case <-rm.ctx.Done():
+				case inProgressErr <- networkError:
+				}
+			}
+			if expandedSpec == nil || failed || len(loadErrors) > 0 || ctx.Err() != nil {
+				break
+			}
+			expandedSelector, parseErr := rm.ipldBridge.ParseSelector(expandedSpec)
+			if parseErr != nil || !rm.expandRequest(requestID, expandedSpec) {
+				break
+			}
+			selector = expandedSelector
+			// the expanded request traverses from the root again, so only nodes
+			// earlier requests did not reach are reported
+			visitor = warnings.wrapVisitor(decodeTracker.wrapVisitor(prefetch.wrapVisitor(visited.skip(visited.record(progress.wrapVisitor(visitToChannel(ctx, inProgressChan, warnings)))))))
+		}
+		if pushed != nil && !failed && err == nil && ctx.Err() == nil {
+			select {
+			case roots := <-pushed:
+				rm.loadPushedSubtrees(ctx, requestID, roots, connectivity)
+			default:
+			}
+		}
+		if connectivity != nil && !failed && ctx.Err() == nil {
+			err := connectivity.verify(ctx, rm.ipldBridge, ipldbridge.BindContext(ctx, rm.localLoader), root, selector)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+				case inProgressErr <- err:
+				}
+			}
+		}
+		// a cancelled request still needs cleaning up
+		select {
+		case <-rm.ctx.Done():
 		case rm.messages <- &terminateRequestMessage{requestID}:
 		}
 		close(inProgressChan)
@@ -15,8 +15,12 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/persistentextensions"
 
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	mh "github.com/multiformats/go-multihash"
 
 	"github.com/ipld/go-ipld-prime"
 
@@ -63,7 +67,7 @@ func newFakeAsyncLoader() *fakeAsyncLoader {
 		blks:             make(chan []blocks.Block, 1),
 	}
 }
-func (fal *fakeAsyncLoader) StartRequest(requestID graphsync.RequestID) {
+func (fal *fakeAsyncLoader) StartRequest(ctx context.Context, requestID graphsync.RequestID) {
 }
 func (fal *fakeAsyncLoader) ProcessResponse(responses map[graphsync.RequestID]metadata.Metadata,
 	blks []blocks.Block) {
@@ -372,6 +376,127 @@ func TestCancelRequestInProgress(t *testing.T) {
 	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
 }
 
+func TestCancelPeer(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 4)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+
+	var errChans []<-chan error
+	for i := 0; i < 3; i++ {
+		_, errChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+		errChans = append(errChans, errChan)
+	}
+	_, _ = requestManager.SendRequest(requestCtx, peers[1], r, s)
+	readNNetworkRequests(requestCtx, t, requestRecordChan, 4)
+
+	if cancelled := requestManager.CancelPeer(peers[0]); cancelled != 3 {
+		t.Fatal("should have cancelled every request to the peer")
+	}
+	cancels := readNNetworkRequests(requestCtx, t, requestRecordChan, 3)
+	for _, rr := range cancels {
+		if rr.p != peers[0] || !rr.gsr.IsCancel() {
+			t.Fatal("did not send correct cancel messages over network")
+		}
+	}
+	for _, errChan := range errChans {
+		errs := testutil.CollectErrors(requestCtx, t, errChan)
+		if len(errs) != 1 || errs[0] != graphsync.ErrRequestCancelled {
+			t.Fatal("should have reported request was cancelled")
+		}
+	}
+
+	activeRequests := requestManager.ActiveRequests()
+	if len(activeRequests) != 1 || activeRequests[0].Peer != peers[1] {
+		t.Fatal("should not have cancelled requests to other peers")
+	}
+	if requestManager.CancelPeer(peers[0]) != 0 {
+		t.Fatal("should have no requests left to cancel")
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 4)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.SetRequestLimits(2, 1)
+	requestManager.Startup()
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(3)
+
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+
+	// the second request waits on the per peer limit, the fourth on the total
+	firstCtx, firstCancel := context.WithCancel(requestCtx)
+	defer firstCancel()
+	thirdCtx, thirdCancel := context.WithCancel(requestCtx)
+	defer thirdCancel()
+	_, _ = requestManager.SendRequest(firstCtx, peers[0], r, s)
+	_, _ = requestManager.SendRequest(requestCtx, peers[0], r, s)
+	_, _ = requestManager.SendRequest(thirdCtx, peers[1], r, s)
+	_, _ = requestManager.SendRequest(requestCtx, peers[2], r, s)
+
+	verifySent := func(expectedCancel peer.ID, expectedRequest peer.ID) {
+		var cancelled, requested bool
+		for _, rr := range readNNetworkRequests(requestCtx, t, requestRecordChan, 2) {
+			if rr.gsr.IsCancel() {
+				cancelled = rr.p == expectedCancel
+			} else {
+				requested = rr.p == expectedRequest
+			}
+		}
+		if !cancelled || !requested {
+			t.Fatal("did not let the next waiting request through")
+		}
+	}
+	verifyNoneSent := func() {
+		select {
+		case <-requestRecordChan:
+			t.Fatal("sent a request beyond the limits")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	sentTo := make(map[peer.ID]bool)
+	for _, rr := range readNNetworkRequests(requestCtx, t, requestRecordChan, 2) {
+		sentTo[rr.p] = true
+	}
+	if !sentTo[peers[0]] || !sentTo[peers[1]] {
+		t.Fatal("did not send the requests within the limits")
+	}
+	verifyNoneSent()
+	if len(requestManager.ActiveRequests()) != 2 {
+		t.Fatal("waiting requests should not be active")
+	}
+
+	// the waiting request to the first peer now fits, but the total is reached
+	// again before the request to the third peer
+	firstCancel()
+	verifySent(peers[0], peers[0])
+	verifyNoneSent()
+
+	thirdCancel()
+	verifySent(peers[1], peers[2])
+}
+
 func TestCancelManagerExitsGracefully(t *testing.T) {
 	requestRecordChan := make(chan requestRecord, 2)
 	fph := &fakePeerHandler{requestRecordChan}
@@ -602,6 +727,421 @@ func TestRequestReturnsMissingBlocks(t *testing.T) {
 
 }
 
+func TestEmptyResponse(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	receivedStatus := make(chan graphsync.ResponseStatusCode, 1)
+	requestManager.RegisterHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		receivedStatus <- responseData.Status()
+		return nil
+	})
+
+	// the responder still sends the root block needed to traverse the request
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+
+	md := encodedMetadataForBlocks(t, fakeIPLDBridge, blks, true)
+	emptyResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedEmpty, md),
+	}
+	requestManager.ProcessResponses(peers[0], emptyResponses, blks)
+
+	select {
+	case <-requestCtx.Done():
+		t.Fatal("should have received response status but didn't")
+	case status := <-receivedStatus:
+		if status != graphsync.RequestCompletedEmpty {
+			t.Fatal("should have received empty completion status but didn't")
+		}
+	}
+	fal.successResponseOn(rr.gsr.ID(), blks)
+	testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
+func TestBlockNotSentWarning(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	// the responder skipped the second block, which loads from the local store
+	skipped := cidlink.Link{Cid: blks[1].Cid()}
+	fal.successResponseOn(rr.gsr.ID(), []blocks.Block{blks[0], blks[2]})
+	fal.responseOn(rr.gsr.ID(), skipped, types.AsyncLoadResult{Data: blks[1].RawData(), NotSent: true})
+
+	responses := testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	verifyMatchedResponses(t, responses, blks)
+	for i, response := range responses {
+		if i != 1 {
+			if len(response.Warnings) != 0 {
+				t.Fatal("should not have warned about a block that was sent")
+			}
+			continue
+		}
+		if len(response.Warnings) != 1 ||
+			response.Warnings[0].Code != graphsync.WarningBlockNotSent ||
+			response.Warnings[0].Link != skipped {
+			t.Fatal("should have warned that the block was not sent")
+		}
+	}
+}
+
+func TestBlockDecodeError(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	ipldBridge := ipldbridge.NewIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, ipldBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// a block whose cid claims dag-cbor, but whose bytes are not valid cbor
+	invalidData := []byte{0xff, 0xff, 0xff, 0xff}
+	invalidCid, err := cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256).Sum(invalidData)
+	if err != nil {
+		t.Fatal("unable to create cid")
+	}
+	root := cidlink.Link{Cid: invalidCid}
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	s := ssb.ExploreAll(ssb.Matcher()).Node()
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], root, s)
+
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	fal.responseOn(rr.gsr.ID(), root, types.AsyncLoadResult{Data: invalidData})
+
+	responses := testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	if len(responses) != 0 {
+		t.Fatal("should not have traversed invalid block")
+	}
+	if len(errs) != 1 {
+		t.Fatal("should have sent one error")
+	}
+	decodeErr, ok := errs[0].(graphsync.BlockDecodeError)
+	if !ok || decodeErr.Err == nil || !decodeErr.Cid.Equals(invalidCid) {
+		t.Fatal("should have sent block decode error naming invalid block")
+	}
+}
+
+func TestMinProgressInterval(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 4)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+	minProgressInterval := 20 * time.Millisecond
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+
+	// a responder that accepts the request but never sends a block
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s, graphsync.MinProgressInterval(minProgressInterval))
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	if _, ok := rr.gsr.Extension(graphsync.ExtensionMinProgressInterval); ok {
+		t.Fatal("should not have sent min progress interval to responder")
+	}
+	acceptedResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestAcknowledged),
+	}
+	requestManager.ProcessResponses(peers[0], acceptedResponses, nil)
+
+	testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	if len(errs) != 1 || errs[0] != graphsync.ErrNoInitialResponse {
+		t.Fatal("should have aborted request with no initial response")
+	}
+	cancelRequest := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	if !cancelRequest.gsr.IsCancel() || cancelRequest.gsr.ID() != rr.gsr.ID() {
+		t.Fatal("should have cancelled request with responder")
+	}
+
+	// once a block has arrived, slow progress does not abort the request
+	returnedResponseChan, returnedErrorChan = requestManager.SendRequest(requestCtx, peers[0], r, s, graphsync.MinProgressInterval(minProgressInterval))
+	rr = readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	firstBlockResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, encodedMetadataForBlocks(t, fakeIPLDBridge, blks[:1], true)),
+	}
+	requestManager.ProcessResponses(peers[0], firstBlockResponses, blks[:1])
+	time.Sleep(2 * minProgressInterval)
+	fal.successResponseOn(rr.gsr.ID(), blks)
+
+	responses := testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	if len(responses) != len(blks) {
+		t.Fatal("should have completed request after initial response")
+	}
+}
+
+func TestAcknowledgesMessages(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+	requestManager.SendRequest(requestCtx, peers[0], r, s)
+
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+
+	sequenceData := testutil.RandomBytes(10)
+	md := encodedMetadataForBlocks(t, fakeIPLDBridge, blks[:1], true)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md, graphsync.ExtensionData{
+			Name: graphsync.ExtensionAck,
+			Data: sequenceData,
+		}),
+	}
+	requestManager.ProcessResponses(peers[0], responses, blks[:1])
+
+	ackRecord := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	ackData, found := ackRecord.gsr.Extension(graphsync.ExtensionAck)
+	if ackRecord.p != peers[0] || ackRecord.gsr.ID() != rr.gsr.ID() ||
+		!ackRecord.gsr.IsAck() || !found || !reflect.DeepEqual(ackData, sequenceData) {
+		t.Fatal("did not acknowledge message")
+	}
+
+	// messages for requests not in progress, or from another peer, are not
+	// acknowledged
+	otherPeer := testutil.GeneratePeers(1)[0]
+	requestManager.ProcessResponses(otherPeer, responses, blks[:1])
+	unknownResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID()+1, graphsync.PartialResponse, md, graphsync.ExtensionData{
+			Name: graphsync.ExtensionAck,
+			Data: sequenceData,
+		}),
+	}
+	requestManager.ProcessResponses(peers[0], unknownResponses, blks[:1])
+	select {
+	case <-requestRecordChan:
+		t.Fatal("should not acknowledge messages for requests not in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestPersistentExtensions(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("AppleSauce/McGee"),
+		Data: testutil.RandomBytes(100),
+	}
+	receivedExtensionData := make(chan []byte, 2)
+	requestManager.RegisterHook(func(p peer.ID, responseData graphsync.ResponseData) error {
+		data, _ := responseData.Extension(extension.Name)
+		receivedExtensionData <- data
+		return nil
+	})
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blks))
+	r := cidlink.Link{Cid: blks[0].Cid()}
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+
+	namesData, err := persistentextensions.EncodeNames([]graphsync.ExtensionName{extension.Name}, fakeIPLDBridge)
+	if err != nil {
+		t.Fatal("unable to encode persistent extension names")
+	}
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse,
+			encodedMetadataForBlocks(t, fakeIPLDBridge, blks[:1], true),
+			extension,
+			graphsync.ExtensionData{Name: graphsync.ExtensionPersistentExtensions, Data: namesData}),
+	}
+	requestManager.ProcessResponses(peers[0], firstResponses, blks[:1])
+	secondResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull,
+			encodedMetadataForBlocks(t, fakeIPLDBridge, blks[1:], true)),
+	}
+	requestManager.ProcessResponses(peers[0], secondResponses, blks[1:])
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-requestCtx.Done():
+			t.Fatal("should have run hook for response but didn't")
+		case data := <-receivedExtensionData:
+			if !reflect.DeepEqual(data, extension.Data) {
+				t.Fatal("hook did not see persistent extension on every response")
+			}
+		}
+	}
+	fal.successResponseOn(rr.gsr.ID(), blks)
+	testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+}
+
+type fakePeerConnector struct {
+	err error
+	// if set, dials wait for it to close, and report whether they had a
+	// deadline on dialed
+	release chan struct{}
+	dialed  chan bool
+}
+
+func (fpc *fakePeerConnector) ConnectTo(ctx context.Context, p peer.ID) error {
+	if fpc.release != nil {
+		_, hasDeadline := ctx.Deadline()
+		fpc.dialed <- hasDeadline
+		select {
+		case <-fpc.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fpc.err
+}
+
+func TestFailedDial(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.ConnectBeforeRequests(&fakePeerConnector{err: errors.New("no route")}, time.Second)
+	requestManager.Startup()
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blocks := testutil.GenerateBlocksOfSize(5, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blocks))
+	r := cidlink.Link{Cid: blocks[0].Cid()}
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	if len(errs) != 1 {
+		t.Fatal("should have sent a single error")
+	}
+	dialErr, ok := errs[0].(graphsync.DialError)
+	if !ok || dialErr.Peer != peers[0] {
+		t.Fatal("should have sent a dial error for the peer")
+	}
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+	select {
+	case <-requestRecordChan:
+		t.Fatal("should not have sent a request")
+	default:
+	}
+}
+
+func TestDialInBackgroundWithoutTimeout(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	fpc := &fakePeerConnector{release: make(chan struct{}), dialed: make(chan bool, 1)}
+	requestManager.ConnectBeforeRequests(fpc, 0)
+	requestManager.Startup()
+
+	testCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	// the request itself has no deadline, so any the dial has is its own
+	requestCtx, cancelRequest := context.WithCancel(ctx)
+	defer cancelRequest()
+	peers := testutil.GeneratePeers(1)
+
+	blocks := testutil.GenerateBlocksOfSize(5, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blocks))
+	r := cidlink.Link{Cid: blocks[0].Cid()}
+	// the request returns while the dial is still in progress
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+
+	select {
+	case <-testCtx.Done():
+		t.Fatal("should have dialed peer")
+	case hasDeadline := <-fpc.dialed:
+		if hasDeadline {
+			t.Fatal("should not have set a dial timeout")
+		}
+	}
+	select {
+	case <-requestRecordChan:
+		t.Fatal("should not have sent a request before dialing")
+	default:
+	}
+	close(fpc.release)
+
+	rr := readNNetworkRequests(testCtx, t, requestRecordChan, 1)[0]
+	fal.successResponseOn(rr.gsr.ID(), blocks)
+	requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, encodedMetadataForBlocks(t, fakeIPLDBridge, blocks, true)),
+	}, blocks)
+	testutil.CollectResponses(testCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(testCtx, t, returnedErrorChan)
+}
+
 func TestEncodingExtensions(t *testing.T) {
 	requestRecordChan := make(chan requestRecord, 2)
 	fph := &fakePeerHandler{requestRecordChan}
@@ -711,3 +1251,95 @@ func TestEncodingExtensions(t *testing.T) {
 		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
 	})
 }
+
+func TestCancelAfterReadingProgress(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.Startup()
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	requestCtx1, cancel1 := context.WithCancel(requestCtx)
+	peers := testutil.GeneratePeers(1)
+
+	blocks := testutil.GenerateBlocksOfSize(5, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blocks))
+	r := cidlink.Link{Cid: blocks[0].Cid()}
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx1, peers[0], r, s)
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+
+	md := encodedMetadataForBlocks(t, fakeIPLDBridge, blocks, true)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+	}
+	requestManager.ProcessResponses(peers[0], responses, blocks)
+	fal.successResponseOn(rr.gsr.ID(), blocks)
+	testutil.ReadNResponses(requestCtx, t, returnedResponseChan, 1)
+
+	// stop reading progress and cancel
+	cancel1()
+	rr = readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	if !rr.gsr.IsCancel() {
+		t.Fatal("did not send cancel message over network")
+	}
+	_ = testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+
+	// the traversal should finish and clean up the request
+	for {
+		fal.responseChannelsLk.Lock()
+		remaining := len(fal.responseChannels)
+		fal.responseChannelsLk.Unlock()
+		if remaining == 0 {
+			break
+		}
+		select {
+		case <-requestCtx.Done():
+			t.Fatal("did not clean up cancelled request")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestMaxBufferedProgress(t *testing.T) {
+	requestRecordChan := make(chan requestRecord, 2)
+	fph := &fakePeerHandler{requestRecordChan}
+	fakeIPLDBridge := testbridge.NewMockIPLDBridge()
+	ctx := context.Background()
+	fal := newFakeAsyncLoader()
+	requestManager := New(ctx, fal, fakeIPLDBridge)
+	requestManager.SetDelegate(fph)
+	requestManager.SetMaxBufferedProgress(2)
+	requestManager.Startup()
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blocks := testutil.GenerateBlocksOfSize(5, 100)
+	s := testbridge.NewMockSelectorSpec(cidsForBlocks(blocks))
+	r := cidlink.Link{Cid: blocks[0].Cid()}
+	returnedResponseChan, returnedErrorChan := requestManager.SendRequest(requestCtx, peers[0], r, s)
+	rr := readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+
+	// progress arrives, but is never read
+	md := encodedMetadataForBlocks(t, fakeIPLDBridge, blocks, true)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+	}
+	requestManager.ProcessResponses(peers[0], responses, blocks)
+	fal.successResponseOn(rr.gsr.ID(), blocks)
+
+	rr = readNNetworkRequests(requestCtx, t, requestRecordChan, 1)[0]
+	if !rr.gsr.IsCancel() {
+		t.Fatal("did not send cancel message over network")
+	}
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	if len(errs) != 1 || errs[0] != graphsync.ErrProgressNotRead {
+		t.Fatal("should return progress not read error")
+	}
+	_ = testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+}
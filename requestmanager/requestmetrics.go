@@ -0,0 +1,40 @@
+package requestmanager
+
+import (
+	"github.com/ipfs/go-graphsync"
+)
+
+// RequestMetrics is notified of the progress of every request the requestor
+// makes, with the labels the request was made with using
+// graphsync.WithMetricLabels, or nil labels if it had none.
+type RequestMetrics interface {
+	// RequestStarted is called once when a request is sent
+	RequestStarted(labels map[string]string)
+
+	// BlockReceived is called for each block of size bytes received for a
+	// request
+	BlockReceived(labels map[string]string, size int)
+
+	// RequestCompleted is called once when the responder finishes a request,
+	// with the status it finished with
+	RequestCompleted(labels map[string]string, status graphsync.ResponseStatusCode)
+
+	// RequestCancelled is called once when the requestor cancels a request
+	// before the responder finishes it
+	RequestCancelled(labels map[string]string)
+}
+
+// NoopRequestMetrics is the default RequestMetrics, which ignores all events
+type NoopRequestMetrics struct{}
+
+// RequestStarted does nothing
+func (NoopRequestMetrics) RequestStarted(map[string]string) {}
+
+// BlockReceived does nothing
+func (NoopRequestMetrics) BlockReceived(map[string]string, int) {}
+
+// RequestCompleted does nothing
+func (NoopRequestMetrics) RequestCompleted(map[string]string, graphsync.ResponseStatusCode) {}
+
+// RequestCancelled does nothing
+func (NoopRequestMetrics) RequestCancelled(map[string]string) {}
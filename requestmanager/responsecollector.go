@@ -8,20 +8,25 @@ import (
 
 type responseCollector struct {
 	ctx context.Context
+	// if more than this many progress events are waiting to be read, the
+	// request is cancelled. Zero means no limit.
+	maxBufferedResponses int
 }
 
 func newResponseCollector(ctx context.Context) *responseCollector {
-	return &responseCollector{ctx}
+	return &responseCollector{ctx: ctx}
 }
 
 func (rc *responseCollector) collectResponses(
 	requestCtx context.Context,
 	incomingResponses <-chan graphsync.ResponseProgress,
 	incomingErrors <-chan error,
-	cancelRequest func()) (<-chan graphsync.ResponseProgress, <-chan error) {
+	cancelRequest func(reason graphsync.CancelReason)) (<-chan graphsync.ResponseProgress, <-chan error) {
 
 	returnedResponses := make(chan graphsync.ResponseProgress)
 	returnedErrors := make(chan error)
+	// closed if the request is cancelled because progress was not read
+	stalled := make(chan struct{})
 
 	go func() {
 		var receivedResponses []graphsync.ResponseProgress
@@ -44,7 +49,7 @@ func (rc *responseCollector) collectResponses(
 				return
 			case <-requestCtx.Done():
 				if incomingResponses != nil {
-					cancelRequest()
+					cancelRequest(graphsync.CancelReasonFromContext(requestCtx))
 				}
 				return
 			case response, ok := <-incomingResponses:
@@ -52,6 +57,11 @@ func (rc *responseCollector) collectResponses(
 					incomingResponses = nil
 				} else {
 					receivedResponses = append(receivedResponses, response)
+					if rc.maxBufferedResponses > 0 && len(receivedResponses) > rc.maxBufferedResponses {
+						close(stalled)
+						cancelRequest(graphsync.CancelReason{Code: graphsync.CancelReasonProgressNotRead})
+						return
+					}
 				}
 			case outgoingResponses() <- nextResponse():
 				receivedResponses = receivedResponses[1:]
@@ -81,9 +91,19 @@ func (rc *responseCollector) collectResponses(
 				return
 			case <-requestCtx.Done():
 				return
+			case <-stalled:
+				receivedErrors = append(receivedErrors, graphsync.ErrProgressNotRead)
+				stalled = nil
 			case err, ok := <-incomingErrors:
 				if !ok {
 					incomingErrors = nil
+					// the cancel may close incoming errors before the stall is seen
+					select {
+					case <-stalled:
+						receivedErrors = append(receivedErrors, graphsync.ErrProgressNotRead)
+						stalled = nil
+					default:
+					}
 				} else {
 					receivedErrors = append(receivedErrors, err)
 				}
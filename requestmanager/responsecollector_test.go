@@ -24,7 +24,7 @@ func TestBufferingResponseProgress(t *testing.T) {
 	defer requestCancel()
 	incomingResponses := make(chan graphsync.ResponseProgress)
 	incomingErrors := make(chan error)
-	cancelRequest := func() {}
+	cancelRequest := func(graphsync.CancelReason) {}
 
 	outgoingResponses, outgoingErrors := rc.collectResponses(
 		requestCtx, incomingResponses, incomingErrors, cancelRequest)
@@ -4,4 +4,7 @@ package types
 type AsyncLoadResult struct {
 	Data []byte
 	Err  error
+	// NotSent is true if the responder listed the block as sent but it never
+	// arrived, so Data came from the local store
+	NotSent bool
 }
@@ -1,29 +1,259 @@
 package requestmanager
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"io/ioutil"
+	"sync"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/nonce"
+	"github.com/ipfs/go-graphsync/selectorutil"
 	ipld "github.com/ipld/go-ipld-prime"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
 )
 
-func visitToChannel(ctx context.Context, inProgressChan chan graphsync.ResponseProgress) ipldbridge.AdvVisitFn {
-	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason) error {
+func visitToChannel(ctx context.Context, inProgressChan chan graphsync.ResponseProgress, warnings *warningTracker) ipldbridge.ExploringVisitFn {
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
 		select {
 		case <-ctx.Done():
+			// stop the traversal, rather than visit the rest of the block
+			return ctx.Err()
 		case inProgressChan <- graphsync.ResponseProgress{
 			Node:      node,
 			Path:      tp.Path,
 			LastBlock: tp.LastBlock,
+			Explored:  explored,
+			Warnings:  warnings.take(),
 		}:
 		}
 		return nil
 	}
 }
 
+// warningTracker holds the warnings raised loading a block until the
+// traversal reports the first node in it, so they go out with that node's
+// progress. A nil warningTracker reports no warnings.
+type warningTracker struct {
+	pending []graphsync.Warning
+}
+
+func (wt *warningTracker) record(warning graphsync.Warning) {
+	wt.pending = append(wt.pending, warning)
+}
+
+func (wt *warningTracker) take() []graphsync.Warning {
+	if wt == nil {
+		return nil
+	}
+	warnings := wt.pending
+	wt.pending = nil
+	return warnings
+}
+
+// wrapVisitor drops the warnings for a node that was visited but not
+// reported, so they are not reported with a later node
+func (wt *warningTracker) wrapVisitor(visitor ipldbridge.ExploringVisitFn) ipldbridge.ExploringVisitFn {
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
+		err := visitor(tp, node, tr, explored)
+		wt.pending = nil
+		return err
+	}
+}
+
+// blockProgress reports only the first node visited in each distinct block,
+// for requests made with graphsync.ProgressPerBlock. A nil blockProgress
+// reports every node.
+type blockProgress struct {
+	root ipld.Link
+	seen map[ipld.Link]struct{}
+}
+
+func newBlockProgress(root ipld.Link) *blockProgress {
+	return &blockProgress{root: root, seen: make(map[ipld.Link]struct{})}
+}
+
+func (bp *blockProgress) wrapVisitor(visitor ipldbridge.ExploringVisitFn) ipldbridge.ExploringVisitFn {
+	if bp == nil {
+		return visitor
+	}
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
+		// nodes in the root block have no last block
+		if tp.LastBlock.Link == nil {
+			tp.LastBlock.Link = bp.root
+		}
+		if _, ok := bp.seen[tp.LastBlock.Link]; ok {
+			return nil
+		}
+		err := visitor(tp, node, tr, explored)
+		if err == nil {
+			bp.seen[tp.LastBlock.Link] = struct{}{}
+		}
+		return err
+	}
+}
+
+// visitedPaths records the nodes a traversal has reported, so a second
+// traversal of the same DAG can report only the ones the first did not reach
+type visitedPaths map[string]struct{}
+
+func (vp visitedPaths) record(visitor ipldbridge.ExploringVisitFn) ipldbridge.ExploringVisitFn {
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
+		err := visitor(tp, node, tr, explored)
+		if err == nil {
+			vp[tp.Path.String()] = struct{}{}
+		}
+		return err
+	}
+}
+
+func (vp visitedPaths) skip(visitor ipldbridge.ExploringVisitFn) ipldbridge.ExploringVisitFn {
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
+		if _, ok := vp[tp.Path.String()]; ok {
+			return nil
+		}
+		return visitor(tp, node, tr, explored)
+	}
+}
+
+// blockDecodeTracker identifies traversal errors caused by a block that
+// loaded successfully but could not be decoded. A traversal visits each node
+// it loads immediately after decoding it, so a link that was loaded but not
+// yet visited when the traversal fails is the block that failed to decode.
+type blockDecodeTracker struct {
+	pending ipld.Link
+}
+
+func (bdt *blockDecodeTracker) wrapLoader(loader ipld.Loader) ipld.Loader {
+	return func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		result, err := loader(link, linkContext)
+		if err == nil {
+			bdt.pending = link
+		} else {
+			bdt.pending = nil
+		}
+		return result, err
+	}
+}
+
+func (bdt *blockDecodeTracker) wrapVisitor(visitor ipldbridge.ExploringVisitFn) ipldbridge.ExploringVisitFn {
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
+		bdt.pending = nil
+		return visitor(tp, node, tr, explored)
+	}
+}
+
+func (bdt *blockDecodeTracker) decodeError(err error) error {
+	decodeErr := graphsync.BlockDecodeError{Err: err}
+	if c, err := ipldbridge.LinkCid(bdt.pending); err == nil {
+		decodeErr.Cid = c
+	}
+	return decodeErr
+}
+
+// verifyBlockBytes wraps a traversal's loader, for requests made with
+// graphsync.RawPassthrough, so a block whose bytes do not hash to its CID
+// fails to load with a graphsync.BlockBytesMismatchError. Like other load
+// errors, the failure goes to errorChan and the traversal does not follow the
+// link, though with a nil errorChan the load returns it instead.
+func verifyBlockBytes(ctx context.Context, loader ipld.Loader, errorChan chan error) ipld.Loader {
+	return func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		result, err := loader(link, linkContext)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(result)
+		if err != nil {
+			return nil, err
+		}
+		if ipldbridge.BlockBytesMatch(link, data) {
+			return bytes.NewReader(data), nil
+		}
+		c, _ := ipldbridge.LinkCid(link)
+		mismatchErr := graphsync.BlockBytesMismatchError{Cid: c}
+		if errorChan == nil {
+			return nil, mismatchErr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case errorChan <- mismatchErr:
+			return nil, ipldbridge.ErrDoNotFollow()
+		}
+	}
+}
+
+// connectivityCheck records the blocks a responder sends for a request made
+// with graphsync.VerifyConnectivity, so once the traversal is done it can check
+// the local store connects all of them to the root
+type connectivityCheck struct {
+	lk       sync.Mutex
+	received []ipld.Link
+	// pushed are blocks loaded from subtrees the responder pushed, which the
+	// selector is not expected to reach
+	pushed map[ipld.Link]struct{}
+}
+
+func (cc *connectivityCheck) recordReceived(link ipld.Link) {
+	cc.lk.Lock()
+	cc.received = append(cc.received, link)
+	cc.lk.Unlock()
+}
+
+func (cc *connectivityCheck) recordPushed(link ipld.Link) {
+	cc.lk.Lock()
+	if cc.pushed == nil {
+		cc.pushed = make(map[ipld.Link]struct{})
+	}
+	cc.pushed[link] = struct{}{}
+	cc.lk.Unlock()
+}
+
+// verify runs the selector again over the local store alone, noting the first
+// link it cannot load and received blocks it never reaches
+func (cc *connectivityCheck) verify(ctx context.Context,
+	ipldBridge ipldbridge.IPLDBridge,
+	localLoader ipldbridge.Loader,
+	root ipld.Link,
+	selector ipldbridge.Selector) error {
+	var connectivityErr graphsync.ConnectivityError
+	reached := make(map[ipld.Link]struct{})
+	recordingLoader := func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		result, err := localLoader(link, linkContext)
+		if err != nil {
+			connectivityErr.Missing = append(connectivityErr.Missing, link)
+			return nil, ipldbridge.ErrDoNotFollow()
+		}
+		reached[link] = struct{}{}
+		return result, nil
+	}
+	err := ipldBridge.Traverse(ctx, recordingLoader, root, selector, func(ipldbridge.TraversalProgress, ipld.Node, ipldbridge.TraversalReason) error {
+		return nil
+	})
+	if err != nil && len(connectivityErr.Missing) == 0 {
+		return err
+	}
+	cc.lk.Lock()
+	for _, link := range cc.received {
+		if _, ok := cc.pushed[link]; ok {
+			continue
+		}
+		if _, ok := reached[link]; !ok {
+			connectivityErr.Orphans = append(connectivityErr.Orphans, link)
+		}
+	}
+	cc.lk.Unlock()
+	if len(connectivityErr.Missing) > 0 || len(connectivityErr.Orphans) > 0 {
+		return connectivityErr
+	}
+	return nil
+}
+
 func metadataForResponses(responses []gsmsg.GraphSyncResponse, ipldBridge ipldbridge.IPLDBridge) map[graphsync.RequestID]metadata.Metadata {
 	responseMetadata := make(map[graphsync.RequestID]metadata.Metadata, len(responses))
 	for _, response := range responses {
@@ -41,3 +271,200 @@ func metadataForResponses(responses []gsmsg.GraphSyncResponse, ipldBridge ipldbr
 	}
 	return responseMetadata
 }
+
+// selectorExpansions tracks the selector expansions a responder asks for on a
+// request made with graphsync.FollowExpansions
+type selectorExpansions struct {
+	root       cid.Cid
+	spec       ipld.Node
+	extensions []graphsync.ExtensionData
+	remaining  int
+	// pending is the expansion the responder last asked for, if any
+	pending ipld.Node
+	// next receives the expanded selector spec each time the responder
+	// completes the request, or nil if the request is not expanded
+	next chan ipld.Node
+}
+
+func newSelectorExpansions(root cid.Cid, spec ipld.Node, extensions []graphsync.ExtensionData, maxExpansions int) *selectorExpansions {
+	return &selectorExpansions{
+		root:       root,
+		spec:       spec,
+		extensions: extensions,
+		remaining:  maxExpansions,
+		next:       make(chan ipld.Node, 1),
+	}
+}
+
+// complete records that the responder completed the request, expanding the
+// selector with any expansion it asked for if expand is true and the request
+// has expansions left. It returns true if the request is expanded. A nil
+// selectorExpansions never expands.
+func (se *selectorExpansions) complete(expand bool) bool {
+	if se == nil {
+		return false
+	}
+	var expanded ipld.Node
+	if expand && se.pending != nil && se.remaining > 0 {
+		se.spec = selectorutil.UnionSelector(se.spec, se.pending)
+		se.remaining--
+		expanded = se.spec
+	}
+	se.pending = nil
+	select {
+	case se.next <- expanded:
+	default:
+	}
+	return expanded != nil
+}
+
+// request builds the request to send again with the given expanded selector
+// spec. A nonce is replaced with a fresh one, so the responder does not take
+// the request for a replay.
+func (se *selectorExpansions) request(requestID graphsync.RequestID, spec ipld.Node, ipldBridge ipldbridge.IPLDBridge) (gsmsg.GraphSyncRequest, error) {
+	selectorBytes, err := ipldBridge.EncodeNode(spec)
+	if err != nil {
+		return gsmsg.GraphSyncRequest{}, err
+	}
+	extensions, err := refreshNonce(se.extensions, ipldBridge)
+	if err != nil {
+		return gsmsg.GraphSyncRequest{}, err
+	}
+	return gsmsg.NewRequest(requestID, se.root, selectorBytes, maxPriority, extensions...), nil
+}
+
+// refreshNonce replaces a nonce among the extensions of a request sent again
+// with a fresh one, so the responder does not take the request for a replay
+func refreshNonce(extensions []graphsync.ExtensionData, ipldBridge ipldbridge.IPLDBridge) ([]graphsync.ExtensionData, error) {
+	if !hasExtension(extensions, graphsync.ExtensionNonce) {
+		return extensions, nil
+	}
+	nonceExtension, err := nonce.NewExtension(ipldBridge)
+	if err != nil {
+		return nil, err
+	}
+	return append(removeExtension(extensions, graphsync.ExtensionNonce), nonceExtension), nil
+}
+
+// localPrefetcher loads links from the local store ahead of a traversal, for
+// requests made with graphsync.TraversalConcurrency. When the traversal
+// visits a node it explores, the links directly beneath it are queued, and up
+// to n are loaded at once. The traversal still visits nodes in order, taking
+// each prefetched block when it reaches the link, and links the local store
+// does not have load as usual. A nil localPrefetcher prefetches nothing.
+type localPrefetcher struct {
+	ctx     context.Context
+	loader  ipldbridge.Loader
+	n       int
+	lk      sync.Mutex
+	running int
+	queue   []*prefetchedBlock
+	blocks  map[ipld.Link]*prefetchedBlock
+}
+
+// prefetchedBlock is a local load queued ahead of the traversal. Its data is
+// nil if the local store did not have the block.
+type prefetchedBlock struct {
+	link ipld.Link
+	done chan struct{}
+	data []byte
+}
+
+func newLocalPrefetcher(ctx context.Context, loader ipldbridge.Loader, n int) *localPrefetcher {
+	return &localPrefetcher{
+		ctx:    ctx,
+		loader: loader,
+		n:      n,
+		blocks: make(map[ipld.Link]*prefetchedBlock),
+	}
+}
+
+func (lp *localPrefetcher) wrapVisitor(visitor ipldbridge.ExploringVisitFn) ipldbridge.ExploringVisitFn {
+	if lp == nil {
+		return visitor
+	}
+	return func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason, explored bool) error {
+		if explored {
+			lp.prefetchChildren(node)
+		}
+		return visitor(tp, node, tr, explored)
+	}
+}
+
+func (lp *localPrefetcher) wrapLoader(loader ipld.Loader) ipld.Loader {
+	if lp == nil {
+		return loader
+	}
+	return func(link ipld.Link, linkContext ipldbridge.LinkContext) (io.Reader, error) {
+		lp.lk.Lock()
+		block, ok := lp.blocks[link]
+		delete(lp.blocks, link)
+		lp.lk.Unlock()
+		if ok {
+			select {
+			case <-lp.ctx.Done():
+			case <-block.done:
+				if block.data != nil {
+					return bytes.NewReader(block.data), nil
+				}
+			}
+		}
+		return loader(link, linkContext)
+	}
+}
+
+func (lp *localPrefetcher) prefetchChildren(node ipld.Node) {
+	switch node.ReprKind() {
+	case ipld.ReprKind_Map, ipld.ReprKind_List:
+	default:
+		return
+	}
+	lp.lk.Lock()
+	defer lp.lk.Unlock()
+	for itr := ipldselector.NewSegmentIterator(node); !itr.Done(); {
+		_, child, err := itr.Next()
+		if err != nil {
+			return
+		}
+		if child.ReprKind() != ipld.ReprKind_Link {
+			continue
+		}
+		link, err := child.AsLink()
+		if err != nil {
+			continue
+		}
+		if _, ok := lp.blocks[link]; ok {
+			continue
+		}
+		block := &prefetchedBlock{link: link, done: make(chan struct{})}
+		lp.blocks[link] = block
+		lp.queue = append(lp.queue, block)
+	}
+	for lp.running < lp.n && len(lp.queue) > 0 {
+		lp.running++
+		go lp.work()
+	}
+}
+
+// work loads queued links until the queue is empty
+func (lp *localPrefetcher) work() {
+	for {
+		lp.lk.Lock()
+		if len(lp.queue) == 0 || lp.ctx.Err() != nil {
+			lp.running--
+			lp.lk.Unlock()
+			return
+		}
+		block := lp.queue[0]
+		lp.queue = lp.queue[1:]
+		lp.lk.Unlock()
+		reader, err := lp.loader(block.link, ipldbridge.LinkContext{})
+		if err == nil {
+			block.data, err = ioutil.ReadAll(reader)
+			if err != nil {
+				block.data = nil
+			}
+		}
+		close(block.done)
+	}
+}
@@ -0,0 +1,131 @@
+package responsemanager
+
+import (
+	"context"
+	"io"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/responsemanager/loader"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Checkpoint records how far a responder got with a response to a request
+// made with graphsync.ExtensionCheckpoint
+type Checkpoint struct {
+	Peer    peer.ID
+	Request gsmsg.GraphSyncRequest
+	// Blocks is the number of blocks sent before the checkpoint, and Path,
+	// if Blocks is not zero, is the path from the root to the last of them
+	Blocks int
+	Path   ipld.Path
+}
+
+// CheckpointStore keeps checkpoints for responses in progress, so a responder
+// that restarts can resume them
+type CheckpointStore interface {
+	// SaveCheckpoint stores a checkpoint, replacing any earlier one for the
+	// same peer and request ID
+	SaveCheckpoint(Checkpoint) error
+	// DeleteCheckpoint removes the checkpoint for a response that finished
+	DeleteCheckpoint(p peer.ID, requestID graphsync.RequestID) error
+	// Checkpoints returns every stored checkpoint
+	Checkpoints() ([]Checkpoint, error)
+}
+
+// checkpointer tracks a response's progress, saving it every interval blocks
+// if it has a store. On a resumed response, it also holds back the blocks the
+// traversal passes on its way back to the checkpoint, since they were sent
+// before.
+//
+// Like a loader.PreferredOrder, it sits on both sides of the loader that
+// sends responses, so it knows the path of each block it is sent.
+type checkpointer struct {
+	// the responder's context, rather than the response's
+	ctx            context.Context
+	store          CheckpointStore
+	interval       int
+	checkpoint     Checkpoint
+	responseSender loader.ResponseSender
+
+	// the path of the block being loaded
+	path ipld.Path
+	// true until the traversal passes the block at the checkpoint's path
+	resuming bool
+}
+
+func newCheckpointer(ctx context.Context, store CheckpointStore, interval int, checkpoint Checkpoint, responseSender loader.ResponseSender) *checkpointer {
+	return &checkpointer{
+		ctx:            ctx,
+		store:          store,
+		interval:       interval,
+		checkpoint:     checkpoint,
+		responseSender: responseSender,
+		resuming:       checkpoint.Blocks > 0,
+	}
+}
+
+// start saves a checkpoint for a response just begun, so it is resumed even
+// if the responder stops before the first interval
+func (c *checkpointer) start() {
+	if !c.resuming {
+		c.save()
+	}
+}
+
+// wrapLoader wraps a block loader, noting the path of each block it loads
+func (c *checkpointer) wrapLoader(loader ipldbridge.Loader) ipldbridge.Loader {
+	return func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		c.path = lnkCtx.LinkPath
+		return loader(lnk, lnkCtx)
+	}
+}
+
+// SendResponse sends a block unless it was sent before the checkpoint, and
+// saves a checkpoint every interval blocks sent. Once the responder is
+// stopping, loads fail because of it, so nothing more is sent or saved.
+func (c *checkpointer) SendResponse(requestID graphsync.RequestID, link ipld.Link, data []byte) {
+	if c.ctx.Err() != nil {
+		return
+	}
+	if c.resuming {
+		if c.path.String() == c.checkpoint.Path.String() {
+			c.resuming = false
+		}
+		return
+	}
+	c.responseSender.SendResponse(requestID, link, data)
+	// a block the responder does not have is no point to resume from
+	if data == nil {
+		return
+	}
+	c.checkpoint.Blocks++
+	c.checkpoint.Path = c.path
+	if c.store != nil && c.checkpoint.Blocks%c.interval == 0 {
+		c.save()
+	}
+}
+
+// finish removes the checkpoint of a response that finished or was
+// cancelled, but keeps it if the responder itself is stopping
+func (c *checkpointer) finish() {
+	if c.store == nil || c.ctx.Err() != nil {
+		return
+	}
+	err := c.store.DeleteCheckpoint(c.checkpoint.Peer, c.checkpoint.Request.ID())
+	if err != nil {
+		log.Warningf("Unable to delete checkpoint for request %d: %s", c.checkpoint.Request.ID(), err)
+	}
+}
+
+func (c *checkpointer) save() {
+	if c.store == nil {
+		return
+	}
+	err := c.store.SaveCheckpoint(c.checkpoint)
+	if err != nil {
+		log.Warningf("Unable to save checkpoint for request %d: %s", c.checkpoint.Request.ID(), err)
+	}
+}
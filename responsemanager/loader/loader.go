@@ -2,11 +2,16 @@ package loader
 
 import (
 	"bytes"
+	"container/list"
 	"io"
+	"sync"
+	"time"
 
+	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 // ResponseSender sends responses over the network
@@ -32,6 +37,11 @@ func WrapLoader(loader ipldbridge.Loader,
 			if err == nil {
 				result = &blockBuffer
 				data = blockBuffer.Bytes()
+				// nil data means the block is missing, so an empty block
+				// is sent as an empty slice
+				if data == nil {
+					data = []byte{}
+				}
 			}
 		}
 		responseSender.SendResponse(requestID, lnk, data)
@@ -41,3 +51,290 @@ func WrapLoader(loader ipldbridge.Loader,
 		return result, err
 	}
 }
+
+// LoadSerializer limits each peer to one block load at a time, while loads
+// for different peers still run concurrently. It suits responders whose
+// storage slows down under concurrent reads, such as a spinning disk.
+type LoadSerializer struct {
+	peersLk sync.Mutex
+	peers   map[peer.ID]*peerLoads
+}
+
+type peerLoads struct {
+	refs int
+	lk   sync.Mutex
+}
+
+// NewLoadSerializer creates a new LoadSerializer
+func NewLoadSerializer() *LoadSerializer {
+	return &LoadSerializer{peers: make(map[peer.ID]*peerLoads)}
+}
+
+// WrapLoader wraps a loader used to respond to the given peer, so it waits
+// for any other load for that peer to finish. The returned block is read in
+// full before the next load can start.
+func (ls *LoadSerializer) WrapLoader(p peer.ID, loader ipldbridge.Loader) ipldbridge.Loader {
+	return func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		pl := ls.acquire(p)
+		defer ls.release(p, pl)
+		result, err := loader(lnk, lnkCtx)
+		if err != nil {
+			return nil, err
+		}
+		var blockBuffer bytes.Buffer
+		_, err = io.Copy(&blockBuffer, result)
+		if err != nil {
+			return nil, err
+		}
+		return &blockBuffer, nil
+	}
+}
+
+func (ls *LoadSerializer) acquire(p peer.ID) *peerLoads {
+	ls.peersLk.Lock()
+	pl, ok := ls.peers[p]
+	if !ok {
+		pl = &peerLoads{}
+		ls.peers[p] = pl
+	}
+	pl.refs++
+	ls.peersLk.Unlock()
+	pl.lk.Lock()
+	return pl
+}
+
+func (ls *LoadSerializer) release(p peer.ID, pl *peerLoads) {
+	pl.lk.Unlock()
+	ls.peersLk.Lock()
+	pl.refs--
+	if pl.refs == 0 {
+		delete(ls.peers, p)
+	}
+	ls.peersLk.Unlock()
+}
+
+// BlockCache briefly keeps blocks loaded for one response, so concurrent
+// responses needing the same blocks, such as two peers fetching the same DAG,
+// load each block once. A load for a block another response is already
+// loading waits for and shares its result. The cache is bounded by total
+// block size, and blocks are dropped once they have been cached for the TTL.
+type BlockCache struct {
+	maxBytes uint64
+	ttl      time.Duration
+
+	lk      sync.Mutex
+	size    uint64
+	entries map[ipld.Link]*cacheEntry
+	// entries holding loaded blocks, oldest first
+	order *list.List
+}
+
+type cacheEntry struct {
+	link    ipld.Link
+	done    chan struct{}
+	data    []byte
+	err     error
+	expires time.Time
+	element *list.Element
+}
+
+// NewBlockCache creates a BlockCache holding at most maxBytes of blocks, each
+// for at most ttl
+func NewBlockCache(maxBytes uint64, ttl time.Duration) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[ipld.Link]*cacheEntry),
+		order:    list.New(),
+	}
+}
+
+// WrapLoader wraps a loader so it serves blocks from the cache when
+// possible, and caches the blocks it loads.
+func (bc *BlockCache) WrapLoader(loader ipldbridge.Loader) ipldbridge.Loader {
+	return func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		bc.lk.Lock()
+		bc.evictExpired(time.Now())
+		entry, ok := bc.entries[lnk]
+		if ok {
+			bc.lk.Unlock()
+			<-entry.done
+			if entry.err != nil {
+				return nil, entry.err
+			}
+			return bytes.NewReader(entry.data), nil
+		}
+		entry = &cacheEntry{link: lnk, done: make(chan struct{})}
+		bc.entries[lnk] = entry
+		bc.lk.Unlock()
+
+		entry.data, entry.err = readBlock(loader, lnk, lnkCtx)
+		close(entry.done)
+
+		bc.lk.Lock()
+		if entry.err != nil || uint64(len(entry.data)) > bc.maxBytes {
+			delete(bc.entries, lnk)
+		} else {
+			entry.expires = time.Now().Add(bc.ttl)
+			entry.element = bc.order.PushBack(entry)
+			bc.size += uint64(len(entry.data))
+			for bc.size > bc.maxBytes {
+				bc.evict(bc.order.Front().Value.(*cacheEntry))
+			}
+		}
+		bc.lk.Unlock()
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return bytes.NewReader(entry.data), nil
+	}
+}
+
+// VerifyBytes wraps a loader so a block whose bytes do not hash to its CID
+// fails to load with a graphsync.BlockBytesMismatchError, and so is reported
+// as missing rather than sent, for requests made with graphsync.RawPassthrough
+func VerifyBytes(loader ipldbridge.Loader) ipldbridge.Loader {
+	return func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		data, err := readBlock(loader, lnk, lnkCtx)
+		if err != nil {
+			return nil, err
+		}
+		if !ipldbridge.BlockBytesMatch(lnk, data) {
+			c, _ := ipldbridge.LinkCid(lnk)
+			return nil, graphsync.BlockBytesMismatchError{Cid: c}
+		}
+		return bytes.NewReader(data), nil
+	}
+}
+
+func readBlock(loader ipldbridge.Loader, lnk ipld.Link, lnkCtx ipldbridge.LinkContext) ([]byte, error) {
+	result, err := loader(lnk, lnkCtx)
+	if err != nil {
+		return nil, err
+	}
+	var blockBuffer bytes.Buffer
+	_, err = io.Copy(&blockBuffer, result)
+	if err != nil {
+		return nil, err
+	}
+	return blockBuffer.Bytes(), nil
+}
+
+func (bc *BlockCache) evictExpired(now time.Time) {
+	for front := bc.order.Front(); front != nil; front = bc.order.Front() {
+		entry := front.Value.(*cacheEntry)
+		if entry.expires.After(now) {
+			return
+		}
+		bc.evict(entry)
+	}
+}
+
+func (bc *BlockCache) evict(entry *cacheEntry) {
+	bc.order.Remove(entry.element)
+	delete(bc.entries, entry.link)
+	bc.size -= uint64(len(entry.data))
+}
+
+// PreferredOrder reorders the blocks of a response, as requested with the
+// graphsync.ExtensionPreferredOrder extension, so blocks under each hinted
+// link are sent before blocks under later hints, and before unhinted blocks.
+// Blocks are held back until Flush, or until more than the given number of
+// bytes are held back, so the order is only followed within that window.
+// Blocks under the first hint are never held back.
+//
+// A PreferredOrder sits on both sides of the loader that sends responses:
+// WrapLoader wraps the block loader, so it can see where in the traversal
+// each block is, and it is the ResponseSender for the wrapped loader. It
+// serves one traversal at a time.
+type PreferredOrder struct {
+	hints            map[cid.Cid]int
+	responseSender   ResponseSender
+	maxBufferedBytes uint64
+
+	// paths to the hinted links found so far, and the hint for each
+	hintPaths map[string]int
+	// the hint the block being loaded is under, or -1 if none
+	current       int
+	groups        [][]bufferedResponse
+	unhinted      []bufferedResponse
+	bufferedBytes uint64
+}
+
+type bufferedResponse struct {
+	requestID graphsync.RequestID
+	link      ipld.Link
+	data      []byte
+}
+
+// NewPreferredOrder creates a PreferredOrder that sends blocks under the
+// given hints first, in order, to the given ResponseSender
+func NewPreferredOrder(hints []cid.Cid, responseSender ResponseSender, maxBufferedBytes uint64) *PreferredOrder {
+	hintIndexes := make(map[cid.Cid]int, len(hints))
+	for i := len(hints) - 1; i >= 0; i-- {
+		hintIndexes[hints[i]] = i
+	}
+	return &PreferredOrder{
+		hints:            hintIndexes,
+		responseSender:   responseSender,
+		maxBufferedBytes: maxBufferedBytes,
+		hintPaths:        make(map[string]int),
+		current:          -1,
+		groups:           make([][]bufferedResponse, len(hints)),
+	}
+}
+
+// WrapLoader wraps a block loader, noting which hint each block it loads is
+// under. A block under more than one hint counts as under the first of them.
+func (po *PreferredOrder) WrapLoader(loader ipldbridge.Loader) ipldbridge.Loader {
+	return func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		po.current = -1
+		if c, err := ipldbridge.LinkCid(lnk); err == nil {
+			if hint, ok := po.hints[c]; ok {
+				po.hintPaths[lnkCtx.LinkPath.String()] = hint
+				po.current = hint
+			}
+		}
+		for i := len(lnkCtx.LinkPath.Segments()); i >= 0; i-- {
+			hint, ok := po.hintPaths[lnkCtx.LinkPath.Truncate(i).String()]
+			if ok && (po.current == -1 || hint < po.current) {
+				po.current = hint
+			}
+		}
+		return loader(lnk, lnkCtx)
+	}
+}
+
+// SendResponse holds back a block until blocks under earlier hints are sent
+func (po *PreferredOrder) SendResponse(requestID graphsync.RequestID, link ipld.Link, data []byte) {
+	if po.current == 0 {
+		po.responseSender.SendResponse(requestID, link, data)
+		return
+	}
+	response := bufferedResponse{requestID, link, data}
+	if po.current > 0 {
+		po.groups[po.current] = append(po.groups[po.current], response)
+	} else {
+		po.unhinted = append(po.unhinted, response)
+	}
+	po.bufferedBytes += uint64(len(data))
+	if po.bufferedBytes > po.maxBufferedBytes {
+		po.Flush()
+	}
+}
+
+// Flush sends all held back blocks, in order of their hints, then unhinted
+// blocks in the order they were loaded
+func (po *PreferredOrder) Flush() {
+	for i, group := range po.groups {
+		for _, response := range group {
+			po.responseSender.SendResponse(response.requestID, response.link, response.data)
+		}
+		po.groups[i] = nil
+	}
+	for _, response := range po.unhinted {
+		po.responseSender.SendResponse(response.requestID, response.link, response.data)
+	}
+	po.unhinted = nil
+	po.bufferedBytes = 0
+}
@@ -2,19 +2,26 @@ package loader
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/testbridge"
 	"github.com/ipfs/go-graphsync/testutil"
 
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 type fakeResponseSender struct {
@@ -79,3 +86,328 @@ func TestWrappedLoaderSendsResponses(t *testing.T) {
 		t.Fatal("Should sent metadata for link but no block, but did not")
 	}
 }
+
+func TestLoadSerializer(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+	link := testbridge.NewMockLink()
+	sourceBytes := testutil.RandomBytes(100)
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	loader := func(ipldLink ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		started <- struct{}{}
+		<-release
+		return bytes.NewReader(sourceBytes), nil
+	}
+	ls := NewLoadSerializer()
+	loaded := make(chan []byte, 3)
+	load := func(p peer.ID) {
+		reader, err := ls.WrapLoader(p, loader)(link, ipldbridge.LinkContext{})
+		if err != nil {
+			loaded <- nil
+			return
+		}
+		result, _ := ioutil.ReadAll(reader)
+		loaded <- result
+	}
+	go load(peers[0])
+	go load(peers[0])
+	go load(peers[1])
+
+	// one load from each peer should start, without waiting on the other peer
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("loads for different peers should run concurrently")
+		case <-started:
+		}
+	}
+	select {
+	case <-started:
+		t.Fatal("second load for a peer should wait for the first")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("loads did not finish")
+		case result := <-loaded:
+			if !reflect.DeepEqual(result, sourceBytes) {
+				t.Fatal("should return loaded block")
+			}
+		}
+	}
+	if len(ls.peers) != 0 {
+		t.Fatal("should forget peers with no loads in progress")
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	blocksByLink := make(map[ipld.Link][]byte)
+	links := make([]ipld.Link, 0, 3)
+	for i := 0; i < 3; i++ {
+		link := testbridge.NewMockLink()
+		links = append(links, link)
+		blocksByLink[link] = testutil.RandomBytes(100)
+	}
+	missingLink := testbridge.NewMockLink()
+
+	var loadsLk sync.Mutex
+	loads := make(map[ipld.Link]int)
+	release := make(chan struct{})
+	loader := func(ipldLink ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		<-release
+		loadsLk.Lock()
+		loads[ipldLink]++
+		loadsLk.Unlock()
+		data, ok := blocksByLink[ipldLink]
+		if !ok {
+			return nil, fmt.Errorf("unable to load block")
+		}
+		return bytes.NewReader(data), nil
+	}
+	loadCount := func(link ipld.Link) int {
+		loadsLk.Lock()
+		defer loadsLk.Unlock()
+		return loads[link]
+	}
+	readAll := func(wrappedLoader ipldbridge.Loader, link ipld.Link) []byte {
+		reader, err := wrappedLoader(link, ipldbridge.LinkContext{})
+		if err != nil {
+			return nil
+		}
+		result, _ := ioutil.ReadAll(reader)
+		return result
+	}
+
+	t.Run("concurrent loads share one load", func(t *testing.T) {
+		wrappedLoader := NewBlockCache(1000, time.Minute).WrapLoader(loader)
+		loaded := make(chan []byte, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				loaded <- readAll(wrappedLoader, links[0])
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		for i := 0; i < 3; i++ {
+			select {
+			case <-ctx.Done():
+				t.Fatal("loads did not finish")
+			case result := <-loaded:
+				if !reflect.DeepEqual(result, blocksByLink[links[0]]) {
+					t.Fatal("should return loaded block")
+				}
+			}
+		}
+		if loadCount(links[0]) != 1 {
+			t.Fatal("should only load block once")
+		}
+	})
+
+	t.Run("failed loads are not cached", func(t *testing.T) {
+		wrappedLoader := NewBlockCache(1000, time.Minute).WrapLoader(loader)
+		for i := 0; i < 2; i++ {
+			_, err := wrappedLoader(missingLink, ipldbridge.LinkContext{})
+			if err == nil {
+				t.Fatal("should return error from underlying loader")
+			}
+		}
+		if loadCount(missingLink) != 2 {
+			t.Fatal("should retry failed loads")
+		}
+	})
+
+	t.Run("evicts oldest blocks over size", func(t *testing.T) {
+		wrappedLoader := NewBlockCache(250, time.Minute).WrapLoader(loader)
+		before := loadCount(links[0])
+		for _, link := range links {
+			readAll(wrappedLoader, link)
+		}
+		if !reflect.DeepEqual(readAll(wrappedLoader, links[2]), blocksByLink[links[2]]) {
+			t.Fatal("should return cached block")
+		}
+		if loadCount(links[2]) != 1 {
+			t.Fatal("should keep newest blocks")
+		}
+		readAll(wrappedLoader, links[0])
+		if loadCount(links[0]) != before+2 {
+			t.Fatal("should evict oldest block once over size")
+		}
+	})
+
+	t.Run("evicts blocks after ttl", func(t *testing.T) {
+		wrappedLoader := NewBlockCache(1000, 10*time.Millisecond).WrapLoader(loader)
+		before := loadCount(links[1])
+		readAll(wrappedLoader, links[1])
+		readAll(wrappedLoader, links[1])
+		if loadCount(links[1]) != before+1 {
+			t.Fatal("should serve block from cache before ttl")
+		}
+		time.Sleep(20 * time.Millisecond)
+		readAll(wrappedLoader, links[1])
+		if loadCount(links[1]) != before+2 {
+			t.Fatal("should reload block after ttl")
+		}
+	})
+}
+
+type recordingResponseSender struct {
+	links []ipld.Link
+}
+
+func (rrs *recordingResponseSender) SendResponse(
+	requestID graphsync.RequestID,
+	link ipld.Link,
+	data []byte,
+) {
+	rrs.links = append(rrs.links, link)
+}
+
+func TestPreferredOrder(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(6, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	root, firstHint, firstHintChild, secondHint, secondHintChild, unhinted := links[0], links[1], links[2], links[3], links[4], links[5]
+	// in traversal order
+	loads := []struct {
+		link ipld.Link
+		path string
+	}{
+		{root, ""},
+		{secondHint, "Second"},
+		{secondHintChild, "Second/Child"},
+		{firstHint, "First"},
+		{firstHintChild, "First/Child"},
+		{unhinted, "Other"},
+	}
+	hints := []cid.Cid{firstHint.(cidlink.Link).Cid, secondHint.(cidlink.Link).Cid}
+	requestID := graphsync.RequestID(rand.Int31())
+	traverse := func(po *PreferredOrder) {
+		wrappedLoader := WrapLoader(po.WrapLoader(testbridge.NewMockLoader(blks)), requestID, po)
+		for _, load := range loads {
+			_, err := wrappedLoader(load.link, ipldbridge.LinkContext{LinkPath: ipld.ParsePath(load.path)})
+			if err != nil {
+				t.Fatal("unable to load block")
+			}
+		}
+		po.Flush()
+	}
+
+	t.Run("sends hinted blocks first", func(t *testing.T) {
+		rrs := &recordingResponseSender{}
+		traverse(NewPreferredOrder(hints, rrs, 1000))
+		expected := []ipld.Link{firstHint, firstHintChild, secondHint, secondHintChild, root, unhinted}
+		if !reflect.DeepEqual(rrs.links, expected) {
+			t.Fatal("should send blocks under hints first, in hint order")
+		}
+	})
+
+	t.Run("only holds back blocks within window", func(t *testing.T) {
+		rrs := &recordingResponseSender{}
+		traverse(NewPreferredOrder(hints, rrs, 250))
+		expected := []ipld.Link{secondHint, secondHintChild, root, firstHint, firstHintChild, unhinted}
+		if !reflect.DeepEqual(rrs.links, expected) {
+			t.Fatal("should send held back blocks once over window")
+		}
+	})
+}
+
+type sentBlock struct {
+	link ipld.Link
+	data []byte
+}
+
+type blockRecordingSender struct {
+	sent []sentBlock
+}
+
+func (brs *blockRecordingSender) SendResponse(requestID graphsync.RequestID, link ipld.Link, data []byte) {
+	brs.sent = append(brs.sent, sentBlock{link, data})
+}
+
+func TestResultCache(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	requestID := graphsync.RequestID(rand.Int31())
+	dir, err := ioutil.TempDir("", "graphsync-results")
+	if err != nil {
+		t.Fatal("unable to create cache directory")
+	}
+	defer os.RemoveAll(dir)
+	cache := NewDirResultCache(dir)
+
+	if _, ok := cache.Get(ResultKey(blks[0].Cid(), []byte("selector"))); ok {
+		t.Fatal("should not have found an uncached result")
+	}
+	if ResultKey(blks[0].Cid(), []byte("selector")) == ResultKey(blks[0].Cid(), []byte("other selector")) {
+		t.Fatal("different selectors should have different keys")
+	}
+
+	t.Run("replays recorded blocks in order", func(t *testing.T) {
+		brs := &blockRecordingSender{}
+		recorder := NewResultRecorder(brs, 1000)
+		for _, block := range blks {
+			recorder.SendResponse(requestID, cidlink.Link{Cid: block.Cid()}, block.RawData())
+		}
+		if len(brs.sent) != len(blks) {
+			t.Fatal("did not pass blocks on")
+		}
+		key := ResultKey(blks[0].Cid(), []byte("selector"))
+		err := cache.Put(key, recorder.Result())
+		if err != nil {
+			t.Fatal("unable to store result")
+		}
+		result, ok := cache.Get(key)
+		if !ok {
+			t.Fatal("did not find stored result")
+		}
+		defer result.Close()
+		replayed := &blockRecordingSender{}
+		err = ReplayResult(result, requestID, replayed)
+		if err != nil {
+			t.Fatal("unable to replay result")
+		}
+		if !reflect.DeepEqual(replayed.sent, brs.sent) {
+			t.Fatal("did not replay the blocks sent")
+		}
+	})
+
+	t.Run("missing blocks are not recorded", func(t *testing.T) {
+		recorder := NewResultRecorder(&blockRecordingSender{}, 1000)
+		recorder.SendResponse(requestID, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+		recorder.SendResponse(requestID, cidlink.Link{Cid: blks[1].Cid()}, nil)
+		if recorder.Result() != nil {
+			t.Fatal("should not record a result with a missing block")
+		}
+	})
+
+	t.Run("large results are not recorded", func(t *testing.T) {
+		recorder := NewResultRecorder(&blockRecordingSender{}, 150)
+		for _, block := range blks {
+			recorder.SendResponse(requestID, cidlink.Link{Cid: block.Cid()}, block.RawData())
+		}
+		if recorder.Result() != nil {
+			t.Fatal("should not record a result over the limit")
+		}
+	})
+
+	t.Run("truncated results fail", func(t *testing.T) {
+		recorder := NewResultRecorder(&blockRecordingSender{}, 1000)
+		recorder.SendResponse(requestID, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+		result := recorder.Result()
+		err := ReplayResult(bytes.NewReader(result[:len(result)-1]), requestID, &blockRecordingSender{})
+		if err == nil {
+			t.Fatal("should have failed to replay a truncated result")
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// the largest block a cached result may hold, so a corrupt length in a stored
+// result cannot make ReplayResult allocate without bound
+const maxCachedBlockSize = 1 << 24
+
+// ResultCache stores the blocks a traversal sent, in order, so a later request
+// for the same root and selector is answered by replaying them rather than by
+// traversing again. Content is immutable, so a stored result never goes
+// stale. Keys are hex strings, safe to use as file names.
+type ResultCache interface {
+	// Get returns the result stored under key, to be read to the end and
+	// closed, or false if there is none
+	Get(key string) (io.ReadCloser, bool)
+	// Put stores a result under key
+	Put(key string, result []byte) error
+}
+
+// ResultKey returns the key a result is cached under, a hash of the root and
+// the encoded selector
+func ResultKey(root cid.Cid, selector []byte) string {
+	hash := sha256.New()
+	_, _ = hash.Write(root.Bytes())
+	_, _ = hash.Write(selector)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ResultRecorder is a ResponseSender that passes blocks on to another, while
+// recording them as a result to cache. A traversal with a missing block is
+// not recorded, since the block may turn up later, and neither is one sending
+// more than the given number of bytes.
+type ResultRecorder struct {
+	responseSender ResponseSender
+	maxBytes       uint64
+	result         bytes.Buffer
+	// false once the result cannot be cached
+	complete bool
+}
+
+// NewResultRecorder creates a ResultRecorder sending blocks on to the given
+// ResponseSender
+func NewResultRecorder(responseSender ResponseSender, maxBytes uint64) *ResultRecorder {
+	return &ResultRecorder{
+		responseSender: responseSender,
+		maxBytes:       maxBytes,
+		complete:       true,
+	}
+}
+
+// SendResponse sends a block on and records it
+func (rr *ResultRecorder) SendResponse(requestID graphsync.RequestID, link ipld.Link, data []byte) {
+	rr.responseSender.SendResponse(requestID, link, data)
+	if !rr.complete {
+		return
+	}
+	c, err := ipldbridge.LinkCid(link)
+	if err != nil || data == nil {
+		rr.discard()
+		return
+	}
+	writeUvarintPrefixed(&rr.result, c.Bytes())
+	writeUvarintPrefixed(&rr.result, data)
+	if uint64(rr.result.Len()) > rr.maxBytes {
+		rr.discard()
+	}
+}
+
+// Result returns the recorded result, or nil if it cannot be cached
+func (rr *ResultRecorder) Result() []byte {
+	if !rr.complete {
+		return nil
+	}
+	return rr.result.Bytes()
+}
+
+func (rr *ResultRecorder) discard() {
+	rr.complete = false
+	rr.result = bytes.Buffer{}
+}
+
+func writeUvarintPrefixed(buf *bytes.Buffer, data []byte) {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(data)))
+	buf.Write(prefix[:n])
+	buf.Write(data)
+}
+
+// ReplayResult sends the blocks of a cached result to the ResponseSender, in
+// the order they were recorded, reading them as it goes. Blocks before a
+// corrupt part of the result are already sent when it returns an error.
+func ReplayResult(result io.Reader, requestID graphsync.RequestID, responseSender ResponseSender) error {
+	reader := bufio.NewReader(result)
+	for {
+		cidBytes, err := readUvarintPrefixed(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c, err := cid.Cast(cidBytes)
+		if err != nil {
+			return err
+		}
+		data, err := readUvarintPrefixed(reader)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		responseSender.SendResponse(requestID, cidlink.Link{Cid: c}, data)
+	}
+}
+
+func readUvarintPrefixed(reader *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxCachedBlockSize {
+		return nil, fmt.Errorf("cached result holds a %d byte block", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+// DirResultCache is a ResultCache keeping each result in a file of its own in
+// a directory, so results are streamed from disk rather than held in memory
+type DirResultCache struct {
+	dir string
+}
+
+// NewDirResultCache creates a DirResultCache keeping results in dir, which
+// must exist
+func NewDirResultCache(dir string) *DirResultCache {
+	return &DirResultCache{dir: dir}
+}
+
+// Get opens the file holding the result for key
+func (drc *DirResultCache) Get(key string) (io.ReadCloser, bool) {
+	file, err := os.Open(filepath.Join(drc.dir, key))
+	if err != nil {
+		return nil, false
+	}
+	return file, true
+}
+
+// Put writes a result to a file named after its key. The file is written
+// under another name first, so a concurrent Get never sees part of it.
+func (drc *DirResultCache) Put(key string, result []byte) error {
+	file, err := ioutil.TempFile(drc.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(result)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(drc.dir, key))
+}
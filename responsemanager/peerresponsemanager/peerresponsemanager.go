@@ -28,3 +28,16 @@ func New(ctx context.Context, createPeerSender PeerSenderFactory) *PeerResponseM
 func (prm *PeerResponseManager) SenderForPeer(p peer.ID) PeerResponseSender {
 	return prm.GetProcess(p).(PeerResponseSender)
 }
+
+// QueueStats returns the messages waiting to be handed to the network for
+// each peer with a response sender
+func (prm *PeerResponseManager) QueueStats() map[peer.ID]QueueStats {
+	stats := make(map[peer.ID]QueueStats)
+	for _, p := range prm.ConnectedPeers() {
+		process, ok := prm.Process(p)
+		if ok {
+			stats[p] = process.(PeerResponseSender).QueueStats()
+		}
+	}
+	return stats
+}
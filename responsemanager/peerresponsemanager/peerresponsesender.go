@@ -3,12 +3,13 @@ package peerresponsemanager
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ack"
+	"github.com/ipfs/go-graphsync/allocator"
 	"github.com/ipfs/go-graphsync/peermanager"
 
-	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
-
 	"github.com/ipfs/go-graphsync/ipldbridge"
 
 	logging "github.com/ipfs/go-log"
@@ -22,8 +23,9 @@ import (
 )
 
 const (
-	// max block size is the maximum size for batching blocks in a single payload
-	maxBlockSize = 512 * 1024
+	// defaultMaxBlockSize is the default maximum size for batching blocks in a
+	// single payload
+	defaultMaxBlockSize = 512 * 1024
 )
 
 var log = logging.Logger("graphsync")
@@ -35,17 +37,43 @@ type PeerMessageHandler interface {
 }
 
 type peerResponseSender struct {
-	p            peer.ID
-	ctx          context.Context
-	cancel       context.CancelFunc
-	peerHandler  PeerMessageHandler
-	ipldBridge   ipldbridge.IPLDBridge
-	outgoingWork chan struct{}
+	p               peer.ID
+	ctx             context.Context
+	cancel          context.CancelFunc
+	peerHandler     PeerMessageHandler
+	ipldBridge      ipldbridge.IPLDBridge
+	allocator       *allocator.Allocator
+	queued          *allocator.Allocator
+	maxQueuedBytes  uint64
+	outgoingWork    chan struct{}
+	maxBlockSize    uint64
+	batchWindow     time.Duration
+	reportAbandoned func(peer.ID, []gsmsg.GraphSyncResponse, error)
 
 	linkTrackerLk      sync.RWMutex
 	linkTracker        *linktracker.LinkTracker
 	responseBuildersLk sync.RWMutex
 	responseBuilders   []*responsebuilder.ResponseBuilder
+	ackWindows         map[graphsync.RequestID]*ackWindow
+	// messages taken to send but not yet handed to the network
+	handingOff int
+}
+
+// QueueStats describes the messages for a peer built but not yet handed to
+// the network
+type QueueStats struct {
+	Messages int
+	// Bytes is the size of the blocks in the messages
+	Bytes uint64
+}
+
+// ackWindow holds the messages for a request with acknowledgements enabled,
+// so they can wait on the peer without holding up other requests
+type ackWindow struct {
+	window           int
+	lastAcked        int
+	nextSequence     int
+	responseBuilders []*responsebuilder.ResponseBuilder
 }
 
 // PeerResponseSender handles batching, deduping, and sending responses for
@@ -57,24 +85,87 @@ type PeerResponseSender interface {
 		link ipld.Link,
 		data []byte,
 	)
+	QueueResponse(
+		requestID graphsync.RequestID,
+		link ipld.Link,
+		data []byte,
+	) bool
 	SendExtensionData(graphsync.RequestID, graphsync.ExtensionData)
+	SendPersistentExtensionData(graphsync.RequestID, graphsync.ExtensionData)
 	FinishRequest(requestID graphsync.RequestID)
+	FinishEmptyRequest(requestID graphsync.RequestID)
 	FinishWithError(requestID graphsync.RequestID, status graphsync.ResponseStatusCode)
+	CancelRequest(requestID graphsync.RequestID)
+	EnableAcknowledgements(requestID graphsync.RequestID, window int)
+	Acknowledge(requestID graphsync.RequestID, sequence int)
+	IgnoreBlocks(requestID graphsync.RequestID, links []ipld.Link)
+	QueueStats() QueueStats
+}
+
+// SenderOption configures a PeerResponseSender
+type SenderOption func(*peerResponseSender)
+
+// MaxMessageBlockBytes sets the most block data batched into a single
+// response message. A block larger than this is still sent, alone. The
+// default is 512KiB.
+func MaxMessageBlockBytes(n uint64) SenderOption {
+	return func(prm *peerResponseSender) {
+		prm.maxBlockSize = n
+	}
+}
+
+// BatchWindow waits d after new response data is ready before sending it, so
+// data that arrives in the meantime goes in the same messages. By default
+// data is sent as soon as it is ready.
+func BatchWindow(d time.Duration) SenderOption {
+	return func(prm *peerResponseSender) {
+		prm.batchWindow = d
+	}
+}
+
+// MaxQueuedBytes limits the size of the blocks in messages for the peer not
+// yet handed to the network, so a peer slow to read its stream pauses the
+// traversals responding to it, rather than its messages using ever more
+// memory. A block larger than n is still sent, alone. By default there is no
+// limit.
+func MaxQueuedBytes(n uint64) SenderOption {
+	return func(prm *peerResponseSender) {
+		prm.maxQueuedBytes = n
+	}
+}
+
+// ReportAbandoned tells fn of the responses still waiting to be sent when the
+// sender shuts down, as it does when the peer disconnects, with
+// graphsync.ErrSendAbandoned.
+func ReportAbandoned(fn func(p peer.ID, responses []gsmsg.GraphSyncResponse, err error)) SenderOption {
+	return func(prm *peerResponseSender) {
+		prm.reportAbandoned = fn
+	}
 }
 
 // NewResponseSender generates a new PeerResponseSender for the given context, peer ID,
-// using the given peer message handler and bridge to IPLD.
-func NewResponseSender(ctx context.Context, p peer.ID, peerHandler PeerMessageHandler, ipldBridge ipldbridge.IPLDBridge) PeerResponseSender {
+// using the given peer message handler and bridge to IPLD. Blocks waiting to be
+// sent are allocated from the given allocator, which may be shared by the
+// senders for all peers.
+func NewResponseSender(ctx context.Context, p peer.ID, peerHandler PeerMessageHandler, ipldBridge ipldbridge.IPLDBridge, responseAllocator *allocator.Allocator, options ...SenderOption) PeerResponseSender {
 	ctx, cancel := context.WithCancel(ctx)
-	return &peerResponseSender{
+	prm := &peerResponseSender{
 		p:            p,
 		ctx:          ctx,
 		cancel:       cancel,
 		peerHandler:  peerHandler,
 		ipldBridge:   ipldBridge,
+		allocator:    responseAllocator,
 		outgoingWork: make(chan struct{}, 1),
+		maxBlockSize: defaultMaxBlockSize,
 		linkTracker:  linktracker.New(),
+		ackWindows:   make(map[graphsync.RequestID]*ackWindow),
 	}
+	for _, option := range options {
+		option(prm)
+	}
+	prm.queued = allocator.New(prm.maxQueuedBytes)
+	return prm
 }
 
 // Startup initiates message sending for a peer
@@ -88,13 +179,23 @@ func (prm *peerResponseSender) Shutdown() {
 }
 
 func (prm *peerResponseSender) SendExtensionData(requestID graphsync.RequestID, extension graphsync.ExtensionData) {
-	if prm.buildResponse(0, func(responseBuilder *responsebuilder.ResponseBuilder) {
+	if prm.buildResponse(requestID, 0, func(responseBuilder *responsebuilder.ResponseBuilder) {
 		responseBuilder.AddExtensionData(requestID, extension)
 	}) {
 		prm.signalWork()
 	}
 }
 
+// SendPersistentExtensionData sends extension data once, marked so the
+// requestor applies it to every later response for the request
+func (prm *peerResponseSender) SendPersistentExtensionData(requestID graphsync.RequestID, extension graphsync.ExtensionData) {
+	if prm.buildResponse(requestID, 0, func(responseBuilder *responsebuilder.ResponseBuilder) {
+		responseBuilder.AddPersistentExtensionData(requestID, extension)
+	}) {
+		prm.signalWork()
+	}
+}
+
 // SendResponse sends a given link for a given
 // requestID across the wire, as well as its corresponding
 // block if the block is present and has not already been sent
@@ -103,6 +204,21 @@ func (prm *peerResponseSender) SendResponse(
 	link ipld.Link,
 	data []byte,
 ) {
+	prm.QueueResponse(requestID, link, data)
+}
+
+// QueueResponse is SendResponse, but reports whether the block itself was
+// queued to send, rather than missing or already sent
+func (prm *peerResponseSender) QueueResponse(
+	requestID graphsync.RequestID,
+	link ipld.Link,
+	data []byte,
+) bool {
+	// the link tracker and metadata key on cidlink.Link, so custom link types
+	// are tracked by the CID they resolve to
+	if _, ok := link.(ipldbridge.CidLink); ok {
+		link, _ = ipldbridge.NormalizeLink(link)
+	}
 	hasBlock := data != nil
 	prm.linkTrackerLk.Lock()
 	sendBlock := hasBlock && prm.linkTracker.BlockRefCount(link) == 0
@@ -113,19 +229,36 @@ func (prm *peerResponseSender) SendResponse(
 	prm.linkTracker.RecordLinkTraversal(requestID, link, hasBlock)
 	prm.linkTrackerLk.Unlock()
 
-	if prm.buildResponse(blkSize, func(responseBuilder *responsebuilder.ResponseBuilder) {
+	// wait for room to buffer the block, which pauses the traversal
+	// loading blocks until earlier messages are sent
+	if sendBlock {
+		if prm.queued.Allocate(prm.ctx, uint64(blkSize)) != nil {
+			return false
+		}
+		if prm.allocator.Allocate(prm.ctx, uint64(blkSize)) != nil {
+			prm.queued.Release(uint64(blkSize))
+			return false
+		}
+	}
+
+	if prm.buildResponse(requestID, blkSize, func(responseBuilder *responsebuilder.ResponseBuilder) {
 		if sendBlock {
-			cidLink := link.(cidlink.Link)
-			block, err := blocks.NewBlockWithCid(data, cidLink.Cid)
+			c, err := ipldbridge.LinkCid(link)
 			if err != nil {
-				log.Errorf("Data did not match cid when sending link for %s", cidLink.String())
+				log.Errorf("Unable to send block for link %s: %s", link.String(), err)
+			} else {
+				block, err := blocks.NewBlockWithCid(data, c)
+				if err != nil {
+					log.Errorf("Data did not match cid when sending link for %s", link.String())
+				}
+				responseBuilder.AddBlock(block)
 			}
-			responseBuilder.AddBlock(block)
 		}
 		responseBuilder.AddLink(requestID, link, hasBlock)
 	}) {
 		prm.signalWork()
 	}
+	return sendBlock
 }
 
 // FinishRequest marks the given requestID as having sent all responses
@@ -142,34 +275,113 @@ func (prm *peerResponseSender) FinishRequest(requestID graphsync.RequestID) {
 	prm.finish(requestID, status)
 }
 
-// FinishWithError marks the given requestID as having terminated with an error
+// FinishEmptyRequest marks the given requestID as having sent all responses
+// for a traversal in which the selector matched no nodes
+func (prm *peerResponseSender) FinishEmptyRequest(requestID graphsync.RequestID) {
+	prm.linkTrackerLk.Lock()
+	isComplete := prm.linkTracker.FinishRequest(requestID)
+	prm.linkTrackerLk.Unlock()
+	var status graphsync.ResponseStatusCode
+	if isComplete {
+		status = graphsync.RequestCompletedEmpty
+	} else {
+		status = graphsync.RequestCompletedPartial
+	}
+	prm.finish(requestID, status)
+}
+
+// FinishWithError marks the given requestID as having terminated with an error.
+// Messages for the request waiting on acknowledgements are sent without
+// waiting any longer, since a requestor that gave up on the request may never
+// send them.
 func (prm *peerResponseSender) FinishWithError(requestID graphsync.RequestID, status graphsync.ResponseStatusCode) {
 	prm.linkTrackerLk.Lock()
 	prm.linkTracker.FinishRequest(requestID)
 	prm.linkTrackerLk.Unlock()
 
 	prm.finish(requestID, status)
+	prm.responseBuildersLk.Lock()
+	aw, ok := prm.ackWindows[requestID]
+	if ok {
+		delete(prm.ackWindows, requestID)
+		prm.responseBuilders = append(prm.responseBuilders, aw.responseBuilders...)
+	}
+	prm.responseBuildersLk.Unlock()
+	if ok {
+		prm.signalWork()
+	}
+}
+
+// CancelRequest drops the messages for a request the requestor cancelled
+// that are waiting on acknowledgements, which will not come, freeing their
+// blocks
+func (prm *peerResponseSender) CancelRequest(requestID graphsync.RequestID) {
+	prm.responseBuildersLk.Lock()
+	aw, ok := prm.ackWindows[requestID]
+	delete(prm.ackWindows, requestID)
+	prm.responseBuildersLk.Unlock()
+	if ok {
+		prm.releaseBlockMemory(aw.responseBuilders)
+	}
+}
+
+// IgnoreBlocks marks the given links as already sent for the request, so if
+// they are traversed their blocks are reported present but not sent.
+func (prm *peerResponseSender) IgnoreBlocks(requestID graphsync.RequestID, links []ipld.Link) {
+	prm.linkTrackerLk.Lock()
+	for _, link := range links {
+		prm.linkTracker.RecordLinkTraversal(requestID, link, true)
+	}
+	prm.linkTrackerLk.Unlock()
+}
+
+// EnableAcknowledgements sends responses for the given request in their own
+// numbered messages, and holds back further messages for the request whenever
+// window of them are awaiting acknowledgement from the peer. Responses for
+// other requests are sent in the meantime.
+func (prm *peerResponseSender) EnableAcknowledgements(requestID graphsync.RequestID, window int) {
+	prm.responseBuildersLk.Lock()
+	prm.ackWindows[requestID] = &ackWindow{window: window, nextSequence: 1}
+	prm.responseBuildersLk.Unlock()
+}
+
+// Acknowledge records that the peer received all messages for the given
+// request up to and including the given sequence number
+func (prm *peerResponseSender) Acknowledge(requestID graphsync.RequestID, sequence int) {
+	prm.responseBuildersLk.Lock()
+	aw, ok := prm.ackWindows[requestID]
+	if ok && sequence > aw.lastAcked {
+		aw.lastAcked = sequence
+	}
+	prm.responseBuildersLk.Unlock()
+	if ok {
+		prm.signalWork()
+	}
 }
 
 func (prm *peerResponseSender) finish(requestID graphsync.RequestID, status graphsync.ResponseStatusCode) {
-	if prm.buildResponse(0, func(responseBuilder *responsebuilder.ResponseBuilder) {
+	if prm.buildResponse(requestID, 0, func(responseBuilder *responsebuilder.ResponseBuilder) {
 		responseBuilder.AddCompletedRequest(requestID, status)
 	}) {
 		prm.signalWork()
 	}
 }
-func (prm *peerResponseSender) buildResponse(blkSize int, buildResponseFn func(*responsebuilder.ResponseBuilder)) bool {
+func (prm *peerResponseSender) buildResponse(requestID graphsync.RequestID, blkSize int, buildResponseFn func(*responsebuilder.ResponseBuilder)) bool {
 	prm.responseBuildersLk.Lock()
 	defer prm.responseBuildersLk.Unlock()
-	if shouldBeginNewResponse(prm.responseBuilders, blkSize) {
-		prm.responseBuilders = append(prm.responseBuilders, responsebuilder.New())
+	responseBuilders := &prm.responseBuilders
+	if aw, ok := prm.ackWindows[requestID]; ok {
+		responseBuilders = &aw.responseBuilders
+	}
+	if shouldBeginNewResponse(*responseBuilders, blkSize, int(prm.maxBlockSize)) {
+		*responseBuilders = append(*responseBuilders, responsebuilder.New())
 	}
-	responseBuilder := prm.responseBuilders[len(prm.responseBuilders)-1]
+	responseBuilder := (*responseBuilders)[len(*responseBuilders)-1]
 	buildResponseFn(responseBuilder)
 	return !responseBuilder.Empty()
 }
 
-func shouldBeginNewResponse(responseBuilders []*responsebuilder.ResponseBuilder, blkSize int) bool {
+func shouldBeginNewResponse(responseBuilders []*responsebuilder.ResponseBuilder, blkSize int, maxBlockSize int) bool {
 	if len(responseBuilders) == 0 {
 		return true
 	}
@@ -190,8 +402,23 @@ func (prm *peerResponseSender) run() {
 	for {
 		select {
 		case <-prm.ctx.Done():
+			prm.responseBuildersLk.Lock()
+			prm.abandon(prm.responseBuilders)
+			prm.responseBuilders = nil
+			for _, aw := range prm.ackWindows {
+				prm.abandon(aw.responseBuilders)
+				aw.responseBuilders = nil
+			}
+			prm.responseBuildersLk.Unlock()
 			return
 		case <-prm.outgoingWork:
+			if prm.batchWindow > 0 {
+				select {
+				case <-prm.ctx.Done():
+					continue
+				case <-time.After(prm.batchWindow):
+				}
+			}
 			prm.sendResponseMessages()
 		}
 	}
@@ -201,6 +428,10 @@ func (prm *peerResponseSender) sendResponseMessages() {
 	prm.responseBuildersLk.Lock()
 	builders := prm.responseBuilders
 	prm.responseBuilders = nil
+	for requestID, aw := range prm.ackWindows {
+		builders = append(builders, prm.takeAckWindowMessages(requestID, aw)...)
+	}
+	prm.handingOff = countMessages(builders)
 	prm.responseBuildersLk.Unlock()
 
 	for _, builder := range builders {
@@ -219,6 +450,85 @@ func (prm *peerResponseSender) sendResponseMessages() {
 		case <-done:
 		case <-prm.ctx.Done():
 		}
+		prm.responseBuildersLk.Lock()
+		prm.handingOff--
+		prm.responseBuildersLk.Unlock()
+		prm.queued.Release(uint64(builder.BlockSize()))
+		prm.allocator.Release(uint64(builder.BlockSize()))
+	}
+
+}
+
+// abandon drops messages that will not be sent, reporting their responses
+func (prm *peerResponseSender) abandon(builders []*responsebuilder.ResponseBuilder) {
+	if prm.reportAbandoned != nil {
+		for _, builder := range builders {
+			if builder.Empty() {
+				continue
+			}
+			responses, _, err := builder.Build(prm.ipldBridge)
+			if err == nil && len(responses) > 0 {
+				prm.reportAbandoned(prm.p, responses, graphsync.ErrSendAbandoned)
+			}
+		}
+	}
+	prm.releaseBlockMemory(builders)
+}
+
+func (prm *peerResponseSender) releaseBlockMemory(builders []*responsebuilder.ResponseBuilder) {
+	for _, builder := range builders {
+		prm.queued.Release(uint64(builder.BlockSize()))
+		prm.allocator.Release(uint64(builder.BlockSize()))
+	}
+}
+
+// QueueStats returns the messages for the peer not yet handed to the network
+func (prm *peerResponseSender) QueueStats() QueueStats {
+	prm.responseBuildersLk.RLock()
+	messages := prm.handingOff + countMessages(prm.responseBuilders)
+	for _, aw := range prm.ackWindows {
+		messages += countMessages(aw.responseBuilders)
+	}
+	prm.responseBuildersLk.RUnlock()
+	return QueueStats{Messages: messages, Bytes: prm.queued.Allocated()}
+}
+
+func countMessages(builders []*responsebuilder.ResponseBuilder) int {
+	count := 0
+	for _, builder := range builders {
+		if !builder.Empty() {
+			count++
+		}
 	}
+	return count
+}
 
+// takeAckWindowMessages removes as many of the request's waiting messages as
+// its window allows, numbering each one. Once the request's final message is
+// taken the window is dropped. Call with responseBuildersLk held.
+func (prm *peerResponseSender) takeAckWindowMessages(requestID graphsync.RequestID, aw *ackWindow) []*responsebuilder.ResponseBuilder {
+	var builders []*responsebuilder.ResponseBuilder
+	for len(aw.responseBuilders) > 0 && aw.nextSequence-aw.lastAcked <= aw.window {
+		builder := aw.responseBuilders[0]
+		aw.responseBuilders = aw.responseBuilders[1:]
+		if builder.Empty() {
+			continue
+		}
+		ackData, err := ack.EncodeInt(aw.nextSequence, prm.ipldBridge)
+		if err != nil {
+			log.Errorf("Unable to encode message sequence number: %s", err.Error())
+		} else {
+			builder.AddExtensionData(requestID, graphsync.ExtensionData{
+				Name: graphsync.ExtensionAck,
+				Data: ackData,
+			})
+		}
+		aw.nextSequence++
+		builders = append(builders, builder)
+		if builder.Completed(requestID) {
+			delete(prm.ackWindows, requestID)
+			break
+		}
+	}
+	return builders
 }
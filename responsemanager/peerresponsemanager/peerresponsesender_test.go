@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ack"
+	"github.com/ipfs/go-graphsync/allocator"
 	"github.com/ipfs/go-graphsync/testbridge"
 
 	blocks "github.com/ipfs/go-block-format"
@@ -53,7 +55,7 @@ func TestPeerResponseManagerSendsResponses(t *testing.T) {
 		sent: sent,
 	}
 	ipldBridge := testbridge.NewMockIPLDBridge()
-	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge)
+	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge, allocator.New(0))
 	peerResponseManager.Startup()
 
 	peerResponseManager.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -188,7 +190,7 @@ func TestPeerResponseManagerSendsVeryLargeBlocksResponses(t *testing.T) {
 		sent: sent,
 	}
 	ipldBridge := testbridge.NewMockIPLDBridge()
-	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge)
+	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge, allocator.New(0))
 	peerResponseManager.Startup()
 
 	peerResponseManager.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -313,7 +315,7 @@ func TestPeerResponseManagerSendsExtensionData(t *testing.T) {
 		sent: sent,
 	}
 	ipldBridge := testbridge.NewMockIPLDBridge()
-	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge)
+	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge, allocator.New(0))
 	peerResponseManager.Startup()
 
 	peerResponseManager.SendResponse(requestID1, links[0], blks[0].RawData())
@@ -373,6 +375,325 @@ func TestPeerResponseManagerSendsExtensionData(t *testing.T) {
 	}
 }
 
+type sentMessage struct {
+	responses []gsmsg.GraphSyncResponse
+	blks      []blocks.Block
+}
+
+type recordingPeerHandler struct {
+	sentMessages chan sentMessage
+}
+
+func (rph *recordingPeerHandler) SendResponse(p peer.ID, responses []gsmsg.GraphSyncResponse, blks []blocks.Block) <-chan struct{} {
+	rph.sentMessages <- sentMessage{responses, blks}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func TestPeerResponseManagerRespectsAckWindow(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	// generate large blocks so each goes in its own message
+	blks := testutil.GenerateBlocksOfSize(5, 1000000)
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	sentMessages := make(chan sentMessage, len(blks))
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, allocator.New(0))
+	peerResponseManager.Startup()
+
+	peerResponseManager.EnableAcknowledgements(requestID1, 2)
+	for _, block := range blks {
+		peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: block.Cid()}, block.RawData())
+	}
+
+	expectMessages := func(firstSequence int, count int) {
+		for i := 0; i < count; i++ {
+			var message sentMessage
+			select {
+			case <-ctx.Done():
+				t.Fatal("Did not send message within ack window")
+			case message = <-sentMessages:
+			}
+			response, err := findResponseForRequestID(message.responses, requestID1)
+			if err != nil {
+				t.Fatal("Did not send response for request")
+			}
+			ackData, found := response.Extension(graphsync.ExtensionAck)
+			if !found {
+				t.Fatal("Did not send sequence number with message")
+			}
+			sequence, err := ack.DecodeInt(ackData, ipldBridge)
+			if err != nil || sequence != firstSequence+i {
+				t.Fatal("Sent incorrect sequence number")
+			}
+		}
+	}
+	expectNoMessages := func() {
+		select {
+		case <-sentMessages:
+			t.Fatal("Sent more messages than ack window allows")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	expectMessages(1, 2)
+	expectNoMessages()
+
+	peerResponseManager.Acknowledge(requestID1, 1)
+	expectMessages(3, 1)
+	expectNoMessages()
+
+	peerResponseManager.Acknowledge(requestID1, 3)
+	expectMessages(4, 2)
+}
+
+func TestPeerResponseManagerAckWindowDoesNotBlockOtherRequests(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	requestID2 := requestID1 + 1
+	blks := testutil.GenerateBlocksOfSize(4, 1000000)
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	sentMessages := make(chan sentMessage, len(blks))
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, allocator.New(0))
+	peerResponseManager.Startup()
+
+	peerResponseManager.EnableAcknowledgements(requestID1, 1)
+	peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+	peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData())
+
+	var message sentMessage
+	select {
+	case <-ctx.Done():
+		t.Fatal("Did not send first message for request with acknowledgements")
+	case message = <-sentMessages:
+	}
+	if _, err := findResponseForRequestID(message.responses, requestID1); err != nil {
+		t.Fatal("Did not send response for request with acknowledgements")
+	}
+
+	// request 1 now waits on an ack, which must not hold up request 2
+	peerResponseManager.SendResponse(requestID2, cidlink.Link{Cid: blks[2].Cid()}, blks[2].RawData())
+	peerResponseManager.SendResponse(requestID2, cidlink.Link{Cid: blks[3].Cid()}, blks[3].RawData())
+	peerResponseManager.FinishRequest(requestID2)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Request without acknowledgements was held up by another request's ack window")
+		case message = <-sentMessages:
+		}
+		if _, err := findResponseForRequestID(message.responses, requestID1); err == nil {
+			t.Fatal("Sent more messages than ack window allows")
+		}
+		if _, err := findResponseForRequestID(message.responses, requestID2); err != nil {
+			t.Fatal("Did not send response for request without acknowledgements")
+		}
+	}
+
+	peerResponseManager.Acknowledge(requestID1, 1)
+	select {
+	case <-ctx.Done():
+		t.Fatal("Did not send message after acknowledgement")
+	case message = <-sentMessages:
+	}
+	if _, err := findResponseForRequestID(message.responses, requestID1); err != nil {
+		t.Fatal("Did not send response for request with acknowledgements")
+	}
+}
+
+func TestPeerResponseManagerCancelDropsAckWindow(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(3, 1000000)
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	sentMessages := make(chan sentMessage, len(blks))
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	responseAllocator := allocator.New(0)
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, responseAllocator)
+	peerResponseManager.Startup()
+
+	peerResponseManager.EnableAcknowledgements(requestID1, 1)
+	for _, block := range blks {
+		peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: block.Cid()}, block.RawData())
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("Did not send first message within ack window")
+	case <-sentMessages:
+	}
+
+	// the request is cancelled with messages still waiting on an ack
+	peerResponseManager.CancelRequest(requestID1)
+	// the message already sent frees its block once handed off
+	for {
+		stats := peerResponseManager.QueueStats()
+		if stats.Messages == 0 && stats.Bytes == 0 && responseAllocator.Allocated() == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("Should have dropped messages waiting on acknowledgement")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	peerResponseManager.Acknowledge(requestID1, 1)
+	select {
+	case <-sentMessages:
+		t.Fatal("Should not send messages for cancelled request")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestPeerResponseManagerFinishWithErrorFlushesAckWindow(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(3, 1000000)
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	sentMessages := make(chan sentMessage, len(blks))
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, allocator.New(0))
+	peerResponseManager.Startup()
+
+	peerResponseManager.EnableAcknowledgements(requestID1, 1)
+	for _, block := range blks {
+		peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: block.Cid()}, block.RawData())
+	}
+	peerResponseManager.FinishWithError(requestID1, graphsync.RequestFailedUnknown)
+
+	// the rest are sent without waiting for acknowledgements
+	var status graphsync.ResponseStatusCode
+	for i := 0; i < len(blks); i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Did not send messages for failed request")
+		case message := <-sentMessages:
+			response, err := findResponseForRequestID(message.responses, requestID1)
+			if err != nil {
+				t.Fatal("Did not send response for request")
+			}
+			status = response.Status()
+		}
+	}
+	if status != graphsync.RequestFailedUnknown {
+		t.Fatal("Did not send failure status last")
+	}
+	if stats := peerResponseManager.QueueStats(); stats.Messages != 0 {
+		t.Fatal("Should not hold messages for failed request")
+	}
+}
+
+func TestPeerResponseManagerIgnoresBlocks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	sentMessages := make(chan sentMessage, 1)
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, allocator.New(0))
+
+	peerResponseManager.IgnoreBlocks(requestID1, []ipld.Link{cidlink.Link{Cid: blks[0].Cid()}})
+	if peerResponseManager.QueueResponse(requestID1, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData()) {
+		t.Fatal("Should not report ignored block as queued")
+	}
+	if !peerResponseManager.QueueResponse(requestID1, cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData()) {
+		t.Fatal("Should report block as queued")
+	}
+	peerResponseManager.FinishRequest(requestID1)
+	peerResponseManager.Startup()
+
+	var message sentMessage
+	select {
+	case <-ctx.Done():
+		t.Fatal("Did not send message")
+	case message = <-sentMessages:
+	}
+	if len(message.blks) != 1 || message.blks[0].Cid() != blks[1].Cid() {
+		t.Fatal("Should not have sent ignored block")
+	}
+	response, err := findResponseForRequestID(message.responses, requestID1)
+	if err != nil {
+		t.Fatal("Did not send response for request")
+	}
+	if response.Status() != graphsync.RequestCompletedFull {
+		t.Fatal("Ignored blocks should still count as present")
+	}
+}
+
+func TestPeerResponseManagerMaxMessageBlockBytes(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	sentMessages := make(chan sentMessage, len(blks))
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, allocator.New(0), MaxMessageBlockBytes(150))
+
+	for _, block := range blks {
+		peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: block.Cid()}, block.RawData())
+	}
+	peerResponseManager.Startup()
+
+	for _, block := range blks {
+		var message sentMessage
+		select {
+		case <-ctx.Done():
+			t.Fatal("Did not send a message for each block")
+		case message = <-sentMessages:
+		}
+		if len(message.blks) != 1 || message.blks[0].Cid() != block.Cid() {
+			t.Fatal("Did not split blocks across messages")
+		}
+	}
+}
+
+func TestPeerResponseManagerBatchWindow(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	sentMessages := make(chan sentMessage, len(blks))
+	rph := &recordingPeerHandler{sentMessages}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, rph, ipldBridge, allocator.New(0), BatchWindow(100*time.Millisecond))
+	peerResponseManager.Startup()
+
+	peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+	time.Sleep(10 * time.Millisecond)
+	peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData())
+	peerResponseManager.FinishRequest(requestID1)
+
+	var message sentMessage
+	select {
+	case <-ctx.Done():
+		t.Fatal("Did not send message")
+	case message = <-sentMessages:
+	}
+	if len(message.blks) != 2 {
+		t.Fatal("Did not batch data that arrived within the window")
+	}
+}
+
 func findResponseForRequestID(responses []gsmsg.GraphSyncResponse, requestID graphsync.RequestID) (gsmsg.GraphSyncResponse, error) {
 	for _, response := range responses {
 		if response.RequestID() == requestID {
@@ -381,3 +702,57 @@ func findResponseForRequestID(responses []gsmsg.GraphSyncResponse, requestID gra
 	}
 	return gsmsg.GraphSyncResponse{}, fmt.Errorf("Response Not Found")
 }
+
+func TestPeerResponseManagerMaxQueuedBytes(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.RequestID(rand.Int31())
+	blks := testutil.GenerateBlocksOfSize(10, 100)
+	// a stalled stream: messages are taken but never finish sending
+	fph := &fakePeerHandler{sent: make(chan struct{}, len(blks)), done: make(chan struct{})}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	peerResponseManager := NewResponseSender(ctx, p, fph, ipldBridge, allocator.New(0),
+		MaxMessageBlockBytes(100), MaxQueuedBytes(300))
+	peerResponseManager.Startup()
+
+	traversed := make(chan int, len(blks))
+	go func() {
+		for i, block := range blks {
+			peerResponseManager.SendResponse(requestID1, cidlink.Link{Cid: block.Cid()}, block.RawData())
+			traversed <- i
+		}
+	}()
+
+	sent := 0
+	paused := false
+	for !paused {
+		select {
+		case <-ctx.Done():
+			t.Fatal("traversal did not pause")
+		case <-traversed:
+			sent++
+		case <-time.After(50 * time.Millisecond):
+			paused = true
+		}
+	}
+	if sent != 3 {
+		t.Fatal("did not pause the traversal once the queue was full")
+	}
+	stats := peerResponseManager.QueueStats()
+	if stats.Bytes != 300 || stats.Messages != 3 {
+		t.Fatal("did not report the queued messages")
+	}
+
+	// the peer reading its stream again lets the traversal go on
+	close(fph.done)
+	for sent < len(blks) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("traversal did not resume")
+		case <-traversed:
+			sent++
+		}
+	}
+}
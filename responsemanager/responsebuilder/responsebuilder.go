@@ -6,6 +6,7 @@ import (
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/persistentextensions"
 	"github.com/ipld/go-ipld-prime"
 )
 
@@ -18,6 +19,7 @@ type ResponseBuilder struct {
 	completedResponses map[graphsync.RequestID]graphsync.ResponseStatusCode
 	outgoingResponses  map[graphsync.RequestID]metadata.Metadata
 	extensions         map[graphsync.RequestID][]graphsync.ExtensionData
+	persistentNames    map[graphsync.RequestID][]graphsync.ExtensionName
 }
 
 // New generates a new ResponseBuilder.
@@ -26,6 +28,7 @@ func New() *ResponseBuilder {
 		completedResponses: make(map[graphsync.RequestID]graphsync.ResponseStatusCode),
 		outgoingResponses:  make(map[graphsync.RequestID]metadata.Metadata),
 		extensions:         make(map[graphsync.RequestID][]graphsync.ExtensionData),
+		persistentNames:    make(map[graphsync.RequestID][]graphsync.ExtensionName),
 	}
 }
 
@@ -40,6 +43,18 @@ func (rb *ResponseBuilder) AddExtensionData(requestID graphsync.RequestID, exten
 	rb.extensions[requestID] = append(rb.extensions[requestID], extension)
 }
 
+// AddPersistentExtensionData adds the given extension data to the response,
+// marking it as applying to all later responses for the request as well
+func (rb *ResponseBuilder) AddPersistentExtensionData(requestID graphsync.RequestID, extension graphsync.ExtensionData) {
+	rb.AddExtensionData(requestID, extension)
+	rb.persistentNames[requestID] = append(rb.persistentNames[requestID], extension.Name)
+	// make sure the extension goes out in next response even if no links are sent
+	_, ok := rb.outgoingResponses[requestID]
+	if !ok {
+		rb.outgoingResponses[requestID] = nil
+	}
+}
+
 // BlockSize returns the total size of all blocks in this response
 func (rb *ResponseBuilder) BlockSize() int {
 	return rb.blkSize
@@ -63,6 +78,13 @@ func (rb *ResponseBuilder) AddCompletedRequest(requestID graphsync.RequestID, st
 	}
 }
 
+// Completed returns true if the response marks the given request as
+// completed.
+func (rb *ResponseBuilder) Completed(requestID graphsync.RequestID) bool {
+	_, ok := rb.completedResponses[requestID]
+	return ok
+}
+
 // Empty returns true if there is no content to send
 func (rb *ResponseBuilder) Empty() bool {
 	return len(rb.outgoingBlocks) == 0 && len(rb.outgoingResponses) == 0
@@ -80,6 +102,16 @@ func (rb *ResponseBuilder) Build(ipldBridge ipldbridge.IPLDBridge) ([]gsmsg.Grap
 			Name: graphsync.ExtensionMetadata,
 			Data: mdRaw,
 		})
+		if names, ok := rb.persistentNames[requestID]; ok {
+			namesRaw, err := persistentextensions.EncodeNames(names, ipldBridge)
+			if err != nil {
+				return nil, nil, err
+			}
+			rb.extensions[requestID] = append(rb.extensions[requestID], graphsync.ExtensionData{
+				Name: graphsync.ExtensionPersistentExtensions,
+				Data: namesRaw,
+			})
+		}
 		status, isComplete := rb.completedResponses[requestID]
 		responses = append(responses, gsmsg.NewResponse(requestID, responseCode(status, isComplete), rb.extensions[requestID]...))
 	}
@@ -9,6 +9,7 @@ import (
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/metadata"
+	"github.com/ipfs/go-graphsync/persistentextensions"
 	"github.com/ipfs/go-graphsync/testbridge"
 	"github.com/ipfs/go-graphsync/testutil"
 	"github.com/ipld/go-ipld-prime"
@@ -155,6 +156,41 @@ func TestMessageBuilding(t *testing.T) {
 	}
 }
 
+func TestPersistentExtensionBuilding(t *testing.T) {
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	rb := New()
+	requestID := graphsync.RequestID(rand.Int31())
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("AppleSauce/McGee"),
+		Data: testutil.RandomBytes(100),
+	}
+	rb.AddPersistentExtensionData(requestID, extension)
+	if rb.Empty() {
+		t.Fatal("should send persistent extension even without links")
+	}
+
+	responses, _, err := rb.Build(ipldBridge)
+	if err != nil {
+		t.Fatal("Error building responses")
+	}
+	response, err := findResponseForRequestID(responses, requestID)
+	if err != nil {
+		t.Fatal("did not generate response")
+	}
+	returnedData, found := response.Extension(extension.Name)
+	if !found || !reflect.DeepEqual(extension.Data, returnedData) {
+		t.Fatal("Failed to encode persistent extension")
+	}
+	namesRaw, found := response.Extension(graphsync.ExtensionPersistentExtensions)
+	if !found {
+		t.Fatal("Did not mark extension as persistent")
+	}
+	names, err := persistentextensions.DecodeNames(namesRaw, ipldBridge)
+	if err != nil || !reflect.DeepEqual(names, []graphsync.ExtensionName{extension.Name}) {
+		t.Fatal("Marked incorrect extensions as persistent")
+	}
+}
+
 func findResponseForRequestID(responses []gsmsg.GraphSyncResponse, requestID graphsync.RequestID) (gsmsg.GraphSyncResponse, error) {
 	for _, response := range responses {
 		if response.RequestID() == requestID {
@@ -1,31 +1,59 @@
 package responsemanager
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ack"
+	"github.com/ipfs/go-graphsync/byterange"
+	"github.com/ipfs/go-graphsync/cancelreason"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/cursor"
 	"github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/persistentextensions"
 	"github.com/ipfs/go-graphsync/responsemanager/loader"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
 	"github.com/ipfs/go-graphsync/responsemanager/selectorvalidator"
+	logging "github.com/ipfs/go-log"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	ipld "github.com/ipld/go-ipld-prime"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
+var log = logging.Logger("graphsync")
+
 const (
 	maxInProcessRequests = 6
 	maxRecursionDepth    = 100
 	thawSpeed            = time.Millisecond * 100
+	// the most block data held back to follow a request's preferred order
+	maxPreferredOrderBytes = 4 << 20
+	// how deep each subtree pushed to a requestor is followed
+	pushedSubtreeDepth = 100
 )
 
 type inProgressResponseStatus struct {
 	ctx      context.Context
 	cancelFn func()
 	request  gsmsg.GraphSyncRequest
+	scratch  graphsync.RequestScratch
+	// the checkpoint a response resumed with ResumeCheckpoints starts from
+	resumeFrom *Checkpoint
+	// started is set once the response is taken off the queue to execute
+	started bool
 }
 
 type responseKey struct {
@@ -34,14 +62,48 @@ type responseKey struct {
 }
 
 type responseTaskData struct {
-	ctx     context.Context
-	request gsmsg.GraphSyncRequest
+	ctx        context.Context
+	request    gsmsg.GraphSyncRequest
+	scratch    graphsync.RequestScratch
+	resumeFrom *Checkpoint
+}
+
+// requestWithScratch presents a request to hooks along with the scratch they
+// share for it
+type requestWithScratch struct {
+	gsmsg.GraphSyncRequest
+	scratch graphsync.RequestScratch
+}
+
+// RequestScratch returns the scratch shared by hooks for the request
+func (rws requestWithScratch) RequestScratch() graphsync.RequestScratch {
+	return rws.scratch
 }
 
 type requestHook struct {
 	hook graphsync.OnRequestReceivedHook
 }
 
+type requestQueuedHook struct {
+	hook graphsync.OnRequestQueuedHook
+}
+
+type requestStartedHook struct {
+	hook graphsync.OnRequestStartedHook
+}
+
+type requestCancelledHook struct {
+	hook graphsync.OnRequestCancelledHook
+}
+
+type responseCompletedHook struct {
+	hook graphsync.OnResponseCompletedHook
+}
+
+type responseUndeliverableHook struct {
+	hook graphsync.OnResponseUndeliverableHook
+}
+
 // QueryQueue is an interface that can receive new selector query tasks
 // and prioritize them as needed, and pop them off later
 type QueryQueue interface {
@@ -63,18 +125,79 @@ type responseManagerMessage interface {
 // ResponseManager handles incoming requests from the network, initiates selector
 // traversals, and transmits responses
 type ResponseManager struct {
+	// set atomically once a hook for undeliverable responses is registered
+	trackingDelivery int32
+
 	ctx         context.Context
 	cancelFn    context.CancelFunc
 	loader      ipldbridge.Loader
 	ipldBridge  ipldbridge.IPLDBridge
 	peerManager PeerManager
 	queryQueue  QueryQueue
+	// preferred over loader, if set
+	contextLoader ipldbridge.ContextLoader
+
+	messages              chan responseManagerMessage
+	workSignal            chan struct{}
+	ticker                *time.Ticker
+	inProgressResponses   map[responseKey]inProgressResponseStatus
+	requestHooks          []requestHook
+	requestQueuedHooks    []requestQueuedHook
+	requestStartedHooks   []requestStartedHook
+	requestCancelledHooks []requestCancelledHook
+	completedHooks        []responseCompletedHook
+	undeliverableHooks    []responseUndeliverableHook
+	loadSerializer        *loader.LoadSerializer
+	checkpointStore       CheckpointStore
+	checkpointInterval    int
+	blockCache            *loader.BlockCache
+	resultCache           loader.ResultCache
+	maxResultBytes        uint64
+	maxResponseDuration   time.Duration
+	maxServedPeers        int
+	// number of responses worked on at once
+	inProcessWorkers int
+	// number of in progress responses for each peer being served
+	servedPeers map[peer.ID]int
+	// requests worked on since undeliverable hooks were registered, until
+	// their final response is sent or abandoned
+	awaitingDelivery map[responseKey]graphsync.RequestData
+
+	registeredSelectorsLk sync.RWMutex
+	registeredSelectors   map[string]registeredSelector
+
+	advertisedExtensionsLk sync.RWMutex
+	advertisedExtensions   []graphsync.ExtensionName
+}
 
-	messages            chan responseManagerMessage
-	workSignal          chan struct{}
-	ticker              *time.Ticker
-	inProgressResponses map[responseKey]inProgressResponseStatus
-	requestHooks        []requestHook
+// builtinExtensions are the extensions the response manager handles itself,
+// which it tells requestors it supports
+var builtinExtensions = []graphsync.ExtensionName{
+	graphsync.ExtensionMetadata,
+	graphsync.ExtensionDoNotSendCIDs,
+	graphsync.ExtensionAckWindow,
+	graphsync.ExtensionAck,
+	graphsync.ExtensionPersistentExtensions,
+	graphsync.ExtensionPreferredOrder,
+	graphsync.ExtensionByteRange,
+	graphsync.ExtensionSelectorName,
+	graphsync.ExtensionCancelReason,
+	graphsync.ExtensionAcceptPush,
+	graphsync.ExtensionPushedSubtrees,
+	graphsync.ExtensionRedirect,
+	graphsync.ExtensionCursor,
+	graphsync.ExtensionRawPassthrough,
+	graphsync.ExtensionSupportedExtensions,
+}
+
+// errRedirected ends the hooks for a request a hook redirected
+var errRedirected = errors.New("request redirected")
+
+// registeredSelector is a selector spec registered by name, along with the
+// selector parsed from it
+type registeredSelector struct {
+	spec     ipld.Node
+	selector ipldbridge.Selector
 }
 
 // New creates a new response manager from the given context, loader,
@@ -86,16 +209,21 @@ func New(ctx context.Context,
 	queryQueue QueryQueue) *ResponseManager {
 	ctx, cancelFn := context.WithCancel(ctx)
 	return &ResponseManager{
-		ctx:                 ctx,
-		cancelFn:            cancelFn,
-		loader:              loader,
-		ipldBridge:          ipldBridge,
-		peerManager:         peerManager,
-		queryQueue:          queryQueue,
-		messages:            make(chan responseManagerMessage, 16),
-		workSignal:          make(chan struct{}, 1),
-		ticker:              time.NewTicker(thawSpeed),
-		inProgressResponses: make(map[responseKey]inProgressResponseStatus),
+		ctx:                  ctx,
+		cancelFn:             cancelFn,
+		loader:               loader,
+		ipldBridge:           ipldBridge,
+		peerManager:          peerManager,
+		queryQueue:           queryQueue,
+		messages:             make(chan responseManagerMessage, 16),
+		workSignal:           make(chan struct{}, 1),
+		ticker:               time.NewTicker(thawSpeed),
+		inProgressResponses:  make(map[responseKey]inProgressResponseStatus),
+		awaitingDelivery:     make(map[responseKey]graphsync.RequestData),
+		servedPeers:          make(map[peer.ID]int),
+		inProcessWorkers:     maxInProcessRequests,
+		registeredSelectors:  make(map[string]registeredSelector),
+		advertisedExtensions: append([]graphsync.ExtensionName(nil), builtinExtensions...),
 	}
 }
 
@@ -121,6 +249,129 @@ func (rm *ResponseManager) RegisterHook(hook graphsync.OnRequestReceivedHook) {
 	}
 }
 
+// RegisterQueuedHook registers a hook that runs as each incoming request is
+// queued
+func (rm *ResponseManager) RegisterQueuedHook(hook graphsync.OnRequestQueuedHook) {
+	select {
+	case rm.messages <- &requestQueuedHook{hook}:
+	case <-rm.ctx.Done():
+	}
+}
+
+// RegisterStartedHook registers a hook that runs as each queued request is
+// taken off the queue to be worked on
+func (rm *ResponseManager) RegisterStartedHook(hook graphsync.OnRequestStartedHook) {
+	select {
+	case rm.messages <- &requestStartedHook{hook}:
+	case <-rm.ctx.Done():
+	}
+}
+
+// RegisterCompletedHook registers a hook that runs as the responder finishes
+// working on each request the requestor did not cancel
+func (rm *ResponseManager) RegisterCompletedHook(hook graphsync.OnResponseCompletedHook) {
+	select {
+	case rm.messages <- &responseCompletedHook{hook}:
+	case <-rm.ctx.Done():
+	}
+}
+
+// RegisterCancelledHook registers a hook that runs as the requestor cancels
+// each queued or in progress request
+func (rm *ResponseManager) RegisterCancelledHook(hook graphsync.OnRequestCancelledHook) {
+	select {
+	case rm.messages <- &requestCancelledHook{hook}:
+	case <-rm.ctx.Done():
+	}
+}
+
+// RegisterUndeliverableHook registers a hook that runs for each request whose
+// responses are in a message that could not be sent. Only messages reported
+// with ResponsesReported are known about.
+func (rm *ResponseManager) RegisterUndeliverableHook(hook graphsync.OnResponseUndeliverableHook) {
+	atomic.StoreInt32(&rm.trackingDelivery, 1)
+	select {
+	case rm.messages <- &responseUndeliverableHook{hook}:
+	case <-rm.ctx.Done():
+	}
+}
+
+type responsesReportedMessage struct {
+	p         peer.ID
+	responses []gsmsg.GraphSyncResponse
+	err       error
+}
+
+// ResponsesReported tells the response manager a message with the given
+// responses was sent to the peer, if err is nil, or abandoned because of err.
+func (rm *ResponseManager) ResponsesReported(p peer.ID, responses []gsmsg.GraphSyncResponse, err error) {
+	if atomic.LoadInt32(&rm.trackingDelivery) == 0 {
+		return
+	}
+	select {
+	case rm.messages <- &responsesReportedMessage{p, responses, err}:
+	case <-rm.ctx.Done():
+	}
+}
+
+// RegisterSelector parses the given selector spec once, and uses it for any
+// request naming it in a graphsync.ExtensionSelectorName extension, skipping
+// the decoding, validation, and parsing of the selector in the request.
+func (rm *ResponseManager) RegisterSelector(name string, selectorSpec ipld.Node) error {
+	selector, err := rm.ipldBridge.ParseSelector(selectorSpec)
+	if err != nil {
+		return err
+	}
+	rm.registeredSelectorsLk.Lock()
+	rm.registeredSelectors[name] = registeredSelector{selectorSpec, selector}
+	rm.registeredSelectorsLk.Unlock()
+	return nil
+}
+
+// AdvertiseExtension adds an extension to those requestors are told this
+// responder supports. An extension can be advertised only once.
+func (rm *ResponseManager) AdvertiseExtension(name graphsync.ExtensionName) error {
+	rm.advertisedExtensionsLk.Lock()
+	defer rm.advertisedExtensionsLk.Unlock()
+	for _, advertised := range rm.advertisedExtensions {
+		if advertised == name {
+			return graphsync.ErrExtensionAlreadyRegistered
+		}
+	}
+	rm.advertisedExtensions = append(rm.advertisedExtensions, name)
+	return nil
+}
+
+// sendSupportedExtensions answers a query for the extensions this responder
+// supports, without queueing it
+func (rm *ResponseManager) sendSupportedExtensions(p peer.ID, request gsmsg.GraphSyncRequest) {
+	peerResponseSender := rm.peerManager.SenderForPeer(p)
+	rm.advertisedExtensionsLk.RLock()
+	namesData, err := persistentextensions.EncodeNames(rm.advertisedExtensions, rm.ipldBridge)
+	rm.advertisedExtensionsLk.RUnlock()
+	if err != nil {
+		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+		return
+	}
+	peerResponseSender.SendExtensionData(request.ID(), graphsync.ExtensionData{
+		Name: graphsync.ExtensionSupportedExtensions,
+		Data: namesData,
+	})
+	peerResponseSender.FinishRequest(request.ID())
+}
+
+// lookupSelector returns the registered selector named by the request, if any
+func (rm *ResponseManager) lookupSelector(request gsmsg.GraphSyncRequest) (registeredSelector, bool) {
+	name, ok := request.Extension(graphsync.ExtensionSelectorName)
+	if !ok {
+		return registeredSelector{}, false
+	}
+	rm.registeredSelectorsLk.RLock()
+	defer rm.registeredSelectorsLk.RUnlock()
+	registered, ok := rm.registeredSelectors[string(name)]
+	return registered, ok
+}
+
 type synchronizeMessage struct {
 	sync chan struct{}
 }
@@ -144,7 +395,8 @@ type responseDataRequest struct {
 }
 
 type finishResponseRequest struct {
-	key responseKey
+	key   responseKey
+	stats graphsync.TraversalStats
 }
 
 func (rm *ResponseManager) processQueriesWorker() {
@@ -175,9 +427,16 @@ func (rm *ResponseManager) processQueriesWorker() {
 			case <-rm.ctx.Done():
 				return
 			}
-			rm.executeQuery(taskData.ctx, key.p, taskData.request)
+			// the response was cancelled after it was taken off the queue
+			if taskData == nil {
+				continue
+			}
+			var stats graphsync.TraversalStats
+			start := time.Now()
+			rm.executeQuery(taskData.ctx, key.p, taskData.request, taskData.scratch, taskData.resumeFrom, &stats)
+			stats.Duration = time.Since(start)
 			select {
-			case rm.messages <- &finishResponseRequest{key}:
+			case rm.messages <- &finishResponseRequest{key, stats}:
 			case <-rm.ctx.Done():
 			}
 		}
@@ -187,14 +446,90 @@ func (rm *ResponseManager) processQueriesWorker() {
 
 }
 
-func noopVisitor(tp ipldbridge.TraversalProgress, n ipld.Node, tr ipldbridge.TraversalReason) error {
-	return nil
+// abortOnDone stops a traversal at its next load once the context is done
+func abortOnDone(ctx context.Context, loader ipldbridge.Loader) ipldbridge.Loader {
+	return func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return loader(lnk, lnkCtx)
+	}
+}
+
+func matchTrackingVisitor(visited *bool, matched *bool) ipldbridge.AdvVisitFn {
+	return func(tp ipldbridge.TraversalProgress, n ipld.Node, tr ipldbridge.TraversalReason) error {
+		*visited = true
+		if tr == ipldbridge.TraversalReasonSelectionMatch {
+			*matched = true
+		}
+		return nil
+	}
+}
+
+// traversalStatsRecorder counts the nodes a response's traversal visits and
+// the blocks the peer's sender queues for it, which leaves out those the
+// peer was already sent
+type traversalStatsRecorder struct {
+	stats              *graphsync.TraversalStats
+	peerResponseSender peerresponsemanager.PeerResponseSender
+}
+
+func (tsr *traversalStatsRecorder) SendResponse(requestID graphsync.RequestID, link ipld.Link, data []byte) {
+	if tsr.peerResponseSender.QueueResponse(requestID, link, data) {
+		tsr.stats.BlocksSent++
+	}
+}
+
+func (tsr *traversalStatsRecorder) wrapVisitor(visitor ipldbridge.AdvVisitFn) ipldbridge.AdvVisitFn {
+	return func(tp ipldbridge.TraversalProgress, n ipld.Node, tr ipldbridge.TraversalReason) error {
+		tsr.stats.NodesVisited++
+		if depth := len(tp.Path.Segments()); depth > tsr.stats.MaxDepth {
+			tsr.stats.MaxDepth = depth
+		}
+		return visitor(tp, n, tr)
+	}
+}
+
+// selectorHasMatcher returns true if a matcher clause appears anywhere in the
+// selector spec. Selectors without one only explore, so nodes they visit are
+// never reported as matches.
+func selectorHasMatcher(node ipld.Node) bool {
+	switch node.ReprKind() {
+	case ipld.ReprKind_Map:
+		iterator := node.MapIterator()
+		for !iterator.Done() {
+			key, value, err := iterator.Next()
+			if err != nil {
+				return false
+			}
+			if keyString, _ := key.AsString(); keyString == ipldselector.SelectorKey_Matcher {
+				return true
+			}
+			if selectorHasMatcher(value) {
+				return true
+			}
+		}
+	case ipld.ReprKind_List:
+		iterator := node.ListIterator()
+		for !iterator.Done() {
+			_, value, err := iterator.Next()
+			if err != nil {
+				return false
+			}
+			if selectorHasMatcher(value) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type hookActions struct {
 	isValidated        bool
 	requestID          graphsync.RequestID
 	peerResponseSender peerresponsemanager.PeerResponseSender
+	scratch            graphsync.RequestScratch
+	pushRoots          []cid.Cid
 	err                error
 }
 
@@ -202,53 +537,464 @@ func (ha *hookActions) SendExtensionData(ext graphsync.ExtensionData) {
 	ha.peerResponseSender.SendExtensionData(ha.requestID, ext)
 }
 
+func (ha *hookActions) SendPersistentExtensionData(ext graphsync.ExtensionData) {
+	ha.peerResponseSender.SendPersistentExtensionData(ha.requestID, ext)
+}
+
 func (ha *hookActions) TerminateWithError(err error) {
 	ha.err = err
 	ha.peerResponseSender.FinishWithError(ha.requestID, graphsync.RequestFailedUnknown)
 }
 
+func (ha *hookActions) Redirect(root cid.Cid) {
+	ha.err = errRedirected
+	ha.peerResponseSender.SendExtensionData(ha.requestID, graphsync.ExtensionData{
+		Name: graphsync.ExtensionRedirect,
+		Data: root.Bytes(),
+	})
+	ha.peerResponseSender.FinishWithError(ha.requestID, graphsync.RequestFailedContentNotFound)
+}
+
 func (ha *hookActions) ValidateRequest() {
 	ha.isValidated = true
 }
 
+func (ha *hookActions) RequestScratch() graphsync.RequestScratch {
+	return ha.scratch
+}
+
+func (ha *hookActions) PushSubtrees(roots ...cid.Cid) {
+	ha.pushRoots = append(ha.pushRoots, roots...)
+}
+
 func (rm *ResponseManager) executeQuery(ctx context.Context,
 	p peer.ID,
-	request gsmsg.GraphSyncRequest) {
+	request gsmsg.GraphSyncRequest,
+	scratch graphsync.RequestScratch,
+	resumeFrom *Checkpoint,
+	stats *graphsync.TraversalStats) {
+	if rm.maxResponseDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rm.maxResponseDuration)
+		defer cancel()
+	}
 	peerResponseSender := rm.peerManager.SenderForPeer(p)
-	selectorSpec, err := rm.ipldBridge.DecodeNode(request.Selector())
-	if err != nil {
-		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
-		return
+	registered, isRegistered := rm.lookupSelector(request)
+	selectorSpec := registered.spec
+	var err error
+	if !isRegistered {
+		selectorSpec, err = rm.ipldBridge.DecodeNode(request.Selector())
+		if err != nil {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+			return
+		}
 	}
-	ha := &hookActions{false, request.ID(), peerResponseSender, nil}
+	ha := &hookActions{false, request.ID(), peerResponseSender, scratch, nil, nil}
+	hookRequest := requestWithScratch{request, scratch}
 	for _, requestHook := range rm.requestHooks {
-		requestHook.hook(p, request, ha)
+		requestHook.hook(p, hookRequest, ha)
 		if ha.err != nil {
 			return
 		}
 	}
-	if !ha.isValidated {
-		err = selectorvalidator.ValidateSelector(rm.ipldBridge, selectorSpec, maxRecursionDepth)
+	if len(ha.pushRoots) > 0 {
+		pushedData, err := cidset.EncodeCidList(ha.pushRoots, rm.ipldBridge)
 		if err != nil {
 			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
 			return
 		}
+		peerResponseSender.SendExtensionData(request.ID(), graphsync.ExtensionData{
+			Name: graphsync.ExtensionPushedSubtrees,
+			Data: pushedData,
+		})
 	}
-	selector, err := rm.ipldBridge.ParseSelector(selectorSpec)
+	selector := registered.selector
+	if !isRegistered {
+		if !ha.isValidated {
+			err = selectorvalidator.ValidateSelector(rm.ipldBridge, selectorSpec, maxRecursionDepth)
+			if err != nil {
+				peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+				return
+			}
+		}
+		selector, err = rm.ipldBridge.ParseSelector(selectorSpec)
+		if err != nil {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+			return
+		}
+	}
+	if windowData, ok := request.Extension(graphsync.ExtensionAckWindow); ok {
+		window, err := ack.DecodeInt(windowData, rm.ipldBridge)
+		if err != nil || window <= 0 {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+			return
+		}
+		peerResponseSender.EnableAcknowledgements(request.ID(), window)
+	}
+	if doNotSendData, ok := request.Extension(graphsync.ExtensionDoNotSendCIDs); ok {
+		doNotSend, err := cidset.DecodeCidSet(doNotSendData, rm.ipldBridge)
+		if err != nil {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+			return
+		}
+		links := make([]ipld.Link, 0, doNotSend.Len())
+		_ = doNotSend.ForEach(func(c cid.Cid) error {
+			links = append(links, cidlink.Link{Cid: c})
+			return nil
+		})
+		peerResponseSender.IgnoreBlocks(request.ID(), links)
+	}
+	rootLink := cidlink.Link{Cid: request.Root()}
+	blockLoader := rm.loader
+	if rm.contextLoader != nil {
+		blockLoader = ipldbridge.BindContext(ctx, rm.contextLoader)
+	}
+	if rm.loadSerializer != nil {
+		blockLoader = rm.loadSerializer.WrapLoader(p, blockLoader)
+	}
+	if rm.blockCache != nil {
+		blockLoader = rm.blockCache.WrapLoader(blockLoader)
+	}
+	// verified after the block cache, which may hold blocks loaded for
+	// responses that were not
+	_, passthrough := request.Extension(graphsync.ExtensionRawPassthrough)
+	if passthrough {
+		blockLoader = loader.VerifyBytes(blockLoader)
+	}
+	if rangeData, ok := request.Extension(graphsync.ExtensionByteRange); ok {
+		rm.sendByteRange(request.ID(), rootLink, selectorSpec, rangeData, blockLoader, peerResponseSender)
+		return
+	}
+	resumeCursor, resuming, err := rm.decodeCursor(request)
 	if err != nil {
+		log.Infof("Unable to resume request %d: %s", request.ID(), err)
 		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
 		return
 	}
-	rootLink := cidlink.Link{Cid: request.Root()}
-	wrappedLoader := loader.WrapLoader(rm.loader, request.ID(), peerResponseSender)
-	err = rm.ipldBridge.Traverse(ctx, wrappedLoader, rootLink, selector, noopVisitor)
+	pushLoader := blockLoader
+	statsRecorder := &traversalStatsRecorder{stats, peerResponseSender}
+	var responseSender loader.ResponseSender = statsRecorder
+	var preferredOrder *loader.PreferredOrder
+	if hintData, ok := request.Extension(graphsync.ExtensionPreferredOrder); ok {
+		if resuming {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+			return
+		}
+		hints, err := cidset.DecodeCidList(hintData, rm.ipldBridge)
+		if err != nil {
+			peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+			return
+		}
+		preferredOrder = loader.NewPreferredOrder(hints, responseSender, maxPreferredOrderBytes)
+		blockLoader = preferredOrder.WrapLoader(blockLoader)
+		responseSender = preferredOrder
+	}
+	// blocks sent in a preferred order are not sent in traversal order, so
+	// there is no one point a response could resume from. Otherwise, how far
+	// the response gets is tracked for a cursor, should it be interrupted,
+	// and saved as checkpoints if the request asks.
+	_, checkpointed := request.Extension(graphsync.ExtensionCheckpoint)
+	checkpointed = checkpointed && rm.checkpointStore != nil && preferredOrder == nil
+	var progress *checkpointer
+	if preferredOrder == nil {
+		checkpoint := Checkpoint{Peer: p, Request: request}
+		if resumeFrom != nil {
+			checkpoint = *resumeFrom
+		} else if resuming {
+			checkpoint.Blocks = resumeCursor.Blocks
+			checkpoint.Path = resumeCursor.Path
+		}
+		var store CheckpointStore
+		if checkpointed {
+			store = rm.checkpointStore
+		}
+		progress = newCheckpointer(rm.ctx, store, rm.checkpointInterval, checkpoint, responseSender)
+		progress.start()
+		defer progress.finish()
+		blockLoader = progress.wrapLoader(blockLoader)
+		responseSender = progress
+	}
+	// cached results are in traversal order, and hold every block, but are
+	// replayed without loading their blocks to verify them
+	var resultKey string
+	var resultRecorder *loader.ResultRecorder
+	if rm.resultCache != nil && preferredOrder == nil && !checkpointed && !resuming && !passthrough {
+		if selectorBytes, err := rm.ipldBridge.EncodeNode(selectorSpec); err == nil {
+			resultKey = loader.ResultKey(request.Root(), selectorBytes)
+		}
+	}
+	if resultKey != "" {
+		if result, ok := rm.resultCache.Get(resultKey); ok {
+			err := loader.ReplayResult(result, request.ID(), responseSender)
+			_ = result.Close()
+			if err != nil {
+				log.Warningf("Unable to replay cached result for request %d: %s", request.ID(), err)
+				rm.finishInterrupted(request, progress, peerResponseSender, graphsync.RequestFailedUnknown)
+				return
+			}
+			rm.finishMatchedQuery(ctx, request, ha.pushRoots, pushLoader, peerResponseSender)
+			return
+		}
+		resultRecorder = loader.NewResultRecorder(responseSender, rm.maxResultBytes)
+		responseSender = resultRecorder
+	}
+	// a response stops at its next load once the requestor cancels it, as
+	// well as once it runs out of time, so it ends with a cursor
+	wrappedLoader := abortOnDone(ctx, loader.WrapLoader(blockLoader, request.ID(), responseSender))
+	var visited, matched bool
+	err = rm.ipldBridge.Traverse(ctx, wrappedLoader, rootLink, selector, statsRecorder.wrapVisitor(matchTrackingVisitor(&visited, &matched)))
+	if preferredOrder != nil {
+		preferredOrder.Flush()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		rm.finishInterrupted(request, progress, peerResponseSender, graphsync.RequestFailedTimeout)
+		return
+	}
 	if err != nil {
-		peerResponseSender.FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+		rm.finishInterrupted(request, progress, peerResponseSender, graphsync.RequestFailedUnknown)
 		return
 	}
+	if !matched && (!visited || selectorHasMatcher(selectorSpec)) {
+		peerResponseSender.FinishEmptyRequest(request.ID())
+		return
+	}
+	if resultRecorder != nil {
+		if result := resultRecorder.Result(); result != nil {
+			if err := rm.resultCache.Put(resultKey, result); err != nil {
+				log.Warningf("Unable to cache result for request %d: %s", request.ID(), err)
+			}
+		}
+	}
+	rm.finishMatchedQuery(ctx, request, ha.pushRoots, pushLoader, peerResponseSender)
+}
+
+// decodeCursor reads the cursor a request resumes from, if it has one, which
+// must be for the same root and selector
+func (rm *ResponseManager) decodeCursor(request gsmsg.GraphSyncRequest) (cursor.Cursor, bool, error) {
+	data, ok := request.Extension(graphsync.ExtensionCursor)
+	if !ok {
+		return cursor.Cursor{}, false, nil
+	}
+	c, err := cursor.DecodeCursor(data, rm.ipldBridge)
+	if err != nil {
+		return cursor.Cursor{}, false, err
+	}
+	if !c.Root.Equals(request.Root()) || !bytes.Equal(c.Selector, request.Selector()) {
+		return cursor.Cursor{}, false, errors.New("cursor is for a different root or selector")
+	}
+	return c, true, nil
+}
+
+// finishInterrupted ends a response that stopped partway through with the
+// given status, first telling the requestor how far it got, so it can resume
+// it, if it sent any blocks. It is sent whatever stopped the response, though
+// a requestor that cancelled the request no longer reads it.
+func (rm *ResponseManager) finishInterrupted(request gsmsg.GraphSyncRequest, progress *checkpointer, peerResponseSender peerresponsemanager.PeerResponseSender, status graphsync.ResponseStatusCode) {
+	rm.sendCursor(request, progress, peerResponseSender)
+	peerResponseSender.FinishWithError(request.ID(), status)
+}
+
+func (rm *ResponseManager) sendCursor(request gsmsg.GraphSyncRequest, progress *checkpointer, peerResponseSender peerresponsemanager.PeerResponseSender) {
+	if progress == nil || progress.checkpoint.Blocks == 0 {
+		return
+	}
+	data, err := cursor.EncodeCursor(cursor.Cursor{
+		Root:     request.Root(),
+		Selector: request.Selector(),
+		Blocks:   progress.checkpoint.Blocks,
+		Path:     progress.checkpoint.Path,
+	}, rm.ipldBridge)
+	if err != nil {
+		log.Warningf("Unable to encode cursor for request %d: %s", request.ID(), err)
+		return
+	}
+	peerResponseSender.SendExtensionData(request.ID(), graphsync.ExtensionData{
+		Name: graphsync.ExtensionCursor,
+		Data: data,
+	})
+}
+
+// finishMatchedQuery finishes a response whose selector matched, after
+// pushing any subtrees hooks asked to push
+func (rm *ResponseManager) finishMatchedQuery(ctx context.Context,
+	request gsmsg.GraphSyncRequest,
+	pushRoots []cid.Cid,
+	pushLoader ipldbridge.Loader,
+	peerResponseSender peerresponsemanager.PeerResponseSender) {
+	if _, ok := request.Extension(graphsync.ExtensionAcceptPush); ok && len(pushRoots) > 0 {
+		rm.pushSubtrees(ctx, request.ID(), pushRoots, pushLoader, peerResponseSender)
+	}
 	peerResponseSender.FinishRequest(request.ID())
 }
 
+// pushSubtrees sends the DAGs under roots on a response, after the blocks the
+// selector reaches. The traversal has already succeeded, so a subtree the
+// responder cannot send in full does not fail the request.
+func (rm *ResponseManager) pushSubtrees(ctx context.Context,
+	requestID graphsync.RequestID,
+	roots []cid.Cid,
+	blockLoader ipldbridge.Loader,
+	peerResponseSender peerresponsemanager.PeerResponseSender) {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	spec := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(pushedSubtreeDepth),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	selector, err := rm.ipldBridge.ParseSelector(spec)
+	if err != nil {
+		log.Warningf("Unable to parse selector for pushed subtrees: %s", err)
+		return
+	}
+	wrappedLoader := loader.WrapLoader(blockLoader, requestID, peerResponseSender)
+	if rm.maxResponseDuration > 0 {
+		wrappedLoader = abortOnDone(ctx, wrappedLoader)
+	}
+	for _, root := range roots {
+		err := rm.ipldBridge.Traverse(ctx, wrappedLoader, cidlink.Link{Cid: root}, selector, func(ipldbridge.TraversalProgress, ipld.Node, ipldbridge.TraversalReason) error {
+			return nil
+		})
+		if err != nil {
+			log.Infof("Unable to push subtree %s for request %d: %s", root, requestID, err)
+		}
+	}
+}
+
+// sendByteRange answers a request for a range of bytes within its root block
+// with just those bytes, instead of traversing the selector. A range applies
+// only to the root block, so it is refused with a selector reaching past it.
+func (rm *ResponseManager) sendByteRange(requestID graphsync.RequestID,
+	root ipld.Link,
+	selectorSpec ipld.Node,
+	rangeData []byte,
+	blockLoader ipldbridge.Loader,
+	peerResponseSender peerresponsemanager.PeerResponseSender) {
+	if !byterange.SelectsRootOnly(selectorSpec) {
+		peerResponseSender.FinishWithError(requestID, graphsync.RequestFailedUnknown)
+		return
+	}
+	byteRange, err := byterange.DecodeRequest(rangeData, rm.ipldBridge)
+	if err != nil {
+		peerResponseSender.FinishWithError(requestID, graphsync.RequestFailedUnknown)
+		return
+	}
+	reader, err := blockLoader(root, ipldbridge.LinkContext{})
+	if err != nil {
+		peerResponseSender.FinishWithError(requestID, graphsync.RequestFailedContentNotFound)
+		return
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		peerResponseSender.FinishWithError(requestID, graphsync.RequestFailedUnknown)
+		return
+	}
+	response, err := byterange.Slice(data, byteRange)
+	if err != nil {
+		peerResponseSender.FinishWithError(requestID, graphsync.RequestFailedUnknown)
+		return
+	}
+	responseData, err := byterange.EncodeResponse(response, rm.ipldBridge)
+	if err != nil {
+		peerResponseSender.FinishWithError(requestID, graphsync.RequestFailedUnknown)
+		return
+	}
+	peerResponseSender.SendExtensionData(requestID, graphsync.ExtensionData{
+		Name: graphsync.ExtensionByteRange,
+		Data: responseData,
+	})
+	peerResponseSender.FinishRequest(requestID)
+}
+
+// SetContextLoader loads blocks for each response with a loader given the
+// response's context, rather than the loader the response manager was created
+// with, so a cancelled response aborts a slow load. A load shared by
+// responses through UseBlockCache is made with the context of the response
+// that started it. It must be called before Startup.
+func (rm *ResponseManager) SetContextLoader(loader ipldbridge.ContextLoader) {
+	rm.contextLoader = loader
+}
+
+// SerializeLoadsPerPeer limits each peer to one block load at a time, across
+// all of its requests. It must be called before Startup.
+func (rm *ResponseManager) SerializeLoadsPerPeer() {
+	rm.loadSerializer = loader.NewLoadSerializer()
+}
+
+// UseBlockCache shares blocks loaded for one response with other responses
+// needing them at the same time, keeping up to maxBytes of blocks for up to
+// ttl each. It must be called before Startup.
+func (rm *ResponseManager) UseBlockCache(maxBytes uint64, ttl time.Duration) {
+	rm.blockCache = loader.NewBlockCache(maxBytes, ttl)
+}
+
+// UseResultCache answers a request for a root and selector whose result is
+// in cache by replaying the blocks stored there, skipping the traversal and
+// the loader, and stores the result of each traversal that sends every block
+// it reaches, up to maxBytes of them. Requests with a preferred order, or made
+// with checkpoints or graphsync.RawPassthrough, are always traversed. It must
+// be called before Startup.
+func (rm *ResponseManager) UseResultCache(cache loader.ResultCache, maxBytes uint64) {
+	rm.resultCache = cache
+	rm.maxResultBytes = maxBytes
+}
+
+// SetMaxServedPeers refuses requests from new peers while n distinct peers
+// have responses in progress, finishing them with graphsync.RequestFailedBusy.
+// Peers already being served are unaffected, and a peer's slot frees once its
+// last response finishes or is cancelled. It must be called before Startup.
+func (rm *ResponseManager) SetMaxServedPeers(n int) {
+	rm.maxServedPeers = n
+}
+
+// SetMaxInProcessResponses sets how many responses, across all peers, are
+// worked on at once. The rest wait in the queue. The default is 6. It must be
+// called before Startup.
+func (rm *ResponseManager) SetMaxInProcessResponses(n int) {
+	rm.inProcessWorkers = n
+}
+
+// SetMaxResponseDuration aborts any response still in progress after d,
+// finishing it with graphsync.RequestFailedTimeout. A response is checked
+// before each block it loads, so a single slow load can overrun d. It must be
+// called before Startup.
+func (rm *ResponseManager) SetMaxResponseDuration(d time.Duration) {
+	rm.maxResponseDuration = d
+}
+
+// SetCheckpointStore saves the progress of responses to requests made with
+// graphsync.ExtensionCheckpoint to store, once they start and every interval
+// blocks after, so ResumeCheckpoints can resume them after a restart. It must
+// be called before Startup.
+func (rm *ResponseManager) SetCheckpointStore(store CheckpointStore, interval int) {
+	if interval < 1 {
+		interval = 1
+	}
+	rm.checkpointStore = store
+	rm.checkpointInterval = interval
+	_ = rm.AdvertiseExtension(graphsync.ExtensionCheckpoint)
+}
+
+type resumeCheckpointsMessage struct {
+	checkpoints []Checkpoint
+}
+
+// ResumeCheckpoints queues a response for each checkpoint in the store set
+// with SetCheckpointStore, as though its request had just been received
+// again. The traversal loads the blocks up to the checkpoint again to find
+// its way back to it, but only sends the blocks after it, so the DAG must be
+// unchanged. Blocks a stopped responder had queued but not yet sent are lost.
+func (rm *ResponseManager) ResumeCheckpoints() error {
+	if rm.checkpointStore == nil {
+		return nil
+	}
+	checkpoints, err := rm.checkpointStore.Checkpoints()
+	if err != nil {
+		return err
+	}
+	select {
+	case rm.messages <- &resumeCheckpointsMessage{checkpoints}:
+	case <-rm.ctx.Done():
+	}
+	return nil
+}
+
 // Startup starts processing for the WantManager.
 func (rm *ResponseManager) Startup() {
 	go rm.run()
@@ -267,7 +1013,7 @@ func (rm *ResponseManager) cleanupInProcessResponses() {
 
 func (rm *ResponseManager) run() {
 	defer rm.cleanupInProcessResponses()
-	for i := 0; i < maxInProcessRequests; i++ {
+	for i := 0; i < rm.inProcessWorkers; i++ {
 		go rm.processQueriesWorker()
 	}
 
@@ -284,15 +1030,55 @@ func (rm *ResponseManager) run() {
 func (prm *processRequestMessage) handle(rm *ResponseManager) {
 	for _, request := range prm.requests {
 		key := responseKey{p: prm.p, requestID: request.ID()}
+		if request.IsAck() {
+			rm.processAck(prm.p, request)
+			continue
+		}
+		if _, ok := request.Extension(graphsync.ExtensionSupportedExtensions); ok && !request.IsCancel() {
+			rm.sendSupportedExtensions(prm.p, request)
+			continue
+		}
 		if !request.IsCancel() {
+			if rm.maxServedPeers > 0 && rm.servedPeers[prm.p] == 0 && len(rm.servedPeers) >= rm.maxServedPeers {
+				rm.peerManager.SenderForPeer(prm.p).FinishWithError(request.ID(), graphsync.RequestFailedBusy)
+				continue
+			}
+			if response, ok := rm.inProgressResponses[key]; ok {
+				// a repeated request, most likely reissued by a requestor that
+				// restarted, carries on with the response already in progress
+				if isRepeatedRequest(response.request, request) {
+					continue
+				}
+				// but an ID reused for a different request leaves the
+				// requestor unable to tell the two apart, so both fail with
+				// a single status for the ID. One already executing sends
+				// it as it stops, and one still queued is failed here.
+				response.cancelFn()
+				if response.started {
+					continue
+				}
+				rm.queryQueue.Remove(key, key.p)
+				rm.removeResponse(key)
+				rm.peerManager.SenderForPeer(prm.p).FinishWithError(request.ID(), graphsync.RequestFailedUnknown)
+				continue
+			}
 			ctx, cancelFn := context.WithCancel(rm.ctx)
+			rm.servedPeers[prm.p]++
+			scratch := graphsync.NewRequestScratch()
 			rm.inProgressResponses[key] =
 				inProgressResponseStatus{
 					ctx:      ctx,
 					cancelFn: cancelFn,
 					request:  request,
+					scratch:  scratch,
 				}
+			if len(rm.undeliverableHooks) > 0 {
+				rm.awaitingDelivery[key] = requestWithScratch{request, scratch}
+			}
 			rm.queryQueue.PushBlock(prm.p, peertask.Task{Identifier: key, Priority: int(request.Priority())})
+			for _, queuedHook := range rm.requestQueuedHooks {
+				queuedHook.hook(prm.p, requestWithScratch{request, scratch})
+			}
 			select {
 			case rm.workSignal <- struct{}{}:
 			default:
@@ -301,21 +1087,150 @@ func (prm *processRequestMessage) handle(rm *ResponseManager) {
 			rm.queryQueue.Remove(key, key.p)
 			response, ok := rm.inProgressResponses[key]
 			if ok {
+				// a response removed from the queue is never finished, so
+				// it must stop counting against the peer here
+				rm.removeResponse(key)
 				response.cancelFn()
+				rm.peerManager.SenderForPeer(prm.p).CancelRequest(request.ID())
+				delete(rm.awaitingDelivery, key)
+				rm.runCancelledHooks(prm.p, requestWithScratch{response.request, response.scratch}, request)
 			}
 		}
 	}
 }
 
+// isRepeatedRequest checks whether a request asks for the same root,
+// selector, and extensions as one already in progress with its ID. Nonces
+// differ on every send, so they are not compared.
+func isRepeatedRequest(inProgress gsmsg.GraphSyncRequest, request gsmsg.GraphSyncRequest) bool {
+	if !inProgress.Root().Equals(request.Root()) || !bytes.Equal(inProgress.Selector(), request.Selector()) {
+		return false
+	}
+	// every extension on the request must match, and the in progress request
+	// must have no others
+	unmatched := 0
+	for _, name := range request.ExtensionNames() {
+		if name == graphsync.ExtensionNonce {
+			continue
+		}
+		unmatched++
+		data, _ := request.Extension(name)
+		inProgressData, ok := inProgress.Extension(name)
+		if !ok || !bytes.Equal(data, inProgressData) {
+			return false
+		}
+	}
+	for _, name := range inProgress.ExtensionNames() {
+		if name != graphsync.ExtensionNonce {
+			unmatched--
+		}
+	}
+	return unmatched == 0
+}
+
+// runCancelledHooks tells hooks a request was cancelled, with the reason sent
+// on the cancel, if any
+func (rm *ResponseManager) runCancelledHooks(p peer.ID, request graphsync.RequestData, cancel gsmsg.GraphSyncRequest) {
+	if len(rm.requestCancelledHooks) == 0 {
+		return
+	}
+	reason := graphsync.CancelReason{Code: graphsync.CancelReasonUnknown}
+	if reasonData, ok := cancel.Extension(graphsync.ExtensionCancelReason); ok {
+		decoded, err := cancelreason.DecodeCancelReason(reasonData, rm.ipldBridge)
+		if err != nil {
+			log.Infof("Unable to decode cancel reason from peer %s: %s", p, err)
+		} else {
+			reason = decoded
+		}
+	}
+	for _, cancelledHook := range rm.requestCancelledHooks {
+		cancelledHook.hook(p, request, reason)
+	}
+}
+
+func (rm *ResponseManager) processAck(p peer.ID, request gsmsg.GraphSyncRequest) {
+	ackData, _ := request.Extension(graphsync.ExtensionAck)
+	sequence, err := ack.DecodeInt(ackData, rm.ipldBridge)
+	if err != nil {
+		log.Infof("Unable to decode ack from peer %s: %s", p, err)
+		return
+	}
+	rm.peerManager.SenderForPeer(p).Acknowledge(request.ID(), sequence)
+}
+
 func (rh *requestHook) handle(rm *ResponseManager) {
 	rm.requestHooks = append(rm.requestHooks, *rh)
 }
 
+func (rqh *requestQueuedHook) handle(rm *ResponseManager) {
+	rm.requestQueuedHooks = append(rm.requestQueuedHooks, *rqh)
+}
+
+func (rsh *requestStartedHook) handle(rm *ResponseManager) {
+	rm.requestStartedHooks = append(rm.requestStartedHooks, *rsh)
+}
+
+func (rch *requestCancelledHook) handle(rm *ResponseManager) {
+	rm.requestCancelledHooks = append(rm.requestCancelledHooks, *rch)
+}
+
+func (rch *responseCompletedHook) handle(rm *ResponseManager) {
+	rm.completedHooks = append(rm.completedHooks, *rch)
+}
+
+func (ruh *responseUndeliverableHook) handle(rm *ResponseManager) {
+	rm.undeliverableHooks = append(rm.undeliverableHooks, *ruh)
+}
+
+func (rrm *responsesReportedMessage) handle(rm *ResponseManager) {
+	// a message may hold several responses to the same request, but hooks
+	// run once for each request
+	abandoned := make(map[responseKey]struct{})
+	for _, response := range rrm.responses {
+		key := responseKey{p: rrm.p, requestID: response.RequestID()}
+		request, ok := rm.awaitingDelivery[key]
+		if !ok {
+			continue
+		}
+		if _, ok := abandoned[key]; rrm.err != nil && !ok {
+			abandoned[key] = struct{}{}
+			for _, undeliverableHook := range rm.undeliverableHooks {
+				undeliverableHook.hook(rrm.p, request, rrm.err)
+			}
+		}
+		if gsmsg.IsTerminalResponseCode(response.Status()) {
+			delete(rm.awaitingDelivery, key)
+		}
+	}
+}
+
+func (rcm *resumeCheckpointsMessage) handle(rm *ResponseManager) {
+	for _, checkpoint := range rcm.checkpoints {
+		key := responseKey{p: checkpoint.Peer, requestID: checkpoint.Request.ID()}
+		if _, ok := rm.inProgressResponses[key]; ok {
+			continue
+		}
+		(&processRequestMessage{checkpoint.Peer, []gsmsg.GraphSyncRequest{checkpoint.Request}}).handle(rm)
+		response, ok := rm.inProgressResponses[key]
+		if !ok {
+			continue
+		}
+		resumeFrom := checkpoint
+		response.resumeFrom = &resumeFrom
+		rm.inProgressResponses[key] = response
+	}
+}
+
 func (rdr *responseDataRequest) handle(rm *ResponseManager) {
 	response, ok := rm.inProgressResponses[rdr.key]
 	var taskData *responseTaskData
 	if ok {
-		taskData = &responseTaskData{response.ctx, response.request}
+		response.started = true
+		rm.inProgressResponses[rdr.key] = response
+		taskData = &responseTaskData{response.ctx, response.request, response.scratch, response.resumeFrom}
+		for _, startedHook := range rm.requestStartedHooks {
+			startedHook.hook(rdr.key.p, requestWithScratch{response.request, response.scratch})
+		}
 	} else {
 		taskData = nil
 	}
@@ -330,8 +1245,19 @@ func (frr *finishResponseRequest) handle(rm *ResponseManager) {
 	if !ok {
 		return
 	}
-	delete(rm.inProgressResponses, frr.key)
+	rm.removeResponse(frr.key)
 	response.cancelFn()
+	for _, completedHook := range rm.completedHooks {
+		completedHook.hook(frr.key.p, requestWithScratch{response.request, response.scratch}, frr.stats)
+	}
+}
+
+func (rm *ResponseManager) removeResponse(key responseKey) {
+	delete(rm.inProgressResponses, key)
+	rm.servedPeers[key.p]--
+	if rm.servedPeers[key.p] <= 0 {
+		delete(rm.servedPeers, key.p)
+	}
 }
 
 func (sm *synchronizeMessage) handle(rm *ResponseManager) {
@@ -3,22 +3,31 @@ package responsemanager
 import (
 	"context"
 	"errors"
+	"io"
 	"math"
 	"math/rand"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ack"
+	"github.com/ipfs/go-graphsync/ipldbridge"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/responsemanager/peerresponsemanager"
+	"github.com/ipfs/go-graphsync/responsemanager/selectorvalidator"
 	"github.com/ipfs/go-graphsync/testbridge"
 	"github.com/ipfs/go-graphsync/testutil"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	ipld "github.com/ipld/go-ipld-prime"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -73,12 +82,15 @@ func (fqq *fakeQueryQueue) ThawRound() {
 }
 
 type fakePeerManager struct {
+	lastPeerLk         sync.Mutex
 	lastPeer           peer.ID
 	peerResponseSender peerresponsemanager.PeerResponseSender
 }
 
 func (fpm *fakePeerManager) SenderForPeer(p peer.ID) peerresponsemanager.PeerResponseSender {
+	fpm.lastPeerLk.Lock()
 	fpm.lastPeer = p
+	fpm.lastPeerLk.Unlock()
 	return fpm.peerResponseSender
 }
 
@@ -97,10 +109,17 @@ type completedRequest struct {
 	requestID graphsync.RequestID
 	result    graphsync.ResponseStatusCode
 }
+type ackWindow struct {
+	requestID graphsync.RequestID
+	window    int
+}
+
 type fakePeerResponseSender struct {
 	sentResponses        chan sentResponse
 	sentExtensions       chan sentExtension
 	lastCompletedRequest chan completedRequest
+	ackWindows           chan ackWindow
+	acks                 chan int
 }
 
 func (fprs *fakePeerResponseSender) Startup()  {}
@@ -114,6 +133,15 @@ func (fprs *fakePeerResponseSender) SendResponse(
 	fprs.sentResponses <- sentResponse{requestID, link, data}
 }
 
+func (fprs *fakePeerResponseSender) QueueResponse(
+	requestID graphsync.RequestID,
+	link ipld.Link,
+	data []byte,
+) bool {
+	fprs.SendResponse(requestID, link, data)
+	return data != nil
+}
+
 func (fprs *fakePeerResponseSender) SendExtensionData(
 	requestID graphsync.RequestID,
 	extension graphsync.ExtensionData,
@@ -121,14 +149,44 @@ func (fprs *fakePeerResponseSender) SendExtensionData(
 	fprs.sentExtensions <- sentExtension{requestID, extension}
 }
 
+func (fprs *fakePeerResponseSender) SendPersistentExtensionData(
+	requestID graphsync.RequestID,
+	extension graphsync.ExtensionData,
+) {
+	fprs.sentExtensions <- sentExtension{requestID, extension}
+}
+
 func (fprs *fakePeerResponseSender) FinishRequest(requestID graphsync.RequestID) {
 	fprs.lastCompletedRequest <- completedRequest{requestID, graphsync.RequestCompletedFull}
 }
 
+func (fprs *fakePeerResponseSender) FinishEmptyRequest(requestID graphsync.RequestID) {
+	fprs.lastCompletedRequest <- completedRequest{requestID, graphsync.RequestCompletedEmpty}
+}
+
+func (fprs *fakePeerResponseSender) CancelRequest(requestID graphsync.RequestID) {}
+
 func (fprs *fakePeerResponseSender) FinishWithError(requestID graphsync.RequestID, status graphsync.ResponseStatusCode) {
 	fprs.lastCompletedRequest <- completedRequest{requestID, status}
 }
 
+func (fprs *fakePeerResponseSender) EnableAcknowledgements(requestID graphsync.RequestID, window int) {
+	if fprs.ackWindows != nil {
+		fprs.ackWindows <- ackWindow{requestID, window}
+	}
+}
+
+func (fprs *fakePeerResponseSender) IgnoreBlocks(requestID graphsync.RequestID, links []ipld.Link) {}
+func (fprs *fakePeerResponseSender) QueueStats() peerresponsemanager.QueueStats {
+	return peerresponsemanager.QueueStats{}
+}
+
+func (fprs *fakePeerResponseSender) Acknowledge(requestID graphsync.RequestID, sequence int) {
+	if fprs.acks != nil {
+		fprs.acks <- sequence
+	}
+}
+
 func TestIncomingQuery(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
@@ -185,6 +243,188 @@ func TestIncomingQuery(t *testing.T) {
 	}
 }
 
+func TestIncomingQueryWithRegisteredSelector(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
+	defer cancel()
+	blks := testutil.GenerateBlocksOfSize(5, 20)
+	loader := testbridge.NewMockLoader(blks)
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	requestIDChan := make(chan completedRequest, 1)
+	sentResponses := make(chan sentResponse, len(blks))
+	sentExtensions := make(chan sentExtension, 1)
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses, sentExtensions: sentExtensions}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, loader, ipldBridge, peerManager, queryQueue)
+	responseManager.Startup()
+
+	cids := make([]cid.Cid, 0, 5)
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	selectorName := "all-blocks"
+	err := responseManager.RegisterSelector(selectorName, testbridge.NewMockSelectorSpec(cids))
+	if err != nil {
+		t.Fatal("error registering selector")
+	}
+	err = responseManager.RegisterSelector("invalid", testbridge.NewUnparsableSelectorSpec(cids))
+	if err == nil {
+		t.Fatal("should not register a selector that does not parse")
+	}
+
+	p := testutil.GeneratePeers(1)[0]
+	sendRequest := func(selector []byte, name string) {
+		requestID := graphsync.RequestID(rand.Int31())
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(requestID, cids[0], selector, graphsync.Priority(math.MaxInt32), graphsync.ExtensionData{
+				Name: graphsync.ExtensionSelectorName,
+				Data: []byte(name),
+			}),
+		}
+		responseManager.ProcessRequests(ctx, p, requests)
+		select {
+		case <-ctx.Done():
+			t.Fatal("Should have completed request but didn't")
+		case completed := <-requestIDChan:
+			if completed.result != graphsync.RequestCompletedFull {
+				t.Fatal("should have completed request with selector")
+			}
+		}
+		for i := 0; i < len(blks); i++ {
+			select {
+			case sentResponse := <-sentResponses:
+				if sentResponse.requestID != requestID {
+					t.Fatal("incorrect response id")
+				}
+			case <-ctx.Done():
+				t.Fatal("did not send enough responses")
+			}
+		}
+	}
+
+	// the registered selector is used in place of the undecodable one sent
+	sendRequest(testutil.RandomBytes(100), selectorName)
+
+	// unknown names fall back to the selector sent
+	selector, err := ipldBridge.EncodeNode(testbridge.NewMockSelectorSpec(cids))
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	sendRequest(selector, "unknown")
+}
+
+func TestIncomingQueryMatchingNothing(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
+	defer cancel()
+	blks := testutil.GenerateBlocksOfSize(5, 20)
+	loader := testbridge.NewMockLoader(blks)
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	requestIDChan := make(chan completedRequest, 1)
+	sentResponses := make(chan sentResponse, len(blks))
+	sentExtensions := make(chan sentExtension, 1)
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses, sentExtensions: sentExtensions}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, loader, ipldBridge, peerManager, queryQueue)
+	responseManager.Startup()
+
+	// none of these cids are present in the loader, so nothing will match
+	cids := testutil.GenerateCids(1)
+	selectorSpec := testbridge.NewMockSelectorSpec(cids)
+	selector, err := ipldBridge.EncodeNode(selectorSpec)
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	requests := []gsmsg.GraphSyncRequest{
+		gsmsg.NewRequest(requestID, cids[0], selector, graphsync.Priority(math.MaxInt32)),
+	}
+	p := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(ctx, p, requests)
+	select {
+	case <-ctx.Done():
+		t.Fatal("Should have completed request but didn't")
+	case lastRequest := <-requestIDChan:
+		if lastRequest.requestID != requestID {
+			t.Fatal("completed incorrect request")
+		}
+		if lastRequest.result != graphsync.RequestCompletedEmpty {
+			t.Fatal("should have completed with empty status but didn't")
+		}
+	}
+}
+
+func TestIncomingQueryWithAcks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
+	defer cancel()
+	blks := testutil.GenerateBlocksOfSize(5, 20)
+	loader := testbridge.NewMockLoader(blks)
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	requestIDChan := make(chan completedRequest, 1)
+	sentResponses := make(chan sentResponse, len(blks))
+	sentExtensions := make(chan sentExtension, 1)
+	ackWindows := make(chan ackWindow, 1)
+	acks := make(chan int, 1)
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses, sentExtensions: sentExtensions, ackWindows: ackWindows, acks: acks}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, loader, ipldBridge, peerManager, queryQueue)
+	responseManager.Startup()
+
+	cids := make([]cid.Cid, 0, 5)
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	selectorSpec := testbridge.NewMockSelectorSpec(cids)
+	selector, err := ipldBridge.EncodeNode(selectorSpec)
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	windowData, err := ack.EncodeInt(2, ipldBridge)
+	if err != nil {
+		t.Fatal("error encoding ack window")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	requests := []gsmsg.GraphSyncRequest{
+		gsmsg.NewRequest(requestID, cids[0], selector, graphsync.Priority(math.MaxInt32), graphsync.ExtensionData{
+			Name: graphsync.ExtensionAckWindow,
+			Data: windowData,
+		}),
+	}
+	p := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(ctx, p, requests)
+	select {
+	case <-ctx.Done():
+		t.Fatal("Should have enabled acknowledgements but didn't")
+	case receivedWindow := <-ackWindows:
+		if receivedWindow.requestID != requestID || receivedWindow.window != 2 {
+			t.Fatal("Enabled acknowledgements with incorrect window")
+		}
+	}
+
+	sequenceData, err := ack.EncodeInt(3, ipldBridge)
+	if err != nil {
+		t.Fatal("error encoding ack")
+	}
+	responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{gsmsg.AckRequest(requestID, sequenceData)})
+	select {
+	case <-ctx.Done():
+		t.Fatal("Should have processed ack but didn't")
+	case sequence := <-acks:
+		if sequence != 3 {
+			t.Fatal("Acknowledged incorrect sequence number")
+		}
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("Should have completed request but didn't")
+	case <-requestIDChan:
+	}
+}
+
 func TestCancellationQueryInProgress(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
@@ -327,6 +567,139 @@ func TestEarlyCancellation(t *testing.T) {
 	}
 }
 
+func TestRepeatedRequestID(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
+	defer cancel()
+	blks := testutil.GenerateBlocksOfSize(5, 20)
+	loader := testbridge.NewMockLoader(blks)
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	requestIDChan := make(chan completedRequest, 1)
+	sentResponses := make(chan sentResponse)
+	sentExtensions := make(chan sentExtension, 1)
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses, sentExtensions: sentExtensions}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	queryQueue.popWait.Add(1)
+	responseManager := New(ctx, loader, ipldBridge, peerManager, queryQueue)
+	responseManager.Startup()
+
+	cids := make([]cid.Cid, 0, 5)
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	selectorSpec := testbridge.NewMockSelectorSpec(cids)
+	selector, err := ipldBridge.EncodeNode(selectorSpec)
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	request := gsmsg.NewRequest(requestID, cids[0], selector, graphsync.Priority(math.MaxInt32))
+	p := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{request})
+
+	// an identical request carries on with the one in progress
+	responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{request})
+	responseManager.synchronize()
+	select {
+	case <-requestIDChan:
+		t.Fatal("should not have responded to repeated request")
+	default:
+	}
+
+	// a different request with the same ID fails
+	conflicting := gsmsg.NewRequest(requestID, cids[1], selector, graphsync.Priority(math.MaxInt32))
+	responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{conflicting})
+	select {
+	case <-ctx.Done():
+		t.Fatal("should have failed conflicting request")
+	case completed := <-requestIDChan:
+		if completed.requestID != requestID || completed.result != graphsync.RequestFailedUnknown {
+			t.Fatal("should have failed conflicting request with RequestFailedUnknown")
+		}
+	}
+
+	// and the response in progress is abandoned
+	queryQueue.popWait.Done()
+	select {
+	case <-ctx.Done():
+	case <-sentResponses:
+		t.Fatal("should not send responses for abandoned request")
+	case <-requestIDChan:
+		t.Fatal("should not have completed abandoned request")
+	}
+}
+
+func TestRepeatedRequestIDWhileExecuting(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
+	defer cancel()
+	blks := testutil.GenerateBlocksOfSize(5, 20)
+	mockLoader := testbridge.NewMockLoader(blks)
+	// hold the first load until the conflicting request arrives
+	loading := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var loaded int32
+	loader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		if atomic.AddInt32(&loaded, 1) == 1 {
+			loading <- struct{}{}
+			<-release
+		}
+		return mockLoader(lnk, lnkCtx)
+	}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	requestIDChan := make(chan completedRequest, 2)
+	sentResponses := make(chan sentResponse, len(blks))
+	sentExtensions := make(chan sentExtension, 1)
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses, sentExtensions: sentExtensions}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, loader, ipldBridge, peerManager, queryQueue)
+	responseManager.Startup()
+
+	cids := make([]cid.Cid, 0, 5)
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	selectorSpec := testbridge.NewMockSelectorSpec(cids)
+	selector, err := ipldBridge.EncodeNode(selectorSpec)
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	requestID := graphsync.RequestID(rand.Int31())
+	request := gsmsg.NewRequest(requestID, cids[0], selector, graphsync.Priority(math.MaxInt32))
+	p := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{request})
+	select {
+	case <-ctx.Done():
+		t.Fatal("should have started executing request")
+	case <-loading:
+	}
+
+	// a different request with the same ID stops the one executing, which
+	// sends the only status for the ID. The mock traversal does not fail on
+	// being stopped, so which status that is is not checked.
+	conflicting := gsmsg.NewRequest(requestID, cids[1], selector, graphsync.Priority(math.MaxInt32))
+	responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{conflicting})
+	responseManager.synchronize()
+	close(release)
+	var completed []completedRequest
+	for {
+		select {
+		case <-ctx.Done():
+			if len(completed) != 1 || completed[0].requestID != requestID {
+				t.Fatalf("should have sent exactly one status for the ID, got %d", len(completed))
+			}
+			if atomic.LoadInt32(&loaded) == int32(len(blks)) {
+				t.Fatal("should have stopped the response executing")
+			}
+			return
+		case c := <-requestIDChan:
+			completed = append(completed, c)
+		}
+	}
+}
+
 func TestValidationAndExtensions(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 40*time.Millisecond)
@@ -489,3 +862,399 @@ func TestValidationAndExtensions(t *testing.T) {
 		})
 	})
 }
+
+func TestSerializeLoadsPerPeer(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+	requestsPerPeer := 3
+	blocksPerRequest := 5
+
+	// give each peer's requests their own blocks, so loads can be attributed
+	blockPeers := make(map[cid.Cid]peer.ID)
+	var blks []blocks.Block
+	requestsForPeer := make(map[peer.ID][]gsmsg.GraphSyncRequest)
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	for _, p := range peers {
+		for i := 0; i < requestsPerPeer; i++ {
+			requestBlks := testutil.GenerateBlocksOfSize(blocksPerRequest, 20)
+			cids := make([]cid.Cid, 0, blocksPerRequest)
+			for _, block := range requestBlks {
+				cids = append(cids, block.Cid())
+				blockPeers[block.Cid()] = p
+			}
+			blks = append(blks, requestBlks...)
+			selector, err := ipldBridge.EncodeNode(testbridge.NewMockSelectorSpec(cids))
+			if err != nil {
+				t.Fatal("error encoding selector")
+			}
+			requestsForPeer[p] = append(requestsForPeer[p], gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), cids[0], selector, graphsync.Priority(math.MaxInt32)))
+		}
+	}
+
+	// record the most loads ever in progress at once for each peer
+	mockLoader := testbridge.NewMockLoader(blks)
+	var loadsLk sync.Mutex
+	activeLoads := make(map[peer.ID]int)
+	maxActiveLoads := make(map[peer.ID]int)
+	recordingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		p := blockPeers[lnk.(cidlink.Link).Cid]
+		loadsLk.Lock()
+		activeLoads[p]++
+		if activeLoads[p] > maxActiveLoads[p] {
+			maxActiveLoads[p] = activeLoads[p]
+		}
+		loadsLk.Unlock()
+		time.Sleep(time.Millisecond)
+		loadsLk.Lock()
+		activeLoads[p]--
+		loadsLk.Unlock()
+		return mockLoader(lnk, lnkCtx)
+	}
+
+	totalRequests := len(peers) * requestsPerPeer
+	requestIDChan := make(chan completedRequest, totalRequests)
+	sentResponses := make(chan sentResponse, len(blks))
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, recordingLoader, ipldBridge, peerManager, queryQueue)
+	responseManager.SerializeLoadsPerPeer()
+	responseManager.Startup()
+
+	for _, p := range peers {
+		responseManager.ProcessRequests(ctx, p, requestsForPeer[p])
+	}
+	for i := 0; i < totalRequests; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Should have completed requests but didn't")
+		case completed := <-requestIDChan:
+			if completed.result != graphsync.RequestCompletedFull {
+				t.Fatal("request failed")
+			}
+		}
+	}
+	if len(sentResponses) != len(blks) {
+		t.Fatal("did not send all blocks")
+	}
+	for _, p := range peers {
+		if maxActiveLoads[p] != 1 {
+			t.Fatal("loads for a single peer overlapped")
+		}
+	}
+}
+
+func TestMaxServedPeers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(3)
+	blks := testutil.GenerateBlocksOfSize(5, 20)
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	cids := make([]cid.Cid, 0, len(blks))
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	selector, err := ipldBridge.EncodeNode(testbridge.NewMockSelectorSpec(cids))
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	newRequest := func() gsmsg.GraphSyncRequest {
+		return gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), blks[0].Cid(), selector, graphsync.Priority(math.MaxInt32))
+	}
+
+	// hold every response in progress until released
+	release := make(chan struct{})
+	mockLoader := testbridge.NewMockLoader(blks)
+	blockingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return mockLoader(lnk, lnkCtx)
+	}
+
+	requestIDChan := make(chan completedRequest, 5)
+	sentResponses := make(chan sentResponse, 5*len(blks))
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, blockingLoader, ipldBridge, peerManager, queryQueue)
+	responseManager.SetMaxServedPeers(2)
+	responseManager.Startup()
+
+	responseManager.ProcessRequests(ctx, peers[0], []gsmsg.GraphSyncRequest{newRequest()})
+	responseManager.ProcessRequests(ctx, peers[1], []gsmsg.GraphSyncRequest{newRequest()})
+	rejectedRequest := newRequest()
+	responseManager.ProcessRequests(ctx, peers[2], []gsmsg.GraphSyncRequest{rejectedRequest})
+	select {
+	case <-ctx.Done():
+		t.Fatal("Should have rejected request from third peer but didn't")
+	case completed := <-requestIDChan:
+		if completed.requestID != rejectedRequest.ID() || completed.result != graphsync.RequestFailedBusy {
+			t.Fatal("should have rejected request from third peer as busy")
+		}
+	}
+
+	// peers already being served can make more requests
+	responseManager.ProcessRequests(ctx, peers[0], []gsmsg.GraphSyncRequest{newRequest()})
+	responseManager.synchronize()
+	select {
+	case completed := <-requestIDChan:
+		t.Fatalf("should not have finished request early, got status %d", completed.result)
+	default:
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Should have completed requests but didn't")
+		case completed := <-requestIDChan:
+			if completed.result != graphsync.RequestCompletedFull {
+				t.Fatal("request failed")
+			}
+		}
+	}
+
+	// once earlier peers are done, the third peer can be served. Responses
+	// finish just after their last message is sent, so retry while busy.
+	for {
+		responseManager.ProcessRequests(ctx, peers[2], []gsmsg.GraphSyncRequest{newRequest()})
+		var completed completedRequest
+		select {
+		case <-ctx.Done():
+			t.Fatal("should have served third peer once a slot was free")
+		case completed = <-requestIDChan:
+		}
+		if completed.result == graphsync.RequestCompletedFull {
+			break
+		}
+		if completed.result != graphsync.RequestFailedBusy {
+			t.Fatal("request failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequestQueuedAndStartedHooks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	blks := testutil.GenerateBlocksOfSize(1, 20)
+
+	// block every traversal until released, so requests beyond the in
+	// process limit stay queued
+	release := make(chan struct{})
+	mockLoader := testbridge.NewMockLoader(blks)
+	blockingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return mockLoader(lnk, lnkCtx)
+	}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	totalRequests := maxInProcessRequests + 2
+	requestIDChan := make(chan completedRequest, totalRequests)
+	sentResponses := make(chan sentResponse, totalRequests)
+	fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses}
+	peerManager := &fakePeerManager{peerResponseSender: fprs}
+	queryQueue := &fakeQueryQueue{}
+	responseManager := New(ctx, blockingLoader, ipldBridge, peerManager, queryQueue)
+	responseManager.Startup()
+
+	type hookEvent struct {
+		started   bool
+		p         peer.ID
+		requestID graphsync.RequestID
+	}
+	hookEvents := make(chan hookEvent, totalRequests*2)
+	responseManager.RegisterQueuedHook(func(p peer.ID, request graphsync.RequestData) {
+		hookEvents <- hookEvent{false, p, request.ID()}
+	})
+	responseManager.RegisterStartedHook(func(p peer.ID, request graphsync.RequestData) {
+		hookEvents <- hookEvent{true, p, request.ID()}
+	})
+
+	selector, err := ipldBridge.EncodeNode(testbridge.NewMockSelectorSpec([]cid.Cid{blks[0].Cid()}))
+	if err != nil {
+		t.Fatal("error encoding selector")
+	}
+	requests := make([]gsmsg.GraphSyncRequest, 0, totalRequests)
+	for i := 0; i < totalRequests; i++ {
+		requests = append(requests, gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), blks[0].Cid(), selector, graphsync.Priority(math.MaxInt32)))
+	}
+	p := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(ctx, p, requests)
+
+	queued := make(map[graphsync.RequestID]bool)
+	started := make(map[graphsync.RequestID]bool)
+	readEvents := func(count int) {
+		for i := 0; i < count; i++ {
+			select {
+			case <-ctx.Done():
+				t.Fatal("hooks did not fire")
+			case event := <-hookEvents:
+				if event.p != p {
+					t.Fatal("hook received wrong peer")
+				}
+				if event.started {
+					if !queued[event.requestID] || started[event.requestID] {
+						t.Fatal("request should start once, after being queued")
+					}
+					started[event.requestID] = true
+				} else {
+					if queued[event.requestID] {
+						t.Fatal("request should only be queued once")
+					}
+					queued[event.requestID] = true
+				}
+			}
+		}
+	}
+
+	// every request is queued, but only as many as the limit start
+	readEvents(totalRequests + maxInProcessRequests)
+	if len(queued) != totalRequests || len(started) != maxInProcessRequests {
+		t.Fatal("should start only as many requests as the in process limit")
+	}
+	select {
+	case <-hookEvents:
+		t.Fatal("should not start requests beyond the in process limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the rest start as the first finish
+	close(release)
+	readEvents(totalRequests - maxInProcessRequests)
+	if len(started) != totalRequests {
+		t.Fatal("should start all requests")
+	}
+}
+
+func TestSelectorHasMatcher(t *testing.T) {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	exploreOnly := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(10),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if selectorHasMatcher(exploreOnly) {
+		t.Fatal("explore only selector should not have matcher")
+	}
+	withMatcher := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Parents", ssb.ExploreIndex(0, ssb.Matcher()))
+	}).Node()
+	if !selectorHasMatcher(withMatcher) {
+		t.Fatal("should have found nested matcher")
+	}
+}
+
+func BenchmarkSelectorFromRequest(b *testing.B) {
+	ipldBridge := ipldbridge.NewIPLDBridge()
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	selectorSpec := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(100),
+		ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Parents", ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+			efsb.Insert("Messages", ssb.ExploreAll(ssb.Matcher()))
+		})).Node()
+	selector, err := ipldBridge.EncodeNode(selectorSpec)
+	if err != nil {
+		b.Fatal("error encoding selector")
+	}
+	responseManager := New(context.Background(), nil, ipldBridge, &fakePeerManager{}, &fakeQueryQueue{})
+	err = responseManager.RegisterSelector("chain", selectorSpec)
+	if err != nil {
+		b.Fatal("error registering selector")
+	}
+	root := testutil.GenerateCids(1)[0]
+	request := gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), root, selector, graphsync.Priority(math.MaxInt32), graphsync.ExtensionData{
+		Name: graphsync.ExtensionSelectorName,
+		Data: []byte("chain"),
+	})
+
+	b.Run("decode, validate, and parse", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			spec, err := ipldBridge.DecodeNode(request.Selector())
+			if err != nil {
+				b.Fatal("error decoding selector")
+			}
+			err = selectorvalidator.ValidateSelector(ipldBridge, spec, maxRecursionDepth)
+			if err != nil {
+				b.Fatal("error validating selector")
+			}
+			_, err = ipldBridge.ParseSelector(spec)
+			if err != nil {
+				b.Fatal("error parsing selector")
+			}
+		}
+	})
+	b.Run("registered", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok := responseManager.lookupSelector(request); !ok {
+				b.Fatal("registered selector not found")
+			}
+		}
+	})
+}
+
+func BenchmarkConcurrentIdenticalRequests(b *testing.B) {
+	blks := testutil.GenerateBlocksOfSize(20, 100)
+	cids := make([]cid.Cid, 0, len(blks))
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	ipldBridge := testbridge.NewMockIPLDBridge()
+	selector, err := ipldBridge.EncodeNode(testbridge.NewMockSelectorSpec(cids))
+	if err != nil {
+		b.Fatal("error encoding selector")
+	}
+	// a slow store that serves one read at a time, like a single disk
+	mockLoader := testbridge.NewMockLoader(blks)
+	var storeLk sync.Mutex
+	var loads int
+	slowLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		storeLk.Lock()
+		defer storeLk.Unlock()
+		loads++
+		time.Sleep(100 * time.Microsecond)
+		return mockLoader(lnk, lnkCtx)
+	}
+	peers := testutil.GeneratePeers(2)
+
+	// a fresh responder each time, so the cache only helps the two requests
+	// running together
+	run := func(b *testing.B, useCache bool) {
+		loads = 0
+		for i := 0; i < b.N; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			requestIDChan := make(chan completedRequest, len(peers))
+			sentResponses := make(chan sentResponse, len(peers)*len(blks))
+			fprs := &fakePeerResponseSender{lastCompletedRequest: requestIDChan, sentResponses: sentResponses}
+			peerManager := &fakePeerManager{peerResponseSender: fprs}
+			responseManager := New(ctx, slowLoader, ipldBridge, peerManager, &fakeQueryQueue{})
+			if useCache {
+				responseManager.UseBlockCache(uint64(len(blks)*100), time.Second)
+			}
+			responseManager.Startup()
+			for _, p := range peers {
+				request := gsmsg.NewRequest(graphsync.RequestID(rand.Int31()), cids[0], selector, graphsync.Priority(math.MaxInt32))
+				responseManager.ProcessRequests(ctx, p, []gsmsg.GraphSyncRequest{request})
+			}
+			for range peers {
+				completed := <-requestIDChan
+				if completed.result != graphsync.RequestCompletedFull {
+					b.Fatal("request failed")
+				}
+			}
+			cancel()
+		}
+		b.Logf("%d loads for %d iterations", loads, b.N)
+	}
+	b.Run("no cache", func(b *testing.B) {
+		run(b, false)
+	})
+	b.Run("shared cache", func(b *testing.B) {
+		run(b, true)
+	})
+}
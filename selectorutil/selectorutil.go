@@ -0,0 +1,225 @@
+package selectorutil
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+)
+
+// fieldSubtreeDepth is how deep FieldsSelector follows each field, the
+// deepest recursion responders accept by default
+const fieldSubtreeDepth = 100
+
+// ErrUnboundedSelector means a selector on an incoming request was rejected
+// because its traversal depth is not bounded by the selector itself
+var ErrUnboundedSelector = errors.New("selector traversal is unbounded")
+
+// FieldsSelector returns a selector spec that matches only the named fields
+// of the root node, along with everything beneath them, including the blocks
+// they link to. Other fields of the root are not traversed, so their blocks
+// are not sent. Each field is followed at most 100 levels deep, so the
+// selector passes default responder validation.
+func FieldsSelector(fields ...string) ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		for _, field := range fields {
+			efsb.Insert(field, ssb.ExploreRecursive(selector.RecursionLimitDepth(fieldSubtreeDepth),
+				ssb.ExploreUnion(ssb.Matcher(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))))
+		}
+	}).Node()
+}
+
+// UnionSelector returns a selector spec that traverses everything any of the
+// given selector specs would
+func UnionSelector(specs ...ipld.Node) ipld.Node {
+	nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+	return nb.CreateMap(func(mb fluent.MapBuilder, knb fluent.NodeBuilder, vnb fluent.NodeBuilder) {
+		mb.Insert(knb.CreateString(selector.SelectorKey_ExploreUnion), vnb.CreateList(func(lb fluent.ListBuilder, vnb fluent.NodeBuilder) {
+			for _, spec := range specs {
+				lb.Append(spec)
+			}
+		}))
+	})
+}
+
+// LocalVisit traverses root with the selector spec using only the given
+// loader, such as one for the local store, and returns the CIDs of the blocks
+// the traversal visits, in the order it first loads them. A block the loader
+// cannot load does not fail the visit, but the traversal cannot go on past
+// it, so it stops there and the block's CID is returned as missing.
+func LocalVisit(ctx context.Context, bridge ipldbridge.IPLDBridge, loader ipldbridge.Loader, root ipld.Link, selectorSpec ipld.Node) (visited []cid.Cid, missing []cid.Cid, err error) {
+	selector, err := bridge.ParseSelector(selectorSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := cid.NewSet()
+	recordingLoader := func(lnk ipld.Link, lnkCtx ipldbridge.LinkContext) (io.Reader, error) {
+		c, err := ipldbridge.LinkCid(lnk)
+		if err != nil {
+			return nil, err
+		}
+		result, err := loader(lnk, lnkCtx)
+		if err != nil {
+			missing = append(missing, c)
+			return nil, ipldbridge.ErrDoNotFollow()
+		}
+		if seen.Visit(c) {
+			visited = append(visited, c)
+		}
+		return result, nil
+	}
+	err = bridge.Traverse(ctx, recordingLoader, root, selector, func(ipldbridge.TraversalProgress, ipld.Node, ipldbridge.TraversalReason) error {
+		return nil
+	})
+	if err != nil && len(missing) == 0 {
+		return nil, nil, err
+	}
+	return visited, missing, nil
+}
+
+// IsBounded returns true if the given selector spec limits how deep any
+// traversal with it can go -- that is, every recursive selector in it either
+// has a depth limit or can never reach its recursive edge. Selectors that
+// cannot be read as a selector spec are not considered bounded.
+//
+// An unbounded selector is not necessarily a problem: walking an entire
+// chain of unknown length, for example, requires one.
+func IsBounded(node ipld.Node) bool {
+	unbounded, err := isUnbounded(node)
+	return err == nil && !unbounded
+}
+
+func isUnbounded(node ipld.Node) (bool, error) {
+	key, body, err := selectorClause(node)
+	if err != nil {
+		return false, err
+	}
+	children, err := selectorChildren(key, body)
+	if err != nil {
+		return false, err
+	}
+	if key == selector.SelectorKey_ExploreRecursive {
+		limit, err := body.LookupString(selector.SelectorKey_Limit)
+		if err != nil {
+			return false, err
+		}
+		_, err = limit.LookupString(selector.SelectorKey_LimitNone)
+		if err == nil {
+			recurses, err := reachesRecursiveEdge(children[0])
+			if err != nil || recurses {
+				return recurses, err
+			}
+		}
+	}
+	for _, child := range children {
+		unbounded, err := isUnbounded(child)
+		if err != nil || unbounded {
+			return unbounded, err
+		}
+	}
+	return false, nil
+}
+
+// reachesRecursiveEdge returns true if the sequence of a recursive selector
+// contains the edge that recurses back to it. Edges inside nested recursive
+// selectors belong to those selectors, and are not followed.
+func reachesRecursiveEdge(node ipld.Node) (bool, error) {
+	key, body, err := selectorClause(node)
+	if err != nil {
+		return false, err
+	}
+	switch key {
+	case selector.SelectorKey_ExploreRecursiveEdge:
+		return true, nil
+	case selector.SelectorKey_ExploreRecursive:
+		return false, nil
+	}
+	children, err := selectorChildren(key, body)
+	if err != nil {
+		return false, err
+	}
+	for _, child := range children {
+		recurses, err := reachesRecursiveEdge(child)
+		if err != nil || recurses {
+			return recurses, err
+		}
+	}
+	return false, nil
+}
+
+// selectorClause splits a selector spec node into its single key, naming the
+// selector type, and the body of the selector
+func selectorClause(node ipld.Node) (string, ipld.Node, error) {
+	if node.ReprKind() != ipld.ReprKind_Map || node.Length() != 1 {
+		return "", nil, errors.New("selector spec must be a map with a single key")
+	}
+	key, body, err := node.MapIterator().Next()
+	if err != nil {
+		return "", nil, err
+	}
+	keyString, err := key.AsString()
+	if err != nil {
+		return "", nil, err
+	}
+	return keyString, body, nil
+}
+
+// selectorChildren returns the selector specs nested in the body of a
+// selector of the given type
+func selectorChildren(key string, body ipld.Node) ([]ipld.Node, error) {
+	switch key {
+	case selector.SelectorKey_ExploreAll,
+		selector.SelectorKey_ExploreIndex,
+		selector.SelectorKey_ExploreRange,
+		selector.SelectorKey_ExploreConditional:
+		next, err := body.LookupString(selector.SelectorKey_Next)
+		if err != nil {
+			return nil, err
+		}
+		return []ipld.Node{next}, nil
+	case selector.SelectorKey_ExploreRecursive:
+		sequence, err := body.LookupString(selector.SelectorKey_Sequence)
+		if err != nil {
+			return nil, err
+		}
+		return []ipld.Node{sequence}, nil
+	case selector.SelectorKey_ExploreFields:
+		fields, err := body.LookupString(selector.SelectorKey_Fields)
+		if err != nil {
+			return nil, err
+		}
+		var children []ipld.Node
+		iterator := fields.MapIterator()
+		for !iterator.Done() {
+			_, child, err := iterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child)
+		}
+		return children, nil
+	case selector.SelectorKey_ExploreUnion:
+		var children []ipld.Node
+		iterator := body.ListIterator()
+		for !iterator.Done() {
+			_, child, err := iterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child)
+		}
+		return children, nil
+	case selector.SelectorKey_Matcher, selector.SelectorKey_ExploreRecursiveEdge:
+		return nil, nil
+	default:
+		return nil, errors.New("unknown selector type")
+	}
+}
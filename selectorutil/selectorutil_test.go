@@ -0,0 +1,184 @@
+package selectorutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/testbridge"
+	"github.com/ipfs/go-graphsync/testutil"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestIsBounded(t *testing.T) {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+
+	depthLimited := ssb.ExploreRecursive(selector.RecursionLimitDepth(100),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if !IsBounded(depthLimited) {
+		t.Fatal("depth limited selector should be bounded")
+	}
+
+	unlimited := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	if IsBounded(unlimited) {
+		t.Fatal("unlimited selector with recursive edge should be unbounded")
+	}
+
+	unlimitedFields := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Parents", ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+		})).Node()
+	if IsBounded(unlimitedFields) {
+		t.Fatal("unlimited selector with recursive edge under a field should be unbounded")
+	}
+
+	neverRecurses := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.Matcher())).Node()
+	if !IsBounded(neverRecurses) {
+		t.Fatal("unlimited selector without recursive edge should be bounded")
+	}
+
+	nestedUnlimited := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
+		ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Self", ssb.ExploreRecursiveEdge())
+			efsb.Insert("Children", ssb.ExploreRecursive(selector.RecursionLimitNone(),
+				ssb.ExploreAll(ssb.ExploreRecursiveEdge())))
+		})).Node()
+	if IsBounded(nestedUnlimited) {
+		t.Fatal("depth limited selector containing unlimited recursion should be unbounded")
+	}
+
+	nestedLimited := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Children", ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
+				ssb.ExploreAll(ssb.ExploreRecursiveEdge())))
+		})).Node()
+	if !IsBounded(nestedLimited) {
+		t.Fatal("unlimited selector should be bounded if only a nested, limited recursion has an edge")
+	}
+
+	notASelector := ipldfree.String("not a selector")
+	if IsBounded(notASelector) {
+		t.Fatal("invalid selector spec should not be bounded")
+	}
+}
+
+func TestFieldsSelector(t *testing.T) {
+	spec := FieldsSelector("Messages", "Timestamp")
+	if !IsBounded(spec) {
+		t.Fatal("fields selector should be bounded")
+	}
+	_, err := selector.ParseSelector(spec)
+	if err != nil {
+		t.Fatal("fields selector should parse")
+	}
+	fields, err := spec.LookupString(selector.SelectorKey_ExploreFields)
+	if err != nil {
+		t.Fatal("fields selector should explore fields")
+	}
+	fieldSpecs, err := fields.LookupString(selector.SelectorKey_Fields)
+	if err != nil || fieldSpecs.Length() != 2 {
+		t.Fatal("fields selector should explore each named field")
+	}
+	_, err = fieldSpecs.LookupString("Parents")
+	if err == nil {
+		t.Fatal("fields selector should not explore other fields")
+	}
+}
+
+func TestUnionSelector(t *testing.T) {
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	bounded := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	unbounded := ssb.ExploreRecursive(selector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	spec := UnionSelector(bounded, FieldsSelector("Messages"))
+	_, err := selector.ParseSelector(spec)
+	if err != nil {
+		t.Fatal("union selector should parse")
+	}
+	members, err := spec.LookupString(selector.SelectorKey_ExploreUnion)
+	if err != nil || members.Length() != 2 {
+		t.Fatal("union selector should explore each member")
+	}
+	if !IsBounded(spec) {
+		t.Fatal("union of bounded selectors should be bounded")
+	}
+	if IsBounded(UnionSelector(bounded, unbounded)) {
+		t.Fatal("union containing an unbounded selector should be unbounded")
+	}
+}
+
+func TestLocalVisit(t *testing.T) {
+	ctx := context.Background()
+	bridge := ipldbridge.NewIPLDBridge()
+	store := make(map[ipld.Link][]byte)
+	loader, storer := testbridge.NewMockStore(store)
+
+	// a block chain, each block linking to the one before it under Parents
+	blockChainLength := 10
+	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
+	nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+	var links []ipld.Link
+	for i := 0; i < blockChainLength; i++ {
+		parents := links
+		if len(parents) > 0 {
+			parents = parents[len(parents)-1:]
+		}
+		node := nb.CreateMap(func(mb fluent.MapBuilder, knb fluent.NodeBuilder, vnb fluent.NodeBuilder) {
+			mb.Insert(knb.CreateString("Parents"), vnb.CreateList(func(lb fluent.ListBuilder, vnb fluent.NodeBuilder) {
+				for _, parent := range parents {
+					lb.Append(vnb.CreateLink(parent))
+				}
+			}))
+			mb.Insert(knb.CreateString("Messages"), vnb.CreateBytes(testutil.RandomBytes(100)))
+		})
+		link, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, node, storer)
+		if err != nil {
+			t.Fatal("error storing block")
+		}
+		links = append(links, link)
+	}
+	tip := links[len(links)-1]
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	spec := ssb.ExploreRecursive(selector.RecursionLimitDepth(blockChainLength),
+		ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Parents", ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+		})).Node()
+
+	visited, missing, err := LocalVisit(ctx, bridge, loader, tip, spec)
+	if err != nil {
+		t.Fatal("error visiting a complete chain")
+	}
+	if len(missing) != 0 || len(visited) != blockChainLength {
+		t.Fatal("did not visit the whole chain")
+	}
+	for i, c := range visited {
+		if c != links[blockChainLength-1-i].(cidlink.Link).Cid {
+			t.Fatal("did not visit blocks in traversal order")
+		}
+	}
+
+	// the traversal stops at a missing block, and reports it
+	missingLink := links[blockChainLength/2]
+	delete(store, missingLink)
+	visited, missing, err = LocalVisit(ctx, bridge, loader, tip, spec)
+	if err != nil {
+		t.Fatal("a missing block should not fail the visit")
+	}
+	if len(visited) != blockChainLength/2-1 {
+		t.Fatal("visited blocks beyond the missing block")
+	}
+	if len(missing) != 1 || missing[0] != missingLink.(cidlink.Link).Cid {
+		t.Fatal("did not report the missing block")
+	}
+}
@@ -0,0 +1,274 @@
+package storeutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	ipld "github.com/ipld/go-ipld-prime"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	carV2HeaderSize = 40
+	// offsets within the CARv2 header, after the characteristics bitfield
+	carV2DataOffsetPos  = 16
+	carV2IndexOffsetPos = 32
+
+	indexSortedCodec          = 0x0400
+	multihashIndexSortedCodec = 0x0401
+	indexRecordOffsetSize     = 8
+)
+
+// carV2Pragma is the fixed prefix identifying a CARv2 file: a CARv1 style
+// header reading {version: 2}
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+var (
+	// ErrBlockNotFound means a block was requested that is not in the CAR
+	ErrBlockNotFound = errors.New("block not found in CAR")
+	// ErrCARClosed means a block was requested after the CAR was closed
+	ErrCARClosed = errors.New("CAR is closed")
+)
+
+type carV2Reader struct {
+	lk      sync.RWMutex
+	mapped  []byte
+	release func([]byte) error
+	data    []byte
+	// section offsets by multihash code, then digest. IndexSorted indexes do
+	// not record the hash function, so they are stored under anyHashCode
+	offsets map[uint64]map[string][]uint64
+}
+
+const anyHashCode = ^uint64(0)
+
+// LoaderForCARv2 returns an IPLD Loader function compatible with graphsync
+// that serves blocks from an indexed CARv2 file, without importing it. The
+// file is memory mapped and blocks are found through its index, so the CAR
+// must have been written with one. Loading a block that is not in the CAR
+// returns ErrBlockNotFound.
+//
+// The index is read into a hash table when the CAR is opened, so each load
+// takes constant time, at the cost of opening taking time and memory in
+// proportion to the number of blocks.
+//
+// The returned Closer unmaps the file. Loads after it is called fail with
+// ErrCARClosed; readers already returned by the loader remain valid.
+func LoaderForCARv2(path string) (ipld.Loader, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	mapped, release, err := mapFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &carV2Reader{mapped: mapped, release: release}
+	err = cr.readIndex()
+	if err != nil {
+		_ = release(mapped)
+		return nil, nil, err
+	}
+	return cr.load, cr, nil
+}
+
+func (cr *carV2Reader) readIndex() error {
+	if len(cr.mapped) < len(carV2Pragma)+carV2HeaderSize || !bytes.HasPrefix(cr.mapped, carV2Pragma) {
+		return errors.New("not a CARv2 file")
+	}
+	header := cr.mapped[len(carV2Pragma):]
+	dataOffset := binary.LittleEndian.Uint64(header[carV2DataOffsetPos:])
+	dataSize := binary.LittleEndian.Uint64(header[carV2DataOffsetPos+8:])
+	indexOffset := binary.LittleEndian.Uint64(header[carV2IndexOffsetPos:])
+	if dataOffset > uint64(len(cr.mapped)) || dataSize > uint64(len(cr.mapped))-dataOffset {
+		return errors.New("CARv2 data payload out of range")
+	}
+	if indexOffset == 0 {
+		return errors.New("CARv2 has no index")
+	}
+	if indexOffset > uint64(len(cr.mapped)) {
+		return errors.New("CARv2 index out of range")
+	}
+	cr.data = cr.mapped[dataOffset : dataOffset+dataSize]
+
+	index := cr.mapped[indexOffset:]
+	codec, n := binary.Uvarint(index)
+	if n <= 0 {
+		return errors.New("malformed CARv2 index")
+	}
+	index = index[n:]
+	cr.offsets = make(map[uint64]map[string][]uint64)
+	switch codec {
+	case indexSortedCodec:
+		offsets, _, err := readMultiWidthIndex(index)
+		if err != nil {
+			return err
+		}
+		cr.offsets[anyHashCode] = offsets
+	case multihashIndexSortedCodec:
+		count, index, err := readUint32(index)
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < count; i++ {
+			var code uint64
+			code, index, err = readUint64(index)
+			if err != nil {
+				return err
+			}
+			cr.offsets[code], index, err = readMultiWidthIndex(index)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported CARv2 index codec 0x%x", codec)
+	}
+	return nil
+}
+
+// readMultiWidthIndex reads runs of index records of the same width, each a
+// multihash digest followed by the offset of its section in the CARv1 data,
+// into section offsets by digest
+func readMultiWidthIndex(index []byte) (map[string][]uint64, []byte, error) {
+	count, index, err := readUint32(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	offsets := make(map[string][]uint64)
+	for i := uint32(0); i < count; i++ {
+		var width uint32
+		width, index, err = readUint32(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		var size uint64
+		size, index, err = readUint64(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		if width <= indexRecordOffsetSize || size > uint64(len(index)) || size%uint64(width) != 0 {
+			return nil, nil, errors.New("malformed CARv2 index")
+		}
+		for records := index[:size]; len(records) > 0; records = records[width:] {
+			digest := string(records[:width-indexRecordOffsetSize])
+			offset := binary.LittleEndian.Uint64(records[width-indexRecordOffsetSize:])
+			offsets[digest] = append(offsets[digest], offset)
+		}
+		index = index[size:]
+	}
+	return offsets, index, nil
+}
+
+func readUint32(buf []byte) (uint32, []byte, error) {
+	if len(buf) < 4 {
+		return 0, nil, errors.New("malformed CARv2 index")
+	}
+	return binary.LittleEndian.Uint32(buf), buf[4:], nil
+}
+
+func readUint64(buf []byte) (uint64, []byte, error) {
+	if len(buf) < 8 {
+		return 0, nil, errors.New("malformed CARv2 index")
+	}
+	return binary.LittleEndian.Uint64(buf), buf[8:], nil
+}
+
+func (cr *carV2Reader) load(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
+	c, err := ipldbridge.LinkCid(lnk)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil {
+		return nil, err
+	}
+	cr.lk.RLock()
+	defer cr.lk.RUnlock()
+	if cr.mapped == nil {
+		return nil, ErrCARClosed
+	}
+	offsets, ok := cr.offsets[decoded.Code]
+	if !ok {
+		offsets = cr.offsets[anyHashCode]
+	}
+	// an IndexSorted index can hold the same digest under different hash
+	// functions, so check each candidate section's multihash
+	for _, offset := range offsets[string(decoded.Digest)] {
+		sectionCid, data, err := cr.readSection(offset)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(sectionCid.Hash(), c.Hash()) {
+			return bytes.NewReader(append([]byte(nil), data...)), nil
+		}
+	}
+	return nil, ErrBlockNotFound
+}
+
+// readSection reads the CID and block data of the section at the given
+// offset in the CARv1 data payload
+func (cr *carV2Reader) readSection(offset uint64) (cid.Cid, []byte, error) {
+	if offset >= uint64(len(cr.data)) {
+		return cid.Undef, nil, errors.New("CARv2 index offset out of range")
+	}
+	section := cr.data[offset:]
+	length, n := binary.Uvarint(section)
+	if n <= 0 || length > uint64(len(section)-n) {
+		return cid.Undef, nil, errors.New("malformed CAR section")
+	}
+	section = section[n : uint64(n)+length]
+	cidLength, err := cidByteLength(section)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	c, err := cid.Cast(section[:cidLength])
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	return c, section[cidLength:], nil
+}
+
+// cidByteLength returns the length of the binary CID at the start of buf
+func cidByteLength(buf []byte) (int, error) {
+	// CIDv0 is a bare sha2-256 multihash
+	if len(buf) >= 34 && buf[0] == mh.SHA2_256 && buf[1] == 32 {
+		return 34, nil
+	}
+	read := 0
+	// version, codec, hash function and digest length
+	var digestLength uint64
+	for i := 0; i < 4; i++ {
+		value, n := binary.Uvarint(buf[read:])
+		if n <= 0 {
+			return 0, errors.New("malformed CID in CAR section")
+		}
+		read += n
+		digestLength = value
+	}
+	if digestLength > uint64(len(buf)-read) {
+		return 0, errors.New("malformed CID in CAR section")
+	}
+	return read + int(digestLength), nil
+}
+
+// Close unmaps the CAR file
+func (cr *carV2Reader) Close() error {
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+	if cr.mapped == nil {
+		return nil
+	}
+	mapped := cr.mapped
+	cr.mapped = nil
+	cr.data = nil
+	return cr.release(mapped)
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package storeutil
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads the whole of f into memory, on platforms where it is not
+// memory mapped
+func mapFile(f *os.File) ([]byte, func([]byte) error, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func([]byte) error { return nil }, nil
+}
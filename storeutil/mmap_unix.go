@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package storeutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile memory maps the whole of f read only
+func mapFile(f *os.File) ([]byte, func([]byte) error, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, func([]byte) error { return nil }, nil
+	}
+	mapped, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mapped, syscall.Munmap, nil
+}
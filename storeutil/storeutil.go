@@ -2,24 +2,25 @@ package storeutil
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-graphsync/ipldbridge"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	ipld "github.com/ipld/go-ipld-prime"
-	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 )
 
 // LoaderForBlockstore returns an IPLD Loader function compatible with graphsync
 // from an IPFS blockstore
 func LoaderForBlockstore(bs bstore.Blockstore) ipld.Loader {
 	return func(lnk ipld.Link, lnkCtx ipld.LinkContext) (io.Reader, error) {
-		asCidLink, ok := lnk.(cidlink.Link)
-		if !ok {
-			return nil, fmt.Errorf("Unsupported Link Type")
+		c, err := ipldbridge.LinkCid(lnk)
+		if err != nil {
+			return nil, err
 		}
-		block, err := bs.Get(asCidLink.Cid)
+		block, err := bs.Get(c)
 		if err != nil {
 			return nil, err
 		}
@@ -33,11 +34,11 @@ func StorerForBlockstore(bs bstore.Blockstore) ipld.Storer {
 	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
 		var buffer bytes.Buffer
 		committer := func(lnk ipld.Link) error {
-			asCidLink, ok := lnk.(cidlink.Link)
-			if !ok {
-				return fmt.Errorf("Unsupported Link Type")
+			c, err := ipldbridge.LinkCid(lnk)
+			if err != nil {
+				return err
 			}
-			block, err := blocks.NewBlockWithCid(buffer.Bytes(), asCidLink.Cid)
+			block, err := blocks.NewBlockWithCid(buffer.Bytes(), c)
 			if err != nil {
 				return err
 			}
@@ -46,3 +47,61 @@ func StorerForBlockstore(bs bstore.Blockstore) ipld.Storer {
 		return &buffer, committer, nil
 	}
 }
+
+// ErrInvalidQuorum means a quorum storer was asked for a quorum it can never
+// meet, or one that every write meets without storing anything
+var ErrInvalidQuorum = errors.New("quorum must be between 1 and the number of storers")
+
+// MultiStorer returns an IPLD Storer function that writes each committed block
+// to all of the given storers, and only reports success if every one of them
+// commits the block. It errors if no storers are given.
+func MultiStorer(storers ...ipld.Storer) (ipld.Storer, error) {
+	return QuorumStorer(len(storers), storers...)
+}
+
+// QuorumStorer returns an IPLD Storer function that writes each committed block
+// to all of the given storers, and reports success if at least quorum of them
+// commit the block. It returns ErrInvalidQuorum unless quorum is between 1 and
+// the number of storers.
+//
+// If fewer than quorum storers succeed, the commit errors. When used as the
+// storer for graphsync, a failed commit means the block is not stored, so the
+// requestor cannot load it and the request returns an error for that link
+// rather than completing successfully.
+func QuorumStorer(quorum int, storers ...ipld.Storer) (ipld.Storer, error) {
+	if quorum < 1 || quorum > len(storers) {
+		return nil, ErrInvalidQuorum
+	}
+	return func(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+		var buffer bytes.Buffer
+		committer := func(lnk ipld.Link) error {
+			var errs []error
+			committed := 0
+			for _, storer := range storers {
+				err := storeBytes(storer, lnkCtx, lnk, buffer.Bytes())
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				committed++
+			}
+			if committed < quorum {
+				return fmt.Errorf("Only committed block to %d of %d required stores: %v", committed, quorum, errs)
+			}
+			return nil
+		}
+		return &buffer, committer, nil
+	}, nil
+}
+
+func storeBytes(storer ipld.Storer, lnkCtx ipld.LinkContext, lnk ipld.Link, data []byte) error {
+	writer, committer, err := storer(lnkCtx)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return committer(lnk)
+}
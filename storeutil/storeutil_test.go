@@ -1,16 +1,23 @@
 package storeutil
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dss "github.com/ipfs/go-datastore/sync"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 
+	"github.com/ipfs/go-graphsync/testbridge"
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
@@ -57,3 +64,142 @@ func TestStorer(t *testing.T) {
 		t.Fatal("Block not written to store")
 	}
 }
+
+func failingStorer(lnkCtx ipld.LinkContext) (io.Writer, ipld.StoreCommitter, error) {
+	return ioutil.Discard, func(ipld.Link) error {
+		return errors.New("disk full")
+	}, nil
+}
+
+func commitBlocks(storer ipld.Storer, blks []blocks.Block) error {
+	for _, blk := range blks {
+		buffer, commit, err := storer(ipld.LinkContext{})
+		if err != nil {
+			return err
+		}
+		_, err = buffer.Write(blk.RawData())
+		if err != nil {
+			return err
+		}
+		err = commit(cidlink.Link{Cid: blk.Cid()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMultiStorer(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(5, 1000)
+	blockStore1 := make(map[ipld.Link][]byte)
+	_, storer1 := testbridge.NewMockStore(blockStore1)
+	blockStore2 := make(map[ipld.Link][]byte)
+	_, storer2 := testbridge.NewMockStore(blockStore2)
+
+	mustCommit := func(storer ipld.Storer, err error) error {
+		if err != nil {
+			t.Fatal("Unable to create storer")
+		}
+		return commitBlocks(storer, blks)
+	}
+
+	t.Run("writes to all stores", func(t *testing.T) {
+		err := mustCommit(MultiStorer(storer1, storer2))
+		if err != nil {
+			t.Fatal("Unable to commit with storer function")
+		}
+		for _, blk := range blks {
+			link := cidlink.Link{Cid: blk.Cid()}
+			if !reflect.DeepEqual(blockStore1[link], blk.RawData()) ||
+				!reflect.DeepEqual(blockStore2[link], blk.RawData()) {
+				t.Fatal("Block not written to all stores")
+			}
+		}
+	})
+
+	t.Run("errors if any store fails", func(t *testing.T) {
+		err := mustCommit(MultiStorer(storer1, failingStorer))
+		if err == nil {
+			t.Fatal("Should have errored when a store failed")
+		}
+	})
+
+	t.Run("succeeds if quorum of stores succeeds", func(t *testing.T) {
+		err := mustCommit(QuorumStorer(2, storer1, failingStorer, storer2))
+		if err != nil {
+			t.Fatal("Should have committed when quorum was met")
+		}
+		err = mustCommit(QuorumStorer(2, storer1, failingStorer, failingStorer))
+		if err == nil {
+			t.Fatal("Should have errored when quorum was not met")
+		}
+	})
+
+	t.Run("rejects quorums that cannot be meaningfully met", func(t *testing.T) {
+		if _, err := QuorumStorer(0, storer1, storer2); err != ErrInvalidQuorum {
+			t.Fatal("Should have rejected a quorum of zero")
+		}
+		if _, err := QuorumStorer(3, storer1, storer2); err != ErrInvalidQuorum {
+			t.Fatal("Should have rejected a quorum larger than the number of stores")
+		}
+		if _, err := MultiStorer(); err != ErrInvalidQuorum {
+			t.Fatal("Should have rejected writing to no stores")
+		}
+	})
+}
+
+func TestLoaderForCARv2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storeutil")
+	if err != nil {
+		t.Fatal("unable to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocks.car")
+	blks := testutil.GenerateBlocksOfSize(5, 1000)
+	err = testutil.WriteCARv2(path, []cid.Cid{blks[0].Cid()}, blks)
+	if err != nil {
+		t.Fatal("unable to write CARv2")
+	}
+
+	loader, closer, err := LoaderForCARv2(path)
+	if err != nil {
+		t.Fatal("unable to open CARv2")
+	}
+	for _, blk := range blks {
+		data, err := loader(cidlink.Link{Cid: blk.Cid()}, ipld.LinkContext{})
+		if err != nil {
+			t.Fatal("Unable to load block with loader")
+		}
+		bytes, err := ioutil.ReadAll(data)
+		if err != nil {
+			t.Fatal("Unable to read bytes from reader returned by loader")
+		}
+		if !reflect.DeepEqual(bytes, blk.RawData()) {
+			t.Fatal("Did not return correct block with loader")
+		}
+	}
+
+	missing := testutil.GenerateBlocksOfSize(1, 1000)[0]
+	_, err = loader(cidlink.Link{Cid: missing.Cid()}, ipld.LinkContext{})
+	if err != ErrBlockNotFound {
+		t.Fatal("Should not find block missing from CAR")
+	}
+
+	err = closer.Close()
+	if err != nil {
+		t.Fatal("unable to close CARv2")
+	}
+	_, err = loader(cidlink.Link{Cid: blks[0].Cid()}, ipld.LinkContext{})
+	if err != ErrCARClosed {
+		t.Fatal("Should not load blocks once closed")
+	}
+
+	err = ioutil.WriteFile(path, blks[0].RawData(), 0644)
+	if err != nil {
+		t.Fatal("unable to write file")
+	}
+	_, _, err = LoaderForCARv2(path)
+	if err == nil {
+		t.Fatal("Should not open a file that is not a CARv2")
+	}
+}
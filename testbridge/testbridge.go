@@ -74,7 +74,7 @@ func (mb *mockIPLDBridge) Traverse(ctx context.Context, loader ipldbridge.Loader
 			fn(ipldbridge.TraversalProgress{LastBlock: struct {
 				Path ipld.Path
 				Link ipld.Link
-			}{ipld.Path{}, cidlink.Link{Cid: lnk}}}, node, 0)
+			}{ipld.Path{}, cidlink.Link{Cid: lnk}}}, node, ipldbridge.TraversalReasonSelectionMatch)
 		}
 		select {
 		case <-ctx.Done():
@@ -85,6 +85,20 @@ func (mb *mockIPLDBridge) Traverse(ctx context.Context, loader ipldbridge.Loader
 	return nil
 }
 
+// TraverseExploring treats the cids visited by a mock selector as a chain, so
+// every node but the last is explored.
+func (mb *mockIPLDBridge) TraverseExploring(ctx context.Context, loader ipldbridge.Loader, root ipld.Link, s ipldbridge.Selector, fn ipldbridge.ExploringVisitFn) error {
+	ms, ok := s.(*mockSelector)
+	if !ok {
+		return fmt.Errorf("not supported")
+	}
+	visited := 0
+	return mb.Traverse(ctx, loader, root, s, func(tp ipldbridge.TraversalProgress, node ipld.Node, tr ipldbridge.TraversalReason) error {
+		visited++
+		return fn(tp, node, tr, visited < len(ms.cidsVisited))
+	})
+}
+
 func (mb *mockIPLDBridge) WalkMatching(node ipld.Node, s ipldbridge.Selector, fn ipldbridge.VisitFn) error {
 	spec, ok := node.(*mockSelectorSpec)
 	if ok && spec.FailValidation {
@@ -0,0 +1,143 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+const (
+	carV2HeaderSize           = 40
+	multihashIndexSortedCodec = 0x0401
+)
+
+type carIndexRecord struct {
+	digest []byte
+	offset uint64
+}
+
+// WriteCARv2 writes the given blocks to a CARv2 file at path, with the given
+// roots and a MultihashIndexSorted index
+func WriteCARv2(path string, roots []cid.Cid, blks []blocks.Block) error {
+	var data bytes.Buffer
+	writeCARv1Header(&data, roots)
+	// hash function -> digest length -> records
+	records := make(map[uint64]map[int][]carIndexRecord)
+	for _, blk := range blks {
+		decoded, err := mh.Decode(blk.Cid().Hash())
+		if err != nil {
+			return err
+		}
+		if records[decoded.Code] == nil {
+			records[decoded.Code] = make(map[int][]carIndexRecord)
+		}
+		records[decoded.Code][len(decoded.Digest)] = append(records[decoded.Code][len(decoded.Digest)],
+			carIndexRecord{decoded.Digest, uint64(data.Len())})
+		cidBytes := blk.Cid().Bytes()
+		writeUvarint(&data, uint64(len(cidBytes)+len(blk.RawData())))
+		data.Write(cidBytes)
+		data.Write(blk.RawData())
+	}
+
+	var file bytes.Buffer
+	file.Write(carV2Pragma)
+	dataOffset := uint64(len(carV2Pragma) + carV2HeaderSize)
+	header := make([]byte, carV2HeaderSize)
+	binary.LittleEndian.PutUint64(header[16:], dataOffset)
+	binary.LittleEndian.PutUint64(header[24:], uint64(data.Len()))
+	binary.LittleEndian.PutUint64(header[32:], dataOffset+uint64(data.Len()))
+	file.Write(header)
+	file.Write(data.Bytes())
+
+	writeUvarint(&file, multihashIndexSortedCodec)
+	codes := make([]uint64, 0, len(records))
+	for code := range records {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	writeUint32(&file, uint32(len(codes)))
+	for _, code := range codes {
+		writeUint64(&file, code)
+		byLength := records[code]
+		lengths := make([]int, 0, len(byLength))
+		for length := range byLength {
+			lengths = append(lengths, length)
+		}
+		sort.Ints(lengths)
+		writeUint32(&file, uint32(len(lengths)))
+		for _, length := range lengths {
+			bucket := byLength[length]
+			sort.Slice(bucket, func(i, j int) bool { return bytes.Compare(bucket[i].digest, bucket[j].digest) < 0 })
+			width := length + 8
+			writeUint32(&file, uint32(width))
+			writeUint64(&file, uint64(width*len(bucket)))
+			for _, record := range bucket {
+				file.Write(record.digest)
+				writeUint64(&file, record.offset)
+			}
+		}
+	}
+	return ioutil.WriteFile(path, file.Bytes(), 0644)
+}
+
+// writeCARv1Header writes the DAG-CBOR encoded {roots, version: 1} header of
+// a CARv1, with its length prefix
+func writeCARv1Header(buf *bytes.Buffer, roots []cid.Cid) {
+	var header bytes.Buffer
+	header.WriteByte(0xa2)
+	writeCBORHead(&header, 3, uint64(len("roots")))
+	header.WriteString("roots")
+	writeCBORHead(&header, 4, uint64(len(roots)))
+	for _, root := range roots {
+		// tag 42, a CID as bytes with a leading multibase identity prefix
+		header.Write([]byte{0xd8, 0x2a})
+		writeCBORHead(&header, 2, uint64(len(root.Bytes())+1))
+		header.WriteByte(0x00)
+		header.Write(root.Bytes())
+	}
+	writeCBORHead(&header, 3, uint64(len("version")))
+	header.WriteString("version")
+	header.WriteByte(0x01)
+	writeUvarint(buf, uint64(header.Len()))
+	buf.Write(header.Bytes())
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, value uint64) {
+	switch {
+	case value < 24:
+		buf.WriteByte(major<<5 | byte(value))
+	case value < 1<<8:
+		buf.Write([]byte{major<<5 | 24, byte(value)})
+	case value < 1<<16:
+		buf.Write([]byte{major<<5 | 25, byte(value >> 8), byte(value)})
+	default:
+		buf.WriteByte(major<<5 | 26)
+		var encoded [4]byte
+		binary.BigEndian.PutUint32(encoded[:], uint32(value))
+		buf.Write(encoded[:])
+	}
+}
+
+func writeUvarint(buf *bytes.Buffer, value uint64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buf.Write(encoded[:binary.PutUvarint(encoded, value)])
+}
+
+func writeUint32(buf *bytes.Buffer, value uint32) {
+	var encoded [4]byte
+	binary.LittleEndian.PutUint32(encoded[:], value)
+	buf.Write(encoded[:])
+}
+
+func writeUint64(buf *bytes.Buffer, value uint64) {
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], value)
+	buf.Write(encoded[:])
+}
@@ -0,0 +1,74 @@
+package inmemory_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	"github.com/ipfs/go-graphsync/testutil/inmemory"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	ipldfree "github.com/ipld/go-ipld-prime/impl/free"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func ExampleNewInMemoryExchangePair() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	requestor, responder := inmemory.NewInMemoryExchangePair(ctx)
+
+	// store a leaf, and a root linking to it, on the responder
+	linkBuilder := cidlink.LinkBuilder{Prefix: cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256)}
+	nb := fluent.WrapNodeBuilder(ipldfree.NodeBuilder())
+	leaf := nb.CreateString("hello")
+	leafLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, leaf, responder.Storer)
+	if err != nil {
+		panic(err)
+	}
+	root := nb.CreateMap(func(mb fluent.MapBuilder, knb fluent.NodeBuilder, vnb fluent.NodeBuilder) {
+		mb.Insert(knb.CreateString("Leaf"), vnb.CreateLink(leafLink))
+	})
+	rootLink, err := linkBuilder.Build(ctx, ipldbridge.LinkContext{}, root, responder.Storer)
+	if err != nil {
+		panic(err)
+	}
+
+	// count the requests the responder receives
+	received := make(chan struct{}, 1)
+	err = responder.RegisterRequestReceivedHook(func(p peer.ID, request graphsync.RequestData, hookActions graphsync.RequestReceivedHookActions) {
+		received <- struct{}{}
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ssb := builder.NewSelectorSpecBuilder(ipldfree.NodeBuilder())
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitDepth(10),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	progress, errs := requestor.Request(ctx, responder.Peer, rootLink, allSelector)
+	for range progress {
+	}
+	for err := range errs {
+		panic(err)
+	}
+	<-received
+
+	// the requestor now has both blocks
+	for _, lnk := range []ipld.Link{rootLink, leafLink} {
+		has, err := requestor.Blockstore.Has(lnk.(cidlink.Link).Cid)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(has)
+	}
+	// Output:
+	// true
+	// true
+}
@@ -0,0 +1,62 @@
+// Package inmemory connects two graphsync exchanges in process, without
+// libp2p, so applications can quickly test the hooks and selectors they use
+// with graphsync. It is meant for tests only.
+package inmemory
+
+import (
+	"context"
+
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	"github.com/ipfs/go-graphsync/ipldbridge"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/storeutil"
+	"github.com/ipfs/go-graphsync/testutil"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Exchange is one side of an in memory exchange pair. It is a
+// graphsync.GraphExchange, along with the peer ID the other side knows it by
+// and the store it loads and stores blocks with.
+type Exchange struct {
+	graphsync.GraphExchange
+	Peer       peer.ID
+	Blockstore bstore.Blockstore
+	Loader     ipldbridge.Loader
+	Storer     ipldbridge.Storer
+}
+
+// NewInMemoryExchangePair returns two connected graphsync exchanges, each
+// backed by its own empty in memory blockstore, which exchange messages over
+// a network.InProcessNetwork. Either can make requests to the other using its Peer. The given
+// options apply to both exchanges, which shut down when ctx is cancelled.
+//
+// It is for testing only, and sending messages between the pair never fails.
+func NewInMemoryExchangePair(ctx context.Context, options ...gsimpl.Option) (*Exchange, *Exchange) {
+	peers := testutil.GeneratePeers(2)
+	ipn := gsnet.NewInProcessNetwork()
+	net1 := gsnet.NewFromTransport(ipn.Transport(peers[0]))
+	net2 := gsnet.NewFromTransport(ipn.Transport(peers[1]))
+	bridge := ipldbridge.NewIPLDBridge()
+	exchange1 := newExchange(ctx, net1, bridge, peers[0], options)
+	exchange2 := newExchange(ctx, net2, bridge, peers[1], options)
+	// peers on an in process network can always reach each other
+	_ = net1.ConnectTo(ctx, peers[1])
+	return exchange1, exchange2
+}
+
+func newExchange(ctx context.Context, net gsnet.GraphSyncNetwork, bridge ipldbridge.IPLDBridge, p peer.ID, options []gsimpl.Option) *Exchange {
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	loader := storeutil.LoaderForBlockstore(bs)
+	storer := storeutil.StorerForBlockstore(bs)
+	return &Exchange{
+		GraphExchange: gsimpl.New(ctx, net, bridge, loader, storer, options...),
+		Peer:          p,
+		Blockstore:    bs,
+		Loader:        loader,
+		Storer:        storer,
+	}
+}
@@ -0,0 +1,78 @@
+package throughput
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Tracker estimates the rate, in bytes per second, at which data arrives from
+// each peer, as a moving average weighted towards recent transfers. Each
+// arrival is measured against the one before it from the same peer, so a
+// steady stream of messages measures the rate the link delivers them at.
+// Arrivals after the peer has been idle longer than the idle timeout only
+// start a new measurement, so time spent not transferring does not count.
+type Tracker struct {
+	// weight given to each new measurement, between 0 and 1
+	alpha float64
+	idle  time.Duration
+
+	lk    sync.Mutex
+	peers map[peer.ID]*peerEstimate
+}
+
+type peerEstimate struct {
+	last        time.Time
+	bytesPerSec float64
+	measured    bool
+}
+
+// New returns a Tracker weighting each new measurement by alpha, which should
+// be between 0 and 1, and treating gaps longer than idle between arrivals as
+// idle time
+func New(alpha float64, idle time.Duration) *Tracker {
+	return &Tracker{
+		alpha: alpha,
+		idle:  idle,
+		peers: make(map[peer.ID]*peerEstimate),
+	}
+}
+
+// Record notes that n bytes arrived from p at the given time
+func (t *Tracker) Record(p peer.ID, n int, at time.Time) {
+	if n <= 0 {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	estimate, ok := t.peers[p]
+	if !ok {
+		t.peers[p] = &peerEstimate{last: at}
+		return
+	}
+	elapsed := at.Sub(estimate.last)
+	estimate.last = at
+	if elapsed <= 0 || elapsed > t.idle {
+		return
+	}
+	sample := float64(n) / elapsed.Seconds()
+	if !estimate.measured {
+		estimate.bytesPerSec = sample
+		estimate.measured = true
+		return
+	}
+	estimate.bytesPerSec = t.alpha*sample + (1-t.alpha)*estimate.bytesPerSec
+}
+
+// Estimate returns the estimated bytes per second from p, or zero if too
+// little has arrived from p to measure
+func (t *Tracker) Estimate(p peer.ID) float64 {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	estimate, ok := t.peers[p]
+	if !ok {
+		return 0
+	}
+	return estimate.bytesPerSec
+}
@@ -0,0 +1,37 @@
+package throughput
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestTrackerEstimates(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	tracker := New(0.5, time.Second)
+	start := time.Now()
+
+	tracker.Record(peers[0], 1000, start)
+	if tracker.Estimate(peers[0]) != 0 {
+		t.Fatal("should not estimate from a single arrival")
+	}
+	tracker.Record(peers[0], 1000, start.Add(100*time.Millisecond))
+	if tracker.Estimate(peers[0]) != 10000 {
+		t.Fatal("should have estimated from the first measurement")
+	}
+	tracker.Record(peers[0], 1000, start.Add(150*time.Millisecond))
+	if tracker.Estimate(peers[0]) != 15000 {
+		t.Fatal("should have averaged in the next measurement")
+	}
+
+	// an arrival after an idle gap does not drag the estimate down
+	tracker.Record(peers[0], 1000, start.Add(10*time.Second))
+	if tracker.Estimate(peers[0]) != 15000 {
+		t.Fatal("should not have measured across an idle gap")
+	}
+
+	if tracker.Estimate(peers[1]) != 0 {
+		t.Fatal("should not estimate for unknown peers")
+	}
+}